@@ -44,6 +44,37 @@ LOCK TABLES `_group` WRITE;
 /*!40000 ALTER TABLE `_group` ENABLE KEYS */;
 UNLOCK TABLES;
 
+--
+-- Table structure for table `coin_pass`
+--
+
+DROP TABLE IF EXISTS `coin_pass`;
+/*!40101 SET @saved_cs_client     = @@character_set_client */;
+/*!40101 SET character_set_client = utf8 */;
+CREATE TABLE `coin_pass` (
+  `id` bigint(20) NOT NULL AUTO_INCREMENT,
+  `group_id` varchar(255) COLLATE utf8mb4_unicode_ci NOT NULL,
+  `from_user` varchar(128) COLLATE utf8mb4_unicode_ci NOT NULL,
+  `to_user` varchar(128) COLLATE utf8mb4_unicode_ci NOT NULL,
+  `coin` int(11) NOT NULL,
+  `passed_at` datetime NOT NULL DEFAULT current_timestamp(),
+  `reassigned` tinyint(1) NOT NULL DEFAULT 0,
+  `forced` tinyint(1) NOT NULL DEFAULT 0,
+  PRIMARY KEY (`id`),
+  KEY `group_id` (`group_id`,`id`),
+  CONSTRAINT `coin_pass_ibfk_1` FOREIGN KEY (`group_id`) REFERENCES `_group` (`id`) ON DELETE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+/*!40101 SET character_set_client = @saved_cs_client */;
+
+--
+-- Dumping data for table `coin_pass`
+--
+
+LOCK TABLES `coin_pass` WRITE;
+/*!40000 ALTER TABLE `coin_pass` DISABLE KEYS */;
+/*!40000 ALTER TABLE `coin_pass` ENABLE KEYS */;
+UNLOCK TABLES;
+
 --
 -- Table structure for table `group_member`
 --
@@ -81,7 +112,13 @@ DROP TABLE IF EXISTS `user`;
 CREATE TABLE `user` (
   `username` varchar(128) COLLATE utf8mb4_unicode_ci NOT NULL,
   `password` varchar(512) COLLATE utf8mb4_unicode_ci NOT NULL,
-  PRIMARY KEY (`username`)
+  `email` varchar(255) COLLATE utf8mb4_unicode_ci DEFAULT NULL,
+  `email_verified` tinyint(1) NOT NULL DEFAULT 0,
+  `disabled_at` datetime(3) DEFAULT NULL,
+  `sessions_revoked_at` datetime(3) DEFAULT NULL,
+  `role` varchar(16) COLLATE utf8mb4_unicode_ci NOT NULL DEFAULT 'user',
+  PRIMARY KEY (`username`),
+  UNIQUE KEY `email` (`email`)
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
 /*!40101 SET character_set_client = @saved_cs_client */;
 
@@ -91,9 +128,387 @@ CREATE TABLE `user` (
 
 LOCK TABLES `user` WRITE;
 /*!40000 ALTER TABLE `user` DISABLE KEYS */;
-INSERT INTO `user` VALUES ('test','40bd001563085fc35165329ea1ff5c5ecbdbbeef'),('test2','40bd001563085fc35165329ea1ff5c5ecbdbbeef');
+INSERT INTO `user` VALUES ('test','40bd001563085fc35165329ea1ff5c5ecbdbbeef',NULL,0,NULL,NULL,'user'),('test2','40bd001563085fc35165329ea1ff5c5ecbdbbeef',NULL,0,NULL,NULL,'user');
 /*!40000 ALTER TABLE `user` ENABLE KEYS */;
 UNLOCK TABLES;
+
+--
+-- Table structure for table `webhook`
+--
+
+DROP TABLE IF EXISTS `webhook`;
+/*!40101 SET @saved_cs_client     = @@character_set_client */;
+/*!40101 SET character_set_client = utf8 */;
+CREATE TABLE `webhook` (
+  `id` varchar(255) COLLATE utf8mb4_unicode_ci NOT NULL,
+  `group_id` varchar(255) COLLATE utf8mb4_unicode_ci NOT NULL,
+  `url` varchar(2048) COLLATE utf8mb4_unicode_ci NOT NULL,
+  `secret` varchar(255) COLLATE utf8mb4_unicode_ci NOT NULL,
+  `events` varchar(255) COLLATE utf8mb4_unicode_ci NOT NULL,
+  `active` tinyint(1) NOT NULL DEFAULT 1,
+  `failures` int(11) NOT NULL DEFAULT 0,
+  `created_at` datetime NOT NULL DEFAULT current_timestamp(),
+  PRIMARY KEY (`id`),
+  KEY `group_id` (`group_id`),
+  CONSTRAINT `webhook_ibfk_1` FOREIGN KEY (`group_id`) REFERENCES `_group` (`id`) ON DELETE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+/*!40101 SET character_set_client = @saved_cs_client */;
+
+--
+-- Dumping data for table `webhook`
+--
+
+LOCK TABLES `webhook` WRITE;
+/*!40000 ALTER TABLE `webhook` DISABLE KEYS */;
+/*!40000 ALTER TABLE `webhook` ENABLE KEYS */;
+UNLOCK TABLES;
+
+--
+-- Table structure for table `webhook_delivery`
+--
+
+DROP TABLE IF EXISTS `webhook_delivery`;
+/*!40101 SET @saved_cs_client     = @@character_set_client */;
+/*!40101 SET character_set_client = utf8 */;
+CREATE TABLE `webhook_delivery` (
+  `id` bigint(20) NOT NULL AUTO_INCREMENT,
+  `webhook_id` varchar(255) COLLATE utf8mb4_unicode_ci NOT NULL,
+  `event` varchar(32) COLLATE utf8mb4_unicode_ci NOT NULL,
+  `payload` text COLLATE utf8mb4_unicode_ci NOT NULL,
+  `status` varchar(16) COLLATE utf8mb4_unicode_ci NOT NULL DEFAULT 'pending',
+  `attempts` int(11) NOT NULL DEFAULT 0,
+  `next_attempt` datetime NOT NULL DEFAULT current_timestamp(),
+  `status_code` int(11) DEFAULT NULL,
+  `error` varchar(512) COLLATE utf8mb4_unicode_ci DEFAULT NULL,
+  `created_at` datetime NOT NULL DEFAULT current_timestamp(),
+  `delivered_at` datetime DEFAULT NULL,
+  PRIMARY KEY (`id`),
+  KEY `due` (`status`,`next_attempt`),
+  KEY `webhook_id` (`webhook_id`,`id`),
+  CONSTRAINT `webhook_delivery_ibfk_1` FOREIGN KEY (`webhook_id`) REFERENCES `webhook` (`id`) ON DELETE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+/*!40101 SET character_set_client = @saved_cs_client */;
+
+--
+-- Dumping data for table `webhook_delivery`
+--
+
+LOCK TABLES `webhook_delivery` WRITE;
+/*!40000 ALTER TABLE `webhook_delivery` DISABLE KEYS */;
+/*!40000 ALTER TABLE `webhook_delivery` ENABLE KEYS */;
+UNLOCK TABLES;
+
+--
+-- Table structure for table `device`
+--
+
+DROP TABLE IF EXISTS `device`;
+/*!40101 SET @saved_cs_client     = @@character_set_client */;
+/*!40101 SET character_set_client = utf8 */;
+CREATE TABLE `device` (
+  `token` varchar(255) COLLATE utf8mb4_unicode_ci NOT NULL,
+  `username` varchar(128) COLLATE utf8mb4_unicode_ci NOT NULL,
+  `platform` varchar(16) COLLATE utf8mb4_unicode_ci NOT NULL,
+  `created_at` datetime NOT NULL DEFAULT current_timestamp(),
+  PRIMARY KEY (`token`),
+  KEY `username` (`username`),
+  CONSTRAINT `device_ibfk_1` FOREIGN KEY (`username`) REFERENCES `user` (`username`) ON DELETE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+/*!40101 SET character_set_client = @saved_cs_client */;
+
+--
+-- Dumping data for table `device`
+--
+
+LOCK TABLES `device` WRITE;
+/*!40000 ALTER TABLE `device` DISABLE KEYS */;
+/*!40000 ALTER TABLE `device` ENABLE KEYS */;
+UNLOCK TABLES;
+
+--
+-- Table structure for table `quiet_hours`
+--
+
+DROP TABLE IF EXISTS `quiet_hours`;
+/*!40101 SET @saved_cs_client     = @@character_set_client */;
+/*!40101 SET character_set_client = utf8 */;
+CREATE TABLE `quiet_hours` (
+  `username` varchar(128) COLLATE utf8mb4_unicode_ci NOT NULL,
+  `start_hour` tinyint(4) NOT NULL,
+  `end_hour` tinyint(4) NOT NULL,
+  `timezone` varchar(64) COLLATE utf8mb4_unicode_ci NOT NULL DEFAULT 'UTC',
+  PRIMARY KEY (`username`),
+  CONSTRAINT `quiet_hours_ibfk_1` FOREIGN KEY (`username`) REFERENCES `user` (`username`) ON DELETE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+/*!40101 SET character_set_client = @saved_cs_client */;
+
+--
+-- Dumping data for table `quiet_hours`
+--
+
+LOCK TABLES `quiet_hours` WRITE;
+/*!40000 ALTER TABLE `quiet_hours` DISABLE KEYS */;
+/*!40000 ALTER TABLE `quiet_hours` ENABLE KEYS */;
+UNLOCK TABLES;
+
+--
+-- Table structure for table `notification_outbox`
+--
+
+DROP TABLE IF EXISTS `notification_outbox`;
+/*!40101 SET @saved_cs_client     = @@character_set_client */;
+/*!40101 SET character_set_client = utf8 */;
+CREATE TABLE `notification_outbox` (
+  `id` bigint(20) NOT NULL AUTO_INCREMENT,
+  `username` varchar(128) COLLATE utf8mb4_unicode_ci NOT NULL,
+  `kind` varchar(32) COLLATE utf8mb4_unicode_ci NOT NULL,
+  `dedupe_key` varchar(255) COLLATE utf8mb4_unicode_ci NOT NULL,
+  `payload` text COLLATE utf8mb4_unicode_ci NOT NULL,
+  `status` varchar(16) COLLATE utf8mb4_unicode_ci NOT NULL DEFAULT 'pending',
+  `attempts` int(11) NOT NULL DEFAULT 0,
+  `next_attempt` datetime NOT NULL DEFAULT current_timestamp(),
+  `error` varchar(512) COLLATE utf8mb4_unicode_ci DEFAULT NULL,
+  `created_at` datetime NOT NULL DEFAULT current_timestamp(),
+  `sent_at` datetime DEFAULT NULL,
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `dedupe_key` (`dedupe_key`),
+  KEY `due` (`status`,`next_attempt`),
+  CONSTRAINT `notification_outbox_ibfk_1` FOREIGN KEY (`username`) REFERENCES `user` (`username`) ON DELETE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+/*!40101 SET character_set_client = @saved_cs_client */;
+
+--
+-- Dumping data for table `notification_outbox`
+--
+
+LOCK TABLES `notification_outbox` WRITE;
+/*!40000 ALTER TABLE `notification_outbox` DISABLE KEYS */;
+/*!40000 ALTER TABLE `notification_outbox` ENABLE KEYS */;
+UNLOCK TABLES;
+
+--
+-- Table structure for table `notification_delivery`
+--
+
+DROP TABLE IF EXISTS `notification_delivery`;
+/*!40101 SET @saved_cs_client     = @@character_set_client */;
+/*!40101 SET character_set_client = utf8 */;
+CREATE TABLE `notification_delivery` (
+  `notification_id` bigint(20) NOT NULL,
+  `device_token` varchar(255) COLLATE utf8mb4_unicode_ci NOT NULL,
+  `sent_at` datetime NOT NULL DEFAULT current_timestamp(),
+  PRIMARY KEY (`notification_id`,`device_token`),
+  CONSTRAINT `notification_delivery_ibfk_1` FOREIGN KEY (`notification_id`) REFERENCES `notification_outbox` (`id`) ON DELETE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+/*!40101 SET character_set_client = @saved_cs_client */;
+
+--
+-- Dumping data for table `notification_delivery`
+--
+
+LOCK TABLES `notification_delivery` WRITE;
+/*!40000 ALTER TABLE `notification_delivery` DISABLE KEYS */;
+/*!40000 ALTER TABLE `notification_delivery` ENABLE KEYS */;
+UNLOCK TABLES;
+
+--
+-- Table structure for table `one_time_code`
+--
+
+DROP TABLE IF EXISTS `one_time_code`;
+/*!40101 SET @saved_cs_client     = @@character_set_client */;
+/*!40101 SET character_set_client = utf8 */;
+CREATE TABLE `one_time_code` (
+  `id` bigint(20) NOT NULL AUTO_INCREMENT,
+  `username` varchar(128) COLLATE utf8mb4_unicode_ci NOT NULL,
+  `purpose` varchar(16) COLLATE utf8mb4_unicode_ci NOT NULL,
+  `code_hash` char(64) COLLATE utf8mb4_unicode_ci NOT NULL,
+  `expires_at` datetime NOT NULL,
+  `used_at` datetime DEFAULT NULL,
+  `attempts` int(11) NOT NULL DEFAULT 0,
+  `created_at` datetime NOT NULL DEFAULT current_timestamp(),
+  PRIMARY KEY (`id`),
+  KEY `lookup` (`username`,`purpose`,`code_hash`),
+  CONSTRAINT `one_time_code_ibfk_1` FOREIGN KEY (`username`) REFERENCES `user` (`username`) ON DELETE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+/*!40101 SET character_set_client = @saved_cs_client */;
+
+--
+-- Dumping data for table `one_time_code`
+--
+
+LOCK TABLES `one_time_code` WRITE;
+/*!40000 ALTER TABLE `one_time_code` DISABLE KEYS */;
+/*!40000 ALTER TABLE `one_time_code` ENABLE KEYS */;
+UNLOCK TABLES;
+
+--
+-- Table structure for table `two_factor`
+--
+
+DROP TABLE IF EXISTS `two_factor`;
+/*!40101 SET @saved_cs_client     = @@character_set_client */;
+/*!40101 SET character_set_client = utf8 */;
+CREATE TABLE `two_factor` (
+  `username` varchar(128) COLLATE utf8mb4_unicode_ci NOT NULL,
+  `secret` varchar(64) COLLATE utf8mb4_unicode_ci NOT NULL,
+  `enabled` tinyint(1) NOT NULL DEFAULT 0,
+  `last_step` bigint(20) NOT NULL DEFAULT 0,
+  `created_at` datetime NOT NULL DEFAULT current_timestamp(),
+  `confirmed_at` datetime DEFAULT NULL,
+  PRIMARY KEY (`username`),
+  CONSTRAINT `two_factor_ibfk_1` FOREIGN KEY (`username`) REFERENCES `user` (`username`) ON DELETE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+/*!40101 SET character_set_client = @saved_cs_client */;
+
+--
+-- Dumping data for table `two_factor`
+--
+
+LOCK TABLES `two_factor` WRITE;
+/*!40000 ALTER TABLE `two_factor` DISABLE KEYS */;
+/*!40000 ALTER TABLE `two_factor` ENABLE KEYS */;
+UNLOCK TABLES;
+
+--
+-- Table structure for table `recovery_code`
+--
+
+DROP TABLE IF EXISTS `recovery_code`;
+/*!40101 SET @saved_cs_client     = @@character_set_client */;
+/*!40101 SET character_set_client = utf8 */;
+CREATE TABLE `recovery_code` (
+  `id` bigint(20) NOT NULL AUTO_INCREMENT,
+  `username` varchar(128) COLLATE utf8mb4_unicode_ci NOT NULL,
+  `code_hash` char(64) COLLATE utf8mb4_unicode_ci NOT NULL,
+  `used_at` datetime DEFAULT NULL,
+  PRIMARY KEY (`id`),
+  KEY `lookup` (`username`,`code_hash`),
+  CONSTRAINT `recovery_code_ibfk_1` FOREIGN KEY (`username`) REFERENCES `user` (`username`) ON DELETE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+/*!40101 SET character_set_client = @saved_cs_client */;
+
+--
+-- Dumping data for table `recovery_code`
+--
+
+LOCK TABLES `recovery_code` WRITE;
+/*!40000 ALTER TABLE `recovery_code` DISABLE KEYS */;
+/*!40000 ALTER TABLE `recovery_code` ENABLE KEYS */;
+UNLOCK TABLES;
+--
+-- Table structure for table `audit_event`
+--
+
+DROP TABLE IF EXISTS `audit_event`;
+/*!40101 SET @saved_cs_client     = @@character_set_client */;
+/*!40101 SET character_set_client = utf8 */;
+CREATE TABLE `audit_event` (
+  `id` bigint(20) NOT NULL AUTO_INCREMENT,
+  `actor` varchar(128) COLLATE utf8mb4_unicode_ci NOT NULL,
+  `action` varchar(64) COLLATE utf8mb4_unicode_ci NOT NULL,
+  `target` varchar(128) COLLATE utf8mb4_unicode_ci DEFAULT NULL,
+  `group_id` varchar(255) COLLATE utf8mb4_unicode_ci DEFAULT NULL,
+  `ip` varchar(45) COLLATE utf8mb4_unicode_ci DEFAULT NULL,
+  `request_id` varchar(64) COLLATE utf8mb4_unicode_ci DEFAULT NULL,
+  `created_at` datetime(3) NOT NULL DEFAULT current_timestamp(3),
+  PRIMARY KEY (`id`),
+  KEY `actor` (`actor`,`id`),
+  KEY `target` (`target`,`id`),
+  KEY `group_id` (`group_id`,`id`),
+  KEY `action` (`action`,`id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+/*!40101 SET character_set_client = @saved_cs_client */;
+
+--
+-- Dumping data for table `audit_event`
+--
+
+LOCK TABLES `audit_event` WRITE;
+/*!40000 ALTER TABLE `audit_event` DISABLE KEYS */;
+/*!40000 ALTER TABLE `audit_event` ENABLE KEYS */;
+UNLOCK TABLES;
+
+--
+-- Table structure for table `pass_rollup`
+--
+
+DROP TABLE IF EXISTS `pass_rollup`;
+/*!40101 SET @saved_cs_client     = @@character_set_client */;
+/*!40101 SET character_set_client = utf8 */;
+CREATE TABLE `pass_rollup` (
+  `group_id` varchar(255) COLLATE utf8mb4_unicode_ci NOT NULL,
+  `username` varchar(128) COLLATE utf8mb4_unicode_ci NOT NULL,
+  `day` date NOT NULL,
+  `passes` int(11) NOT NULL DEFAULT 0,
+  `pushups` bigint(20) NOT NULL DEFAULT 0,
+  `held_seconds` bigint(20) NOT NULL DEFAULT 0,
+  `holds` int(11) NOT NULL DEFAULT 0,
+  `missed` int(11) NOT NULL DEFAULT 0,
+  PRIMARY KEY (`group_id`,`day`,`username`),
+  KEY `username` (`username`,`day`),
+  CONSTRAINT `pass_rollup_ibfk_1` FOREIGN KEY (`group_id`) REFERENCES `_group` (`id`) ON DELETE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+/*!40101 SET character_set_client = @saved_cs_client */;
+
+--
+-- Dumping data for table `pass_rollup`
+--
+
+LOCK TABLES `pass_rollup` WRITE;
+/*!40000 ALTER TABLE `pass_rollup` DISABLE KEYS */;
+/*!40000 ALTER TABLE `pass_rollup` ENABLE KEYS */;
+UNLOCK TABLES;
+
+--
+-- Table structure for table `achievement`
+--
+
+DROP TABLE IF EXISTS `achievement`;
+/*!40101 SET @saved_cs_client     = @@character_set_client */;
+/*!40101 SET character_set_client = utf8 */;
+CREATE TABLE `achievement` (
+  `username` varchar(128) COLLATE utf8mb4_unicode_ci NOT NULL,
+  `badge` varchar(64) COLLATE utf8mb4_unicode_ci NOT NULL,
+  `earned_at` datetime(3) NOT NULL DEFAULT current_timestamp(3),
+  PRIMARY KEY (`username`,`badge`),
+  CONSTRAINT `achievement_ibfk_1` FOREIGN KEY (`username`) REFERENCES `user` (`username`) ON DELETE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+/*!40101 SET character_set_client = @saved_cs_client */;
+
+--
+-- Dumping data for table `achievement`
+--
+
+LOCK TABLES `achievement` WRITE;
+/*!40000 ALTER TABLE `achievement` DISABLE KEYS */;
+/*!40000 ALTER TABLE `achievement` ENABLE KEYS */;
+UNLOCK TABLES;
+
+--
+-- Table structure for table `schema_migration`
+--
+
+DROP TABLE IF EXISTS `schema_migration`;
+/*!40101 SET @saved_cs_client     = @@character_set_client */;
+/*!40101 SET character_set_client = utf8 */;
+CREATE TABLE `schema_migration` (
+  `version` int(11) NOT NULL,
+  `name` varchar(128) COLLATE utf8mb4_unicode_ci NOT NULL,
+  `applied_at` datetime NOT NULL DEFAULT current_timestamp(),
+  PRIMARY KEY (`version`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+/*!40101 SET character_set_client = @saved_cs_client */;
+
+--
+-- Dumping data for table `schema_migration`
+--
+
+LOCK TABLES `schema_migration` WRITE;
+/*!40000 ALTER TABLE `schema_migration` DISABLE KEYS */;
+INSERT INTO `schema_migration` VALUES (0,'baseline','2021-10-25 14:25:35'),(1,'coin_pass','2021-10-25 14:25:35'),(2,'webhooks','2021-10-25 14:25:35'),(3,'notifications','2021-10-25 14:25:35'),(4,'email','2021-10-25 14:25:35'),(5,'two_factor','2021-10-25 14:25:35'),(6,'user_status','2021-10-25 14:25:35'),(7,'admin_audit','2021-10-25 14:25:35'),(8,'stats','2021-10-25 14:25:35'),(9,'achievements','2021-10-25 14:25:35');
+/*!40000 ALTER TABLE `schema_migration` ENABLE KEYS */;
+UNLOCK TABLES;
 /*!40103 SET TIME_ZONE=@OLD_TIME_ZONE */;
 
 /*!40101 SET SQL_MODE=@OLD_SQL_MODE */;
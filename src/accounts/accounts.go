@@ -0,0 +1,232 @@
+// Account rules shared by every API and purestctl
+// Handlers and the CLI call these instead of bsql,
+// so a disabled account or revoked session is refused the same way everywhere
+package accounts
+
+import (
+	"benschreiber.com/purestserver/src/audit"
+	"benschreiber.com/purestserver/src/bsql"
+	"benschreiber.com/purestserver/src/metrics"
+	"context"
+	"time"
+)
+
+// A broken account rule
+// Any other error out of this package is a database error
+type Error string
+
+func (e Error) Error() string {
+	return string(e)
+}
+
+const (
+	ErrUserExists         Error = "user already exists"
+	ErrUserNotFound       Error = "user not found"
+	ErrEmailInUse         Error = "email already in use"
+	ErrInvalidCredentials Error = "invalid credentials"
+	ErrDisabled           Error = "account is disabled"
+	ErrUnknownRole        Error = "unknown role"
+)
+
+// System-wide roles, admins can use /api/admin
+// Only purestctl grants a role, so an admin token can't make more admins
+const (
+	ROLE_USER  = "user"
+	ROLE_ADMIN = "admin"
+)
+
+// Insert a new user, email may be empty
+func Register(ctx context.Context, user string, pass string, email string) error {
+	ok, err := bsql.UserExists(ctx, user)
+	if err != nil {
+		return err
+	}
+	if ok {
+		return ErrUserExists
+	}
+
+	// The unique keys still catch two registrations racing past this check
+	if email == "" {
+		err = bsql.InsertNewUser(ctx, user, pass)
+	} else {
+		err = bsql.InsertNewUserEmail(ctx, user, pass, email)
+	}
+	if err != nil {
+		if bsql.DuplicateEntry(err) {
+			if email == "" {
+				return ErrUserExists
+			}
+			return ErrEmailInUse
+		}
+		return err
+	}
+
+	metrics.UsersRegistered.Inc()
+	audit.Record(ctx, audit.Event{Actor: user, Action: audit.REGISTER, Target: user})
+	return nil
+}
+
+// Check a username and password before a session is issued
+// A disabled account is only reported to someone who knows its password
+// Failures on an existing account are audited, LoggedIn records the success
+func Login(ctx context.Context, user string, pass string) error {
+	ok, err := bsql.UserExists(ctx, user)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrUserNotFound
+	}
+
+	ok, err = bsql.MatchUserPass(ctx, user, pass)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return LoginFailed(ctx, user, ErrInvalidCredentials)
+	}
+
+	status, ok, err := bsql.GetUserStatus(ctx, user)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrUserNotFound
+	}
+	if status.Disabled {
+		return LoginFailed(ctx, user, ErrDisabled)
+	}
+	return nil
+}
+
+// Audit a failed login to user's account, returns reason
+// Handlers call it for a wrong second factor
+func LoginFailed(ctx context.Context, user string, reason error) error {
+	audit.Record(ctx, audit.Event{Actor: user, Action: audit.LOGIN_FAILED, Target: user})
+	return reason
+}
+
+// Audit a finished login, after the password and any second factor
+func LoggedIn(ctx context.Context, user string) {
+	audit.Record(ctx, audit.Event{Actor: user, Action: audit.LOGIN, Target: user})
+}
+
+// Whether a session of user issued at issued may still be used
+// False once the user is deleted or disabled, or their sessions were revoked after it was issued
+func Active(ctx context.Context, user string, issued time.Time) (bool, error) {
+	status, ok, err := bsql.GetUserStatus(ctx, user)
+	if err != nil || !ok {
+		return false, err
+	}
+	if status.Disabled {
+		return false, nil
+	}
+	return issued.After(status.SessionsRevokedAt), nil
+}
+
+// Whether user has the admin role and may use /api/admin
+// Active() already refused disabled users
+func IsAdmin(ctx context.Context, user string) (bool, error) {
+	status, ok, err := bsql.GetUserStatus(ctx, user)
+	if err != nil || !ok {
+		return false, err
+	}
+	return status.Role == ROLE_ADMIN, nil
+}
+
+// Give a user a role
+func SetRole(ctx context.Context, user string, role string) error {
+	if role != ROLE_USER && role != ROLE_ADMIN {
+		return ErrUnknownRole
+	}
+
+	ok, err := bsql.UserExists(ctx, user)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrUserNotFound
+	}
+
+	_, err = bsql.SetUserRole(ctx, user, role)
+	return err
+}
+
+// A user as admins see it
+func Get(ctx context.Context, user string) (*bsql.UserAccount, error) {
+	account, ok, err := bsql.GetUserAccount(ctx, user)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, ErrUserNotFound
+	}
+	return account, nil
+}
+
+// A page of users whose username or email starts with q, empty lists every user
+func Search(ctx context.Context, q string, limit int, offset int) ([]bsql.UserAccount, error) {
+	return bsql.SearchUsers(ctx, q, limit, offset)
+}
+
+// Stop a user from logging in and end every session they have
+// Disabling a disabled user does nothing
+func Disable(ctx context.Context, user string) error {
+	ok, err := bsql.UserExists(ctx, user)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrUserNotFound
+	}
+
+	_, err = bsql.DisableUser(ctx, user, time.Now())
+	return err
+}
+
+// Let a disabled user log in again, their old sessions stay revoked
+func Enable(ctx context.Context, user string) error {
+	ok, err := bsql.UserExists(ctx, user)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrUserNotFound
+	}
+
+	_, err = bsql.EnableUser(ctx, user)
+	return err
+}
+
+// End every session of a user, on every server sharing the database
+// Sessions are kept in memory, they stop working on their next request
+func RevokeSessions(ctx context.Context, user string) error {
+	ok, err := bsql.UserExists(ctx, user)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrUserNotFound
+	}
+
+	_, err = bsql.RevokeSessions(ctx, user, time.Now())
+	return err
+}
+
+// Set a new password and end every session, whoever had the old one may hold a token
+func ResetPassword(ctx context.Context, user string, pass string) error {
+	if err := RevokeSessions(ctx, user); err != nil {
+		return err
+	}
+	return bsql.UpdatePassword(ctx, user, pass)
+}
+
+// Set a new password for a signed in user and end their sessions on every server
+// Returns when they were revoked, the caller's own session is renewed past it with tokens.RevokeOthers
+func ChangePassword(ctx context.Context, user string, pass string) (time.Time, error) {
+	revoked, err := bsql.RevokeSessions(ctx, user, time.Now())
+	if err != nil {
+		return revoked, err
+	}
+	return revoked, bsql.UpdatePassword(ctx, user, pass)
+}
@@ -0,0 +1,313 @@
+// Badges earned from group events, SQL: table achievement
+// RULES says what earns a badge: the events that can, a metric of the user the event is about
+// and the range it has to be in, a new badge is a new rule and at most a new metric
+// A badge is awarded once, the award is published to the group as events.BADGE_EARNED
+// Events are evaluated by a worker, off the request that published them
+// Must call achievements.Init() after events.Init() to start evaluating
+package achievements
+
+import (
+	"benschreiber.com/purestserver/src/accounts"
+	"benschreiber.com/purestserver/src/audit"
+	"benschreiber.com/purestserver/src/bsql"
+	"benschreiber.com/purestserver/src/events"
+	"benschreiber.com/purestserver/src/lifecycle"
+	"benschreiber.com/purestserver/src/logging"
+	"benschreiber.com/purestserver/src/stats"
+	"context"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"time"
+)
+
+var logger = logging.For("achievements")
+
+// Metrics rules compare, of the user an event is about
+const (
+	HOLD_SECONDS   = "hold_seconds"   // how long they had the coin before the pass, not for a group's first pass or an operator's pass or hand-over
+	LONGEST_STREAK = "longest_streak" // most consecutive days they passed
+	PUSHUPS        = "pushups"        // lifetime, over every group
+	GROUPS_CREATED = "groups_created" // ever, disbanded ones included
+)
+
+// Longest badge id the achievement table stores
+const MAX_BADGE = 64
+
+// Events waiting for the worker before new ones are dropped
+// A dropped pass still counts towards streak and pushup badges on the next one
+const QUEUE_SIZE = 256
+
+var queue chan events.Event
+
+// What earns a badge, the metric has to be at least AtLeast and at most AtMost, zero is no bound
+// Badge is stored per user, renaming it takes it away from everyone who earned it
+type Rule struct {
+	Badge       string   `json:"badge"`
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	On          []string `json:"-"` // event types that evaluate it
+	Metric      string   `json:"-"`
+	AtLeast     int64    `json:"-"`
+	AtMost      int64    `json:"-"`
+}
+
+// Every badge, in the order they are evaluated
+var RULES = []Rule{
+	{
+		Badge:       "hot_potato",
+		Name:        "Hot Potato",
+		Description: "Pass the coin within an hour of getting it",
+		On:          []string{events.COIN_PASSED},
+		Metric:      HOLD_SECONDS,
+		AtMost:      int64(time.Hour.Seconds()),
+	},
+	{
+		Badge:       "streak_7",
+		Name:        "Full Week",
+		Description: "Pass the coin 7 days in a row",
+		On:          []string{events.COIN_PASSED},
+		Metric:      LONGEST_STREAK,
+		AtLeast:     7,
+	},
+	{
+		Badge:       "pushups_1000",
+		Name:        "Thousand Club",
+		Description: "Do 1000 pushups",
+		On:          []string{events.COIN_PASSED},
+		Metric:      PUSHUPS,
+		AtLeast:     1000,
+	},
+	{
+		Badge:       "founder",
+		Name:        "Founder",
+		Description: "Create a group",
+		On:          []string{events.GROUP_CREATED},
+		Metric:      GROUPS_CREATED,
+		AtLeast:     1,
+	},
+}
+
+// A badge a user earned, also the data of events.BADGE_EARNED
+// Name and Description are empty for a badge whose rule was removed
+type Badge struct {
+	Username string `json:"username"`
+	Rule
+	EarnedAt time.Time `json:"earned_at"`
+}
+
+// The user an event is about and what is known of them, stats are loaded once per event
+type subject struct {
+	ctx   context.Context
+	user  string
+	event events.Event
+	stats *stats.UserStats
+}
+
+func (s *subject) userStats() (*stats.UserStats, error) {
+	if s.stats == nil {
+		us, err := stats.ForUser(s.ctx, s.user)
+		if err != nil {
+			return nil, err
+		}
+		s.stats = us
+	}
+	return s.stats, nil
+}
+
+// Metric values of a subject, false when the metric doesn't apply to the event
+var metrics = map[string]func(s *subject) (int64, bool, error){
+	HOLD_SECONDS: func(s *subject) (int64, bool, error) {
+		pass, ok := s.event.Data.(*bsql.CoinPass)
+		if !ok {
+			return 0, false, nil
+		}
+		return bsql.GetPassHold(s.ctx, pass.ID)
+	},
+	LONGEST_STREAK: func(s *subject) (int64, bool, error) {
+		us, err := s.userStats()
+		if err != nil {
+			return 0, false, err
+		}
+		return int64(us.LongestStreak), true, nil
+	},
+	PUSHUPS: func(s *subject) (int64, bool, error) {
+		us, err := s.userStats()
+		if err != nil {
+			return 0, false, err
+		}
+		return us.Pushups, true, nil
+	},
+	GROUPS_CREATED: func(s *subject) (int64, bool, error) {
+		n, err := audit.Count(s.ctx, s.user, audit.GROUP_CREATE)
+		return int64(n), true, err
+	},
+}
+
+// Metric value in the rule's range
+func (r *Rule) earned(v int64) bool {
+	return (r.AtLeast == 0 || v >= r.AtLeast) && (r.AtMost == 0 || v <= r.AtMost)
+}
+
+// Rule evaluated on events of type t
+func (r *Rule) on(t string) bool {
+	for _, v := range r.On {
+		if v == t {
+			return true
+		}
+	}
+	return false
+}
+
+// The user an event can earn a badge for: the passer, or whoever joined or created the group
+func user(e events.Event) string {
+	switch data := e.Data.(type) {
+	case *bsql.CoinPass:
+		return data.From
+	case gin.H:
+		if u, ok := data["username"].(string); ok {
+			return u
+		}
+		u, _ := data["by"].(string)
+		return u
+	}
+	return ""
+}
+
+// Rules evaluated on events of type t
+func rulesOn(t string) []*Rule {
+	var rules []*Rule
+	for i := range RULES {
+		if RULES[i].on(t) {
+			rules = append(rules, &RULES[i])
+		}
+	}
+	return rules
+}
+
+// Events sink, queue events that can earn a badge without blocking the publisher
+func enqueue(e events.Event) {
+	if len(rulesOn(e.Type)) == 0 {
+		return
+	}
+	select {
+	case queue <- e:
+	default:
+		logger.Warn("dropping event, achievements are behind", "group", e.Group, "type", e.Type)
+	}
+}
+
+// Evaluate queued events until shutdown
+func work(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case e := <-queue:
+			evaluate(ctx, e)
+		}
+	}
+}
+
+// Award every badge the event earned its user
+func evaluate(ctx context.Context, e events.Event) {
+	s := &subject{ctx: ctx, user: user(e), event: e}
+	if s.user == "" || s.user == bsql.DELETED_USER {
+		return
+	}
+	if err := award(s, rulesOn(e.Type)); err != nil {
+		logger.Error("achievements failed", "user", s.user, "event", e.Type, "err", err)
+	}
+}
+
+// Check rules against s, skipping badges they already have
+func award(s *subject, rules []*Rule) error {
+	owned, err := bsql.GetAchievements(s.ctx, s.user)
+	if err != nil {
+		return err
+	}
+	has := make(map[string]bool, len(owned))
+	for _, a := range owned {
+		has[a.Badge] = true
+	}
+
+	for _, r := range rules {
+		if has[r.Badge] {
+			continue
+		}
+		v, ok, err := metrics[r.Metric](s)
+		if err != nil {
+			return err
+		}
+		if !ok || !r.earned(v) {
+			continue
+		}
+
+		// Another server may have awarded it since, only the first insert announces it
+		ok, err = bsql.InsertAchievement(s.ctx, s.user, r.Badge)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+
+		logger.Info("badge earned", "user", s.user, "badge", r.Badge)
+		events.Publish(events.Event{
+			Type:  events.BADGE_EARNED,
+			Group: s.event.Group,
+			Data:  &Badge{Username: s.user, Rule: *r, EarnedAt: time.Now().UTC()},
+		})
+	}
+	return nil
+}
+
+// Badges of any user, oldest first
+func For(ctx context.Context, user string) ([]Badge, error) {
+	ok, err := bsql.UserExists(ctx, user)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, accounts.ErrUserNotFound
+	}
+
+	owned, err := bsql.GetAchievements(ctx, user)
+	if err != nil {
+		return nil, err
+	}
+
+	rules := make(map[string]Rule, len(RULES))
+	for _, r := range RULES {
+		rules[r.Badge] = r
+	}
+	out := make([]Badge, 0, len(owned))
+	for _, a := range owned {
+		r, ok := rules[a.Badge]
+		if !ok {
+			r = Rule{Badge: a.Badge}
+		}
+		out = append(out, Badge{Username: user, Rule: r, EarnedAt: a.EarnedAt})
+	}
+	return out, nil
+}
+
+// Check the rules and start evaluating every group event from now on
+// A rule with an unknown metric or a reused or too long badge is fatal
+func Init() {
+	logger.Info("Initializing achievements", "rules", len(RULES))
+
+	seen := make(map[string]bool, len(RULES))
+	for _, r := range RULES {
+		if _, ok := metrics[r.Metric]; !ok {
+			logging.Fatal(errors.New("achievement " + r.Badge + " has unknown metric " + r.Metric))
+		}
+		if r.Badge == "" || len(r.Badge) > MAX_BADGE || seen[r.Badge] {
+			logging.Fatal(errors.New("achievement badge " + r.Badge + " is empty, too long or reused"))
+		}
+		seen[r.Badge] = true
+	}
+
+	queue = make(chan events.Event, QUEUE_SIZE)
+	lifecycle.Go("achievements", work)
+	events.AddSink(enqueue)
+}
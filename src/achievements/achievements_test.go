@@ -0,0 +1,113 @@
+package achievements
+
+import (
+	"benschreiber.com/purestserver/src/bsql"
+	"benschreiber.com/purestserver/src/events"
+	"github.com/gin-gonic/gin"
+	"testing"
+)
+
+func TestRuleEarned(t *testing.T) {
+	tests := []struct {
+		rule Rule
+		v    int64
+		want bool
+	}{
+		{Rule{AtLeast: 7}, 6, false},
+		{Rule{AtLeast: 7}, 7, true},
+		{Rule{AtLeast: 7}, 100, true},
+		{Rule{AtMost: 3600}, 0, true},
+		{Rule{AtMost: 3600}, 3600, true},
+		{Rule{AtMost: 3600}, 3601, false},
+		{Rule{AtLeast: 10, AtMost: 20}, 9, false},
+		{Rule{AtLeast: 10, AtMost: 20}, 15, true},
+		{Rule{AtLeast: 10, AtMost: 20}, 21, false},
+		{Rule{}, -5, true},
+	}
+	for _, tt := range tests {
+		if got := tt.rule.earned(tt.v); got != tt.want {
+			t.Errorf("Rule{AtLeast: %d, AtMost: %d}.earned(%d) = %v, want %v", tt.rule.AtLeast, tt.rule.AtMost, tt.v, got, tt.want)
+		}
+	}
+}
+
+func TestUser(t *testing.T) {
+	tests := []struct {
+		name string
+		e    events.Event
+		want string
+	}{
+		{"pass", events.Event{Type: events.COIN_PASSED, Data: &bsql.CoinPass{From: "ann", To: "bob"}}, "ann"},
+		{"join", events.Event{Type: events.MEMBER_JOINED, Data: gin.H{"username": "cat"}}, "cat"},
+		{"create", events.Event{Type: events.GROUP_CREATED, Data: gin.H{"by": "dan"}}, "dan"},
+		{"no user", events.Event{Type: events.GROUP_DISBANDED, Data: gin.H{}}, ""},
+		{"other data", events.Event{Type: events.BADGE_EARNED, Data: &Badge{Username: "eve"}}, ""},
+	}
+	for _, tt := range tests {
+		if got := user(tt.e); got != tt.want {
+			t.Errorf("%s: user = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRulesOn(t *testing.T) {
+	tests := []struct {
+		event string
+		want  []string
+	}{
+		{events.COIN_PASSED, []string{"hot_potato", "streak_7", "pushups_1000"}},
+		{events.GROUP_CREATED, []string{"founder"}},
+		{events.BADGE_EARNED, nil},
+		{events.MEMBER_KICKED, nil},
+	}
+	for _, tt := range tests {
+		rules := rulesOn(tt.event)
+		var got []string
+		for _, r := range rules {
+			got = append(got, r.Badge)
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("rulesOn(%s) = %v, want %v", tt.event, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("rulesOn(%s) = %v, want %v", tt.event, got, tt.want)
+				break
+			}
+		}
+	}
+}
+
+func TestEnqueueNeverBlocks(t *testing.T) {
+	queue = make(chan events.Event, 1)
+	t.Cleanup(func() { queue = nil })
+
+	pass := events.Event{Type: events.COIN_PASSED, Data: &bsql.CoinPass{From: "ann"}}
+	enqueue(events.Event{Type: events.MEMBER_KICKED, Data: gin.H{"username": "ann"}})
+	enqueue(pass)
+	enqueue(pass) // full, dropped
+
+	if len(queue) != 1 {
+		t.Fatalf("queue holds %d events, want 1", len(queue))
+	}
+	if e := <-queue; e.Type != events.COIN_PASSED {
+		t.Errorf("queued %s, want only the pass", e.Type)
+	}
+}
+
+func TestRulesValid(t *testing.T) {
+	seen := make(map[string]bool)
+	for _, r := range RULES {
+		if _, ok := metrics[r.Metric]; !ok {
+			t.Errorf("%s: unknown metric %q", r.Badge, r.Metric)
+		}
+		if r.Badge == "" || len(r.Badge) > MAX_BADGE || seen[r.Badge] {
+			t.Errorf("badge %q is empty, too long or reused", r.Badge)
+		}
+		if len(r.On) == 0 {
+			t.Errorf("%s: no events evaluate it", r.Badge)
+		}
+		seen[r.Badge] = true
+	}
+}
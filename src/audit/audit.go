@@ -0,0 +1,111 @@
+// Append-only log of who did what, SQL: table audit_event
+// Callers record after the action succeeded, the request id ties an event to the request's logs
+// Recording is best-effort: the action already happened, so a failed write is logged and never fails the request
+package audit
+
+import (
+	"benschreiber.com/purestserver/src/bsql"
+	"benschreiber.com/purestserver/src/logging"
+	"context"
+)
+
+var logger = logging.For("audit")
+
+// Actions of users, Target is the user acted on, Group the group it happened in
+const (
+	LOGIN          = "login"
+	LOGIN_FAILED   = "login_failed" // wrong password or code, or a disabled account
+	REGISTER       = "register"
+	ACCOUNT_DELETE = "account.delete"
+	GROUP_CREATE   = "group.create"
+	GROUP_JOIN     = "group.join"
+	GROUP_LEAVE    = "group.leave" // the member left or deleted their account
+	GROUP_KICK     = "group.kick"
+	GROUP_DISBAND  = "group.disband"
+	GROUP_TRANSFER = "group.transfer" // Target is the new creator, handed over or left the group by the old one
+	COIN_PASS      = "coin.pass"
+	COIN_HANDOVER  = "coin.handover" // the holder left or deleted their account, Target is the new holder
+)
+
+// Actions of admins and purestctl, prefixed with admin.
+const (
+	ADMIN_SEARCH_USERS     = "admin.search_users"
+	ADMIN_VIEW_USER        = "admin.view_user"
+	ADMIN_DISABLE_USER     = "admin.disable_user"
+	ADMIN_ENABLE_USER      = "admin.enable_user"
+	ADMIN_REVOKE_SESSIONS  = "admin.revoke_sessions"
+	ADMIN_SET_ROLE         = "admin.set_role"
+	ADMIN_RESET_PASSWORD   = "admin.reset_password"
+	ADMIN_CREATE_USER      = "admin.create_user"
+	ADMIN_SEARCH_GROUPS    = "admin.search_groups"
+	ADMIN_VIEW_GROUP       = "admin.view_group"
+	ADMIN_PASS_COIN        = "admin.pass_coin"
+	ADMIN_REASSIGN_COIN    = "admin.reassign_coin"
+	ADMIN_VIEW_AUDIT       = "admin.view_audit"
+	ADMIN_VIEW_RATE_LIMITS = "admin.view_rate_limits"
+	ADMIN_VIEW_SESSIONS    = "admin.view_sessions"
+	ADMIN_EXPORT           = "admin.export"
+)
+
+// Events returned per page when the caller doesn't say
+const (
+	DEFAULT_LIMIT = 50
+	MAX_LIMIT     = 500
+)
+
+// What happened, Actor and Action are required
+type Event struct {
+	Actor  string
+	Action string
+	Target string // user acted on
+	Group  string
+	IP     string // the request's when empty
+}
+
+// Append an event, the request id and IP come from ctx
+// A failed write is only logged, retrying the action would repeat it
+func Record(ctx context.Context, e Event) {
+	ip := e.IP
+	if ip == "" {
+		ip = logging.IP(ctx)
+	}
+	err := bsql.InsertAuditEvent(ctx, &bsql.AuditEvent{
+		Actor:     e.Actor,
+		Action:    e.Action,
+		Target:    e.Target,
+		GroupID:   e.Group,
+		IP:        ip,
+		RequestID: logging.ID(ctx),
+	})
+	if err != nil {
+		logger.Error("audit write failed", "action", e.Action, "actor", e.Actor, "target", e.Target, "group", e.Group, "err", err)
+	}
+}
+
+// Events matching f, newest first, Limit clamped to MAX_LIMIT
+func Query(ctx context.Context, f bsql.AuditFilter) ([]bsql.AuditEvent, error) {
+	if f.Limit <= 0 {
+		f.Limit = DEFAULT_LIMIT
+	}
+	if f.Limit > MAX_LIMIT {
+		f.Limit = MAX_LIMIT
+	}
+	return bsql.GetAuditEvents(ctx, f)
+}
+
+// Events of a group for its owner, newest first, Limit clamped to MAX_LIMIT
+// Leaves out the IPs and request ids of its members' requests
+func ForGroup(ctx context.Context, group string, f bsql.AuditFilter) ([]bsql.GroupAuditEvent, error) {
+	if f.Limit <= 0 {
+		f.Limit = DEFAULT_LIMIT
+	}
+	if f.Limit > MAX_LIMIT {
+		f.Limit = MAX_LIMIT
+	}
+	return bsql.GetGroupAuditEvents(ctx, group, f)
+}
+
+// Times actor did action, counted from the log so it outlives what they acted on
+func Count(ctx context.Context, actor string, action string) (int, error) {
+	return bsql.CountAuditEvents(ctx, actor, action)
+}
@@ -0,0 +1,386 @@
+// JSON request bodies, validated with struct tags through gin binding
+// While HEADER_BODIES is on the old header form is still accepted,
+// validated by the same tags and answered with a Deprecation header
+package bres
+
+import (
+	"benschreiber.com/purestserver/src/config"
+	"benschreiber.com/purestserver/src/logging"
+	"encoding/json"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/go-playground/validator/v10"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// Accept the deprecated header form of request bodies
+// Turn auth.header_bodies off (HEADER_BODIES=off) to require JSON once clients have moved over
+var headerBodies = true
+
+// POST /api/client/login
+type LoginRequest struct {
+	Username string `json:"username" binding:"required,alphanum,max=128"`
+	Password string `json:"password" binding:"required,nowhitespace,max=512"`
+}
+
+func (r *LoginRequest) fromHeaders(c *gin.Context) {
+	r.Username = c.GetHeader("Username")
+	r.Password = c.GetHeader("Password")
+}
+
+// POST /api/client/register
+type RegisterRequest struct {
+	Username string `json:"username" binding:"required,alphanum,max=128"`
+	Password string `json:"password" binding:"required,nowhitespace,max=512"`
+	Email    string `json:"email" binding:"omitempty,email,max=255"`
+}
+
+func (r *RegisterRequest) fromHeaders(c *gin.Context) {
+	r.Username = c.GetHeader("Username")
+	r.Password = c.GetHeader("Password")
+	r.Email = c.GetHeader("Email")
+}
+
+// POST /api/client/login/2fa
+type SecondFactorRequest struct {
+	Challenge string `json:"challenge" binding:"required,max=64"`
+	Code      string `json:"code" binding:"required,max=64"`
+}
+
+func (r *SecondFactorRequest) fromHeaders(c *gin.Context) {
+	r.Challenge = c.GetHeader("Challenge")
+	r.Code = c.GetHeader("Code")
+}
+
+// POST /api/client/email
+type EmailRequest struct {
+	Email string `json:"email" binding:"required,email,max=255"`
+}
+
+func (r *EmailRequest) fromHeaders(c *gin.Context) {
+	r.Email = c.GetHeader("Email")
+}
+
+// POST /api/client/email/verify, /api/client/2fa/confirm
+type CodeRequest struct {
+	Code string `json:"code" binding:"required,max=64"`
+}
+
+func (r *CodeRequest) fromHeaders(c *gin.Context) {
+	r.Code = c.GetHeader("Code")
+}
+
+// POST /api/client/password/forgot
+type ForgotPasswordRequest struct {
+	Username string `json:"username" binding:"required,alphanum,max=128"`
+}
+
+func (r *ForgotPasswordRequest) fromHeaders(c *gin.Context) {
+	r.Username = c.GetHeader("Username")
+}
+
+// POST /api/client/password/reset
+type ResetPasswordRequest struct {
+	Username string `json:"username" binding:"required,alphanum,max=128"`
+	Code     string `json:"code" binding:"required,max=64"`
+	Password string `json:"password" binding:"required,nowhitespace,max=512"`
+}
+
+func (r *ResetPasswordRequest) fromHeaders(c *gin.Context) {
+	r.Username = c.GetHeader("Username")
+	r.Code = c.GetHeader("Code")
+	r.Password = c.GetHeader("Password")
+}
+
+// POST /api/client/password
+type ChangePasswordRequest struct {
+	Password    string `json:"password" binding:"required,max=512"`
+	NewPassword string `json:"new_password" binding:"required,nowhitespace,max=512"`
+}
+
+func (r *ChangePasswordRequest) fromHeaders(c *gin.Context) {
+	r.Password = c.GetHeader("Password")
+	r.NewPassword = c.GetHeader("NewPassword")
+}
+
+// DELETE /api/client, POST /api/client/2fa
+// Re-authentication before something that can't be undone
+type PasswordRequest struct {
+	Password string `json:"password" binding:"required,max=512"`
+}
+
+func (r *PasswordRequest) fromHeaders(c *gin.Context) {
+	r.Password = c.GetHeader("Password")
+}
+
+// DELETE /api/client/2fa
+type DisableTwoFactorRequest struct {
+	Password string `json:"password" binding:"required,max=512"`
+	Code     string `json:"code" binding:"required,max=64"`
+}
+
+func (r *DisableTwoFactorRequest) fromHeaders(c *gin.Context) {
+	r.Password = c.GetHeader("Password")
+	r.Code = c.GetHeader("Code")
+}
+
+// POST /api/client/device
+type DeviceRequest struct {
+	Token    string `json:"token" binding:"required,max=255"`
+	Platform string `json:"platform" binding:"required,oneof=apns fcm"`
+}
+
+func (r *DeviceRequest) fromHeaders(c *gin.Context) {
+	r.Token = c.GetHeader("Device")
+	r.Platform = c.GetHeader("Platform")
+}
+
+// POST /api/client/quiet
+// Hours are pointers so 0, midnight, still counts as given
+type QuietHoursRequest struct {
+	Start    *int   `json:"start" binding:"required,min=0,max=23"`
+	End      *int   `json:"end" binding:"required,min=0,max=23"`
+	Timezone string `json:"timezone" binding:"omitempty,timezone,max=64"`
+}
+
+func (r *QuietHoursRequest) fromHeaders(c *gin.Context) {
+	if n, err := strconv.Atoi(c.GetHeader("Start")); err == nil {
+		r.Start = &n
+	}
+	if n, err := strconv.Atoi(c.GetHeader("End")); err == nil {
+		r.End = &n
+	}
+	r.Timezone = c.GetHeader("Timezone")
+}
+
+// POST /api/group/webhook
+// Events defaults to every event, Secret to a generated one
+type WebhookRequest struct {
+	URL    string   `json:"url" binding:"required,url,max=2048"`
+	Events []string `json:"events" binding:"omitempty,dive,max=32"`
+	Secret string   `json:"secret" binding:"omitempty,max=255"`
+}
+
+func (r *WebhookRequest) fromHeaders(c *gin.Context) {
+	r.URL = c.GetHeader("URL")
+	r.Secret = c.GetHeader("Secret")
+	if h := c.GetHeader("Events"); h != "" {
+		for _, v := range strings.Split(h, ",") {
+			r.Events = append(r.Events, strings.TrimSpace(v))
+		}
+	}
+}
+
+// POST /api/group/join, /api/group/coin
+// v1 only, v2 takes the group id from the path
+type GroupRequest struct {
+	ID string `json:"id" binding:"required,max=255"`
+}
+
+func (r *GroupRequest) fromHeaders(c *gin.Context) {
+	r.ID = c.GetHeader("ID")
+}
+
+// GET /api/admin/users, /api/admin/groups
+// Q matches a prefix, empty lists everything
+type SearchQuery struct {
+	Q      string `form:"q" binding:"max=128"`
+	Limit  int    `form:"limit" binding:"omitempty,min=1,max=500"`
+	Offset int    `form:"offset" binding:"min=0"`
+}
+
+// GET /api/admin/audit
+// Before is the smallest id of the previous page
+type AuditQuery struct {
+	Actor  string `form:"actor" binding:"max=128"`
+	Action string `form:"action" binding:"max=64"`
+	Target string `form:"target" binding:"max=128"`
+	Group  string `form:"group" binding:"max=255"`
+	Before int64  `form:"before" binding:"min=0"`
+	Limit  int    `form:"limit" binding:"omitempty,min=1,max=500"`
+}
+
+// GET /api/v2/groups/:id/audit
+// The admin query without the group, it comes from the path
+type GroupAuditQuery struct {
+	Actor  string `form:"actor" binding:"max=128"`
+	Action string `form:"action" binding:"max=64"`
+	Before int64  `form:"before" binding:"min=0"`
+	Limit  int    `form:"limit" binding:"omitempty,min=1,max=500"`
+}
+
+// GET /api/v2/groups/:id/leaderboard
+// Period defaults to all time
+type LeaderboardQuery struct {
+	Period string `form:"period" binding:"omitempty,oneof=day week month all"`
+}
+
+// PUT /api/v2/groups/:id/creator, POST /api/group/transfer
+type TransferRequest struct {
+	Username string `json:"username" binding:"required,alphanum,max=128"`
+}
+
+func (r *TransferRequest) fromHeaders(c *gin.Context) {
+	r.Username = c.GetHeader("Username")
+}
+
+// POST /api/admin/groups/:id/coin
+type ReassignRequest struct {
+	Username string `json:"username" binding:"required,alphanum,max=128"`
+}
+
+// Only reached outside Strict routes, the admin routes are all Strict
+func (r *ReassignRequest) fromHeaders(c *gin.Context) {
+	r.Username = c.GetHeader("Username")
+}
+
+// A request body that also has a deprecated header form
+type headerRequest interface {
+	fromHeaders(c *gin.Context)
+}
+
+// A single failed field in a 400 response
+type FieldError struct {
+	Field   string `json:"field,omitempty"`
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+// Human readable message for a failed rule
+func message(e validator.FieldError) string {
+	switch e.Tag() {
+	case "required":
+		return "is required"
+	case "alphanum":
+		return "must only contain letters and numbers"
+	case "nowhitespace":
+		return "must not contain whitespace"
+	case "email":
+		return "must be a valid email address"
+	case "max":
+		if e.Kind() == reflect.Int {
+			return "must be at most " + e.Param()
+		}
+		return "must be at most " + e.Param() + " characters"
+	case "min":
+		return "must be at least " + e.Param()
+	case "oneof":
+		return "must be one of " + e.Param()
+	case "url":
+		return "must be a URL"
+	case "timezone":
+		return "must be an IANA timezone name"
+	}
+	return "is invalid"
+}
+
+// Respond with every field that failed validation
+// STATUS: 400 Bad Request
+func abortWithFieldErrors(c *gin.Context, err error) {
+	var fields []FieldError
+
+	switch e := err.(type) {
+	case validator.ValidationErrors:
+		for _, f := range e {
+			fields = append(fields, FieldError{
+				Field:   f.Field(),
+				Rule:    f.Tag(),
+				Message: f.Field() + " " + message(f),
+			})
+		}
+	case *strconv.NumError:
+		fields = append(fields, FieldError{
+			Rule:    "type",
+			Message: strconv.Quote(e.Num) + " is not a number",
+		})
+	case *json.UnmarshalTypeError:
+		fields = append(fields, FieldError{
+			Field:   e.Field,
+			Rule:    "type",
+			Message: e.Field + " must be a " + e.Type.String(),
+		})
+	default:
+		fields = append(fields, FieldError{
+			Rule:    "json",
+			Message: "body must be a JSON object",
+		})
+	}
+
+	logging.From(c).Info("invalid request body", "errors", len(fields))
+	c.AbortWithStatusJSON(400, gin.H{"errors": fields})
+}
+
+// Fill req from the query string, validated by its binding tags
+// STATUS: 400 Bad Request with field errors on an invalid query
+func BindQuery(c *gin.Context, req interface{}) bool {
+	if err := c.ShouldBindQuery(req); err != nil {
+		abortWithFieldErrors(c, err)
+		return false
+	}
+	return true
+}
+
+// Fill req from the JSON body, or from headers while they are still accepted
+// Routes behind Strict always need the JSON body
+// STATUS: 400 Bad Request with field errors on an invalid body
+func BindRequest(c *gin.Context, req headerRequest) bool {
+	if c.Request.ContentLength == 0 && c.ContentType() != binding.MIMEJSON {
+		if !headerBodies || c.GetBool(STRICT_KEY) {
+			abortWithFieldErrors(c, nil)
+			return false
+		}
+
+		c.Header("Deprecation", "true")
+		req.fromHeaders(c)
+		if err := binding.Validator.ValidateStruct(req); err != nil {
+			abortWithFieldErrors(c, err)
+			return false
+		}
+		return true
+	}
+
+	if err := c.ShouldBindJSON(req); err != nil {
+		abortWithFieldErrors(c, err)
+		return false
+	}
+	return true
+}
+
+// Validate a request struct by its binding tags, outside of a gin handler
+// purestctl checks usernames and passwords by the same rules as the APIs
+func Validate(req interface{}) error {
+	rules.Do(setupRules)
+	return binding.Validator.ValidateStruct(req)
+}
+
+var rules sync.Once
+
+func setupValidator() {
+	rules.Do(setupRules)
+	headerBodies = config.Get().Auth.HeaderBodies
+}
+
+// Report fields by their JSON name and add the nowhitespace rule
+func setupRules() {
+	v, ok := binding.Validator.Engine().(*validator.Validate)
+	if !ok {
+		logging.Fatal(errors.New("unexpected gin validator"))
+	}
+
+	v.RegisterTagNameFunc(func(f reflect.StructField) string {
+		name := strings.SplitN(f.Tag.Get("json"), ",", 2)[0]
+		if name == "-" {
+			return ""
+		}
+		return name
+	})
+
+	v.RegisterValidation("nowhitespace", func(fl validator.FieldLevel) bool {
+		return strings.IndexFunc(fl.Field().String(), unicode.IsSpace) == -1
+	})
+}
@@ -2,21 +2,43 @@
 package bres
 
 import (
+	"benschreiber.com/purestserver/src/accounts"
 	"benschreiber.com/purestserver/src/bres/ratelimit"
 	"benschreiber.com/purestserver/src/bres/tokens"
+	"benschreiber.com/purestserver/src/bres/totp"
 	"benschreiber.com/purestserver/src/bsql"
-	"database/sql"
+	"benschreiber.com/purestserver/src/config"
+	"benschreiber.com/purestserver/src/logging"
+	"benschreiber.com/purestserver/src/tracing"
+	"context"
+	"crypto/rand"
+	"errors"
 	"github.com/gin-gonic/gin"
-	"log"
-	"regexp"
+	"go.opentelemetry.io/otel/attribute"
+	"math/big"
+	"strings"
+	"time"
 )
 
+var logger = logging.For("bres")
+
+// Characters of a one-time code, no 0/O or 1/I to misread
+const CODE_ALPHABET = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+const CODE_LENGTH = 8
+
+// Recovery codes handed out when two-factor is enabled
+const RECOVERY_CODES = 10
+
 // Initialize maps in memory
 func Init() {
 
 	tokens.Init()
 
 	ratelimit.Init()
+
+	setupValidator()
+
+	headerTokens = config.Get().Auth.HeaderTokens
 }
 
 // Checks context for specified headers
@@ -24,7 +46,7 @@ func Init() {
 func ValidateHeaders(c *gin.Context, args ...string) bool {
 	for _, v := range args {
 		if c.GetHeader(v) == "" {
-			log.Println("invalid or missing headers")
+			logging.From(c).Info("invalid or missing headers", "header", v)
 			c.AbortWithStatus(400)
 			return false
 		}
@@ -32,87 +54,253 @@ func ValidateHeaders(c *gin.Context, args ...string) bool {
 	return true
 }
 
-// General authentication validation
-// Validate API Tokens
-func ValidateAuthentication(c *gin.Context) (bool, error) {
+// Log err and end the request, for database errors and anything else the client can't fix
+// The process keeps serving, only startup errors are fatal
+// STATUS: 500 Internal Server Error
+func AbortWithError(c *gin.Context, err error) {
+	logging.From(c).Error("request failed", "method", c.Request.Method, "path", c.FullPath(), "err", err)
+	c.AbortWithStatus(500)
+}
 
-	var err error
+// Context keys set by ValidateAuthentication
+const (
+	USER_KEY  = "user"
+	TOKEN_KEY = "token"
+)
 
-	// Validate all headers are present in request
-	if !ValidateHeaders(c, "Token", "Username") {
-		return false, err
-	}
+// Context key set by Strict
+const STRICT_KEY = "strict"
+
+// Middleware refusing the deprecated header forms of bodies and tokens
+// Used on the v2 routes, v1 keeps them until its sunset
+func Strict(c *gin.Context) {
+	c.Set(STRICT_KEY, true)
+	c.Next()
+}
+
+// Realm sent in WWW-Authenticate challenges
+const REALM = "pushupapp"
 
-	// Grab auth fields
-	token := c.GetHeader("Token")
-	username := c.GetHeader("Username")
+// Accept the deprecated Token and Username headers
+// Turn auth.header_tokens off (HEADER_TOKENS=off) to require Authorization: Bearer
+var headerTokens = true
 
-	// Validate user is in allowed characters
-	// STATUS: 400 Bad Request on illegal characters
-	if ok, err := ValidateUserPassRegex(c, username, ""); !ok {
-		return !ok, err
+// Authenticated username, set by ValidateAuthentication
+func User(c *gin.Context) string {
+	return c.GetString(USER_KEY)
+}
+
+// Token the request was authenticated with, set by ValidateAuthentication
+func Token(c *gin.Context) string {
+	return c.GetString(TOKEN_KEY)
+}
+
+// Respond with a Bearer challenge, code is an RFC 6750 error code or empty
+// STATUS: 401 Unauthorized, 400 Bad Request on invalid_request
+func abortWithChallenge(c *gin.Context, code string) {
+	challenge := `Bearer realm="` + REALM + `"`
+	if code != "" {
+		challenge += `, error="` + code + `"`
 	}
+	c.Header("WWW-Authenticate", challenge)
 
-	// Verify the user exists
-	// STATUS: 404 Not Found on non-existant user
-	if ok, err := bsql.UserExists(username); !ok {
+	if code == "invalid_request" {
 		c.AbortWithStatus(400)
-		return ok, err
+		return
+	}
+	c.AbortWithStatus(401)
+}
+
+// Returned by Authenticate for an unknown, expired or stolen token
+var ErrInvalidToken = errors.New("invalid token")
+
+// Token from an Authorization header value, false unless it is "Bearer <token>"
+func ParseBearer(auth string) (string, bool) {
+	parts := strings.SplitN(auth, " ", 2)
+	if len(parts) != 2 || !strings.EqualFold(parts[0], "Bearer") || strings.TrimSpace(parts[1]) == "" {
+		return "", false
 	}
+	return strings.TrimSpace(parts[1]), true
+}
+
+// Resolve a token to its user, shared by every API
+// The token must be unexpired, issued to ip and, when username isn't empty, to that user
+// An invalid token is deleted
+func Authenticate(ctx context.Context, token string, ip string, username string) (user string, err error) {
+	ctx, span := tracing.Start(ctx, "bres.Authenticate")
+	defer func() {
+		span.SetAttributes(attribute.Bool("auth.valid", err == nil))
+		if err != ErrInvalidToken {
+			tracing.Fail(span, err)
+		}
+		span.End()
+	}()
 
 	// Check if api token exists
-	// STATUS: 401 Unauthorized on invalid token
-	if !tokens.TokenExists(token) {
-		log.Println("invalid token")
-		c.AbortWithStatus(401)
-		return false, err
+	client, err := tokens.GetClient(token)
+	if err != nil {
+		logger.Info("invalid token", "ip", ip)
+		return "", ErrInvalidToken
 	}
 
 	// Validate token field
-	// STATUS: 401 Unauthorized on invalid token
-	client, _ := tokens.GetClient(token)
 	if client.Expired() ||
-		client.User != username ||
-		client.IP != c.ClientIP() {
+		client.IP != ip ||
+		(username != "" && client.User != username) {
 
-		log.Println("compromised, expired or invalid")
+		logger.Warn("compromised, expired or invalid token", "user", client.User, "ip", ip)
 		// Remove invalidated Token
 		tokens.DeleteUser(token)
-		c.AbortWithStatus(401)
+		return "", ErrInvalidToken
+	}
+
+	// Verify the user still exists, isn't disabled and the session wasn't revoked,
+	// possibly by another server or purestctl
+	ok, err := accounts.Active(ctx, client.User, client.Issued)
+	if err != nil {
+		return "", err
+	}
+	if !ok {
+		logger.Info("session revoked", "user", client.User)
+		tokens.DeleteUser(token)
+		return "", ErrInvalidToken
+	}
+
+	return client.User, nil
+}
+
+// General authentication validation
+// Validate API Tokens from Authorization: Bearer, the username comes from the token
+// Sets USER_KEY and TOKEN_KEY in the context
+func ValidateAuthentication(c *gin.Context) (bool, error) {
+	ctx, span := tracing.Start(c.Request.Context(), "bres.ValidateAuthentication")
+	defer span.End()
+
+	var err error
+	var token, username string
+
+	// Grab the token, or the deprecated header pair
+	// STATUS: 401 Unauthorized on missing credentials
+	// STATUS: 400 Bad Request on a non Bearer scheme
+	if auth := c.GetHeader("Authorization"); auth != "" {
+		var ok bool
+		if token, ok = ParseBearer(auth); !ok {
+			logging.From(c).Info("invalid authorization header")
+			abortWithChallenge(c, "invalid_request")
+			return false, err
+		}
+
+	} else if headerTokens && !c.GetBool(STRICT_KEY) && c.GetHeader("Token") != "" {
+
+		// Validate all headers are present in request
+		if !ValidateHeaders(c, "Token", "Username") {
+			return false, err
+		}
+		c.Header("Deprecation", "true")
+
+		token = c.GetHeader("Token")
+		username = c.GetHeader("Username")
+
+	} else {
+		abortWithChallenge(c, "")
 		return false, err
+	}
 
+	// Resolve the token, the deprecated Username header must match it
+	// STATUS: 401 Unauthorized on an unknown, expired or stolen token, or a deleted user
+	user, err := Authenticate(ctx, token, c.ClientIP(), username)
+	if err == ErrInvalidToken {
+		abortWithChallenge(c, "invalid_token")
+		return false, nil
 	}
+	if err != nil {
+		return false, err
+	}
+
+	c.Set(USER_KEY, user)
+	c.Set(TOKEN_KEY, token)
+	logging.With(c, "user", user)
 	return true, err
 }
 
-// Check if user is capable of making a coin request
-func ValidateCoinRequest(c *gin.Context, user string, id string) (bool, error) {
-	err := bsql.SelectCoinHolder(user, id)
+// ValidateAuthentication, then require the admin role
+// STATUS: 403 Forbidden for anyone but an admin
+func ValidateAdmin(c *gin.Context) (bool, error) {
+	ok, err := ValidateAuthentication(c)
+	if !ok || err != nil {
+		return false, err
+	}
+
+	ok, err = accounts.IsAdmin(c.Request.Context(), User(c))
 	if err != nil {
-		if err == sql.ErrNoRows {
-			return false, nil
-		}
+		return false, err
 	}
-	return true, err
+	if !ok {
+		logging.From(c).Warn("admin route refused", "route", c.FullPath())
+		c.AbortWithStatus(403)
+		return false, nil
+	}
+	return true, nil
+}
+
+// Generate a random single-use code to send by email
+func NewCode() string {
+	max := big.NewInt(int64(len(CODE_ALPHABET)))
+	code := make([]byte, CODE_LENGTH)
+	for i := range code {
+		n, _ := rand.Int(rand.Reader, max) // only fails with rand.Reader, which crashes the process instead
+		code[i] = CODE_ALPHABET[n.Int64()]
+	}
+	return string(code)
 }
 
-func ValidateUserPassRegex(c *gin.Context, username string, password string) (bool, error) {
+// Generate recovery codes, shown as XXXX-XXXX
+func NewRecoveryCodes() []string {
+	codes := make([]string, RECOVERY_CODES)
+	for i := range codes {
+		code := NewCode()
+		codes[i] = code[:4] + "-" + code[4:]
+	}
+	return codes
+}
 
-	// Handle a bad username that contains illegal characters
-	if regex, err := regexp.Compile("[^A-Za-z0-9]+"); regex.MatchString(username) {
-		log.Println("username does not follow guidelines")
-		c.AbortWithStatus(400)
+// Recovery code in the XXXX-XXXX form the codes were stored in
+// Accepts any case, with or without the dash, false when it can't be one
+func normalizeRecoveryCode(code string) (string, bool) {
+	code = strings.ToUpper(strings.ReplaceAll(code, "-", ""))
+	if len(code) != CODE_LENGTH {
+		return "", false
+	}
+	return code[:4] + "-" + code[4:], true
+}
+
+// Check a second factor for a user with two-factor enabled
+// Accepts a current TOTP code, used once, or an unused recovery code
+func ValidateSecondFactor(ctx context.Context, user string, code string) (ok bool, err error) {
+	ctx, span := tracing.Start(ctx, "bres.ValidateSecondFactor")
+	defer func() {
+		span.SetAttributes(attribute.Bool("auth.valid", ok))
+		tracing.Fail(span, err)
+		span.End()
+	}()
+
+	tf, ok, err := bsql.GetTwoFactor(ctx, user)
+	if err != nil || !ok || !tf.Enabled {
 		return false, err
 	}
 
-	//See if password contains any whitespaces
-	if password != "" {
-		if regex, err := regexp.Compile("\\s+"); regex.MatchString(password) {
-			log.Println("password does not follow guidelines")
-			c.AbortWithStatus(400)
-			return false, err
-		}
+	if step, ok := totp.Validate(tf.Secret, code, time.Now()); ok {
+		return bsql.UseTwoFactorStep(ctx, user, step)
 	}
 
-	return true, nil
+	recovery, ok := normalizeRecoveryCode(code)
+	if !ok {
+		return false, nil
+	}
+
+	ok, err = bsql.ConsumeRecoveryCode(ctx, user, recovery)
+	if ok {
+		logger.Info("recovery code used", "user", user)
+	}
+	return ok, err
 }
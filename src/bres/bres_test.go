@@ -0,0 +1,72 @@
+package bres
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNormalizeRecoveryCode(t *testing.T) {
+	tests := []struct {
+		code string
+		want string
+		ok   bool
+	}{
+		{"ABCD-EFGH", "ABCD-EFGH", true},
+		{"abcd-efgh", "ABCD-EFGH", true},
+		{"ABCDEFGH", "ABCD-EFGH", true},
+		{"AB-CD-EF-GH", "ABCD-EFGH", true},
+		{"ABCD-EFG", "", false},
+		{"ABCD-EFGHJ", "", false},
+		{"", "", false},
+		{"123456", "", false},
+	}
+	for _, tt := range tests {
+		got, ok := normalizeRecoveryCode(tt.code)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("normalizeRecoveryCode(%q) = %q, %v, want %q, %v", tt.code, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestNewRecoveryCodes(t *testing.T) {
+	codes := NewRecoveryCodes()
+	if len(codes) != RECOVERY_CODES {
+		t.Fatalf("%d codes, want %d", len(codes), RECOVERY_CODES)
+	}
+	seen := make(map[string]bool)
+	for _, code := range codes {
+		if got, ok := normalizeRecoveryCode(code); !ok || got != code {
+			t.Errorf("code %q isn't in its stored form", code)
+		}
+		if strings.Trim(strings.ReplaceAll(code, "-", ""), CODE_ALPHABET) != "" {
+			t.Errorf("code %q has characters outside the alphabet", code)
+		}
+		if seen[code] {
+			t.Errorf("code %q repeated", code)
+		}
+		seen[code] = true
+	}
+}
+
+func TestParseBearer(t *testing.T) {
+	tests := []struct {
+		auth  string
+		token string
+		ok    bool
+	}{
+		{"Bearer abc123", "abc123", true},
+		{"bearer abc123", "abc123", true},
+		{"BEARER  abc123 ", "abc123", true},
+		{"Bearer ", "", false},
+		{"Bearer", "", false},
+		{"Basic YW5uOnB3", "", false},
+		{"abc123", "", false},
+		{"", "", false},
+	}
+	for _, tt := range tests {
+		token, ok := ParseBearer(tt.auth)
+		if token != tt.token || ok != tt.ok {
+			t.Errorf("ParseBearer(%q) = %q, %v, want %q, %v", tt.auth, token, ok, tt.token, tt.ok)
+		}
+	}
+}
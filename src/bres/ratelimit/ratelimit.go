@@ -1,18 +1,26 @@
 // Contains gin middleware to ratelimit via IPs
-// Responds with HTTP 429 if a visitor exceeds VISITOR_MAX_REQs
+// Responds with HTTP 429 if a visitor exceeds rate_limit.max_requests per rate_limit.window
 // Must call ratecache.Init() to initialize the maps
 package ratelimit
 
 import (
+	"benschreiber.com/purestserver/src/config"
+	"benschreiber.com/purestserver/src/lifecycle"
+	"benschreiber.com/purestserver/src/logging"
+	"benschreiber.com/purestserver/src/metrics"
+	"context"
 	"github.com/gin-gonic/gin"
-	"log"
+	"sort"
 	"sync"
 	"time"
 )
 
-const (
-	VISITOR_LIFETIME = 10 // in seconds
-	VISITOR_MAX_REQS = 5
+var logger = logging.For("ratelimit")
+
+// Limits from the rate_limit config, set by Init()
+var (
+	visitorLifetime time.Duration
+	visitorMaxReqs  int
 )
 
 type visitor struct {
@@ -38,14 +46,14 @@ func (v *visitor) incrementExp() {
 // is now the time the user should be ratelimited
 func (v *visitor) rateLimit() {
 	v.RateLimited = true
-	v.Exp = v.Exp.Add(time.Second * VISITOR_LIFETIME)
+	v.Exp = v.Exp.Add(visitorLifetime)
 }
 
 // Set to default values for all of a visitors properties
 func (v *visitor) reset() {
-	log.Println("Reseting a visitor")
+	logger.Debug("resetting a visitor")
 	v.Reqs = 0
-	v.Exp = time.Now().Add(time.Second * VISITOR_LIFETIME)
+	v.Exp = time.Now().Add(visitorLifetime)
 	v.RateLimited = false
 }
 
@@ -63,9 +71,9 @@ func (i *IPCache) getVisitor(ip string) *visitor {
 
 // Update the map with a new ip,visitor
 func (i *IPCache) addVisitor(ip string) {
-	log.Println("Adding visitor: " + ip)
+	logger.Debug("adding visitor", "ip", ip)
 	i.Visitors[ip] = &visitor{
-		Exp:  time.Now().Add(time.Second * VISITOR_LIFETIME),
+		Exp:  time.Now().Add(visitorLifetime),
 		Reqs: 1,
 	}
 }
@@ -85,78 +93,119 @@ var cache *IPCache
 
 // Main func, middleware for gin engine (concurrency safe)
 // Runs on every API call
+func IPRateLimiter(c *gin.Context) {
+	if !Allow(c.ClientIP()) {
+
+		// STATUS: 429 RateLimited
+		c.AbortWithStatus(429)
+	}
+}
+
+// Count a request from ip, false if it should be rejected
+// Shared by every listener so an IP has one budget across them
 // Add IP to map if nonexistant
 // Ratelimit user on VISITOR_MAX_REQ exceeded
-func IPRateLimiter(c *gin.Context) {
+func Allow(ip string) bool {
 	cache.Mu.Lock()
 	defer cache.Mu.Unlock()
 
-	if cache.visitorExists(c.ClientIP()) {
+	if cache.visitorExists(ip) {
 
-		v := cache.getVisitor(c.ClientIP())
+		v := cache.getVisitor(ip)
 		if v.expired() {
 			// Renew visitor
 			v.reset()
-			return
+			return true
 		}
 
 		if v.RateLimited {
 
 			// Increment the ratelimit expiration date by 1 second
 			v.incrementExp()
-
-			// STATUS: 429 RateLimited
-			c.AbortWithStatus(429)
-
-			return
+			metrics.RateLimited.Inc()
+			return false
 		}
 
 		// Ratelimit the user if they have
 		// surpassed the allowed requests in the time period
-		if v.Reqs > VISITOR_MAX_REQS {
+		if v.Reqs > visitorMaxReqs {
 
 			// Set RateLimited boolean
 			// Use exp date as throttle time
 			v.rateLimit()
-
-			// STATUS: 429 RateLimited
-			c.AbortWithStatus(429)
-			return
+			metrics.RateLimited.Inc()
+			return false
 		}
 
 		v.increment()
-		return
+		return true
 
 	}
-	cache.addVisitor(c.ClientIP())
-	return
+	cache.addVisitor(ip)
+	return true
 }
 
-// Goroutine to periodically clean visitor maps
-// Lock map while cleaning
-func cleanvisitors() {
-	for {
-		time.Sleep(time.Minute)
-		cache.Mu.Lock()
-		for k, v := range cache.Visitors {
-			if v.expired() {
-				cache.deleteVisitor(k)
-				log.Println("visitor : " + k + " deleted.")
-			}
+// An IP's standing with the rate limiter, for admins
+// Until is when the count resets, or the block ends when Limited
+type Visitor struct {
+	IP       string    `json:"ip"`
+	Requests int       `json:"requests"`
+	Limited  bool      `json:"limited"`
+	Until    time.Time `json:"until"`
+}
 
+// Every unexpired visitor of this server, blocked ones first
+func Visitors() []Visitor {
+	cache.Mu.Lock()
+	defer cache.Mu.Unlock()
+
+	out := make([]Visitor, 0, len(cache.Visitors))
+	for ip, v := range cache.Visitors {
+		if !v.expired() {
+			out = append(out, Visitor{IP: ip, Requests: v.Reqs, Limited: v.RateLimited, Until: v.Exp})
 		}
-		cache.Mu.Unlock()
 	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Limited != out[j].Limited {
+			return out[i].Limited
+		}
+		return out[i].IP < out[j].IP
+	})
+	return out
+}
+
+// Remove expired visitors, runs every rate_limit.clean_period
+// Lock map while cleaning
+func cleanvisitors(ctx context.Context) {
+	cache.Mu.Lock()
+	defer cache.Mu.Unlock()
 
+	for k, v := range cache.Visitors {
+		if v.expired() {
+			cache.deleteVisitor(k)
+			logger.Debug("visitor deleted", "ip", k)
+		}
+
+	}
 }
 
 // Initialize the ratelimit map in memory
 func Init() {
-	log.Println("Initializing ratelimit maps")
+	logger.Info("Initializing ratelimit maps")
+	cfg := config.Get().RateLimit
+	visitorLifetime = cfg.Window
+	visitorMaxReqs = cfg.MaxRequests
+
 	cache = &IPCache{
 		Visitors: make(map[string]*visitor),
 		Mu:        &sync.Mutex{},
 	}
 
-	go cleanvisitors()
+	metrics.Register(metrics.GaugeFunc("rate_limit_visitors", "IPs tracked by the rate limiter.", func() float64 {
+		cache.Mu.Lock()
+		defer cache.Mu.Unlock()
+		return float64(len(cache.Visitors))
+	}))
+
+	lifecycle.Every("visitor_cleaner", cfg.CleanPeriod, 0, cleanvisitors)
 }
@@ -1,31 +1,56 @@
 // Contains functions to store API tokens linked to user accounts in memory
 // Generates a UID  on AddClient()
-// Tokens expire after 6 hour
+// Tokens expire after auth.token_lifetime, 6 hours by default
 // Must call tokens.Init() to initalize maps
 package tokens
 
 import (
+	"benschreiber.com/purestserver/src/config"
+	"benschreiber.com/purestserver/src/health"
+	"benschreiber.com/purestserver/src/lifecycle"
+	"benschreiber.com/purestserver/src/logging"
+	"benschreiber.com/purestserver/src/metrics"
+	"context"
 	"errors"
 	"github.com/google/uuid"
-	"log"
+	"sort"
 	"sync"
 	"time"
 )
 
+var logger = logging.For("tokens")
+
 type client struct {
-	IP   string
-	User string
-	Exp  time.Time
+	IP     string
+	User   string
+	Issued time.Time
+	Exp    time.Time
 }
 
 func (c *client) Expired() bool {
 	return c.Exp.Before(time.Now())
 }
 
+// Login challenge waiting on a second factor
+type challenge struct {
+	client
+	Attempts int
+}
+
+// Challenges expire after 5 minutes or MAX_CHALLENGE_ATTEMPTS wrong codes
+const (
+	CHALLENGE_LIFETIME     = 5 * time.Minute
+	MAX_CHALLENGE_ATTEMPTS = 5
+)
+
+// How long a token is valid, set by Init()
+var tokenLifetime time.Duration
+
 // Struct that maintains a necessary maps for managing TokenCache
 type TokenCache struct {
 	TokenClient map[string]*client
 	UserToken   map[string]string
+	Challenges  map[string]*challenge
 	Mu          *sync.Mutex
 }
 
@@ -35,12 +60,11 @@ func GetClient(token string) (client, error) {
     cache.Mu.Lock()
     defer cache.Mu.Unlock()
 
-    v := cache.TokenClient[token]
 	if v, ok := cache.TokenClient[token]; ok {
 		return *v, nil
 	}
 	err := errors.New("user not found")
-	return *v, err
+	return client{}, err
 
 }
 
@@ -55,28 +79,68 @@ func TokenExists(token string) bool {
 func DeleteUser(token string) error {
     cache.Mu.Lock()
     defer cache.Mu.Unlock()
-    
-	c, err := GetClient(token)
-	if err != nil {
-		return err
+
+	return deleteToken(token)
+}
+
+// Remove a token from both maps
+// Caller must hold cache.Mu
+func deleteToken(token string) error {
+	c, ok := cache.TokenClient[token]
+	if !ok {
+		return errors.New("user not found")
 	}
 
 	delete(cache.TokenClient, token)
-	delete(cache.UserToken, c.User)
-	return err
+	if cache.UserToken[c.User] == token {
+		delete(cache.UserToken, c.User)
+	}
+	return nil
 }
 
+// Invalidate every session of a user
+func RevokeUser(username string) {
+	cache.Mu.Lock()
+	defer cache.Mu.Unlock()
+
+	if token, ok := cache.UserToken[username]; ok {
+		logger.Info("revoking sessions", "user", username)
+		deleteToken(token)
+	}
+}
+
+// Invalidate every session of a user on this server except keep
+// keep is reissued after revoked, when the user's sessions were revoked on every server
+func RevokeOthers(username string, keep string, revoked time.Time) {
+	cache.Mu.Lock()
+	defer cache.Mu.Unlock()
+
+	for k, v := range cache.TokenClient {
+		if v.User != username {
+			continue
+		}
+		if k == keep {
+			if !v.Issued.After(revoked) {
+				v.Issued = revoked.Add(time.Millisecond)
+			}
+			continue
+		}
+		logger.Info("revoking a session", "user", username)
+		deleteToken(k)
+	}
+}
+
+// Caller must hold cache.Mu
 func updateMap(ip string, username string, token string) {
-    cache.Mu.Lock()
-    defer cache.Mu.Unlock()
-    
 
-	// Add a new client to the maps with an exp of 6 hours
+	// Add a new client to the maps with an exp of tokenLifetime
 	// from current time
+	now := time.Now()
 	cache.TokenClient[token] = &client{
-		IP:   ip,
-		User: username,
-		Exp:  time.Now().Add(time.Hour * 6),
+		IP:     ip,
+		User:   username,
+		Issued: now,
+		Exp:    now.Add(tokenLifetime),
 	}
 
 	cache.UserToken[username] = token
@@ -89,9 +153,9 @@ func AddClient(ip string, username string) string {
 	// Create a random uid
 	uid := uuid.New().String()
 
-	if _, err := GetClient(username); err == nil {
-		DeleteUser(username)
-		log.Println("Refreshing a token")
+	if old, ok := cache.UserToken[username]; ok {
+		deleteToken(old)
+		logger.Debug("refreshing a token", "user", username)
 	}
 
 	updateMap(ip, username, uid)
@@ -99,30 +163,149 @@ func AddClient(ip string, username string) string {
 }
 
 
+// Create a short-lived challenge token for a login that needs a second factor
+func AddChallenge(ip string, username string) string {
+	cache.Mu.Lock()
+	defer cache.Mu.Unlock()
+
+	uid := uuid.New().String()
+	cache.Challenges[uid] = &challenge{client: client{
+		IP:   ip,
+		User: username,
+		Exp:  time.Now().Add(CHALLENGE_LIFETIME),
+	}}
+	return uid
+}
+
+// Return the user a challenge was issued to
+// False if it doesn't exist, expired or is used from another IP
+func GetChallenge(token string, ip string) (string, bool) {
+	cache.Mu.Lock()
+	defer cache.Mu.Unlock()
+
+	v, ok := cache.Challenges[token]
+	if !ok {
+		return "", false
+	}
+	if v.Expired() || v.IP != ip {
+		delete(cache.Challenges, token)
+		return "", false
+	}
+	return v.User, true
+}
+
+// Count a wrong code, the challenge is dropped after too many
+func FailChallenge(token string) {
+	cache.Mu.Lock()
+	defer cache.Mu.Unlock()
+
+	if v, ok := cache.Challenges[token]; ok {
+		v.Attempts++
+		if v.Attempts >= MAX_CHALLENGE_ATTEMPTS {
+			logger.Warn("too many attempts on a challenge", "user", v.User)
+			delete(cache.Challenges, token)
+		}
+	}
+}
+
+func DeleteChallenge(token string) {
+	cache.Mu.Lock()
+	defer cache.Mu.Unlock()
+
+	delete(cache.Challenges, token)
+}
+
 func Init() {
 
-	log.Println("Initializing token maps")
+	logger.Info("Initializing token maps")
+	cfg := config.Get().Auth
+	tokenLifetime = cfg.TokenLifetime
 
 	cache = &TokenCache{
 		TokenClient: make(map[string]*client),
 		UserToken:   make(map[string]string),
+		Challenges:  make(map[string]*challenge),
 		Mu:          &sync.Mutex{},
 	}
 
-	go cleanTokens()
+	metrics.Register(
+		metrics.GaugeFunc("active_tokens", "Session tokens in memory, expired ones included until cleaned.", func() float64 {
+			cache.Mu.Lock()
+			defer cache.Mu.Unlock()
+			return float64(len(cache.TokenClient))
+		}),
+		metrics.GaugeFunc("pending_challenges", "Two-factor login challenges waiting on a code.", func() float64 {
+			cache.Mu.Lock()
+			defer cache.Mu.Unlock()
+			return float64(len(cache.Challenges))
+		}),
+	)
+
+	health.Live("tokens", Check)
+
+	lifecycle.Every("token_cleaner", cfg.CleanPeriod, 0, cleanTokens)
 }
 
-// Goroutine to  clean tokens every 10 min 
-func cleanTokens() {
-	for {
-		time.Sleep(time.Minute * 10)
-		cache.Mu.Lock()
-		for _, v := range cache.TokenClient {
-			if v.Expired() {
-				log.Println("Removing a token: " + v.User)
-				DeleteUser(v.User)
-			}
+// A session as admins see it, the token itself never leaves the store
+type Session struct {
+	User      string    `json:"username"`
+	IP        string    `json:"ip"`
+	IssuedAt  time.Time `json:"issued_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// Every unexpired session held by this server, by username
+// Other servers sharing the database hold their own
+func Sessions() []Session {
+	cache.Mu.Lock()
+	defer cache.Mu.Unlock()
+
+	out := make([]Session, 0, len(cache.TokenClient))
+	for _, c := range cache.TokenClient {
+		if !c.Expired() {
+			out = append(out, Session{User: c.User, IP: c.IP, IssuedAt: c.Issued, ExpiresAt: c.Exp})
 		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].User < out[j].User })
+	return out
+}
+
+// The store is initialized and its lock can be taken
+// A lock held until ctx is done means a stuck holder
+func Check(ctx context.Context) error {
+	if cache == nil {
+		return errors.New("token store not initialized")
+	}
+
+	locked := make(chan struct{})
+	go func() {
+		cache.Mu.Lock()
 		cache.Mu.Unlock()
+		close(locked)
+	}()
+
+	select {
+	case <-locked:
+		return nil
+	case <-ctx.Done():
+		return errors.New("token store lock held")
+	}
+}
+
+// Remove expired tokens and challenges, runs every auth.clean_period
+func cleanTokens(ctx context.Context) {
+	cache.Mu.Lock()
+	defer cache.Mu.Unlock()
+
+	for k, v := range cache.TokenClient {
+		if v.Expired() {
+			logger.Debug("removing an expired token", "user", v.User)
+			deleteToken(k)
+		}
+	}
+	for k, v := range cache.Challenges {
+		if v.Expired() {
+			delete(cache.Challenges, k)
+		}
 	}
 }
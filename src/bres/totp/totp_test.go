@@ -0,0 +1,96 @@
+package totp
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// RFC 6238 appendix B SHA1 key "12345678901234567890", base32
+const rfcSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestCode(t *testing.T) {
+	// RFC 6238 appendix B, the last 6 of the 8 digit SHA1 codes
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+	for _, tt := range tests {
+		got, err := Code(rfcSecret, Step(time.Unix(tt.unix, 0)))
+		if err != nil || got != tt.want {
+			t.Errorf("Code at %d = %q, %v, want %q", tt.unix, got, err, tt.want)
+		}
+	}
+
+	if got, err := Code(strings.ToLower(rfcSecret), 1); err != nil || got != mustCode(t, rfcSecret, 1) {
+		t.Errorf("lowercase secret = %q, %v", got, err)
+	}
+	if _, err := Code("not base32!", 1); err == nil {
+		t.Error("invalid secret accepted")
+	}
+}
+
+func mustCode(t *testing.T, secret string, step int64) string {
+	t.Helper()
+	code, err := Code(secret, step)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return code
+}
+
+func TestValidate(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	step := Step(now)
+
+	tests := []struct {
+		name     string
+		secret   string
+		code     string
+		wantStep int64
+		want     bool
+	}{
+		{"current step", rfcSecret, mustCode(t, rfcSecret, step), step, true},
+		{"previous step", rfcSecret, mustCode(t, rfcSecret, step-SKEW), step - SKEW, true},
+		{"next step", rfcSecret, mustCode(t, rfcSecret, step+SKEW), step + SKEW, true},
+		{"too old", rfcSecret, mustCode(t, rfcSecret, step-SKEW-1), 0, false},
+		{"too new", rfcSecret, mustCode(t, rfcSecret, step+SKEW+1), 0, false},
+		{"wrong code", rfcSecret, "000000", 0, false},
+		{"short", rfcSecret, "05047", 0, false},
+		{"long", rfcSecret, "0504710", 0, false},
+		{"empty", rfcSecret, "", 0, false},
+		{"invalid secret", "not base32!", "050471", 0, false},
+	}
+	for _, tt := range tests {
+		gotStep, ok := Validate(tt.secret, tt.code, now)
+		if ok != tt.want || gotStep != tt.wantStep {
+			t.Errorf("%s: Validate = %d, %v, want %d, %v", tt.name, gotStep, ok, tt.wantStep, tt.want)
+		}
+	}
+}
+
+func TestGenerateSecret(t *testing.T) {
+	a, b := GenerateSecret(), GenerateSecret()
+	if a == b {
+		t.Error("two secrets are the same")
+	}
+	key, err := encoding.DecodeString(a)
+	if err != nil || len(key) != SECRET {
+		t.Errorf("secret %q decodes to %d bytes, %v, want %d", a, len(key), err, SECRET)
+	}
+}
+
+func TestURI(t *testing.T) {
+	got := URI("Pushup App", "ann@example.com", "ABC")
+	want := "otpauth://totp/Pushup%20App:ann@example.com?algorithm=SHA1&digits=6&issuer=Pushup+App&period=30&secret=ABC"
+	if got != want {
+		t.Errorf("URI = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,583 @@
+// Queries for account email, one-time codes, password changes, disabling and deletion
+package bsql
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"strings"
+	"time"
+)
+
+// Stands in for a deleted user in the coin history
+// Not a valid username, so it can never collide with a real account
+const DELETED_USER = "[deleted]"
+
+// What happened to a group when one of its members left or deleted their account
+// Creator and CoinHolder are the values after they left,
+// NewCreator and NewCoinHolder say whether they went from the user to another member
+type GroupChange struct {
+	GroupID       string `json:"group_id"`
+	Disbanded     bool   `json:"disbanded"`
+	Creator       string `json:"creator"`
+	CoinHolder    string `json:"coin_holder"`
+	NewCreator    bool   `json:"-"`
+	NewCoinHolder bool   `json:"-"`
+}
+
+// Account state set by operators, SQL: table user
+// SessionsRevokedAt is zero when sessions were never revoked
+type UserStatus struct {
+	Role              string    `json:"role"`
+	Disabled          bool      `json:"disabled"`
+	SessionsRevokedAt time.Time `json:"sessions_revoked_at"`
+}
+
+// SQL: table user as admins see it, without credentials
+type UserAccount struct {
+	Username          string     `json:"username"`
+	Email             *string    `json:"email"`
+	EmailVerified     bool       `json:"email_verified"`
+	Role              string     `json:"role"`
+	DisabledAt        *time.Time `json:"disabled_at"`
+	SessionsRevokedAt *time.Time `json:"sessions_revoked_at"`
+}
+
+func scanUserAccount(row interface{ Scan(...interface{}) error }) (*UserAccount, error) {
+	var u UserAccount
+	var email sql.NullString
+	var disabled, revoked sql.NullTime
+	if err := row.Scan(&u.Username, &email, &u.EmailVerified, &u.Role, &disabled, &revoked); err != nil {
+		return nil, err
+	}
+	if email.Valid {
+		u.Email = &email.String
+	}
+	if disabled.Valid {
+		u.DisabledAt = &disabled.Time
+	}
+	if revoked.Valid {
+		u.SessionsRevokedAt = &revoked.Time
+	}
+	return &u, nil
+}
+
+// Escape LIKE wildcards so s only matches itself
+func likePrefix(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s) + "%"
+}
+
+// One-time code purposes
+const (
+	CODE_VERIFY = "verify"
+	CODE_RESET  = "reset"
+)
+
+// Wrong guesses a one-time code takes before it stops working, even the right one
+const MAX_CODE_ATTEMPTS = 5
+
+func InsertNewUserEmail(ctx context.Context, user string, pass string, email string) error {
+	_, err := insertUserEmailQuery.Exec(ctx, user, pass, email)
+	return err
+}
+
+// Set a new, unverified email on a user
+func UpdateUserEmail(ctx context.Context, user string, email string) error {
+	_, err := updateUserEmailQuery.Exec(ctx, email, user)
+	return err
+}
+
+// Return a user's email and whether it is verified, false if they have none
+func GetUserEmail(ctx context.Context, user string) (string, bool, bool, error) {
+	var email sql.NullString
+	var verified bool
+	err := selectUserEmailQuery.QueryRow(ctx, user).Scan(&email, &verified)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return "", false, false, nil
+		}
+		return "", false, false, err
+	}
+	return email.String, verified, email.Valid, nil
+}
+
+func VerifyUserEmail(ctx context.Context, user string) error {
+	_, err := verifyUserEmailQuery.Exec(ctx, user)
+	return err
+}
+
+func UpdatePassword(ctx context.Context, user string, pass string) error {
+	_, err := updatePasswordQuery.Exec(ctx, pass, user)
+	return err
+}
+
+// Return whether a user is disabled and when their sessions were last revoked, false if they don't exist
+func GetUserStatus(ctx context.Context, user string) (*UserStatus, bool, error) {
+	var status UserStatus
+	var disabled, revoked sql.NullTime
+	err := selectUserStatusQuery.QueryRow(ctx, user).Scan(&status.Role, &disabled, &revoked)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, false, nil
+		}
+		return nil, false, err
+	}
+	status.Disabled = disabled.Valid
+	status.SessionsRevokedAt = revoked.Time
+	return &status, true, nil
+}
+
+// A user as admins see it, false if they don't exist
+func GetUserAccount(ctx context.Context, user string) (*UserAccount, bool, error) {
+	u, err := scanUserAccount(selectUserAccountQuery.QueryRow(ctx, user))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, false, nil
+		}
+		return nil, false, err
+	}
+	return u, true, nil
+}
+
+// Users whose username or email starts with q, in username order
+func SearchUsers(ctx context.Context, q string, limit int, offset int) ([]UserAccount, error) {
+	prefix := likePrefix(q)
+	rows, err := searchUsersQuery.Query(ctx, prefix, prefix, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []UserAccount
+	for rows.Next() {
+		u, err := scanUserAccount(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, *u)
+	}
+	return out, rows.Err()
+}
+
+// Set a user's system-wide role, false if they don't exist or already have it
+func SetUserRole(ctx context.Context, user string, role string) (bool, error) {
+	res, err := updateUserRoleQuery.Exec(ctx, role, user)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+// Disable a user and revoke their sessions at, false if they were already disabled
+func DisableUser(ctx context.Context, user string, at time.Time) (bool, error) {
+	at = roundUp(at)
+	res, err := disableUserQuery.Exec(ctx, at, at, user)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+// Let a disabled user log in again, false if they weren't disabled
+func EnableUser(ctx context.Context, user string) (bool, error) {
+	res, err := enableUserQuery.Exec(ctx, user)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+// Every session of user issued up to at stops working
+// at comes from the caller's clock, like the issue time of a session
+// Returns the revocation time as stored, a session has to be issued after it to work
+func RevokeSessions(ctx context.Context, user string, at time.Time) (time.Time, error) {
+	at = roundUp(at)
+	_, err := revokeSessionsQuery.Exec(ctx, at, user)
+	return at, err
+}
+
+// The columns keep milliseconds, rounding up keeps every session issued before at revoked
+func roundUp(at time.Time) time.Time {
+	return at.Truncate(time.Millisecond).Add(time.Millisecond)
+}
+
+// Store a new code for user, any older unused code with the same purpose stops working
+func InsertCode(ctx context.Context, user string, purpose string, code string, ttl time.Duration) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err = expireCodesQuery.Tx(tx).Exec(ctx, user, purpose); err != nil {
+		return err
+	}
+
+	if _, err = insertCodeQuery.Tx(tx).Exec(ctx, user, purpose, hashCode(code), int(ttl.Seconds())); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Codes are stored as their hex SHA-256, the same as SHA2(code, 256)
+func hashCode(code string) string {
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
+
+// Code matches the stored hash and the code has guesses left
+func checkCode(hash string, attempts int, code string) bool {
+	if attempts >= MAX_CODE_ATTEMPTS {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(hash), []byte(hashCode(code))) == 1
+}
+
+// Mark user's unexpired, unused code for purpose as used if code matches it
+// A wrong code counts against it, after MAX_CODE_ATTEMPTS it never matches
+// False if there was no such code or it didn't match, a code can only be consumed once
+func ConsumeCode(ctx context.Context, user string, purpose string, code string) (bool, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	var id int64
+	var hash string
+	var attempts int
+	err = selectLiveCodeQuery.Tx(tx).QueryRow(ctx, user, purpose).Scan(&id, &hash, &attempts)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	ok := checkCode(hash, attempts, code)
+	if ok {
+		_, err = consumeCodeQuery.Tx(tx).Exec(ctx, id)
+	} else {
+		_, err = failCodeQuery.Tx(tx).Exec(ctx, id)
+	}
+	if err != nil {
+		return false, err
+	}
+	return ok, tx.Commit()
+}
+
+// Give what user has in a group to a random remaining member before they leave it,
+// the group is disbanded if none is left
+func handOver(ctx context.Context, tx *sql.Tx, user string, g *GroupChange) error {
+	if g.Creator != user && g.CoinHolder != user {
+		return nil
+	}
+
+	var next string
+	err := selectOtherMemberQuery.Tx(tx).QueryRow(ctx, g.GroupID, user).Scan(&next)
+	if err == sql.ErrNoRows {
+		if _, err = deleteGroupByIDQuery.Tx(tx).Exec(ctx, g.GroupID); err != nil {
+			return err
+		}
+		g.Disbanded = true
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if g.Creator == user {
+		if _, err = updateGroupCreatorQuery.Tx(tx).Exec(ctx, next, g.GroupID); err != nil {
+			return err
+		}
+		g.Creator, g.NewCreator = next, true
+	}
+
+	if g.CoinHolder == user {
+		if _, err = updateGroupCoinHolderQuery.Tx(tx).Exec(ctx, next, g.GroupID); err != nil {
+			return err
+		}
+		g.CoinHolder, g.NewCoinHolder = next, true
+	}
+	return nil
+}
+
+// Take user out of a group in one transaction, handing over what they had like DeleteAccount
+// Returns false if the group is gone or user is no longer in it
+func LeaveGroup(ctx context.Context, user string, id string) (*GroupChange, bool, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, false, err
+	}
+	defer tx.Rollback()
+
+	g := GroupChange{GroupID: id}
+	err = selectGroupForLeaveQuery.Tx(tx).QueryRow(ctx, id).Scan(&g.Creator, &g.CoinHolder)
+	if err == sql.ErrNoRows {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	res, err := deleteGroupMemberQuery.Tx(tx).Exec(ctx, user, id)
+	if err != nil {
+		return nil, false, err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return nil, false, err
+	}
+
+	if err = handOver(ctx, tx, user, &g); err != nil {
+		return nil, false, err
+	}
+	return &g, true, tx.Commit()
+}
+
+// Make member the creator of a group
+func UpdateGroupCreator(ctx context.Context, member string, id string) error {
+	_, err := updateGroupCreatorQuery.Exec(ctx, member, id)
+	return err
+}
+
+// Delete a user in one transaction without breaking foreign keys
+// Owned groups go to a random remaining member or are disbanded if none is left,
+// held coins go to a random remaining member,
+// the user's coin history and its stats are kept under DELETED_USER
+// Returns every group the user was part of and what happened to it
+func DeleteAccount(ctx context.Context, user string) ([]GroupChange, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	rows, err := selectAccountGroupsQuery.Tx(tx).Query(ctx, user, user, user)
+	if err != nil {
+		return nil, err
+	}
+
+	var changes []GroupChange
+	for rows.Next() {
+		var g GroupChange
+		if err = rows.Scan(&g.GroupID, &g.Creator, &g.CoinHolder); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		changes = append(changes, g)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for i := range changes {
+		if err = handOver(ctx, tx, user, &changes[i]); err != nil {
+			return nil, err
+		}
+	}
+
+	if _, err = deleteUserMembershipsQuery.Tx(tx).Exec(ctx, user); err != nil {
+		return nil, err
+	}
+
+	if _, err = anonymizeCoinPassFromQuery.Tx(tx).Exec(ctx, DELETED_USER, user); err != nil {
+		return nil, err
+	}
+
+	if _, err = anonymizeCoinPassToQuery.Tx(tx).Exec(ctx, DELETED_USER, user); err != nil {
+		return nil, err
+	}
+
+	if _, err = anonymizeRollupQuery.Tx(tx).Exec(ctx, DELETED_USER, user); err != nil {
+		return nil, err
+	}
+
+	if _, err = deleteUserRollupQuery.Tx(tx).Exec(ctx, user); err != nil {
+		return nil, err
+	}
+
+	if _, err = deleteUserQuery.Tx(tx).Exec(ctx, user); err != nil {
+		return nil, err
+	}
+
+	return changes, tx.Commit()
+}
+
+var (
+	selectAccountGroupsQuery,
+	selectOtherMemberQuery,
+	selectGroupForLeaveQuery,
+	deleteGroupByIDQuery,
+	updateGroupCreatorQuery,
+	updateGroupCoinHolderQuery,
+	deleteUserMembershipsQuery,
+	anonymizeCoinPassFromQuery,
+	anonymizeCoinPassToQuery,
+	deleteUserQuery,
+	insertUserEmailQuery,
+	updateUserEmailQuery,
+	selectUserEmailQuery,
+	verifyUserEmailQuery,
+	updatePasswordQuery,
+	expireCodesQuery,
+	insertCodeQuery,
+	selectUserStatusQuery,
+	selectUserAccountQuery,
+	searchUsersQuery,
+	updateUserRoleQuery,
+	disableUserQuery,
+	enableUserQuery,
+	revokeSessionsQuery,
+	selectLiveCodeQuery,
+	consumeCodeQuery,
+	failCodeQuery *stmt
+)
+
+// Setup account prepared statements
+func setupAccountStates() error {
+	var err error
+
+	insertUserEmailQuery, err = prepare("insert_user_email", "insert into user(username, password, email) values (?, SHA(?), ?)")
+	if err != nil {
+		return err
+	}
+
+	updateUserEmailQuery, err = prepare("update_user_email", "update user set email=?, email_verified=0 where username=?")
+	if err != nil {
+		return err
+	}
+
+	selectUserEmailQuery, err = prepare("select_user_email", "select email, email_verified from user where username=?")
+	if err != nil {
+		return err
+	}
+
+	verifyUserEmailQuery, err = prepare("verify_user_email", "update user set email_verified=1 where username=?")
+	if err != nil {
+		return err
+	}
+
+	updatePasswordQuery, err = prepare("update_password", "update user set password=SHA(?) where username=?")
+	if err != nil {
+		return err
+	}
+
+	expireCodesQuery, err = prepare("expire_codes", "update one_time_code set used_at=now() where username=? and purpose=? and used_at is null")
+	if err != nil {
+		return err
+	}
+
+	insertCodeQuery, err = prepare("insert_code", "insert into one_time_code(username, purpose, code_hash, expires_at) values (?, ?, ?, date_add(now(), interval ? second))")
+	if err != nil {
+		return err
+	}
+
+	selectAccountGroupsQuery, err = prepare("select_account_groups", "select id, creator, coin_holder from _group where creator=? or coin_holder=? or id in (select group_id from group_member where username=?)")
+	if err != nil {
+		return err
+	}
+
+	selectOtherMemberQuery, err = prepare("select_other_member", "select username from group_member where group_id=? and username<>? order by rand() limit 1")
+	if err != nil {
+		return err
+	}
+
+	selectGroupForLeaveQuery, err = prepare("select_group_for_leave", "select creator, coin_holder from _group where id=? for update")
+	if err != nil {
+		return err
+	}
+
+	deleteGroupByIDQuery, err = prepare("delete_group_by_id", "delete from _group where id=?")
+	if err != nil {
+		return err
+	}
+
+	updateGroupCreatorQuery, err = prepare("update_group_creator", "update _group set creator=? where id=?")
+	if err != nil {
+		return err
+	}
+
+	updateGroupCoinHolderQuery, err = prepare("update_group_coin_holder", "update _group set coin_holder=? where id=?")
+	if err != nil {
+		return err
+	}
+
+	deleteUserMembershipsQuery, err = prepare("delete_user_memberships", "delete from group_member where username=?")
+	if err != nil {
+		return err
+	}
+
+	anonymizeCoinPassFromQuery, err = prepare("anonymize_coin_pass_from", "update coin_pass set from_user=? where from_user=?")
+	if err != nil {
+		return err
+	}
+
+	anonymizeCoinPassToQuery, err = prepare("anonymize_coin_pass_to", "update coin_pass set to_user=? where to_user=?")
+	if err != nil {
+		return err
+	}
+
+	deleteUserQuery, err = prepare("delete_user", "delete from user where username=?")
+	if err != nil {
+		return err
+	}
+
+	selectUserStatusQuery, err = prepare("select_user_status", "select role, disabled_at, sessions_revoked_at from user where username=?")
+	if err != nil {
+		return err
+	}
+
+	selectUserAccountQuery, err = prepare("select_user_account", "select username, email, email_verified, role, disabled_at, sessions_revoked_at from user where username=?")
+	if err != nil {
+		return err
+	}
+
+	searchUsersQuery, err = prepare("search_users", "select username, email, email_verified, role, disabled_at, sessions_revoked_at from user where username like ? or email like ? order by username limit ? offset ?")
+	if err != nil {
+		return err
+	}
+
+	updateUserRoleQuery, err = prepare("update_user_role", "update user set role=? where username=?")
+	if err != nil {
+		return err
+	}
+
+	disableUserQuery, err = prepare("disable_user", "update user set disabled_at=?, sessions_revoked_at=? where username=? and disabled_at is null")
+	if err != nil {
+		return err
+	}
+
+	enableUserQuery, err = prepare("enable_user", "update user set disabled_at=null where username=? and disabled_at is not null")
+	if err != nil {
+		return err
+	}
+
+	revokeSessionsQuery, err = prepare("revoke_sessions", "update user set sessions_revoked_at=? where username=?")
+	if err != nil {
+		return err
+	}
+
+	selectLiveCodeQuery, err = prepare("select_live_code", "select id, code_hash, attempts from one_time_code where username=? and purpose=? and used_at is null and expires_at>now() order by id desc limit 1 for update")
+	if err != nil {
+		return err
+	}
+
+	consumeCodeQuery, err = prepare("consume_code", "update one_time_code set used_at=now() where id=?")
+	if err != nil {
+		return err
+	}
+
+	failCodeQuery, err = prepare("fail_code", "update one_time_code set attempts=attempts+1 where id=?")
+	if err != nil {
+		return err
+	}
+
+	return err
+}
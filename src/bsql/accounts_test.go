@@ -0,0 +1,45 @@
+package bsql
+
+import (
+	"testing"
+)
+
+func TestHashCode(t *testing.T) {
+	// Same as MySQL SHA2(code, 256), which hashed the codes stored before
+	tests := []struct {
+		code string
+		want string
+	}{
+		{"ABCD2345", "a00d76646eba91b057841554d5c8334f498dc592ed744bce404f21fe271cd36e"},
+		{"", "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"},
+	}
+	for _, tt := range tests {
+		if got := hashCode(tt.code); got != tt.want {
+			t.Errorf("hashCode(%q) = %q, want %q", tt.code, got, tt.want)
+		}
+	}
+}
+
+func TestCheckCode(t *testing.T) {
+	hash := hashCode("ABCD2345")
+
+	tests := []struct {
+		name     string
+		attempts int
+		code     string
+		want     bool
+	}{
+		{"right code", 0, "ABCD2345", true},
+		{"right code after wrong guesses", MAX_CODE_ATTEMPTS - 1, "ABCD2345", true},
+		{"right code out of guesses", MAX_CODE_ATTEMPTS, "ABCD2345", false},
+		{"right code past the limit", MAX_CODE_ATTEMPTS + 3, "ABCD2345", false},
+		{"wrong code", 0, "ABCD2346", false},
+		{"case matters", 0, "abcd2345", false},
+		{"empty", 0, "", false},
+	}
+	for _, tt := range tests {
+		if got := checkCode(hash, tt.attempts, tt.code); got != tt.want {
+			t.Errorf("%s: checkCode = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
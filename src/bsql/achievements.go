@@ -0,0 +1,89 @@
+// Queries for achievements, badges are awarded once per user
+package bsql
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// SQL: table achievement
+type Achievement struct {
+	Username string    `json:"username"`
+	Badge    string    `json:"badge"`
+	EarnedAt time.Time `json:"earned_at"`
+}
+
+// Award badge to user
+// Returns false when they already had it
+func InsertAchievement(ctx context.Context, user string, badge string) (bool, error) {
+	res, err := insertAchievementQuery.Exec(ctx, user, badge)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+// Badges user earned, oldest first
+func GetAchievements(ctx context.Context, user string) ([]Achievement, error) {
+	rows, err := selectAchievementsQuery.Query(ctx, user)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []Achievement
+	for rows.Next() {
+		a := Achievement{Username: user}
+		if err = rows.Scan(&a.Badge, &a.EarnedAt); err != nil {
+			return nil, err
+		}
+		out = append(out, a)
+	}
+	return out, rows.Err()
+}
+
+// Seconds the passer held the coin before a pass, as pass_rollup counts it
+// Returns false for a group's first pass and for operator hand-overs and passes,
+// and for a pass that is gone, its group was disbanded since
+func GetPassHold(ctx context.Context, id int64) (int64, bool, error) {
+	var reassigned, forced bool
+	var held sql.NullInt64
+	err := selectPassHoldQuery.QueryRow(ctx, id).Scan(&reassigned, &forced, &held)
+	if err == sql.ErrNoRows {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	return held.Int64, held.Valid && !reassigned && !forced, nil
+}
+
+var (
+	insertAchievementQuery,
+	selectAchievementsQuery,
+	selectPassHoldQuery *stmt
+)
+
+// Setup achievement prepared statements
+func setupAchievementStates() error {
+	var err error
+
+	insertAchievementQuery, err = prepare("insert_achievement", "insert ignore into achievement(username, badge) values (?, ?)")
+	if err != nil {
+		return err
+	}
+
+	selectAchievementsQuery, err = prepare("select_achievements", "select badge, earned_at from achievement where username=? order by earned_at, badge")
+	if err != nil {
+		return err
+	}
+
+	selectPassHoldQuery, err = prepare("select_pass_hold", "select p.reassigned, p.forced, timestampdiff(second, (select q.passed_at from coin_pass q where q.group_id=p.group_id and q.id<p.id order by q.id desc limit 1), p.passed_at) from coin_pass p where p.id=?")
+	if err != nil {
+		return err
+	}
+
+	return err
+}
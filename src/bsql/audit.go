@@ -0,0 +1,161 @@
+// Queries for the audit log, rows are only ever inserted
+package bsql
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"time"
+)
+
+// SQL: table audit_event
+// Target, GroupID, IP and RequestID are empty when they don't apply
+type AuditEvent struct {
+	ID        int64     `json:"id"`
+	Actor     string    `json:"actor"`
+	Action    string    `json:"action"`
+	Target    string    `json:"target,omitempty"`
+	GroupID   string    `json:"group_id,omitempty"`
+	IP        string    `json:"ip,omitempty"`
+	RequestID string    `json:"request_id,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// An event in a group's log as its owner sees it
+// The IP and request id of members' requests stay with admins
+type GroupAuditEvent struct {
+	ID        int64     `json:"id"`
+	Actor     string    `json:"actor"`
+	Action    string    `json:"action"`
+	Target    string    `json:"target,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Which events GetAuditEvents returns, empty fields match anything
+// Before pages backwards, only events with a smaller id are returned
+type AuditFilter struct {
+	Actor  string
+	Action string
+	Target string
+	Group  string
+	Before int64
+	Limit  int
+}
+
+// NULL for an empty string
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
+
+func InsertAuditEvent(ctx context.Context, e *AuditEvent) error {
+	_, err := insertAuditEventQuery.Exec(ctx,
+		e.Actor,
+		e.Action,
+		nullString(e.Target),
+		nullString(e.GroupID),
+		nullString(e.IP),
+		nullString(e.RequestID))
+	return err
+}
+
+// WHERE, ORDER BY and LIMIT of the events matching f, newest first
+func auditFilter(f AuditFilter) (string, []interface{}) {
+	var where []string
+	var params []interface{}
+	match := func(column string, value string) {
+		if value != "" {
+			where = append(where, column+"=?")
+			params = append(params, value)
+		}
+	}
+	match("actor", f.Actor)
+	match("action", f.Action)
+	match("target", f.Target)
+	match("group_id", f.Group)
+	if f.Before > 0 {
+		where = append(where, "id<?")
+		params = append(params, f.Before)
+	}
+
+	q := ""
+	if len(where) > 0 {
+		q += " where " + strings.Join(where, " and ")
+	}
+	q += " order by id desc limit ?"
+	return q, append(params, f.Limit)
+}
+
+// Matching events, newest first
+// The WHERE clause depends on the filter, so this is timed through query()
+func GetAuditEvents(ctx context.Context, f AuditFilter) ([]AuditEvent, error) {
+	filter, params := auditFilter(f)
+	rows, err := query(ctx, "get_audit_events", "select id, actor, action, target, group_id, ip, request_id, created_at from audit_event"+filter, params...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []AuditEvent
+	for rows.Next() {
+		var e AuditEvent
+		var target, group, ip, requestID sql.NullString
+		if err = rows.Scan(&e.ID, &e.Actor, &e.Action, &target, &group, &ip, &requestID, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+		e.Target, e.GroupID, e.IP, e.RequestID = target.String, group.String, ip.String, requestID.String
+		out = append(out, e)
+	}
+	return out, rows.Err()
+}
+
+// Events of group matching f, newest first, without what identifies the requests
+func GetGroupAuditEvents(ctx context.Context, group string, f AuditFilter) ([]GroupAuditEvent, error) {
+	f.Group = group
+	filter, params := auditFilter(f)
+	rows, err := query(ctx, "get_group_audit_events", "select id, actor, action, target, created_at from audit_event"+filter, params...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []GroupAuditEvent
+	for rows.Next() {
+		var e GroupAuditEvent
+		var target sql.NullString
+		if err = rows.Scan(&e.ID, &e.Actor, &e.Action, &target, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+		e.Target = target.String
+		out = append(out, e)
+	}
+	return out, rows.Err()
+}
+
+// Number of times actor did action
+func CountAuditEvents(ctx context.Context, actor string, action string) (int, error) {
+	var n int
+	err := countAuditEventsQuery.QueryRow(ctx, actor, action).Scan(&n)
+	return n, err
+}
+
+var (
+	insertAuditEventQuery,
+	countAuditEventsQuery *stmt
+)
+
+// Setup audit prepared statements
+func setupAuditStates() error {
+	var err error
+
+	insertAuditEventQuery, err = prepare("insert_audit_event", "insert into audit_event(actor, action, target, group_id, ip, request_id) values (?, ?, ?, ?, ?, ?)")
+	if err != nil {
+		return err
+	}
+
+	countAuditEventsQuery, err = prepare("count_audit_events", "select count(*) from audit_event where actor=? and action=?")
+	if err != nil {
+		return err
+	}
+
+	return err
+}
@@ -0,0 +1,157 @@
+// Batched reads for dataloaders, one query for many keys
+// IN lists vary in length so these can't be prepared statements,
+// they are timed through query() instead
+package bsql
+
+import (
+	"context"
+	"strings"
+)
+
+// "?, ?, ?" for n values
+func placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?, ", n), ", ")
+}
+
+func args(keys []string) []interface{} {
+	a := make([]interface{}, len(keys))
+	for i, k := range keys {
+		a[i] = k
+	}
+	return a
+}
+
+// Groups by id, missing ids are left out
+// Members are not filled in, use GetGroupMembers
+func GetGroups(ctx context.Context, ids []string) (map[string]*Group, error) {
+	rows, err := query(ctx, "get_groups", "select id, coin, creator, coin_holder from _group where id in ("+placeholders(len(ids))+")", args(ids)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	groups := make(map[string]*Group, len(ids))
+	for rows.Next() {
+		var g Group
+		if err = rows.Scan(&g.ID, &g.Token, &g.Creator, &g.TokenHolder); err != nil {
+			return nil, err
+		}
+		groups[g.ID] = &g
+	}
+	return groups, rows.Err()
+}
+
+// Usernames in each group, sorted
+func GetGroupMembers(ctx context.Context, ids []string) (map[string][]string, error) {
+	rows, err := query(ctx, "get_group_members", "select group_id, username from group_member where group_id in ("+placeholders(len(ids))+") order by username", args(ids)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	members := make(map[string][]string, len(ids))
+	for rows.Next() {
+		var id, user string
+		if err = rows.Scan(&id, &user); err != nil {
+			return nil, err
+		}
+		members[id] = append(members[id], user)
+	}
+	return members, rows.Err()
+}
+
+// The latest limit coin passes of each group, newest first
+func GetRecentCoinPasses(ctx context.Context, ids []string, limit int) (map[string][]CoinPass, error) {
+	rows, err := query(ctx, "get_recent_coin_passes", "select id, group_id, from_user, to_user, coin, passed_at from ("+
+		"select *, row_number() over (partition by group_id order by id desc) as n "+
+		"from coin_pass where group_id in ("+placeholders(len(ids))+")"+
+		") p where n <= ? order by id desc", append(args(ids), limit)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	passes := make(map[string][]CoinPass, len(ids))
+	for rows.Next() {
+		var pass CoinPass
+		if err = rows.Scan(
+			&pass.ID,
+			&pass.GroupID,
+			&pass.From,
+			&pass.To,
+			&pass.Coin,
+			&pass.PassedAt); err != nil {
+			return nil, err
+		}
+		passes[pass.GroupID] = append(passes[pass.GroupID], pass)
+	}
+	return passes, rows.Err()
+}
+
+// Number of coin passes in each group
+func GetGroupPassCounts(ctx context.Context, ids []string) (map[string]int, error) {
+	rows, err := query(ctx, "get_group_pass_counts", "select group_id, count(*) from coin_pass where group_id in ("+placeholders(len(ids))+") group by group_id", args(ids)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := make(map[string]int, len(ids))
+	for rows.Next() {
+		var id string
+		var n int
+		if err = rows.Scan(&id, &n); err != nil {
+			return nil, err
+		}
+		counts[id] = n
+	}
+	return counts, rows.Err()
+}
+
+// Ids of every group user is in
+func GetUserGroupIDs(ctx context.Context, user string) ([]string, error) {
+	rows, err := selectUserGroupIDsQuery.Query(ctx, user)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err = rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// How many times user passed the coin on and was handed it
+func GetUserPassCounts(ctx context.Context, user string) (int, int, error) {
+	var passed, received int
+	err := selectUserPassCountsQuery.QueryRow(ctx, user, user).Scan(&passed, &received)
+	return passed, received, err
+}
+
+var (
+	selectUserGroupIDsQuery,
+	selectUserPassCountsQuery *stmt
+)
+
+// Setup the batch file's single key statements
+func setupBatchStates() error {
+	var err error
+
+	selectUserGroupIDsQuery, err = prepare("select_user_group_ids", "select group_id from group_member where username=? order by group_id")
+	if err != nil {
+		return err
+	}
+
+	selectUserPassCountsQuery, err = prepare("select_user_pass_counts", "select coalesce(sum(from_user=?), 0), coalesce(sum(to_user=? and from_user<>to_user), 0) from coin_pass")
+	if err != nil {
+		return err
+	}
+
+	return err
+}
@@ -2,19 +2,26 @@
 package bsql
 
 import (
+	"benschreiber.com/purestserver/src/config"
+	"benschreiber.com/purestserver/src/logging"
+	"benschreiber.com/purestserver/src/metrics"
+	"context"
 	"database/sql"
+	"errors"
 	"github.com/go-sql-driver/mysql"
 	"github.com/google/uuid"
-	"log"
-	"os"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"time"
 )
 
 // SQL Database pointer
 var db *sql.DB
 
+var logger = logging.For("bsql")
+
 // Health check
-func PingDB() error {
-	return db.Ping()
+func PingDB(ctx context.Context) error {
+	return db.PingContext(ctx)
 }
 
 // SQL: table _group
@@ -32,24 +39,34 @@ type GroupMember struct {
 	Username string `json:"username"`
 }
 
+// SQL: table coin_pass
+type CoinPass struct {
+	ID       int64     `json:"id"`
+	GroupID  string    `json:"group_id"`
+	From     string    `json:"from"`
+	To       string    `json:"to"`
+	Coin     int       `json:"coin"`
+	PassedAt time.Time `json:"passed_at"`
+}
+
 // SQL: table user
 type User struct {
 	Username string `json:"username"`
 	Password string `json:"password"`
 }
 
-func InsertNewUser(user string, pass string) error {
-	_, err := insertUserQuery.Exec(user, pass)
+func InsertNewUser(ctx context.Context, user string, pass string) error {
+	_, err := insertUserQuery.Exec(ctx, user, pass)
 	return err
 }
 
-func DeleteGroupMember(member string, id string) (sql.Result, error) {
-	return deleteGroupMemberQuery.Exec(member, id)
+func DeleteGroupMember(ctx context.Context, member string, id string) (sql.Result, error) {
+	return deleteGroupMemberQuery.Exec(ctx, member, id)
 }
 
-func UserGroupCreator(user string, id string) (bool, error) {
+func UserGroupCreator(ctx context.Context, user string, id string) (bool, error) {
 	var group_id string
-	err := selectGroupCreatorQuery.QueryRow(user, id).Scan(&group_id)
+	err := selectGroupCreatorQuery.QueryRow(ctx, user, id).Scan(&group_id)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return false, nil
@@ -58,14 +75,14 @@ func UserGroupCreator(user string, id string) (bool, error) {
 	return true, err
 }
 
-func GroupExists(id string) (bool, error) {
+func GroupExists(ctx context.Context, id string) (bool, error) {
 
 	// Return a value into group if group exists
 	var group string
-	err := selectGroupQuery.QueryRow(id).Scan(&group)
+	err := selectGroupQuery.QueryRow(ctx, id).Scan(&group)
 	if err != nil {
 		if err == sql.ErrNoRows {
-			log.Println("group does not exist")
+			logger.Debug("group does not exist", "group", id)
 			return false, nil
 		}
 	}
@@ -73,11 +90,11 @@ func GroupExists(id string) (bool, error) {
 	return true, err
 }
 
-func UserExists(user string) (bool, error) {
+func UserExists(ctx context.Context, user string) (bool, error) {
 
 	// Return a value into username if the user exists
 	var username string
-	err := selectUserQuery.QueryRow(user).Scan(&username)
+	err := selectUserQuery.QueryRow(ctx, user).Scan(&username)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return false, nil
@@ -87,12 +104,12 @@ func UserExists(user string) (bool, error) {
 	return true, err
 }
 
-func MatchUserPass(user string, pass string) (bool, error) {
+func MatchUserPass(ctx context.Context, user string, pass string) (bool, error) {
 	var username string
-	err := selectUserPassQuery.QueryRow(user, pass).Scan(&username)
+	err := selectUserPassQuery.QueryRow(ctx, user, pass).Scan(&username)
 	if err != nil {
 		if err == sql.ErrNoRows {
-			log.Println("Credentials invalid")
+			logger.Debug("credentials invalid", "user", user)
 			return false, nil
 		}
 	}
@@ -100,10 +117,41 @@ func MatchUserPass(user string, pass string) (bool, error) {
 	return true, err
 }
 
-func GetUserGroup(user string) (*Group, bool, error) {
+func GetUserGroup(ctx context.Context, user string) (*Group, bool, error) {
+	var group Group
+
+	err := selectUserGroupsQuery.QueryRow(ctx, user).Scan(
+		&group.ID,
+		&group.Token,
+		&group.Creator,
+		&group.TokenHolder)
+
+	if err != nil {
+		if err == sql.ErrNoRows {
+			logger.Debug("group not found", "user", user)
+			return &group, false, nil
+		}
+	}
+
+	rows, err := selectGroupMembersQuery.Query(ctx, group.ID)
+	if err != nil {
+		return nil, false, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var username string
+		rows.Scan(&username)
+		group.Members = append(group.Members, username)
+	}
+
+	return &group, true, err
+}
+
+func GetGroup(ctx context.Context, id string) (*Group, bool, error) {
 	var group Group
 
-	err := selectUserGroupsQuery.QueryRow(user).Scan(
+	err := selectGroupByIDQuery.QueryRow(ctx, id).Scan(
 		&group.ID,
 		&group.Token,
 		&group.Creator,
@@ -111,12 +159,13 @@ func GetUserGroup(user string) (*Group, bool, error) {
 
 	if err != nil {
 		if err == sql.ErrNoRows {
-			log.Println("group not found")
+			logger.Debug("group not found", "group", id)
 			return &group, false, nil
 		}
+		return nil, false, err
 	}
 
-	rows, err := selectGroupMembersQuery.Query(group.ID)
+	rows, err := selectGroupMembersQuery.Query(ctx, group.ID)
 	if err != nil {
 		return nil, false, err
 	}
@@ -131,12 +180,13 @@ func GetUserGroup(user string) (*Group, bool, error) {
 	return &group, true, err
 }
 
-func InsertGroupMember(user string, id string) error {
-	_, err := insertGroupMemberQuery.Exec(id, user)
+func InsertGroupMember(ctx context.Context, user string, id string) error {
+	_, err := insertGroupMemberQuery.Exec(ctx, id, user)
 	return err
 }
 
-func InsertNewGroup(user string) error {
+// Returns the new group's id
+func InsertNewGroup(ctx context.Context, user string) (string, error) {
 
 	var err error
 
@@ -144,32 +194,189 @@ func InsertNewGroup(user string) error {
 	id := uuid.New().String()
 	tokenDefaultValue := 1
 
-	_, err = insertGroupQuery.Exec(id, tokenDefaultValue, user, user)
+	_, err = insertGroupQuery.Exec(ctx, id, tokenDefaultValue, user, user)
 	if err != nil {
-		return err
+		return "", err
 	}
 
-	if err = InsertGroupMember(user, id); err != nil {
-		return err
+	if err = InsertGroupMember(ctx, user, id); err != nil {
+		return "", err
 	}
 
-	return err
+	return id, err
 }
 
-func SelectCoinHolder(user string, id string) error {
+// Whether user holds the coin of the group
+func CoinHolder(ctx context.Context, user string, id string) (bool, error) {
 	var username string
-	return selectCoinHolderQuery.QueryRow(user, id).Scan(&username)
+	err := selectCoinHolderQuery.QueryRow(ctx, user, id).Scan(&username)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return false, nil
+		}
+	}
+	return true, err
 }
 
-func UpdateCoin(user string, id string) (error, error) {
-	_, err1 := updateCoinQuery.Exec(id, user)
-	_, err2 := updateCoinHolderQuery.Exec(id, id)
-	return err1, err2
+// Whether user created a group
+func UserOwnsGroup(ctx context.Context, user string) (bool, error) {
+	var id string
+	err := selectOwnedGroupQuery.QueryRow(ctx, user).Scan(&id)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return false, nil
+		}
+	}
+	return true, err
+}
+
+// Error is a MySQL unique key violation
+func DuplicateEntry(err error) bool {
+	merr, ok := err.(*mysql.MySQLError)
+	return ok && merr.Number == 1062
+}
+
+// Pass the coin to a random member in one transaction
+// Records the pass in the group history and, when the holder changed,
+// queues a notification for the new holder in the outbox
+// forced when an operator passes on user's behalf
+// nil if user no longer holds the coin, a retried or concurrent pass changes nothing
+func UpdateCoin(ctx context.Context, user string, id string, forced bool) (*CoinPass, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	res, err := updateCoinQuery.Tx(tx).Exec(ctx, id, user)
+	if err != nil {
+		return nil, err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return nil, err
+	}
+
+	if _, err = updateCoinHolderQuery.Tx(tx).Exec(ctx, id, id); err != nil {
+		return nil, err
+	}
+
+	pass, err := recordPass(ctx, tx, user, id, false, forced)
+	if err != nil {
+		return nil, err
+	}
+	return pass, tx.Commit()
+}
+
+// Hand the coin from holder to member without bumping it, for operators fixing a stuck group
+// Recorded and notified like a pass, nil if holder no longer holds the coin
+func ReassignCoin(ctx context.Context, id string, holder string, member string) (*CoinPass, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	res, err := reassignCoinQuery.Tx(tx).Exec(ctx, member, id, holder)
+	if err != nil {
+		return nil, err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return nil, err
+	}
+
+	pass, err := recordPass(ctx, tx, holder, id, true, false)
+	if err != nil {
+		return nil, err
+	}
+	return pass, tx.Commit()
+}
+
+// Record a pass from user to the group's current holder in the group history, its id is the event id
+// Adds it to the pass rollup and queues a notification for the new holder when the holder changed
+func recordPass(ctx context.Context, tx *sql.Tx, user string, id string, reassigned bool, forced bool) (*CoinPass, error) {
+	res, err := insertCoinPassQuery.Tx(tx).Exec(ctx, user, reassigned, forced, id)
+	if err != nil {
+		return nil, err
+	}
+
+	passID, err := res.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+
+	var pass CoinPass
+	if err = selectCoinPassQuery.Tx(tx).QueryRow(ctx, passID).Scan(
+		&pass.ID,
+		&pass.GroupID,
+		&pass.From,
+		&pass.To,
+		&pass.Coin,
+		&pass.PassedAt); err != nil {
+		return nil, err
+	}
+
+	if _, err = rollupPassQuery.Tx(tx).Exec(ctx, int(HOLD_DEADLINE.Seconds()), passID); err != nil {
+		return nil, err
+	}
+
+	if pass.To != pass.From {
+		if err = insertCoinNotification(ctx, tx, &pass); err != nil {
+			return nil, err
+		}
+	}
+
+	return &pass, nil
 }
 
-func UserInGroup(user string, id string) (bool, error) {
+// A page of ids of the groups whose id, creator or a member starts with q, in id order
+func SearchGroupIDs(ctx context.Context, q string, limit int, offset int) ([]string, error) {
+	prefix := likePrefix(q)
+	rows, err := searchGroupIDsQuery.Query(ctx, prefix, prefix, prefix, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err = rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// Return every coin pass in a group made after the pass with id after
+func GetCoinPassesSince(ctx context.Context, id string, after int64) ([]CoinPass, error) {
+	rows, err := selectCoinPassesSinceQuery.Query(ctx, id, after)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var passes []CoinPass
+	for rows.Next() {
+		var pass CoinPass
+		if err = rows.Scan(
+			&pass.ID,
+			&pass.GroupID,
+			&pass.From,
+			&pass.To,
+			&pass.Coin,
+			&pass.PassedAt); err != nil {
+			return nil, err
+		}
+		passes = append(passes, pass)
+	}
+
+	return passes, rows.Err()
+}
+
+func UserInGroup(ctx context.Context, user string, id string) (bool, error) {
 	var username string
-	err := selectGroupFromUserQuery.QueryRow(id, user).Scan(&username)
+	err := selectGroupFromUserQuery.QueryRow(ctx, id, user).Scan(&username)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return false, nil
@@ -179,26 +386,31 @@ func UserInGroup(user string, id string) (bool, error) {
 
 }
 
-func DeleteGroup(user string) error {
-	_, err := deleteGroupQuery.Exec(user)
+// Delete one group, its members, history and webhooks go with it
+func DeleteGroup(ctx context.Context, id string) error {
+	_, err := deleteGroupByIDQuery.Exec(ctx, id)
 	return err
 
 }
 
-func Establishconnection() error {
+// Connect to the database without preparing statements, for migrations
+// Establishconnection() calls this first
+func Open() error {
 	var err error
 
+	settings := config.Get().DB
 	cfg := mysql.Config{
-		User:                 os.Getenv("DB_USER"),
-		Passwd:               os.Getenv("DB_PASS"),
-		Net:                  os.Getenv("DB_PROTOCOL"),
-		Addr:                 os.Getenv("DB_ADDRESS"),
-		DBName:               os.Getenv("DB_NAME"),
+		User:                 settings.User,
+		Passwd:               settings.Pass,
+		Net:                  settings.Protocol,
+		Addr:                 settings.Address,
+		DBName:               settings.Name,
+		ParseTime:            true,
 	}
 
 	db, err = sql.Open("mysql", cfg.FormatDSN())
 	if err != nil {
-		log.Println("err here")
+		logger.Error("opening database failed", "err", err)
 		return err
 }
 
@@ -206,19 +418,95 @@ func Establishconnection() error {
 		return err
 	}
 
+	// Connection pool stats on /metrics
+	metrics.Register(collectors.NewDBStatsCollector(db, cfg.DBName))
+	return nil
+}
+
+// Connect, apply pending migrations when db.migrate is on, and prepare every statement
+// Statements need the migrated schema, so pending migrations are an error when it is off
+func Establishconnection() error {
+	if err := Open(); err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	if config.Get().DB.Migrate {
+		if _, err := Migrate(ctx); err != nil {
+			return err
+		}
+	}
+	pending, err := Pending(ctx)
+	if err != nil {
+		return err
+	}
+	if len(pending) > 0 {
+		return errors.New("pending migrations: " + names(pending) + ", run purestctl migrate or turn db.migrate on")
+	}
+
 	if err = setupPrepStates(); err != nil {
 		return err
 	}
-	log.Println("Connected to Database!")
+
+	if err = setupWebhookStates(); err != nil {
+		return err
+	}
+
+	if err = setupNotificationStates(); err != nil {
+		return err
+	}
+
+	if err = setupAccountStates(); err != nil {
+		return err
+	}
+
+	if err = setupTwoFactorStates(); err != nil {
+		return err
+	}
+
+	if err = setupBatchStates(); err != nil {
+		return err
+	}
+
+	if err = setupAuditStates(); err != nil {
+		return err
+	}
+
+	if err = setupStatsStates(); err != nil {
+		return err
+	}
+	if err = setupAchievementStates(); err != nil {
+		return err
+	}
+	prepared.Store(true)
+	registerHealth()
+
+	logger.Info("Connected to Database!")
 
 	return err
 }
 
+// Close every prepared statement, then the pool
+// Callers must have stopped issuing queries
+func Close() error {
+	prepared.Store(false)
+	for _, st := range statements {
+		if err := st.s.Close(); err != nil {
+			logger.Warn("closing statement failed", "query", st.name, "err", err)
+		}
+	}
+	statements = nil
+
+	logger.Info("Closing database connections")
+	return db.Close()
+}
+
 var (
 	insertUserQuery,
 	selectUserQuery,
 	selectUserPassQuery,
 	selectUserGroupsQuery,
+	selectGroupByIDQuery,
 	selectGroupMembersQuery,
 	insertGroupQuery,
 	insertGroupMemberQuery,
@@ -227,86 +515,121 @@ var (
 	updateCoinHolderQuery,
 	selectGroupQuery,
 	selectGroupCreatorQuery,
+	selectOwnedGroupQuery,
 	selectGroupFromUserQuery,
-	deleteGroupQuery,
-	deleteGroupMemberQuery *sql.Stmt
+	insertCoinPassQuery,
+	selectCoinPassQuery,
+	selectCoinPassesSinceQuery,
+	reassignCoinQuery,
+	searchGroupIDsQuery,
+	deleteGroupMemberQuery *stmt
 )
 
 //Setup all prepared statements
 func setupPrepStates() error {
 	var err error
 
-	insertUserQuery, err = db.Prepare("insert into user(username, password) values (?, SHA(?))")
+	insertUserQuery, err = prepare("insert_user", "insert into user(username, password) values (?, SHA(?))")
+	if err != nil {
+		return err
+	}
+
+	selectUserQuery, err = prepare("select_user", "select username from user where username=?")
+	if err != nil {
+		return err
+	}
+
+	selectUserPassQuery, err = prepare("select_user_pass", "select username from user where username=? and password=SHA(?)")
+	if err != nil {
+		return err
+	}
+
+	selectUserGroupsQuery, err = prepare("select_user_groups", "select * from _group where _group.id=(select group_id from group_member where username=?)")
+	if err != nil {
+		return err
+	}
+
+	selectGroupByIDQuery, err = prepare("select_group_by_id", "select * from _group where id=?")
+	if err != nil {
+		return err
+	}
+
+	selectGroupMembersQuery, err = prepare("select_group_members", "select username from group_member where group_id=?")
+	if err != nil {
+		return err
+	}
+
+	insertGroupQuery, err = prepare("insert_group", "insert into _group(id, coin, creator, coin_holder) values (?, ?, ?, ?)")
 	if err != nil {
 		return err
 	}
 
-	selectUserQuery, err = db.Prepare("select username from user where username=?")
+	insertGroupMemberQuery, err = prepare("insert_group_member", "insert into group_member(group_id, username) values (?, ?)")
 	if err != nil {
 		return err
 	}
 
-	selectUserPassQuery, err = db.Prepare("select username from user where username=? and password=SHA(?)")
+	selectCoinHolderQuery, err = prepare("select_coin_holder", "select coin_holder from _group where coin_holder=? and id=?")
 	if err != nil {
 		return err
 	}
 
-	selectUserGroupsQuery, err = db.Prepare("select * from _group where _group.id=(select group_id from group_member where username=?)")
+	updateCoinQuery, err = prepare("update_coin", "update _group set _group.coin = (_group.coin + 1) where id=? and coin_holder=?")
 	if err != nil {
 		return err
 	}
 
-	selectGroupMembersQuery, err = db.Prepare("select username from group_member where group_id=?")
+	updateCoinHolderQuery, err = prepare("update_coin_holder", "update _group set coin_holder=(select username from group_member where group_id=? order by rand() limit 1) where id=?")
 	if err != nil {
 		return err
 	}
 
-	insertGroupQuery, err = db.Prepare("insert into _group(id, coin, creator, coin_holder) values (?, ?, ?, ?)")
+	selectGroupQuery, err = prepare("select_group", "select id from _group where _group.id=?")
 	if err != nil {
 		return err
 	}
 
-	insertGroupMemberQuery, err = db.Prepare("insert into group_member(group_id, username) values (?, ?)")
+	selectGroupCreatorQuery, err = prepare("select_group_creator", "select id from _group where creator=? and id=?")
 	if err != nil {
 		return err
 	}
 
-	selectCoinHolderQuery, err = db.Prepare("select coin_holder from _group where coin_holder=? and id=?")
+	selectOwnedGroupQuery, err = prepare("select_owned_group", "select id from _group where creator=? limit 1")
 	if err != nil {
 		return err
 	}
 
-	updateCoinQuery, err = db.Prepare("update _group set _group.coin = (_group.coin + 1) where id=? and coin_holder=?")
+	selectGroupFromUserQuery, err = prepare("select_group_from_user", "select username from group_member where group_id=? and username=?")
 	if err != nil {
 		return err
 	}
 
-	updateCoinHolderQuery, err = db.Prepare("update _group set coin_holder=(select username from group_member where group_id=? order by rand() limit 1) where id=?")
+	deleteGroupMemberQuery, err = prepare("delete_group_member", "delete from group_member where username=? and group_id=?")
 	if err != nil {
 		return err
 	}
 
-	selectGroupQuery, err = db.Prepare("select id from _group where _group.id=?")
+	insertCoinPassQuery, err = prepare("insert_coin_pass", "insert into coin_pass(group_id, from_user, to_user, coin, reassigned, forced) select id, ?, coin_holder, coin, ?, ? from _group where id=?")
 	if err != nil {
 		return err
 	}
 
-	selectGroupCreatorQuery, err = db.Prepare("select id from _group where creator=? and id=?")
+	selectCoinPassQuery, err = prepare("select_coin_pass", "select id, group_id, from_user, to_user, coin, passed_at from coin_pass where id=?")
 	if err != nil {
 		return err
 	}
 
-	selectGroupFromUserQuery, err = db.Prepare("select username from group_member where group_id=? and username=?")
+	selectCoinPassesSinceQuery, err = prepare("select_coin_passes_since", "select id, group_id, from_user, to_user, coin, passed_at from coin_pass where group_id=? and id>? order by id")
 	if err != nil {
 		return err
 	}
 
-	deleteGroupMemberQuery, err = db.Prepare("delete from group_member where username=? and group_id=?")
+	reassignCoinQuery, err = prepare("reassign_coin", "update _group set coin_holder=? where id=? and coin_holder=?")
 	if err != nil {
 		return err
 	}
 
-	deleteGroupQuery, err = db.Prepare("delete from _group where creator=?")
+	searchGroupIDsQuery, err = prepare("search_group_ids", "select id from _group where id like ? or creator like ? or id in (select group_id from group_member where username like ?) order by id limit ? offset ?")
 	if err != nil {
 		return err
 	}
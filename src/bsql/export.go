@@ -0,0 +1,111 @@
+// Consistent read of the data operators can export
+// Password hashes, codes, two-factor secrets, device tokens and webhook secrets are left out
+package bsql
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// SQL: table user, without credentials
+type ExportUser struct {
+	Username      string     `json:"username"`
+	Email         *string    `json:"email"`
+	EmailVerified bool       `json:"email_verified"`
+	DisabledAt    *time.Time `json:"disabled_at"`
+}
+
+// Tables in the order Export visits them, a row never comes before one it references
+const (
+	EXPORT_USERS       = "user"
+	EXPORT_GROUPS      = "group"
+	EXPORT_MEMBERS     = "group_member"
+	EXPORT_COIN_PASSES = "coin_pass"
+)
+
+// Call fn with every exported row, one table after another, from a single snapshot
+// Rows are *ExportUser, *Group without members, *GroupMember and *CoinPass
+func Export(ctx context.Context, fn func(table string, row interface{}) error) error {
+	tx, err := db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = exportTable(ctx, tx, EXPORT_USERS, "select username, email, email_verified, disabled_at from user order by username",
+		func(rows *sql.Rows) (interface{}, error) {
+			var u ExportUser
+			var email sql.NullString
+			var disabled sql.NullTime
+			if err := rows.Scan(&u.Username, &email, &u.EmailVerified, &disabled); err != nil {
+				return nil, err
+			}
+			if email.Valid {
+				u.Email = &email.String
+			}
+			if disabled.Valid {
+				u.DisabledAt = &disabled.Time
+			}
+			return &u, nil
+		}, fn)
+	if err != nil {
+		return err
+	}
+
+	err = exportTable(ctx, tx, EXPORT_GROUPS, "select id, coin, creator, coin_holder from _group order by id",
+		func(rows *sql.Rows) (interface{}, error) {
+			var g Group
+			err := rows.Scan(&g.ID, &g.Token, &g.Creator, &g.TokenHolder)
+			return &g, err
+		}, fn)
+	if err != nil {
+		return err
+	}
+
+	err = exportTable(ctx, tx, EXPORT_MEMBERS, "select group_id, username from group_member order by group_id, username",
+		func(rows *sql.Rows) (interface{}, error) {
+			var m GroupMember
+			err := rows.Scan(&m.GroupID, &m.Username)
+			return &m, err
+		}, fn)
+	if err != nil {
+		return err
+	}
+
+	err = exportTable(ctx, tx, EXPORT_COIN_PASSES, "select id, group_id, from_user, to_user, coin, passed_at from coin_pass order by id",
+		func(rows *sql.Rows) (interface{}, error) {
+			var p CoinPass
+			err := rows.Scan(&p.ID, &p.GroupID, &p.From, &p.To, &p.Coin, &p.PassedAt)
+			return &p, err
+		}, fn)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Stream one table to fn, timed and traced like any other query
+func exportTable(ctx context.Context, tx *sql.Tx, table string, q string,
+	scan func(rows *sql.Rows) (interface{}, error), fn func(table string, row interface{}) error) error {
+	name := "export_" + table
+	qctx, span, start := begin(ctx, name)
+	rows, err := tx.QueryContext(qctx, q)
+	end(span, name, start, err)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		row, err := scan(rows)
+		if err != nil {
+			return err
+		}
+		if err = fn(table, row); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
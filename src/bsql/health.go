@@ -0,0 +1,81 @@
+// Readiness checks of the database, registered by Establishconnection
+package bsql
+
+import (
+	"benschreiber.com/purestserver/src/health"
+	"context"
+	"errors"
+	"strings"
+	"sync/atomic"
+)
+
+// Tables the server reads and writes, from mysql/dump.sql and migrations/
+var TABLES = []string{
+	"_group",
+	"coin_pass",
+	"group_member",
+	"user",
+	"webhook",
+	"webhook_delivery",
+	"device",
+	"quiet_hours",
+	"notification_outbox",
+	"notification_delivery",
+	"one_time_code",
+	"two_factor",
+	"recovery_code",
+	"schema_migration",
+	"audit_event",
+	"pass_rollup",
+	"achievement",
+}
+
+// Set once every setup*States has prepared its statements
+var prepared atomic.Bool
+
+// Every table in TABLES exists in the connected database
+func CheckSchema(ctx context.Context) error {
+	rows, err := db.QueryContext(ctx, "select table_name from information_schema.tables where table_schema = database()")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	found := make(map[string]bool)
+	for rows.Next() {
+		var name string
+		if err = rows.Scan(&name); err != nil {
+			return err
+		}
+		found[name] = true
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	var missing []string
+	for _, t := range TABLES {
+		if !found[t] {
+			missing = append(missing, t)
+		}
+	}
+	if len(missing) > 0 {
+		return errors.New("missing tables: " + strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// Every setup*States prepared its statements and Close() hasn't run
+func CheckStatements(ctx context.Context) error {
+	if !prepared.Load() {
+		return errors.New("statements not prepared")
+	}
+	return nil
+}
+
+func registerHealth() {
+	health.Ready("database", PingDB)
+	health.Ready("schema", CheckSchema)
+	health.Ready("migrations", CheckMigrations)
+	health.Ready("statements", CheckStatements)
+}
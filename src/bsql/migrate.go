@@ -0,0 +1,219 @@
+// Versioned schema changes, from an empty database or one made before migrations
+// 0000 is the schema from before, it only creates tables that are missing
+// Each file in migrations/ is NNNN_name.sql, applied once in version order
+// and recorded in schema_migration, mysql/dump.sql already records the ones it includes
+package bsql
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"errors"
+	"fmt"
+	"github.com/go-sql-driver/mysql"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// Named lock held while migrating, so two instances starting together don't race
+const MIGRATION_LOCK = "purestserver_migrate"
+
+// How long to wait for another instance to finish migrating
+const MIGRATION_LOCK_TIMEOUT = 60 * time.Second
+
+// A schema change and when it was applied, AppliedAt is nil while pending
+type Migration struct {
+	Version   int        `json:"version"`
+	Name      string     `json:"name"`
+	AppliedAt *time.Time `json:"applied_at"`
+	sql       string
+}
+
+func (m *Migration) String() string {
+	return fmt.Sprintf("%04d_%s", m.Version, m.Name)
+}
+
+// Every migration file in version order
+func migrations() ([]Migration, error) {
+	entries, err := migrationFiles.ReadDir("migrations")
+	if err != nil {
+		return nil, err
+	}
+
+	var out []Migration
+	for _, e := range entries {
+		base := strings.TrimSuffix(e.Name(), ".sql")
+		num, name, ok := strings.Cut(base, "_")
+		version, err := strconv.Atoi(num)
+		if !ok || err != nil {
+			return nil, errors.New("migration file not named NNNN_name.sql: " + e.Name())
+		}
+
+		data, err := migrationFiles.ReadFile(path.Join("migrations", e.Name()))
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, Migration{Version: version, Name: name, sql: string(data)})
+	}
+
+	sort.Slice(out, func(i, j int) bool { return out[i].Version < out[j].Version })
+	for i := 1; i < len(out); i++ {
+		if out[i].Version == out[i-1].Version {
+			return nil, fmt.Errorf("migration version %d used twice", out[i].Version)
+		}
+	}
+	return out, nil
+}
+
+// The statements of a migration, split on semicolons ending a line
+func (m *Migration) statements() []string {
+	var out []string
+	var cur strings.Builder
+	for _, line := range strings.Split(m.sql, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "--") {
+			continue
+		}
+		cur.WriteString(line + "\n")
+		if strings.HasSuffix(trimmed, ";") {
+			out = append(out, strings.TrimSpace(cur.String()))
+			cur.Reset()
+		}
+	}
+	if s := strings.TrimSpace(cur.String()); s != "" {
+		out = append(out, s)
+	}
+	return out
+}
+
+// Every migration, with the time it was applied if it was
+func Migrations(ctx context.Context) ([]Migration, error) {
+	all, err := migrations()
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := query(ctx, "select_migrations", "select version, applied_at from schema_migration")
+	if err != nil {
+		// A database from before migrations, nothing is applied yet
+		if merr, ok := err.(*mysql.MySQLError); ok && merr.Number == 1146 {
+			return all, nil
+		}
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := make(map[int]time.Time)
+	for rows.Next() {
+		var version int
+		var at time.Time
+		if err = rows.Scan(&version, &at); err != nil {
+			return nil, err
+		}
+		applied[version] = at
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for i := range all {
+		if at, ok := applied[all[i].Version]; ok {
+			all[i].AppliedAt = &at
+		}
+	}
+	return all, nil
+}
+
+// Migrations not applied yet, in the order they will be
+func Pending(ctx context.Context) ([]Migration, error) {
+	all, err := Migrations(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var pending []Migration
+	for _, m := range all {
+		if m.AppliedAt == nil {
+			pending = append(pending, m)
+		}
+	}
+	return pending, nil
+}
+
+// Apply every pending migration, returns the ones applied
+// MySQL commits schema changes as it goes, a migration that fails halfway
+// has to be finished by hand before it is recorded
+func Migrate(ctx context.Context) ([]Migration, error) {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	var locked sql.NullInt64
+	if err = conn.QueryRowContext(ctx, "select get_lock(?, ?)", MIGRATION_LOCK, int(MIGRATION_LOCK_TIMEOUT.Seconds())).Scan(&locked); err != nil {
+		return nil, err
+	}
+	if locked.Int64 != 1 {
+		return nil, errors.New("timed out waiting for another instance to finish migrating")
+	}
+	defer conn.ExecContext(context.WithoutCancel(ctx), "select release_lock(?)", MIGRATION_LOCK)
+
+	if _, err = conn.ExecContext(ctx, "create table if not exists schema_migration ("+
+		"version int not null primary key, "+
+		"name varchar(128) not null, "+
+		"applied_at datetime not null default current_timestamp) "+
+		"engine=InnoDB default charset=utf8mb4 collate=utf8mb4_unicode_ci"); err != nil {
+		return nil, err
+	}
+
+	// Read under the lock, another instance may have just applied some
+	pending, err := Pending(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var applied []Migration
+	for _, m := range pending {
+		logger.Info("applying migration", "migration", m.String())
+		for _, s := range m.statements() {
+			if _, err = conn.ExecContext(ctx, s); err != nil {
+				return applied, fmt.Errorf("migration %s: %w", m.String(), err)
+			}
+		}
+		if _, err = conn.ExecContext(ctx, "insert into schema_migration(version, name) values (?, ?)", m.Version, m.Name); err != nil {
+			return applied, err
+		}
+		now := time.Now()
+		m.AppliedAt = &now
+		applied = append(applied, m)
+	}
+	return applied, nil
+}
+
+// Names of the pending migrations, for errors and health checks
+func names(ms []Migration) string {
+	s := make([]string, len(ms))
+	for i := range ms {
+		s[i] = ms[i].String()
+	}
+	return strings.Join(s, ", ")
+}
+
+// No migration is waiting to be applied
+func CheckMigrations(ctx context.Context) error {
+	pending, err := Pending(ctx)
+	if err != nil {
+		return err
+	}
+	if len(pending) > 0 {
+		return errors.New("pending migrations: " + names(pending))
+	}
+	return nil
+}
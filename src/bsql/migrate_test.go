@@ -0,0 +1,34 @@
+package bsql
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestMigrations(t *testing.T) {
+	all, err := migrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) == 0 || all[0].String() != "0000_baseline" {
+		t.Fatalf("migrations don't start with 0000_baseline: %v", all)
+	}
+
+	dump, err := os.ReadFile("../../mysql/dump.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, m := range all {
+		if m.Version != i {
+			t.Errorf("%s out of sequence, want version %d", m.String(), i)
+		}
+		if len(m.statements()) == 0 {
+			t.Errorf("%s has no statements", m.String())
+		}
+		if !strings.Contains(string(dump), fmt.Sprintf("(%d,'%s',", m.Version, m.Name)) {
+			t.Errorf("%s not recorded in dump.sql", m.String())
+		}
+	}
+}
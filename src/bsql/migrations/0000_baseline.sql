@@ -0,0 +1,29 @@
+-- The schema before migrations, users and their groups
+-- A database made from that dump already has these tables, an empty one gets them here
+CREATE TABLE IF NOT EXISTS `user` (
+  `username` varchar(128) COLLATE utf8mb4_unicode_ci NOT NULL,
+  `password` varchar(512) COLLATE utf8mb4_unicode_ci NOT NULL,
+  PRIMARY KEY (`username`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+CREATE TABLE IF NOT EXISTS `_group` (
+  `id` varchar(255) COLLATE utf8mb4_unicode_ci NOT NULL,
+  `coin` int(11) NOT NULL,
+  `creator` varchar(128) COLLATE utf8mb4_unicode_ci NOT NULL,
+  `coin_holder` varchar(128) COLLATE utf8mb4_unicode_ci NOT NULL,
+  PRIMARY KEY (`id`),
+  KEY `creator` (`creator`),
+  KEY `token_holder` (`coin_holder`),
+  CONSTRAINT `_group_ibfk_1` FOREIGN KEY (`creator`) REFERENCES `user` (`username`) ON DELETE CASCADE,
+  CONSTRAINT `_group_ibfk_2` FOREIGN KEY (`coin_holder`) REFERENCES `user` (`username`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+CREATE TABLE IF NOT EXISTS `group_member` (
+  `group_id` varchar(255) COLLATE utf8mb4_unicode_ci DEFAULT NULL,
+  `username` varchar(128) COLLATE utf8mb4_unicode_ci DEFAULT NULL,
+  UNIQUE KEY `group_id_2` (`group_id`,`username`),
+  KEY `group_id` (`group_id`),
+  KEY `username` (`username`),
+  CONSTRAINT `group_member_ibfk_1` FOREIGN KEY (`group_id`) REFERENCES `_group` (`id`) ON DELETE CASCADE,
+  CONSTRAINT `group_member_ibfk_2` FOREIGN KEY (`username`) REFERENCES `user` (`username`) ON DELETE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
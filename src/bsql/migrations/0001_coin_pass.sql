@@ -0,0 +1,12 @@
+-- Every pass of a group's coin, for history and event replay
+CREATE TABLE `coin_pass` (
+  `id` bigint(20) NOT NULL AUTO_INCREMENT,
+  `group_id` varchar(255) COLLATE utf8mb4_unicode_ci NOT NULL,
+  `from_user` varchar(128) COLLATE utf8mb4_unicode_ci NOT NULL,
+  `to_user` varchar(128) COLLATE utf8mb4_unicode_ci NOT NULL,
+  `coin` int(11) NOT NULL,
+  `passed_at` datetime NOT NULL DEFAULT current_timestamp(),
+  PRIMARY KEY (`id`),
+  KEY `group_id` (`group_id`,`id`),
+  CONSTRAINT `coin_pass_ibfk_1` FOREIGN KEY (`group_id`) REFERENCES `_group` (`id`) ON DELETE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
@@ -0,0 +1,33 @@
+-- Group webhooks, events is a comma separated list
+CREATE TABLE `webhook` (
+  `id` varchar(255) COLLATE utf8mb4_unicode_ci NOT NULL,
+  `group_id` varchar(255) COLLATE utf8mb4_unicode_ci NOT NULL,
+  `url` varchar(2048) COLLATE utf8mb4_unicode_ci NOT NULL,
+  `secret` varchar(255) COLLATE utf8mb4_unicode_ci NOT NULL,
+  `events` varchar(255) COLLATE utf8mb4_unicode_ci NOT NULL,
+  `active` tinyint(1) NOT NULL DEFAULT 1,
+  `failures` int(11) NOT NULL DEFAULT 0,
+  `created_at` datetime NOT NULL DEFAULT current_timestamp(),
+  PRIMARY KEY (`id`),
+  KEY `group_id` (`group_id`),
+  CONSTRAINT `webhook_ibfk_1` FOREIGN KEY (`group_id`) REFERENCES `_group` (`id`) ON DELETE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- Delivery queue and log, due rows are pending with next_attempt in the past
+CREATE TABLE `webhook_delivery` (
+  `id` bigint(20) NOT NULL AUTO_INCREMENT,
+  `webhook_id` varchar(255) COLLATE utf8mb4_unicode_ci NOT NULL,
+  `event` varchar(32) COLLATE utf8mb4_unicode_ci NOT NULL,
+  `payload` text COLLATE utf8mb4_unicode_ci NOT NULL,
+  `status` varchar(16) COLLATE utf8mb4_unicode_ci NOT NULL DEFAULT 'pending',
+  `attempts` int(11) NOT NULL DEFAULT 0,
+  `next_attempt` datetime NOT NULL DEFAULT current_timestamp(),
+  `status_code` int(11) DEFAULT NULL,
+  `error` varchar(512) COLLATE utf8mb4_unicode_ci DEFAULT NULL,
+  `created_at` datetime NOT NULL DEFAULT current_timestamp(),
+  `delivered_at` datetime DEFAULT NULL,
+  PRIMARY KEY (`id`),
+  KEY `due` (`status`,`next_attempt`),
+  KEY `webhook_id` (`webhook_id`,`id`),
+  CONSTRAINT `webhook_delivery_ibfk_1` FOREIGN KEY (`webhook_id`) REFERENCES `webhook` (`id`) ON DELETE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
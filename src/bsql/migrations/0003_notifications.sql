@@ -0,0 +1,48 @@
+-- Push tokens of a user's devices
+CREATE TABLE `device` (
+  `token` varchar(255) COLLATE utf8mb4_unicode_ci NOT NULL,
+  `username` varchar(128) COLLATE utf8mb4_unicode_ci NOT NULL,
+  `platform` varchar(16) COLLATE utf8mb4_unicode_ci NOT NULL,
+  `created_at` datetime NOT NULL DEFAULT current_timestamp(),
+  PRIMARY KEY (`token`),
+  KEY `username` (`username`),
+  CONSTRAINT `device_ibfk_1` FOREIGN KEY (`username`) REFERENCES `user` (`username`) ON DELETE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- Hours a user doesn't want pushes, in their timezone
+CREATE TABLE `quiet_hours` (
+  `username` varchar(128) COLLATE utf8mb4_unicode_ci NOT NULL,
+  `start_hour` tinyint(4) NOT NULL,
+  `end_hour` tinyint(4) NOT NULL,
+  `timezone` varchar(64) COLLATE utf8mb4_unicode_ci NOT NULL DEFAULT 'UTC',
+  PRIMARY KEY (`username`),
+  CONSTRAINT `quiet_hours_ibfk_1` FOREIGN KEY (`username`) REFERENCES `user` (`username`) ON DELETE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- Notifications waiting to be pushed, dedupe_key stops the same one being queued twice
+CREATE TABLE `notification_outbox` (
+  `id` bigint(20) NOT NULL AUTO_INCREMENT,
+  `username` varchar(128) COLLATE utf8mb4_unicode_ci NOT NULL,
+  `kind` varchar(32) COLLATE utf8mb4_unicode_ci NOT NULL,
+  `dedupe_key` varchar(255) COLLATE utf8mb4_unicode_ci NOT NULL,
+  `payload` text COLLATE utf8mb4_unicode_ci NOT NULL,
+  `status` varchar(16) COLLATE utf8mb4_unicode_ci NOT NULL DEFAULT 'pending',
+  `attempts` int(11) NOT NULL DEFAULT 0,
+  `next_attempt` datetime NOT NULL DEFAULT current_timestamp(),
+  `error` varchar(512) COLLATE utf8mb4_unicode_ci DEFAULT NULL,
+  `created_at` datetime NOT NULL DEFAULT current_timestamp(),
+  `sent_at` datetime DEFAULT NULL,
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `dedupe_key` (`dedupe_key`),
+  KEY `due` (`status`,`next_attempt`),
+  CONSTRAINT `notification_outbox_ibfk_1` FOREIGN KEY (`username`) REFERENCES `user` (`username`) ON DELETE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- Devices a notification already reached, a retry skips them
+CREATE TABLE `notification_delivery` (
+  `notification_id` bigint(20) NOT NULL,
+  `device_token` varchar(255) COLLATE utf8mb4_unicode_ci NOT NULL,
+  `sent_at` datetime NOT NULL DEFAULT current_timestamp(),
+  PRIMARY KEY (`notification_id`,`device_token`),
+  CONSTRAINT `notification_delivery_ibfk_1` FOREIGN KEY (`notification_id`) REFERENCES `notification_outbox` (`id`) ON DELETE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
@@ -0,0 +1,20 @@
+-- A user's email address, unique once set, and whether they proved it is theirs
+ALTER TABLE `user`
+  ADD COLUMN `email` varchar(255) COLLATE utf8mb4_unicode_ci DEFAULT NULL,
+  ADD COLUMN `email_verified` tinyint(1) NOT NULL DEFAULT 0,
+  ADD UNIQUE KEY `email` (`email`);
+
+-- Emailed verification and password reset codes, only their hash is kept
+CREATE TABLE `one_time_code` (
+  `id` bigint(20) NOT NULL AUTO_INCREMENT,
+  `username` varchar(128) COLLATE utf8mb4_unicode_ci NOT NULL,
+  `purpose` varchar(16) COLLATE utf8mb4_unicode_ci NOT NULL,
+  `code_hash` char(64) COLLATE utf8mb4_unicode_ci NOT NULL,
+  `expires_at` datetime NOT NULL,
+  `used_at` datetime DEFAULT NULL,
+  `attempts` int(11) NOT NULL DEFAULT 0,
+  `created_at` datetime NOT NULL DEFAULT current_timestamp(),
+  PRIMARY KEY (`id`),
+  KEY `lookup` (`username`,`purpose`,`code_hash`),
+  CONSTRAINT `one_time_code_ibfk_1` FOREIGN KEY (`username`) REFERENCES `user` (`username`) ON DELETE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
@@ -0,0 +1,23 @@
+-- TOTP secret of a user, enabled once a code confirmed it
+-- last_step is the newest time step used, a code can't be replayed
+CREATE TABLE `two_factor` (
+  `username` varchar(128) COLLATE utf8mb4_unicode_ci NOT NULL,
+  `secret` varchar(64) COLLATE utf8mb4_unicode_ci NOT NULL,
+  `enabled` tinyint(1) NOT NULL DEFAULT 0,
+  `last_step` bigint(20) NOT NULL DEFAULT 0,
+  `created_at` datetime NOT NULL DEFAULT current_timestamp(),
+  `confirmed_at` datetime DEFAULT NULL,
+  PRIMARY KEY (`username`),
+  CONSTRAINT `two_factor_ibfk_1` FOREIGN KEY (`username`) REFERENCES `user` (`username`) ON DELETE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- Single-use codes that stand in for a TOTP code, only their hash is kept
+CREATE TABLE `recovery_code` (
+  `id` bigint(20) NOT NULL AUTO_INCREMENT,
+  `username` varchar(128) COLLATE utf8mb4_unicode_ci NOT NULL,
+  `code_hash` char(64) COLLATE utf8mb4_unicode_ci NOT NULL,
+  `used_at` datetime DEFAULT NULL,
+  PRIMARY KEY (`id`),
+  KEY `lookup` (`username`,`code_hash`),
+  CONSTRAINT `recovery_code_ibfk_1` FOREIGN KEY (`username`) REFERENCES `user` (`username`) ON DELETE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
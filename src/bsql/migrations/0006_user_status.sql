@@ -0,0 +1,4 @@
+-- Accounts disabled by an operator, and the time every session issued before stops working
+ALTER TABLE `user`
+  ADD COLUMN `disabled_at` datetime(3) DEFAULT NULL,
+  ADD COLUMN `sessions_revoked_at` datetime(3) DEFAULT NULL;
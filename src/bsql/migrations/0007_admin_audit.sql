@@ -0,0 +1,20 @@
+-- System-wide role of a user, admin opens /api/admin
+ALTER TABLE `user`
+  ADD COLUMN `role` varchar(16) COLLATE utf8mb4_unicode_ci NOT NULL DEFAULT 'user';
+
+-- Append-only record of who did what, actors and targets outlive their accounts so there are no foreign keys
+CREATE TABLE `audit_event` (
+  `id` bigint(20) NOT NULL AUTO_INCREMENT,
+  `actor` varchar(128) COLLATE utf8mb4_unicode_ci NOT NULL,
+  `action` varchar(64) COLLATE utf8mb4_unicode_ci NOT NULL,
+  `target` varchar(128) COLLATE utf8mb4_unicode_ci DEFAULT NULL,
+  `group_id` varchar(255) COLLATE utf8mb4_unicode_ci DEFAULT NULL,
+  `ip` varchar(45) COLLATE utf8mb4_unicode_ci DEFAULT NULL,
+  `request_id` varchar(64) COLLATE utf8mb4_unicode_ci DEFAULT NULL,
+  `created_at` datetime(3) NOT NULL DEFAULT current_timestamp(3),
+  PRIMARY KEY (`id`),
+  KEY `actor` (`actor`,`id`),
+  KEY `target` (`target`,`id`),
+  KEY `group_id` (`group_id`,`id`),
+  KEY `action` (`action`,`id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
@@ -0,0 +1,31 @@
+-- Hand-overs by an operator move the coin without anyone doing pushups, stats leave them out
+-- Earlier ones can't be told apart from passes
+ALTER TABLE `coin_pass`
+  ADD COLUMN `reassigned` tinyint(1) NOT NULL DEFAULT 0;
+
+-- Coin history totals per group, day and passer, kept up to date by every pass
+-- so stats and leaderboards don't scan the history
+-- A hold runs from the group's previous pass to this one, missed when longer than bsql.HOLD_DEADLINE
+CREATE TABLE `pass_rollup` (
+  `group_id` varchar(255) COLLATE utf8mb4_unicode_ci NOT NULL,
+  `username` varchar(128) COLLATE utf8mb4_unicode_ci NOT NULL,
+  `day` date NOT NULL,
+  `passes` int(11) NOT NULL DEFAULT 0,
+  `pushups` bigint(20) NOT NULL DEFAULT 0,
+  `held_seconds` bigint(20) NOT NULL DEFAULT 0,
+  `holds` int(11) NOT NULL DEFAULT 0,
+  `missed` int(11) NOT NULL DEFAULT 0,
+  PRIMARY KEY (`group_id`,`day`,`username`),
+  KEY `username` (`username`,`day`),
+  CONSTRAINT `pass_rollup_ibfk_1` FOREIGN KEY (`group_id`) REFERENCES `_group` (`id`) ON DELETE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- The history so far, 86400 is HOLD_DEADLINE
+INSERT INTO `pass_rollup` (`group_id`, `username`, `day`, `passes`, `pushups`, `held_seconds`, `holds`, `missed`)
+  SELECT `group_id`, `from_user`, DATE(`passed_at`), COUNT(*), SUM(`coin`), COALESCE(SUM(`held`), 0), COUNT(`held`), COALESCE(SUM(`held` > 86400), 0)
+  FROM (
+    SELECT `group_id`, `from_user`, `passed_at`, `coin`,
+      TIMESTAMPDIFF(SECOND, LAG(`passed_at`) OVER (PARTITION BY `group_id` ORDER BY `id`), `passed_at`) AS `held`
+    FROM `coin_pass`
+  ) AS `h`
+  GROUP BY `group_id`, `from_user`, DATE(`passed_at`);
@@ -0,0 +1,13 @@
+-- Passes an operator made on the holder's behalf, how long the coin was held says nothing about them
+ALTER TABLE `coin_pass`
+  ADD COLUMN `forced` tinyint(1) NOT NULL DEFAULT 0;
+
+-- Badges a user earned, one row per badge so awarding is idempotent
+-- The badge is the achievements rule's id, rules are in code
+CREATE TABLE `achievement` (
+  `username` varchar(128) COLLATE utf8mb4_unicode_ci NOT NULL,
+  `badge` varchar(64) COLLATE utf8mb4_unicode_ci NOT NULL,
+  `earned_at` datetime(3) NOT NULL DEFAULT current_timestamp(3),
+  PRIMARY KEY (`username`,`badge`),
+  CONSTRAINT `achievement_ibfk_1` FOREIGN KEY (`username`) REFERENCES `user` (`username`) ON DELETE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
@@ -0,0 +1,297 @@
+// Queries for push devices, quiet hours and the notification outbox
+package bsql
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"strconv"
+	"time"
+)
+
+// SQL: table device
+type Device struct {
+	Token     string    `json:"token"`
+	Username  string    `json:"username"`
+	Platform  string    `json:"platform"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// SQL: table quiet_hours
+// Notifications are held from Start until End (hours, 0-23) in Timezone
+type QuietHours struct {
+	Username string `json:"username"`
+	Start    int    `json:"start"`
+	End      int    `json:"end"`
+	Timezone string `json:"timezone"`
+}
+
+// SQL: table notification_outbox
+type Notification struct {
+	ID       int64  `json:"id"`
+	Username string `json:"username"`
+	Kind     string `json:"kind"`
+	Payload  string `json:"payload"`
+	Attempts int    `json:"attempts"`
+}
+
+// Notification kinds
+const NOTIFY_COIN = "coin"
+
+// Outbox statuses
+const (
+	OUTBOX_PENDING = "pending"
+	OUTBOX_SENT    = "sent"
+	OUTBOX_FAILED  = "failed"
+	OUTBOX_SKIPPED = "skipped"
+)
+
+// Queue a "you have the coin" notification inside the UpdateCoin transaction
+// The dedupe key makes a replayed pass queue nothing
+func insertCoinNotification(ctx context.Context, tx *sql.Tx, pass *CoinPass) error {
+	payload, err := json.Marshal(pass)
+	if err != nil {
+		return err
+	}
+
+	key := NOTIFY_COIN + ":" + strconv.FormatInt(pass.ID, 10)
+	_, err = insertNotificationQuery.Tx(tx).Exec(ctx, pass.To, NOTIFY_COIN, key, string(payload))
+	return err
+}
+
+// Register a device token for a user, moving it if another user had it
+func UpsertDevice(ctx context.Context, token string, user string, platform string) error {
+	_, err := upsertDeviceQuery.Exec(ctx, token, user, platform)
+	return err
+}
+
+// Remove a user's device, false if the user has no such device
+func DeleteUserDevice(ctx context.Context, token string, user string) (bool, error) {
+	res, err := deleteUserDeviceQuery.Exec(ctx, token, user)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// Remove a device the provider reported as no longer valid
+func DeleteDevice(ctx context.Context, token string) error {
+	_, err := deleteDeviceQuery.Exec(ctx, token)
+	return err
+}
+
+func GetUserDevices(ctx context.Context, user string) ([]Device, error) {
+	rows, err := selectUserDevicesQuery.Query(ctx, user)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var devices []Device
+	for rows.Next() {
+		var d Device
+		if err = rows.Scan(&d.Token, &d.Username, &d.Platform, &d.CreatedAt); err != nil {
+			return nil, err
+		}
+		devices = append(devices, d)
+	}
+	return devices, rows.Err()
+}
+
+func UpsertQuietHours(ctx context.Context, q *QuietHours) error {
+	_, err := upsertQuietHoursQuery.Exec(ctx, q.Username, q.Start, q.End, q.Timezone)
+	return err
+}
+
+func DeleteQuietHours(ctx context.Context, user string) error {
+	_, err := deleteQuietHoursQuery.Exec(ctx, user)
+	return err
+}
+
+// Return a user's quiet hours, false if they have none
+func GetQuietHours(ctx context.Context, user string) (*QuietHours, bool, error) {
+	var q QuietHours
+	err := selectQuietHoursQuery.QueryRow(ctx, user).Scan(&q.Username, &q.Start, &q.End, &q.Timezone)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, false, nil
+		}
+		return nil, false, err
+	}
+	return &q, true, nil
+}
+
+// Claim up to limit pending notifications that are due, oldest first
+// Claimed rows aren't due again for lease, so no other server sends them meanwhile,
+// finishing or retrying one ends its lease, a server that dies mid-send leaves it to the next
+// Rows another server is claiming are skipped instead of waited on
+func ClaimDueNotifications(ctx context.Context, limit int, lease time.Duration) ([]Notification, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	rows, err := selectDueNotificationsQuery.Tx(tx).Query(ctx, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	var notifications []Notification
+	for rows.Next() {
+		var n Notification
+		if err = rows.Scan(&n.ID, &n.Username, &n.Kind, &n.Payload, &n.Attempts); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		notifications = append(notifications, n)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, n := range notifications {
+		if _, err = leaseNotificationQuery.Tx(tx).Exec(ctx, int(lease.Seconds()), n.ID); err != nil {
+			return nil, err
+		}
+	}
+	return notifications, tx.Commit()
+}
+
+// Devices a notification was already sent to, so a retry skips them
+func GetNotifiedDevices(ctx context.Context, id int64) (map[string]bool, error) {
+	rows, err := selectNotifiedDevicesQuery.Query(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sent := make(map[string]bool)
+	for rows.Next() {
+		var token string
+		if err = rows.Scan(&token); err != nil {
+			return nil, err
+		}
+		sent[token] = true
+	}
+	return sent, rows.Err()
+}
+
+// Record a notification as sent to a device
+func InsertNotifiedDevice(ctx context.Context, id int64, token string) error {
+	_, err := insertNotifiedDeviceQuery.Exec(ctx, id, token)
+	return err
+}
+
+// Set the final status of a notification
+func FinishNotification(ctx context.Context, id int64, status string, msg string) error {
+	_, err := finishNotificationQuery.Exec(ctx, status, msg, id)
+	return err
+}
+
+// Try a notification again after delay
+// Counts as an attempt unless it was only held for quiet hours
+func RetryNotification(ctx context.Context, id int64, msg string, delay time.Duration, attempt bool) error {
+	inc := 0
+	if attempt {
+		inc = 1
+	}
+	_, err := retryNotificationQuery.Exec(ctx, inc, msg, int(delay.Seconds()), id)
+	return err
+}
+
+var (
+	insertNotificationQuery,
+	upsertDeviceQuery,
+	deleteUserDeviceQuery,
+	deleteDeviceQuery,
+	selectUserDevicesQuery,
+	upsertQuietHoursQuery,
+	deleteQuietHoursQuery,
+	selectQuietHoursQuery,
+	selectDueNotificationsQuery,
+	selectNotifiedDevicesQuery,
+	insertNotifiedDeviceQuery,
+	finishNotificationQuery,
+	retryNotificationQuery,
+	leaseNotificationQuery *stmt
+)
+
+// Setup notification prepared statements
+func setupNotificationStates() error {
+	var err error
+
+	insertNotificationQuery, err = prepare("insert_notification", "insert ignore into notification_outbox(username, kind, dedupe_key, payload) values (?, ?, ?, ?)")
+	if err != nil {
+		return err
+	}
+
+	upsertDeviceQuery, err = prepare("upsert_device", "insert into device(token, username, platform) values (?, ?, ?) on duplicate key update username=values(username), platform=values(platform)")
+	if err != nil {
+		return err
+	}
+
+	deleteUserDeviceQuery, err = prepare("delete_user_device", "delete from device where token=? and username=?")
+	if err != nil {
+		return err
+	}
+
+	deleteDeviceQuery, err = prepare("delete_device", "delete from device where token=?")
+	if err != nil {
+		return err
+	}
+
+	selectUserDevicesQuery, err = prepare("select_user_devices", "select token, username, platform, created_at from device where username=?")
+	if err != nil {
+		return err
+	}
+
+	upsertQuietHoursQuery, err = prepare("upsert_quiet_hours", "insert into quiet_hours(username, start_hour, end_hour, timezone) values (?, ?, ?, ?) on duplicate key update start_hour=values(start_hour), end_hour=values(end_hour), timezone=values(timezone)")
+	if err != nil {
+		return err
+	}
+
+	deleteQuietHoursQuery, err = prepare("delete_quiet_hours", "delete from quiet_hours where username=?")
+	if err != nil {
+		return err
+	}
+
+	selectQuietHoursQuery, err = prepare("select_quiet_hours", "select username, start_hour, end_hour, timezone from quiet_hours where username=?")
+	if err != nil {
+		return err
+	}
+
+	selectDueNotificationsQuery, err = prepare("select_due_notifications", "select id, username, kind, payload, attempts from notification_outbox where status='pending' and next_attempt<=now() order by id limit ? for update skip locked")
+	if err != nil {
+		return err
+	}
+
+	selectNotifiedDevicesQuery, err = prepare("select_notified_devices", "select device_token from notification_delivery where notification_id=?")
+	if err != nil {
+		return err
+	}
+
+	insertNotifiedDeviceQuery, err = prepare("insert_notified_device", "insert ignore into notification_delivery(notification_id, device_token) values (?, ?)")
+	if err != nil {
+		return err
+	}
+
+	finishNotificationQuery, err = prepare("finish_notification", "update notification_outbox set status=?, error=?, sent_at=now() where id=?")
+	if err != nil {
+		return err
+	}
+
+	retryNotificationQuery, err = prepare("retry_notification", "update notification_outbox set attempts=attempts+?, error=?, next_attempt=date_add(now(), interval ? second) where id=?")
+	if err != nil {
+		return err
+	}
+
+	leaseNotificationQuery, err = prepare("lease_notification", "update notification_outbox set next_attempt=date_add(now(), interval ? second) where id=?")
+	if err != nil {
+		return err
+	}
+
+	return err
+}
@@ -0,0 +1,177 @@
+// Queries for stats and leaderboards, read from pass_rollup instead of the coin history
+// recordPass adds every pass to it in the pass's transaction
+package bsql
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// A holder who keeps the coin longer missed the deadline
+// 0008_stats.sql backfilled the history with the same value
+const HOLD_DEADLINE = 24 * time.Hour
+
+// Leaderboard periods, each starts at the database's current day, week (Monday) or month
+const (
+	PERIOD_DAY   = "day"
+	PERIOD_WEEK  = "week"
+	PERIOD_MONTH = "month"
+	PERIOD_ALL   = "all"
+)
+
+// Sums of pass_rollup rows
+// Pushups and Passes leave out operator hand-overs, holds count them
+type PassTotals struct {
+	Pushups     int64 `json:"pushups"`
+	Passes      int   `json:"coins_passed"`
+	HeldSeconds int64 `json:"held_seconds"`
+	Holds       int   `json:"holds"`
+	Missed      int   `json:"missed_deadlines"`
+}
+
+// A member's totals over a leaderboard period
+type LeaderboardRow struct {
+	Username string
+	PassTotals
+}
+
+func scanTotals(row interface{ Scan(...interface{}) error }, t *PassTotals) error {
+	return row.Scan(&t.Pushups, &t.Passes, &t.HeldSeconds, &t.Holds, &t.Missed)
+}
+
+// Totals of user's passes in every group, zero without any
+func GetUserTotals(ctx context.Context, user string) (*PassTotals, error) {
+	var t PassTotals
+	if err := scanTotals(selectUserTotalsQuery.QueryRow(ctx, user), &t); err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// Totals of every pass in a group, zero without any
+func GetGroupTotals(ctx context.Context, id string) (*PassTotals, error) {
+	var t PassTotals
+	if err := scanTotals(selectGroupTotalsQuery.QueryRow(ctx, id), &t); err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+func scanDays(rows *sql.Rows, err error) ([]time.Time, error) {
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var days []time.Time
+	for rows.Next() {
+		var day time.Time
+		if err = rows.Scan(&day); err != nil {
+			return nil, err
+		}
+		days = append(days, day)
+	}
+	return days, rows.Err()
+}
+
+// Days user passed the coin in any group, oldest first
+func GetUserPassDays(ctx context.Context, user string) ([]time.Time, error) {
+	return scanDays(selectUserPassDaysQuery.Query(ctx, user))
+}
+
+// Days anyone passed the coin in a group, oldest first
+func GetGroupPassDays(ctx context.Context, id string) ([]time.Time, error) {
+	return scanDays(selectGroupPassDaysQuery.Query(ctx, id))
+}
+
+// Current members of a group with passes in period, most pushups first
+// Members without any are left out
+func GetLeaderboard(ctx context.Context, id string, period string, limit int) ([]LeaderboardRow, error) {
+	rows, err := selectLeaderboardQuery.Query(ctx, id, id, period, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []LeaderboardRow
+	for rows.Next() {
+		var r LeaderboardRow
+		if err = rows.Scan(&r.Username, &r.Pushups, &r.Passes, &r.HeldSeconds, &r.Holds, &r.Missed); err != nil {
+			return nil, err
+		}
+		out = append(out, r)
+	}
+	return out, rows.Err()
+}
+
+var (
+	rollupPassQuery,
+	anonymizeRollupQuery,
+	deleteUserRollupQuery,
+	selectUserTotalsQuery,
+	selectGroupTotalsQuery,
+	selectUserPassDaysQuery,
+	selectGroupPassDaysQuery,
+	selectLeaderboardQuery *stmt
+)
+
+// Setup stats prepared statements
+func setupStatsStates() error {
+	var err error
+
+	// The hold runs from the group's previous pass, a reassign adds a hold but no pass
+	rollupPassQuery, err = prepare("rollup_pass", "insert into pass_rollup(group_id, username, day, passes, pushups, held_seconds, holds, missed) "+
+		"select group_id, from_user, date(passed_at), 1 - reassigned, if(reassigned, 0, coin), coalesce(held, 0), held is not null, coalesce(held > ?, 0) from "+
+		"(select p.group_id, p.from_user, p.passed_at, p.coin, p.reassigned, timestampdiff(second, (select q.passed_at from coin_pass q where q.group_id=p.group_id and q.id<p.id order by q.id desc limit 1), p.passed_at) as held from coin_pass p where p.id=?) h "+
+		"on duplicate key update passes=pass_rollup.passes+values(passes), pushups=pass_rollup.pushups+values(pushups), held_seconds=pass_rollup.held_seconds+values(held_seconds), holds=pass_rollup.holds+values(holds), missed=pass_rollup.missed+values(missed)")
+	if err != nil {
+		return err
+	}
+
+	// Folds a deleted user's rows into DELETED_USER's so group totals stay the same
+	anonymizeRollupQuery, err = prepare("anonymize_rollup", "insert into pass_rollup(group_id, username, day, passes, pushups, held_seconds, holds, missed) "+
+		"select r.group_id, ?, r.day, r.passes, r.pushups, r.held_seconds, r.holds, r.missed from pass_rollup r where r.username=? "+
+		"on duplicate key update passes=pass_rollup.passes+values(passes), pushups=pass_rollup.pushups+values(pushups), held_seconds=pass_rollup.held_seconds+values(held_seconds), holds=pass_rollup.holds+values(holds), missed=pass_rollup.missed+values(missed)")
+	if err != nil {
+		return err
+	}
+
+	deleteUserRollupQuery, err = prepare("delete_user_rollup", "delete from pass_rollup where username=?")
+	if err != nil {
+		return err
+	}
+
+	selectUserTotalsQuery, err = prepare("select_user_totals", "select coalesce(sum(pushups), 0), coalesce(sum(passes), 0), coalesce(sum(held_seconds), 0), coalesce(sum(holds), 0), coalesce(sum(missed), 0) from pass_rollup where username=?")
+	if err != nil {
+		return err
+	}
+
+	selectGroupTotalsQuery, err = prepare("select_group_totals", "select coalesce(sum(pushups), 0), coalesce(sum(passes), 0), coalesce(sum(held_seconds), 0), coalesce(sum(holds), 0), coalesce(sum(missed), 0) from pass_rollup where group_id=?")
+	if err != nil {
+		return err
+	}
+
+	selectUserPassDaysQuery, err = prepare("select_user_pass_days", "select day from pass_rollup where username=? and passes>0 group by day order by day")
+	if err != nil {
+		return err
+	}
+
+	selectGroupPassDaysQuery, err = prepare("select_group_pass_days", "select day from pass_rollup where group_id=? and passes>0 group by day order by day")
+	if err != nil {
+		return err
+	}
+
+	selectLeaderboardQuery, err = prepare("select_leaderboard", "select username, sum(pushups), sum(passes), sum(held_seconds), sum(holds), sum(missed) from pass_rollup "+
+		"where group_id=? and username in (select username from group_member where group_id=?) and day >= case ? "+
+		"when 'day' then curdate() "+
+		"when 'week' then curdate() - interval weekday(curdate()) day "+
+		"when 'month' then curdate() - interval (dayofmonth(curdate()) - 1) day "+
+		"else '1000-01-01' end "+
+		"group by username order by sum(pushups) desc, sum(passes) desc, username limit ?")
+	if err != nil {
+		return err
+	}
+
+	return err
+}
@@ -0,0 +1,86 @@
+package bsql
+
+import (
+	"benschreiber.com/purestserver/src/metrics"
+	"benschreiber.com/purestserver/src/tracing"
+	"context"
+	"database/sql"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"time"
+)
+
+// Prepared statement timed and traced under its query name
+// Parameters never reach the span, only the name does
+type stmt struct {
+	s    *sql.Stmt
+	name string
+}
+
+// Every prepared statement, closed by Close()
+var statements []*stmt
+
+// Prepare a statement, name labels its metric and span
+func prepare(name string, query string) (*stmt, error) {
+	s, err := db.Prepare(query)
+	if err != nil {
+		return nil, err
+	}
+	st := &stmt{s: s, name: name}
+	statements = append(statements, st)
+	return st, nil
+}
+
+// Span and start time of a statement
+// Statements outlive a cancelled request, a client hanging up doesn't fail a write half way
+func begin(ctx context.Context, name string) (context.Context, trace.Span, time.Time) {
+	ctx, span := tracing.Tracer().Start(context.WithoutCancel(ctx), "bsql."+name,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("db.system", "mysql"),
+			attribute.String("db.operation.name", name),
+		))
+	return ctx, span, time.Now()
+}
+
+// err is the statement's error, sql.ErrNoRows never gets here
+func end(span trace.Span, name string, start time.Time, err error) {
+	metrics.ObserveQuery(name, start, err)
+	tracing.Fail(span, err)
+	span.End()
+}
+
+func (s *stmt) Exec(ctx context.Context, args ...interface{}) (sql.Result, error) {
+	ctx, span, start := begin(ctx, s.name)
+	res, err := s.s.ExecContext(ctx, args...)
+	end(span, s.name, start, err)
+	return res, err
+}
+
+func (s *stmt) Query(ctx context.Context, args ...interface{}) (*sql.Rows, error) {
+	ctx, span, start := begin(ctx, s.name)
+	rows, err := s.s.QueryContext(ctx, args...)
+	end(span, s.name, start, err)
+	return rows, err
+}
+
+// The query runs here, Scan only reads the row
+func (s *stmt) QueryRow(ctx context.Context, args ...interface{}) *sql.Row {
+	ctx, span, start := begin(ctx, s.name)
+	row := s.s.QueryRowContext(ctx, args...)
+	end(span, s.name, start, row.Err())
+	return row
+}
+
+// The statement bound to a transaction, still timed and traced
+func (s *stmt) Tx(tx *sql.Tx) *stmt {
+	return &stmt{s: tx.Stmt(s.s), name: s.name}
+}
+
+// Time and trace an unprepared query, for the batched IN lists
+func query(ctx context.Context, name string, q string, args ...interface{}) (*sql.Rows, error) {
+	ctx, span, start := begin(ctx, name)
+	rows, err := db.QueryContext(ctx, q, args...)
+	end(span, name, start, err)
+	return rows, err
+}
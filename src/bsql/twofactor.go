@@ -0,0 +1,203 @@
+// Queries for TOTP two-factor authentication and recovery codes
+package bsql
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// SQL: table two_factor
+// A row with Enabled false is an enrollment waiting for confirmation
+type TwoFactor struct {
+	Username    string     `json:"username"`
+	Secret      string     `json:"-"`
+	Enabled     bool       `json:"enabled"`
+	LastStep    int64      `json:"-"`
+	ConfirmedAt *time.Time `json:"confirmed_at"`
+}
+
+// Second factor methods, recovery codes back up each of them
+const TWO_FACTOR_TOTP = "totp"
+
+// Two-factor state safe to show the user or an admin
+// Method is empty while it is off
+type TwoFactorStatus struct {
+	Enabled       bool       `json:"enabled"`
+	Method        string     `json:"method,omitempty"`
+	ConfirmedAt   *time.Time `json:"confirmed_at"`
+	RecoveryCodes int        `json:"recovery_codes"`
+}
+
+// Start an enrollment, replacing any unconfirmed one
+func InsertTwoFactorSecret(ctx context.Context, user string, secret string) error {
+	_, err := upsertTwoFactorQuery.Exec(ctx, user, secret)
+	return err
+}
+
+// Return a user's two-factor row, false if they never enrolled
+func GetTwoFactor(ctx context.Context, user string) (*TwoFactor, bool, error) {
+	var tf TwoFactor
+	err := selectTwoFactorQuery.QueryRow(ctx, user).Scan(
+		&tf.Username,
+		&tf.Secret,
+		&tf.Enabled,
+		&tf.LastStep,
+		&tf.ConfirmedAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, false, nil
+		}
+		return nil, false, err
+	}
+	return &tf, true, nil
+}
+
+// Two-factor state of a user, disabled if they never enrolled
+func GetTwoFactorStatus(ctx context.Context, user string) (*TwoFactorStatus, error) {
+	tf, ok, err := GetTwoFactor(ctx, user)
+	if err != nil {
+		return nil, err
+	}
+
+	status := &TwoFactorStatus{}
+	if !ok || !tf.Enabled {
+		return status, nil
+	}
+
+	status.Enabled = true
+	status.Method = TWO_FACTOR_TOTP
+	status.ConfirmedAt = tf.ConfirmedAt
+	err = countRecoveryCodesQuery.QueryRow(ctx, user).Scan(&status.RecoveryCodes)
+	return status, err
+}
+
+// Turn on two-factor and replace the recovery codes in one transaction
+// step is the TOTP step used to confirm, it can't be used again
+func EnableTwoFactor(ctx context.Context, user string, step int64, codes []string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err = enableTwoFactorQuery.Tx(tx).Exec(ctx, step, user); err != nil {
+		return err
+	}
+
+	if _, err = deleteRecoveryCodesQuery.Tx(tx).Exec(ctx, user); err != nil {
+		return err
+	}
+
+	for _, code := range codes {
+		if _, err = insertRecoveryCodeQuery.Tx(tx).Exec(ctx, user, code); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// Remove two-factor and every recovery code
+func DisableTwoFactor(ctx context.Context, user string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err = deleteRecoveryCodesQuery.Tx(tx).Exec(ctx, user); err != nil {
+		return err
+	}
+
+	if _, err = deleteTwoFactorQuery.Tx(tx).Exec(ctx, user); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Record a TOTP step as used
+// False if it, or a later step, was already used so a code can't be replayed
+func UseTwoFactorStep(ctx context.Context, user string, step int64) (bool, error) {
+	res, err := useTwoFactorStepQuery.Exec(ctx, step, user, step)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+// Mark a matching unused recovery code as used, false if there was none
+func ConsumeRecoveryCode(ctx context.Context, user string, code string) (bool, error) {
+	res, err := consumeRecoveryCodeQuery.Exec(ctx, user, code)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+var (
+	upsertTwoFactorQuery,
+	selectTwoFactorQuery,
+	enableTwoFactorQuery,
+	deleteTwoFactorQuery,
+	useTwoFactorStepQuery,
+	insertRecoveryCodeQuery,
+	deleteRecoveryCodesQuery,
+	consumeRecoveryCodeQuery,
+	countRecoveryCodesQuery *stmt
+)
+
+// Setup two-factor prepared statements
+func setupTwoFactorStates() error {
+	var err error
+
+	upsertTwoFactorQuery, err = prepare("upsert_two_factor", "insert into two_factor(username, secret) values (?, ?) on duplicate key update secret=values(secret), enabled=0, last_step=0, confirmed_at=null")
+	if err != nil {
+		return err
+	}
+
+	selectTwoFactorQuery, err = prepare("select_two_factor", "select username, secret, enabled, last_step, confirmed_at from two_factor where username=?")
+	if err != nil {
+		return err
+	}
+
+	enableTwoFactorQuery, err = prepare("enable_two_factor", "update two_factor set enabled=1, last_step=?, confirmed_at=now() where username=?")
+	if err != nil {
+		return err
+	}
+
+	deleteTwoFactorQuery, err = prepare("delete_two_factor", "delete from two_factor where username=?")
+	if err != nil {
+		return err
+	}
+
+	useTwoFactorStepQuery, err = prepare("use_two_factor_step", "update two_factor set last_step=? where username=? and last_step<?")
+	if err != nil {
+		return err
+	}
+
+	insertRecoveryCodeQuery, err = prepare("insert_recovery_code", "insert into recovery_code(username, code_hash) values (?, SHA2(?, 256))")
+	if err != nil {
+		return err
+	}
+
+	deleteRecoveryCodesQuery, err = prepare("delete_recovery_codes", "delete from recovery_code where username=?")
+	if err != nil {
+		return err
+	}
+
+	consumeRecoveryCodeQuery, err = prepare("consume_recovery_code", "update recovery_code set used_at=now() where username=? and code_hash=SHA2(?, 256) and used_at is null limit 1")
+	if err != nil {
+		return err
+	}
+
+	countRecoveryCodesQuery, err = prepare("count_recovery_codes", "select count(*) from recovery_code where username=? and used_at is null")
+	if err != nil {
+		return err
+	}
+
+	return err
+}
@@ -0,0 +1,340 @@
+// Queries for group webhooks and their delivery queue
+package bsql
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"time"
+)
+
+// SQL: table webhook
+// Events is stored as a comma separated list
+type Webhook struct {
+	ID        string    `json:"id"`
+	GroupID   string    `json:"group_id"`
+	URL       string    `json:"url"`
+	Secret    string    `json:"-"`
+	Events    []string  `json:"events"`
+	Active    bool      `json:"active"`
+	Failures  int       `json:"failures"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Webhook subscribes to an event type
+func (w *Webhook) Wants(event string) bool {
+	for _, v := range w.Events {
+		if v == event {
+			return true
+		}
+	}
+	return false
+}
+
+// SQL: table webhook_delivery
+// URL and Secret are joined from the webhook when claiming due deliveries
+type WebhookDelivery struct {
+	ID          int64      `json:"id"`
+	WebhookID   string     `json:"webhook_id"`
+	Event       string     `json:"event"`
+	Payload     string     `json:"payload"`
+	Status      string     `json:"status"`
+	Attempts    int        `json:"attempts"`
+	NextAttempt time.Time  `json:"next_attempt"`
+	StatusCode  int        `json:"status_code"`
+	Error       string     `json:"error"`
+	CreatedAt   time.Time  `json:"created_at"`
+	DeliveredAt *time.Time `json:"delivered_at"`
+	URL         string     `json:"-"`
+	Secret      string     `json:"-"`
+}
+
+// Delivery statuses
+const (
+	DELIVERY_PENDING   = "pending"
+	DELIVERY_DELIVERED = "delivered"
+	DELIVERY_FAILED    = "failed"
+)
+
+func InsertWebhook(ctx context.Context, w *Webhook) error {
+	_, err := insertWebhookQuery.Exec(ctx, w.ID, w.GroupID, w.URL, w.Secret, strings.Join(w.Events, ","))
+	return err
+}
+
+func DeleteWebhook(ctx context.Context, hook string, id string) error {
+	_, err := deleteWebhookQuery.Exec(ctx, hook, id)
+	return err
+}
+
+func scanWebhook(row interface{ Scan(...interface{}) error }) (*Webhook, error) {
+	var w Webhook
+	var evs string
+	err := row.Scan(
+		&w.ID,
+		&w.GroupID,
+		&w.URL,
+		&w.Secret,
+		&evs,
+		&w.Active,
+		&w.Failures,
+		&w.CreatedAt)
+	if evs != "" {
+		w.Events = strings.Split(evs, ",")
+	}
+	return &w, err
+}
+
+// Return a webhook only if it belongs to group id
+func GetWebhook(ctx context.Context, hook string, id string) (*Webhook, bool, error) {
+	w, err := scanWebhook(selectWebhookQuery.QueryRow(ctx, hook, id))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			logger.Debug("webhook not found", "webhook", hook, "group", id)
+			return nil, false, nil
+		}
+		return nil, false, err
+	}
+	return w, true, nil
+}
+
+// Return every webhook of a group
+func GetWebhooks(ctx context.Context, id string) ([]Webhook, error) {
+	rows, err := selectGroupWebhooksQuery.Query(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	hooks := []Webhook{}
+	for rows.Next() {
+		w, err := scanWebhook(rows)
+		if err != nil {
+			return nil, err
+		}
+		hooks = append(hooks, *w)
+	}
+	return hooks, rows.Err()
+}
+
+// Queue a payload for delivery to a webhook, due immediately
+func InsertWebhookDelivery(ctx context.Context, hook string, event string, payload string) error {
+	_, err := insertWebhookDeliveryQuery.Exec(ctx, hook, event, payload)
+	return err
+}
+
+// Claim up to limit pending deliveries that are due, oldest first
+// Deliveries of disabled webhooks are never returned
+// Claimed rows aren't due again for lease, so no other server sends them meanwhile,
+// recording the attempt ends the lease, a server that dies mid-send leaves it to the next
+// Rows another server is claiming are skipped instead of waited on
+func ClaimDueWebhookDeliveries(ctx context.Context, limit int, lease time.Duration) ([]WebhookDelivery, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	rows, err := selectDueWebhookDeliveriesQuery.Tx(tx).Query(ctx, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	var deliveries []WebhookDelivery
+	for rows.Next() {
+		var d WebhookDelivery
+		if err = rows.Scan(
+			&d.ID,
+			&d.WebhookID,
+			&d.Event,
+			&d.Payload,
+			&d.Attempts,
+			&d.URL,
+			&d.Secret); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		deliveries = append(deliveries, d)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, d := range deliveries {
+		if _, err = leaseDeliveryQuery.Tx(tx).Exec(ctx, int(lease.Seconds()), d.ID); err != nil {
+			return nil, err
+		}
+	}
+	return deliveries, tx.Commit()
+}
+
+// Return the latest deliveries of a webhook, newest first
+func GetWebhookDeliveries(ctx context.Context, hook string, limit int) ([]WebhookDelivery, error) {
+	rows, err := selectWebhookDeliveriesQuery.Query(ctx, hook, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	deliveries := []WebhookDelivery{}
+	for rows.Next() {
+		var d WebhookDelivery
+		var code sql.NullInt64
+		var msg sql.NullString
+		if err = rows.Scan(
+			&d.ID,
+			&d.WebhookID,
+			&d.Event,
+			&d.Payload,
+			&d.Status,
+			&d.Attempts,
+			&d.NextAttempt,
+			&code,
+			&msg,
+			&d.CreatedAt,
+			&d.DeliveredAt); err != nil {
+			return nil, err
+		}
+		d.StatusCode = int(code.Int64)
+		d.Error = msg.String
+		deliveries = append(deliveries, d)
+	}
+	return deliveries, rows.Err()
+}
+
+// Mark a delivery delivered and reset the webhook failure count
+func WebhookDelivered(ctx context.Context, d *WebhookDelivery, code int) error {
+	if _, err := updateDeliveryDeliveredQuery.Exec(ctx, code, d.ID); err != nil {
+		return err
+	}
+	_, err := resetWebhookFailuresQuery.Exec(ctx, d.WebhookID)
+	return err
+}
+
+// Record a failed attempt, status is pending to retry after delay or failed
+// Returns the consecutive failure count of the webhook
+func WebhookAttemptFailed(ctx context.Context, d *WebhookDelivery, status string, code int, msg string, delay time.Duration) (int, error) {
+	if _, err := updateDeliveryFailedQuery.Exec(ctx, status, code, msg, int(delay.Seconds()), d.ID); err != nil {
+		return 0, err
+	}
+	if _, err := incrementWebhookFailuresQuery.Exec(ctx, d.WebhookID); err != nil {
+		return 0, err
+	}
+
+	var failures int
+	err := selectWebhookFailuresQuery.QueryRow(ctx, d.WebhookID).Scan(&failures)
+	return failures, err
+}
+
+// Stop deliveries to a webhook until it is enabled again
+func DisableWebhook(ctx context.Context, hook string) error {
+	_, err := disableWebhookQuery.Exec(ctx, hook)
+	return err
+}
+
+// Resume deliveries to a disabled webhook, its failures start over
+// Deliveries still pending are sent, events published while it was disabled were never queued
+func EnableWebhook(ctx context.Context, hook string, id string) error {
+	_, err := enableWebhookQuery.Exec(ctx, hook, id)
+	return err
+}
+
+var (
+	insertWebhookQuery,
+	deleteWebhookQuery,
+	selectWebhookQuery,
+	selectGroupWebhooksQuery,
+	insertWebhookDeliveryQuery,
+	selectDueWebhookDeliveriesQuery,
+	leaseDeliveryQuery,
+	selectWebhookDeliveriesQuery,
+	updateDeliveryDeliveredQuery,
+	updateDeliveryFailedQuery,
+	resetWebhookFailuresQuery,
+	incrementWebhookFailuresQuery,
+	selectWebhookFailuresQuery,
+	disableWebhookQuery,
+	enableWebhookQuery *stmt
+)
+
+// Setup webhook prepared statements
+func setupWebhookStates() error {
+	var err error
+
+	insertWebhookQuery, err = prepare("insert_webhook", "insert into webhook(id, group_id, url, secret, events) values (?, ?, ?, ?, ?)")
+	if err != nil {
+		return err
+	}
+
+	deleteWebhookQuery, err = prepare("delete_webhook", "delete from webhook where id=? and group_id=?")
+	if err != nil {
+		return err
+	}
+
+	selectWebhookQuery, err = prepare("select_webhook", "select id, group_id, url, secret, events, active, failures, created_at from webhook where id=? and group_id=?")
+	if err != nil {
+		return err
+	}
+
+	selectGroupWebhooksQuery, err = prepare("select_group_webhooks", "select id, group_id, url, secret, events, active, failures, created_at from webhook where group_id=? order by created_at")
+	if err != nil {
+		return err
+	}
+
+	insertWebhookDeliveryQuery, err = prepare("insert_webhook_delivery", "insert into webhook_delivery(webhook_id, event, payload) values (?, ?, ?)")
+	if err != nil {
+		return err
+	}
+
+	selectDueWebhookDeliveriesQuery, err = prepare("select_due_webhook_deliveries", "select d.id, d.webhook_id, d.event, d.payload, d.attempts, w.url, w.secret from webhook_delivery d join webhook w on w.id=d.webhook_id where d.status='pending' and d.next_attempt<=now() and w.active=1 order by d.id limit ? for update skip locked")
+	if err != nil {
+		return err
+	}
+
+	leaseDeliveryQuery, err = prepare("lease_delivery", "update webhook_delivery set next_attempt=date_add(now(), interval ? second) where id=?")
+	if err != nil {
+		return err
+	}
+
+	selectWebhookDeliveriesQuery, err = prepare("select_webhook_deliveries", "select id, webhook_id, event, payload, status, attempts, next_attempt, status_code, error, created_at, delivered_at from webhook_delivery where webhook_id=? order by id desc limit ?")
+	if err != nil {
+		return err
+	}
+
+	updateDeliveryDeliveredQuery, err = prepare("update_delivery_delivered", "update webhook_delivery set status='delivered', attempts=attempts+1, status_code=?, error=null, delivered_at=now() where id=?")
+	if err != nil {
+		return err
+	}
+
+	updateDeliveryFailedQuery, err = prepare("update_delivery_failed", "update webhook_delivery set status=?, attempts=attempts+1, status_code=?, error=?, next_attempt=date_add(now(), interval ? second) where id=?")
+	if err != nil {
+		return err
+	}
+
+	resetWebhookFailuresQuery, err = prepare("reset_webhook_failures", "update webhook set failures=0 where id=?")
+	if err != nil {
+		return err
+	}
+
+	incrementWebhookFailuresQuery, err = prepare("increment_webhook_failures", "update webhook set failures=failures+1 where id=?")
+	if err != nil {
+		return err
+	}
+
+	selectWebhookFailuresQuery, err = prepare("select_webhook_failures", "select failures from webhook where id=?")
+	if err != nil {
+		return err
+	}
+
+	disableWebhookQuery, err = prepare("disable_webhook", "update webhook set active=0 where id=?")
+	if err != nil {
+		return err
+	}
+
+	enableWebhookQuery, err = prepare("enable_webhook", "update webhook set active=1, failures=0 where id=? and group_id=?")
+	if err != nil {
+		return err
+	}
+
+	return err
+}
@@ -0,0 +1,293 @@
+// Typed server configuration
+// Each setting comes from, highest precedence first: a command line flag
+// (--db.address), its environment variable (DB_ADDRESS), the YAML file given by
+// --config or CONFIG_FILE, then the default below
+// A secret can be read from a file instead: --db.pass_file, DB_PASS_FILE or db.pass_file
+// Must call config.Init() before any other package's Init()
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"time"
+)
+
+// Shown by --print-config in place of a secret
+const REDACTED = "[REDACTED]"
+
+// Exit status of a rejected configuration
+const EXIT_INVALID = 2
+
+type Config struct {
+	Server    Server    `yaml:"server"`
+	DB        DB        `yaml:"db"`
+	Log       Log       `yaml:"log"`
+	Auth      Auth      `yaml:"auth"`
+	RateLimit RateLimit `yaml:"rate_limit"`
+	Mail      Mail      `yaml:"mail"`
+	Push      Push      `yaml:"push"`
+	Tracing   Tracing   `yaml:"tracing"`
+}
+
+type Server struct {
+	Port            int           `yaml:"port" env:"PORT" usage:"REST and GraphQL port"`
+	GRPCAddr        string        `yaml:"grpc_addr" env:"GRPC_ADDR" usage:"gRPC listen address, off to disable, plaintext so keep it off public interfaces"`
+	AdminAddr       string        `yaml:"admin_addr" env:"ADMIN_ADDR" usage:"/livez and /readyz listen address, off to disable"`
+	AdminAPI        string        `yaml:"admin_api" env:"ADMIN_API" usage:"where /api/admin is served: public, admin (the admin listener) or off"`
+	DrainDelay      time.Duration `yaml:"drain_delay" env:"DRAIN_DELAY" usage:"time readiness fails before listeners stop"`
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout" env:"SHUTDOWN_TIMEOUT" usage:"time running requests and workers get to finish"`
+}
+
+type DB struct {
+	User     string `yaml:"user" env:"DB_USER" usage:"database user"`
+	Pass     string `yaml:"pass" env:"DB_PASS" secret:"true" usage:"database password"`
+	Protocol string `yaml:"protocol" env:"DB_PROTOCOL" usage:"tcp or unix"`
+	Address  string `yaml:"address" env:"DB_ADDRESS" usage:"host:port or socket path"`
+	Name     string `yaml:"name" env:"DB_NAME" usage:"database name"`
+	Migrate  bool   `yaml:"migrate" env:"DB_MIGRATE" usage:"apply pending schema migrations on startup"`
+}
+
+type Log struct {
+	Level  string `yaml:"level" env:"LOG_LEVEL" usage:"debug, info, warn or error"`
+	Format string `yaml:"format" env:"LOG_FORMAT" usage:"json or text"`
+}
+
+type Auth struct {
+	TokenLifetime time.Duration `yaml:"token_lifetime" env:"TOKEN_LIFETIME" usage:"how long a session token is valid"`
+	CleanPeriod   time.Duration `yaml:"clean_period" env:"TOKEN_CLEAN_PERIOD" usage:"how often expired tokens are removed"`
+	HeaderTokens  bool          `yaml:"header_tokens" env:"HEADER_TOKENS" usage:"accept the deprecated Token and Username headers"`
+	HeaderBodies  bool          `yaml:"header_bodies" env:"HEADER_BODIES" usage:"accept the deprecated header request bodies"`
+}
+
+type RateLimit struct {
+	Window      time.Duration `yaml:"window" env:"RATE_LIMIT_WINDOW" usage:"period requests are counted over, and the block time"`
+	MaxRequests int           `yaml:"max_requests" env:"RATE_LIMIT_MAX_REQUESTS" usage:"requests per window before an IP is limited"`
+	CleanPeriod time.Duration `yaml:"clean_period" env:"RATE_LIMIT_CLEAN_PERIOD" usage:"how often expired visitors are removed"`
+}
+
+type Mail struct {
+	Provider string `yaml:"provider" env:"MAIL_PROVIDER" usage:"file or smtp"`
+	From     string `yaml:"from" env:"MAIL_FROM" usage:"sender address"`
+	Dir      string `yaml:"dir" env:"MAIL_DIR" usage:"directory of the file provider"`
+	SMTP     SMTP   `yaml:"smtp"`
+}
+
+type SMTP struct {
+	Host string `yaml:"host" env:"SMTP_HOST"`
+	Port string `yaml:"port" env:"SMTP_PORT"`
+	User string `yaml:"user" env:"SMTP_USER"`
+	Pass string `yaml:"pass" env:"SMTP_PASS" secret:"true"`
+}
+
+type Push struct {
+	Provider string `yaml:"provider" env:"PUSH_PROVIDER" usage:"log, file or live"`
+	File     string `yaml:"file" env:"PUSH_FILE" usage:"output of the file provider"`
+	APNs     APNs   `yaml:"apns"`
+	FCM      FCM    `yaml:"fcm"`
+}
+
+type APNs struct {
+	KeyFile string `yaml:"key_file" env:"APNS_KEY_FILE" usage:"PKCS8 signing key, enables APNs on the live provider"`
+	KeyID   string `yaml:"key_id" env:"APNS_KEY_ID"`
+	TeamID  string `yaml:"team_id" env:"APNS_TEAM_ID"`
+	Topic   string `yaml:"topic" env:"APNS_TOPIC"`
+	Sandbox bool   `yaml:"sandbox" env:"APNS_SANDBOX"`
+}
+
+// The access token is read on every send so it can be refreshed outside the server,
+// from FCM_ACCESS_TOKEN or, when set, AccessTokenFile
+type FCM struct {
+	Project         string `yaml:"project" env:"FCM_PROJECT" usage:"enables FCM on the live provider"`
+	AccessTokenFile string `yaml:"access_token_file" env:"FCM_ACCESS_TOKEN_FILE" usage:"file holding the current OAuth2 access token"`
+}
+
+type Tracing struct {
+	Exporter string `yaml:"exporter" env:"OTEL_TRACES_EXPORTER" usage:"none, otlp or console"`
+}
+
+// Settings used when nothing else sets them
+func Default() *Config {
+	return &Config{
+		Server: Server{
+			Port:            8080,
+			GRPCAddr:        "127.0.0.1:9090",
+			AdminAddr:       "127.0.0.1:8081",
+			AdminAPI:        "public",
+			DrainDelay:      5 * time.Second,
+			ShutdownTimeout: 20 * time.Second,
+		},
+		DB: DB{
+			Protocol: "tcp",
+			Address:  "127.0.0.1:3306",
+			Migrate:  true,
+		},
+		Log: Log{
+			Level:  "info",
+			Format: "json",
+		},
+		Auth: Auth{
+			TokenLifetime: 6 * time.Hour,
+			CleanPeriod:   10 * time.Minute,
+			HeaderTokens:  true,
+			HeaderBodies:  true,
+		},
+		RateLimit: RateLimit{
+			Window:      10 * time.Second,
+			MaxRequests: 5,
+			CleanPeriod: time.Minute,
+		},
+		Mail: Mail{
+			Provider: "file",
+			From:     "noreply@localhost",
+			Dir:      "mail",
+		},
+		Push: Push{
+			Provider: "log",
+			File:     "notifications.jsonl",
+		},
+		Tracing: Tracing{
+			Exporter: "none",
+		},
+	}
+}
+
+var current *Config
+
+// The loaded configuration, Init() must have run
+func Get() *Config {
+	return current
+}
+
+// Use c without loading anything, for tests
+func Set(c *Config) {
+	current = c
+}
+
+// Listen address of the REST router
+func (s *Server) Addr() string {
+	return fmt.Sprintf(":%d", s.Port)
+}
+
+// Every problem with c, nil when it can be used
+func (c *Config) Validate() error {
+	var errs []error
+	check := func(ok bool, key string, problem string) {
+		if !ok {
+			errs = append(errs, errors.New(key+": "+problem))
+		}
+	}
+	oneOf := func(v string, key string, values ...string) {
+		for _, value := range values {
+			if v == value {
+				return
+			}
+		}
+		check(false, key, fmt.Sprintf("%q is not one of %v", v, values))
+	}
+	listen := func(addr string, key string) {
+		if addr == "off" {
+			return
+		}
+		_, _, err := net.SplitHostPort(addr)
+		check(err == nil, key, fmt.Sprintf("%q is not host:port or off", addr))
+	}
+
+	check(c.Server.Port > 0 && c.Server.Port < 65536, "server.port", "must be between 1 and 65535")
+	listen(c.Server.GRPCAddr, "server.grpc_addr")
+	listen(c.Server.AdminAddr, "server.admin_addr")
+	oneOf(c.Server.AdminAPI, "server.admin_api", "public", "admin", "off")
+	check(c.Server.AdminAPI != "admin" || c.Server.AdminAddr != "off", "server.admin_api", "admin needs server.admin_addr")
+	check(c.Server.DrainDelay >= 0, "server.drain_delay", "must not be negative")
+	check(c.Server.ShutdownTimeout > 0, "server.shutdown_timeout", "must be positive")
+
+	check(c.DB.User != "", "db.user", "is required")
+	check(c.DB.Name != "", "db.name", "is required")
+	check(c.DB.Address != "", "db.address", "is required")
+	oneOf(c.DB.Protocol, "db.protocol", "tcp", "unix")
+
+	oneOf(c.Log.Level, "log.level", "debug", "info", "warn", "error")
+	oneOf(c.Log.Format, "log.format", "json", "text")
+
+	check(c.Auth.TokenLifetime > 0, "auth.token_lifetime", "must be positive")
+	check(c.Auth.CleanPeriod > 0, "auth.clean_period", "must be positive")
+
+	check(c.RateLimit.Window >= time.Second, "rate_limit.window", "must be at least 1s")
+	check(c.RateLimit.MaxRequests > 0, "rate_limit.max_requests", "must be positive")
+	check(c.RateLimit.CleanPeriod > 0, "rate_limit.clean_period", "must be positive")
+
+	oneOf(c.Mail.Provider, "mail.provider", "file", "smtp")
+	check(c.Mail.From != "", "mail.from", "is required")
+	if c.Mail.Provider == "smtp" {
+		check(c.Mail.SMTP.Host != "", "mail.smtp.host", "is required by the smtp provider")
+		check(c.Mail.SMTP.Port != "", "mail.smtp.port", "is required by the smtp provider")
+	}
+
+	oneOf(c.Push.Provider, "push.provider", "log", "file", "live")
+	if c.Push.Provider == "live" {
+		check(c.Push.APNs.KeyFile != "" || c.Push.FCM.Project != "", "push.provider",
+			"live needs push.apns.key_file or push.fcm.project")
+	}
+	if c.Push.APNs.KeyFile != "" {
+		check(c.Push.APNs.KeyID != "", "push.apns.key_id", "is required with push.apns.key_file")
+		check(c.Push.APNs.TeamID != "", "push.apns.team_id", "is required with push.apns.key_file")
+		check(c.Push.APNs.Topic != "", "push.apns.topic", "is required with push.apns.key_file")
+	}
+
+	oneOf(c.Tracing.Exporter, "tracing.exporter", "none", "otlp", "console")
+
+	return errors.Join(errs...)
+}
+
+// Load the configuration from os.Args and the environment
+// A bad configuration is reported on stderr before logging is set up, and exits
+// --print-config prints the result with secrets redacted, and exits
+func Init() {
+	if args := InitCommand(Default()); len(args) > 0 {
+		invalid(fmt.Errorf("unexpected argument %q", args[0]))
+	}
+}
+
+// Init() for commands like purestctl, c holds the command's defaults
+// Returns the arguments after the flags, the subcommand and its arguments
+func InitCommand(c *Config) []string {
+	opts, err := Load(c, os.Args[0], os.Args[1:], os.LookupEnv)
+	if err == flag.ErrHelp {
+		os.Exit(0)
+	}
+	if err != nil {
+		invalid(err)
+	}
+
+	if opts.Print {
+		out, err := c.Redacted()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		os.Stdout.Write(out)
+		os.Exit(0)
+	}
+
+	current = c
+	return opts.Args
+}
+
+// Report a bad configuration and exit
+func invalid(err error) {
+	fmt.Fprintln(os.Stderr, "invalid configuration:")
+	for _, e := range unwrap(err) {
+		fmt.Fprintln(os.Stderr, "  "+e.Error())
+	}
+	os.Exit(EXIT_INVALID)
+}
+
+// Errors joined by Validate or Load, one per line
+func unwrap(err error) []error {
+	if joined, ok := err.(interface{ Unwrap() []error }); ok {
+		return joined.Unwrap()
+	}
+	return []error{err}
+}
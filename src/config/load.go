@@ -0,0 +1,289 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Suffix of the key, variable or flag reading a secret from a file
+const FILE_SUFFIX = "_file"
+
+// A leaf setting of Config
+type field struct {
+	key    string // dotted yaml path, also the flag name
+	env    string
+	secret bool
+	usage  string
+	value  reflect.Value
+}
+
+// Every leaf setting of c, in declaration order
+func fields(c *Config) []field {
+	var out []field
+	var walk func(v reflect.Value, prefix string)
+	walk = func(v reflect.Value, prefix string) {
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			sf := t.Field(i)
+			key := prefix + sf.Tag.Get("yaml")
+			if sf.Type.Kind() == reflect.Struct && sf.Type != reflect.TypeOf(time.Duration(0)) {
+				walk(v.Field(i), key+".")
+				continue
+			}
+			out = append(out, field{
+				key:    key,
+				env:    sf.Tag.Get("env"),
+				secret: sf.Tag.Get("secret") == "true",
+				usage:  sf.Tag.Get("usage"),
+				value:  v.Field(i),
+			})
+		}
+	}
+	walk(reflect.ValueOf(c).Elem(), "")
+	return out
+}
+
+// Values of one layer by key, secrets read from files end in FILE_SUFFIX
+type layer struct {
+	name   string
+	values map[string]string
+}
+
+// Parse s into the setting
+func (f *field) set(s string) error {
+	v := f.value
+	switch {
+	case v.Type() == reflect.TypeOf(time.Duration(0)):
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return fmt.Errorf("%q is not a duration like 30s or 6h", s)
+		}
+		v.SetInt(int64(d))
+	case v.Kind() == reflect.String:
+		v.SetString(s)
+	case v.Kind() == reflect.Int:
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return fmt.Errorf("%q is not a whole number", s)
+		}
+		v.SetInt(int64(n))
+	case v.Kind() == reflect.Bool:
+		switch strings.ToLower(s) {
+		case "true", "on", "yes", "1":
+			v.SetBool(true)
+		case "false", "off", "no", "0":
+			v.SetBool(false)
+		default:
+			return fmt.Errorf("%q is not on or off", s)
+		}
+	}
+	return nil
+}
+
+// Apply a layer over c, the value or file of every key it sets
+func (l *layer) apply(fs []field) []error {
+	var errs []error
+	for i := range fs {
+		f := &fs[i]
+		value, ok := l.values[f.key]
+		path, fromFile := "", false
+		if f.secret {
+			path, fromFile = l.values[f.key+FILE_SUFFIX]
+		}
+
+		if ok && fromFile {
+			errs = append(errs, fmt.Errorf("%s: set by both %s and %s in %s", f.key, f.key, f.key+FILE_SUFFIX, l.name))
+			continue
+		}
+		if fromFile {
+			data, err := os.ReadFile(path)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", f.key+FILE_SUFFIX, err))
+				continue
+			}
+			value, ok = strings.TrimRight(string(data), "\r\n"), true
+		}
+		if !ok {
+			continue
+		}
+
+		if err := f.set(value); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %s in %s", f.key, err, l.name))
+		}
+	}
+	return errs
+}
+
+// Every key of the YAML file, flattened to dotted paths
+func fileLayer(path string, fs []field) (*layer, []error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, []error{err}
+	}
+
+	var doc map[string]interface{}
+	if err = yaml.Unmarshal(data, &doc); err != nil {
+		return nil, []error{fmt.Errorf("%s: %w", path, err)}
+	}
+
+	known := make(map[string]bool)
+	for _, f := range fs {
+		known[f.key] = true
+		if f.secret {
+			known[f.key+FILE_SUFFIX] = true
+		}
+	}
+
+	l := &layer{name: path, values: make(map[string]string)}
+	var errs []error
+	var flatten func(m map[string]interface{}, prefix string)
+	flatten = func(m map[string]interface{}, prefix string) {
+		for k, v := range m {
+			key := prefix + k
+			if nested, ok := v.(map[string]interface{}); ok {
+				flatten(nested, key+".")
+				continue
+			}
+			if !known[key] {
+				errs = append(errs, fmt.Errorf("%s: unknown setting in %s", key, path))
+				continue
+			}
+			switch v.(type) {
+			case string, int, bool, float64:
+				l.values[key] = fmt.Sprint(v)
+			case nil:
+			default:
+				errs = append(errs, fmt.Errorf("%s: must be a single value in %s", key, path))
+			}
+		}
+	}
+	flatten(doc, "")
+	return l, errs
+}
+
+// Every setting with a variable set in the environment
+func envLayer(fs []field, lookup func(string) (string, bool)) *layer {
+	l := &layer{name: "the environment", values: make(map[string]string)}
+	for _, f := range fs {
+		if v, ok := lookup(f.env); ok {
+			l.values[f.key] = v
+		}
+		if f.secret {
+			if v, ok := lookup(f.env + strings.ToUpper(FILE_SUFFIX)); ok {
+				l.values[f.key+FILE_SUFFIX] = v
+			}
+		}
+	}
+	return l
+}
+
+// What Load read besides the settings
+type Options struct {
+	Print bool     // --print-config was given
+	Args  []string // arguments after the flags
+}
+
+// Load the file, the environment and the flags of args over the defaults in c
+func Load(c *Config, name string, args []string, lookup func(string) (string, bool)) (*Options, error) {
+	var opts Options
+	fs := fields(c)
+
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	file := flags.String("config", "", "YAML config file, or CONFIG_FILE")
+	flags.BoolVar(&opts.Print, "print-config", false, "print the configuration with secrets redacted and exit")
+	for _, f := range fs {
+		usage := f.usage
+		if f.env != "" {
+			usage = strings.TrimSpace(usage + " (" + f.env + ")")
+		}
+		flags.String(f.key, "", usage)
+		if f.secret {
+			flags.String(f.key+FILE_SUFFIX, "", "file holding "+f.key)
+		}
+	}
+	if err := flags.Parse(args); err != nil {
+		return nil, err
+	}
+	opts.Args = flags.Args()
+	cli := &layer{name: "the flags", values: make(map[string]string)}
+	flags.Visit(func(fl *flag.Flag) {
+		if fl.Name != "config" && fl.Name != "print-config" {
+			cli.values[fl.Name] = fl.Value.String()
+		}
+	})
+
+	var errs []error
+	if *file == "" {
+		*file, _ = lookup("CONFIG_FILE")
+	}
+	if *file != "" {
+		l, ferrs := fileLayer(*file, fs)
+		errs = append(errs, ferrs...)
+		if l != nil {
+			errs = append(errs, l.apply(fs)...)
+		}
+	}
+	errs = append(errs, envLayer(fs, lookup).apply(fs)...)
+	errs = append(errs, cli.apply(fs)...)
+
+	// A value that didn't parse kept its default, so this won't repeat it
+	if err := c.Validate(); err != nil {
+		errs = append(errs, unwrap(err)...)
+	}
+	if len(errs) > 0 {
+		return &opts, errors.Join(errs...)
+	}
+	return &opts, nil
+}
+
+// c as YAML, every non-empty secret replaced by REDACTED
+func (c *Config) Redacted() ([]byte, error) {
+	root := &yaml.Node{Kind: yaml.MappingNode}
+	sections := make(map[string]*yaml.Node)
+
+	for _, f := range fields(c) {
+		parent := root
+		parts := strings.Split(f.key, ".")
+		for i := range parts[:len(parts)-1] {
+			path := strings.Join(parts[:i+1], ".")
+			node, ok := sections[path]
+			if !ok {
+				node = &yaml.Node{Kind: yaml.MappingNode}
+				sections[path] = node
+				parent.Content = append(parent.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: parts[i]}, node)
+			}
+			parent = node
+		}
+
+		value := &yaml.Node{Kind: yaml.ScalarNode}
+		switch v := f.value.Interface().(type) {
+		case time.Duration:
+			value.Value = v.String()
+		default:
+			value.Value = fmt.Sprint(v)
+		}
+		if f.secret && value.Value != "" {
+			value.Value = REDACTED
+		}
+		if f.value.Kind() == reflect.String {
+			value.Style = yaml.DoubleQuotedStyle
+		}
+		parent.Content = append(parent.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: parts[len(parts)-1]}, value)
+	}
+
+	var out bytes.Buffer
+	enc := yaml.NewEncoder(&out)
+	enc.SetIndent(2)
+	if err := enc.Encode(root); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), enc.Close()
+}
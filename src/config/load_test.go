@@ -0,0 +1,163 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Write content to name in a temporary directory, returning its path
+func writeFile(t *testing.T, name string, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// Environment lookup over env, the required settings included
+func environment(env map[string]string) func(string) (string, bool) {
+	return func(key string) (string, bool) {
+		if v, ok := env[key]; ok {
+			return v, true
+		}
+		switch key {
+		case "DB_USER":
+			return "pushup", true
+		case "DB_NAME":
+			return "pushupapp", true
+		}
+		return "", false
+	}
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	file := writeFile(t, "config.yaml", "log:\n  level: warn\nserver:\n  port: 8000\n")
+
+	tests := []struct {
+		name  string
+		args  []string
+		env   map[string]string
+		level string
+		port  int
+	}{
+		{"default", nil, nil, "info", 8080},
+		{"file", []string{"--config", file}, nil, "warn", 8000},
+		{"CONFIG_FILE", nil, map[string]string{"CONFIG_FILE": file}, "warn", 8000},
+		{"environment over file", []string{"--config", file}, map[string]string{"LOG_LEVEL": "error"}, "error", 8000},
+		{"flag over environment", []string{"--config", file, "--log.level", "debug"}, map[string]string{"LOG_LEVEL": "error"}, "debug", 8000},
+		{"flag over file", []string{"--config", file, "--server.port=9000"}, nil, "warn", 9000},
+	}
+	for _, tt := range tests {
+		c := Default()
+		if _, err := Load(c, "test", tt.args, environment(tt.env)); err != nil {
+			t.Errorf("%s: Load: %v", tt.name, err)
+			continue
+		}
+		if c.Log.Level != tt.level || c.Server.Port != tt.port {
+			t.Errorf("%s: log.level %q, server.port %d, want %q, %d", tt.name, c.Log.Level, c.Server.Port, tt.level, tt.port)
+		}
+	}
+}
+
+func TestLoadSecretFile(t *testing.T) {
+	secret := writeFile(t, "pass", "hunter2\n")
+	other := writeFile(t, "other", "correct horse\r\n")
+
+	tests := []struct {
+		name string
+		file string
+		args []string
+		env  map[string]string
+		want string
+	}{
+		{"flag", "", []string{"--db.pass_file", secret}, nil, "hunter2"},
+		{"environment", "", nil, map[string]string{"DB_PASS_FILE": secret}, "hunter2"},
+		{"config file", "db:\n  pass_file: " + secret + "\n", nil, nil, "hunter2"},
+		{"crlf trimmed", "", nil, map[string]string{"DB_PASS_FILE": other}, "correct horse"},
+		{"value over file in a lower layer", "", []string{"--db.pass", "flag"}, map[string]string{"DB_PASS_FILE": secret}, "flag"},
+		{"file over value in a lower layer", "", []string{"--db.pass_file", secret}, map[string]string{"DB_PASS": "env"}, "hunter2"},
+	}
+	for _, tt := range tests {
+		args := tt.args
+		if tt.file != "" {
+			args = append([]string{"--config", writeFile(t, "config.yaml", tt.file)}, args...)
+		}
+
+		c := Default()
+		if _, err := Load(c, "test", args, environment(tt.env)); err != nil {
+			t.Errorf("%s: Load: %v", tt.name, err)
+			continue
+		}
+		if c.DB.Pass != tt.want {
+			t.Errorf("%s: db.pass %q, want %q", tt.name, c.DB.Pass, tt.want)
+		}
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	secret := writeFile(t, "pass", "hunter2")
+
+	tests := []struct {
+		name string
+		file string
+		args []string
+		env  map[string]string
+		want string
+	}{
+		{"value and file in one layer", "", nil, map[string]string{"DB_PASS": "x", "DB_PASS_FILE": secret}, "set by both db.pass and db.pass_file in the environment"},
+		{"missing secret file", "", []string{"--db.pass_file", "/nonexistent/pass"}, nil, "db.pass_file:"},
+		{"not a secret", "", []string{"--log.level_file", secret}, nil, "flag provided but not defined"},
+		{"unknown key", "db:\n  pasword: x\n", nil, nil, "db.pasword: unknown setting"},
+		{"not a single value", "log:\n  level: [debug]\n", nil, nil, "log.level: must be a single value"},
+		{"bad duration", "", nil, map[string]string{"TOKEN_LIFETIME": "6"}, `auth.token_lifetime: "6" is not a duration`},
+		{"bad number", "", []string{"--server.port", "http"}, nil, `server.port: "http" is not a whole number in the flags`},
+		{"bad bool", "", nil, map[string]string{"DB_MIGRATE": "maybe"}, `db.migrate: "maybe" is not on or off in the environment`},
+		{"invalid value", "", []string{"--log.level", "loud"}, nil, "log.level:"},
+		{"required", "", nil, map[string]string{"DB_USER": ""}, "db.user: is required"},
+	}
+	for _, tt := range tests {
+		args := tt.args
+		if tt.file != "" {
+			args = append([]string{"--config", writeFile(t, "config.yaml", tt.file)}, args...)
+		}
+
+		_, err := Load(Default(), "test", args, environment(tt.env))
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: Load = %v, want an error containing %q", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestLoadArgs(t *testing.T) {
+	opts, err := Load(Default(), "test", []string{"--print-config", "user", "show", "ann"}, environment(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !opts.Print || strings.Join(opts.Args, " ") != "user show ann" {
+		t.Errorf("options %+v, want print and the subcommand", opts)
+	}
+}
+
+func TestRedacted(t *testing.T) {
+	c := Default()
+	c.DB.Pass = "hunter2"
+	c.Auth.TokenLifetime = 90 * time.Minute
+
+	out, err := c.Redacted()
+	if err != nil {
+		t.Fatal(err)
+	}
+	yaml := string(out)
+	for _, want := range []string{`pass: "` + REDACTED + `"`, "token_lifetime: 1h30m0s", "port: 8080", `pass: ""`} {
+		if !strings.Contains(yaml, want) {
+			t.Errorf("missing %q in\n%s", want, yaml)
+		}
+	}
+	if strings.Contains(yaml, "hunter2") {
+		t.Errorf("secret printed in\n%s", yaml)
+	}
+}
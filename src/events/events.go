@@ -0,0 +1,154 @@
+// In-process pub/sub hub for group events
+// Handlers Publish() after a successful write, streams Subscribe() per group
+// Must call events.Init() to initialize the maps
+package events
+
+import (
+	"benschreiber.com/purestserver/src/logging"
+	"github.com/gin-gonic/gin"
+	"sync"
+)
+
+var logger = logging.For("events")
+
+// Event types sent to subscribers
+const (
+	COIN_PASSED     = "coin"
+	MEMBER_JOINED   = "join"
+	MEMBER_LEFT     = "leave" // the member left or deleted their account
+	MEMBER_KICKED   = "kick"
+	SETTINGS_CHANGE = "settings" // the creator handed the group to another member
+	GROUP_DISBANDED = "disband"
+	GROUP_CREATED   = "create"
+	BADGE_EARNED    = "badge"
+)
+
+// Event takes user out of its group: the group was disbanded,
+// or they were kicked, left or deleted their account
+// Streams end on it, the user can no longer see the group
+func Removes(e Event, user string) bool {
+	switch e.Type {
+	case GROUP_DISBANDED:
+		return true
+	case MEMBER_KICKED, MEMBER_LEFT:
+		data, ok := e.Data.(gin.H)
+		return ok && data["username"] == user
+	}
+	return false
+}
+
+// Buffered events per subscriber before events start being dropped
+const SUBSCRIBER_BUFFER = 16
+
+// A single group event
+// ID is only set for events that can be replayed (coin passes)
+type Event struct {
+	ID    string      `json:"id,omitempty"`
+	Type  string      `json:"type"`
+	Group string      `json:"group_id"`
+	Data  interface{} `json:"data"`
+}
+
+// Maps a group id to the set of subscriber channels
+// Sinks receive every event regardless of group
+// Field Mu for handling concurrency
+type Hub struct {
+	Subscribers map[string]map[chan Event]struct{}
+	Sinks       []func(Event)
+	Mu          *sync.Mutex
+	Closed      bool
+}
+
+var hub *Hub
+
+// Register a new subscriber for a group
+// Returns the event channel and a func to unsubscribe
+// The channel is closed when the hub is, streams end on a closed channel
+func Subscribe(group string) (<-chan Event, func()) {
+	hub.Mu.Lock()
+	defer hub.Mu.Unlock()
+
+	ch := make(chan Event, SUBSCRIBER_BUFFER)
+	if hub.Closed {
+		close(ch)
+		return ch, func() {}
+	}
+	if _, ok := hub.Subscribers[group]; !ok {
+		hub.Subscribers[group] = make(map[chan Event]struct{})
+	}
+	hub.Subscribers[group][ch] = struct{}{}
+
+	return ch, func() { unsubscribe(group, ch) }
+}
+
+// Remove a subscriber, drop the group entry when it is empty
+func unsubscribe(group string, ch chan Event) {
+	hub.Mu.Lock()
+	defer hub.Mu.Unlock()
+
+	subs, ok := hub.Subscribers[group]
+	if !ok {
+		return
+	}
+	if _, ok := subs[ch]; !ok {
+		return
+	}
+
+	delete(subs, ch)
+	close(ch)
+	if len(subs) == 0 {
+		delete(hub.Subscribers, group)
+	}
+}
+
+// Register a func to be called with every published event
+// Sinks run synchronously in Publish(), outside of the hub lock
+func AddSink(sink func(Event)) {
+	hub.Mu.Lock()
+	defer hub.Mu.Unlock()
+
+	hub.Sinks = append(hub.Sinks, sink)
+}
+
+// Send an event to every subscriber of its group, then to every sink
+// Never blocks on subscribers, a subscriber with a full buffer misses the event
+func Publish(e Event) {
+	hub.Mu.Lock()
+	for ch := range hub.Subscribers[e.Group] {
+		select {
+		case ch <- e:
+		default:
+			logger.Warn("dropping event for slow subscriber", "group", e.Group, "type", e.Type)
+		}
+	}
+	sinks := hub.Sinks
+	hub.Mu.Unlock()
+
+	for _, sink := range sinks {
+		sink(e)
+	}
+}
+
+// Close every subscriber channel, ending the SSE, websocket and gRPC streams
+// Sinks keep receiving events published after
+func Close() {
+	hub.Mu.Lock()
+	defer hub.Mu.Unlock()
+
+	for group, subs := range hub.Subscribers {
+		for ch := range subs {
+			close(ch)
+		}
+		delete(hub.Subscribers, group)
+	}
+	hub.Closed = true
+}
+
+// Initialize the subscriber map in memory
+func Init() {
+	logger.Info("Initializing event hub")
+	hub = &Hub{
+		Subscribers: make(map[string]map[chan Event]struct{}),
+		Mu:          &sync.Mutex{},
+	}
+}
@@ -0,0 +1,56 @@
+package events
+
+import (
+	"github.com/gin-gonic/gin"
+	"testing"
+)
+
+func TestRemoves(t *testing.T) {
+	tests := []struct {
+		name string
+		e    Event
+		want bool
+	}{
+		{"disband", Event{Type: GROUP_DISBANDED, Data: gin.H{"by": "bob"}}, true},
+		{"kicked", Event{Type: MEMBER_KICKED, Data: gin.H{"username": "alice", "by": "bob"}}, true},
+		{"someone else kicked", Event{Type: MEMBER_KICKED, Data: gin.H{"username": "carol", "by": "bob"}}, false},
+		{"left or deleted account", Event{Type: MEMBER_LEFT, Data: gin.H{"username": "alice"}}, true},
+		{"someone else left", Event{Type: MEMBER_LEFT, Data: gin.H{"username": "carol"}}, false},
+		{"join", Event{Type: MEMBER_JOINED, Data: gin.H{"username": "alice"}}, false},
+		{"settings", Event{Type: SETTINGS_CHANGE, Data: gin.H{"creator": "alice", "by": "bob"}}, false},
+		{"coin", Event{Type: COIN_PASSED}, false},
+		{"no data", Event{Type: MEMBER_KICKED}, false},
+	}
+	for _, tt := range tests {
+		if got := Removes(tt.e, "alice"); got != tt.want {
+			t.Errorf("%s: Removes = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestPublishSinksAndSubscribers(t *testing.T) {
+	Init()
+	var got []string
+	AddSink(func(e Event) { got = append(got, e.Type) })
+
+	ch, unsubscribe := Subscribe("g1")
+	Publish(Event{Type: COIN_PASSED, Group: "g1"})
+	Publish(Event{Type: COIN_PASSED, Group: "g2"})
+
+	if e := <-ch; e.Group != "g1" {
+		t.Errorf("subscriber got group %q, want g1", e.Group)
+	}
+	select {
+	case e := <-ch:
+		t.Errorf("subscriber got an event of another group: %+v", e)
+	default:
+	}
+	if len(got) != 2 {
+		t.Errorf("sink got %d events, want 2", len(got))
+	}
+
+	unsubscribe()
+	if _, ok := <-ch; ok {
+		t.Error("channel open after unsubscribe")
+	}
+}
@@ -0,0 +1,327 @@
+// WebSocket gateway for group presence, live coin handoff and reactions
+// Connections are authenticated by the caller before Serve() upgrades them
+// Group events are read from the events hub, presence is kept per room here
+// Must call gateway.Init() to initialize the maps
+package gateway
+
+import (
+	"benschreiber.com/purestserver/src/bsql"
+	"benschreiber.com/purestserver/src/events"
+	"benschreiber.com/purestserver/src/logging"
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"sort"
+	"sync"
+	"time"
+)
+
+var logger = logging.For("gateway")
+
+const (
+	WRITE_WAIT      = 10 * time.Second // max time to write a frame
+	PONG_WAIT       = 60 * time.Second // client must answer pings in this time
+	PING_PERIOD     = 50 * time.Second // must be below PONG_WAIT
+	MAX_MESSAGE     = 512              // max bytes of a client message
+	SEND_BUFFER     = 32               // queued messages before a client is dropped
+	REACTION_PERIOD = time.Second      // min time between reactions per connection
+)
+
+// Message types sent over the socket
+const (
+	WELCOME  = "welcome"
+	PRESENCE = "presence"
+	HANDOFF  = "handoff"
+	REACTION = "reaction"
+	ERROR    = "error"
+)
+
+// Reactions a client is allowed to send
+var reactions = map[string]bool{
+	"muscle": true,
+	"fire":   true,
+	"clap":   true,
+	"laugh":  true,
+	"sweat":  true,
+}
+
+// Frame written to and read from the socket
+type Message struct {
+	Type string      `json:"type"`
+	ID   string      `json:"id,omitempty"`
+	Data interface{} `json:"data,omitempty"`
+}
+
+// Frame read from the socket
+type inbound struct {
+	Type     string `json:"type"`
+	Reaction string `json:"reaction"`
+}
+
+// A single websocket connection of a user
+type conn struct {
+	ws       *websocket.Conn
+	user     string
+	group    string
+	send     chan Message
+	done     chan struct{}
+	once     sync.Once
+	lastReac time.Time
+}
+
+// Queue a message without blocking
+// A full buffer means the client is too slow, drop it
+func (c *conn) queue(m Message) {
+	select {
+	case c.send <- m:
+	case <-c.done:
+	default:
+		logger.Warn("dropping slow websocket client", "user", c.user, "group", c.group)
+		c.close()
+	}
+}
+
+// Signal both pumps to stop, safe to call more than once
+func (c *conn) close() {
+	c.once.Do(func() { close(c.done) })
+}
+
+// Every connection in a group
+type room struct {
+	conns map[*conn]struct{}
+}
+
+// Maps a group id to its room
+// Field Mu for handling concurrency
+type Rooms struct {
+	Groups map[string]*room
+	Mu     *sync.Mutex
+}
+
+var rooms *Rooms
+
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+}
+
+// Usernames online in a group, sorted and without duplicates
+// Caller must hold rooms.Mu
+func (r *room) online() []string {
+	seen := make(map[string]bool)
+	users := []string{}
+	for c := range r.conns {
+		if !seen[c.user] {
+			seen[c.user] = true
+			users = append(users, c.user)
+		}
+	}
+	sort.Strings(users)
+	return users
+}
+
+// Send a message to every connection in a group
+// Caller must hold rooms.Mu
+func (r *room) broadcast(m Message) {
+	for c := range r.conns {
+		c.queue(m)
+	}
+}
+
+// Add a connection to its room and announce presence
+func join(c *conn) {
+	rooms.Mu.Lock()
+	defer rooms.Mu.Unlock()
+
+	r, ok := rooms.Groups[c.group]
+	if !ok {
+		r = &room{conns: make(map[*conn]struct{})}
+		rooms.Groups[c.group] = r
+	}
+	r.conns[c] = struct{}{}
+	r.broadcast(Message{Type: PRESENCE, Data: gin.H{"online": r.online()}})
+}
+
+// Remove a connection from its room and announce presence
+func leave(c *conn) {
+	rooms.Mu.Lock()
+	defer rooms.Mu.Unlock()
+
+	r, ok := rooms.Groups[c.group]
+	if !ok {
+		return
+	}
+	delete(r.conns, c)
+	if len(r.conns) == 0 {
+		delete(rooms.Groups, c.group)
+		return
+	}
+	r.broadcast(Message{Type: PRESENCE, Data: gin.H{"online": r.online()}})
+}
+
+// Send a reaction from a connection to its whole room
+func react(c *conn, reaction string) {
+	rooms.Mu.Lock()
+	defer rooms.Mu.Unlock()
+
+	if r, ok := rooms.Groups[c.group]; ok {
+		r.broadcast(Message{Type: REACTION, Data: gin.H{"username": c.user, "reaction": reaction}})
+	}
+}
+
+// Upgrade an authenticated request to a websocket for user in group id
+// The caller must already have checked the token and group membership
+func Serve(ctx *gin.Context, user string, id string) {
+
+	// Snapshot sent first so a reconnecting client can resync
+	group, ok, err := bsql.GetGroup(ctx.Request.Context(), id)
+	if err != nil {
+		logging.From(ctx).Error("websocket snapshot failed", "err", err)
+		ctx.AbortWithStatus(500)
+		return
+	}
+	if !ok {
+		ctx.AbortWithStatus(404)
+		return
+	}
+
+	ws, err := upgrader.Upgrade(ctx.Writer, ctx.Request, nil)
+	if err != nil {
+		// Upgrader already wrote the error response
+		logging.From(ctx).Info("websocket upgrade failed", "err", err)
+		return
+	}
+
+	c := &conn{
+		ws:    ws,
+		user:  user,
+		group: id,
+		send:  make(chan Message, SEND_BUFFER),
+		done:  make(chan struct{}),
+	}
+
+	// Subscribe before the welcome so no coin pass falls in between
+	evs, unsubscribe := events.Subscribe(id)
+
+	c.queue(Message{Type: WELCOME, Data: gin.H{
+		"group":         group,
+		"you_have_coin": group.TokenHolder == user,
+	}})
+	join(c)
+
+	go c.writePump()
+	go c.forward(evs)
+	c.readPump()
+
+	// Read pump returned, tear everything down
+	c.close()
+	unsubscribe()
+	leave(c)
+}
+
+// Forward group events from the hub onto the socket
+func (c *conn) forward(evs <-chan events.Event) {
+	for {
+		select {
+		case e, ok := <-evs:
+			// Hub closed for shutdown
+			if !ok {
+				c.close()
+				return
+			}
+			c.queue(Message{Type: e.Type, ID: e.ID, Data: e.Data})
+
+			if pass, ok := e.Data.(*bsql.CoinPass); ok && e.Type == events.COIN_PASSED && pass.To == c.user {
+				c.queue(Message{Type: HANDOFF, ID: e.ID, Data: pass})
+			}
+			if events.Removes(e, c.user) {
+				c.close()
+				return
+			}
+
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// Read client frames until the socket closes or a pong is missed
+func (c *conn) readPump() {
+	c.ws.SetReadLimit(MAX_MESSAGE)
+	c.ws.SetReadDeadline(time.Now().Add(PONG_WAIT))
+	c.ws.SetPongHandler(func(string) error {
+		return c.ws.SetReadDeadline(time.Now().Add(PONG_WAIT))
+	})
+
+	for {
+		_, data, err := c.ws.ReadMessage()
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseNormalClosure) {
+				logger.Info("websocket closed", "user", c.user, "group", c.group, "err", err)
+			}
+			return
+		}
+
+		var in inbound
+		if err = json.Unmarshal(data, &in); err != nil || in.Type != REACTION {
+			c.queue(Message{Type: ERROR, Data: "unknown message"})
+			continue
+		}
+
+		if !reactions[in.Reaction] {
+			c.queue(Message{Type: ERROR, Data: "unknown reaction"})
+			continue
+		}
+
+		// Lightweight throttle, reactions are not worth a 429
+		if time.Since(c.lastReac) < REACTION_PERIOD {
+			continue
+		}
+		c.lastReac = time.Now()
+
+		react(c, in.Reaction)
+	}
+}
+
+// Write queued messages and heartbeat pings
+// Owns all writes to the socket and closes it on exit
+func (c *conn) writePump() {
+	ticker := time.NewTicker(PING_PERIOD)
+	defer func() {
+		ticker.Stop()
+		c.ws.Close()
+	}()
+
+	for {
+		select {
+		case m := <-c.send:
+			c.ws.SetWriteDeadline(time.Now().Add(WRITE_WAIT))
+			if err := c.ws.WriteJSON(m); err != nil {
+				c.close()
+				return
+			}
+
+		case <-ticker.C:
+			c.ws.SetWriteDeadline(time.Now().Add(WRITE_WAIT))
+			if err := c.ws.WriteMessage(websocket.PingMessage, nil); err != nil {
+				c.close()
+				return
+			}
+
+		case <-c.done:
+			c.ws.SetWriteDeadline(time.Now().Add(WRITE_WAIT))
+			c.ws.WriteMessage(websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+			return
+		}
+	}
+}
+
+// Initialize the room map in memory
+func Init() {
+	logger.Info("Initializing websocket rooms")
+	rooms = &Rooms{
+		Groups: make(map[string]*room),
+		Mu:     &sync.Mutex{},
+	}
+}
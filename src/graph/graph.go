@@ -0,0 +1,88 @@
+// GraphQL API over users, groups, members, coin passes and stats
+// Lets a client load everything it shows in one request instead of one per group,
+// fields are batched onto bsql per request with dataloaders
+// Must call graph.Init() to parse the schema
+package graph
+
+import (
+	"benschreiber.com/purestserver/src/logging"
+	"context"
+	_ "embed"
+	"fmt"
+	"github.com/graph-gophers/graphql-go"
+	gqlerrors "github.com/graph-gophers/graphql-go/errors"
+)
+
+var logger = logging.For("graph")
+
+//go:embed schema.graphql
+var schemaText string
+
+var schema *graphql.Schema
+
+// A query, from a POST body or a websocket subscribe message
+type Request struct {
+	Query         string                 `json:"query" binding:"required"`
+	OperationName string                 `json:"operationName"`
+	Variables     map[string]interface{} `json:"variables"`
+}
+
+// Context key for the authenticated username
+type userKey struct{}
+
+func user(ctx context.Context) string {
+	u, _ := ctx.Value(userKey{}).(string)
+	return u
+}
+
+// Context for running req as user
+func requestContext(ctx context.Context, u string) context.Context {
+	return withLoaders(context.WithValue(ctx, userKey{}, u))
+}
+
+// Reject a query over the complexity limit before it runs
+func check(req *Request) error {
+	if len(req.Query) > MAX_QUERY_LENGTH {
+		return fmt.Errorf("query is longer than %d bytes", MAX_QUERY_LENGTH)
+	}
+
+	cost, err := complexity(req.Query, req.OperationName, req.Variables)
+	if err != nil {
+		// Parse errors are reported by the executor with locations
+		return nil
+	}
+	if cost > MAX_COMPLEXITY {
+		return fmt.Errorf("%w: cost %d is over %d", ErrTooComplex, cost, MAX_COMPLEXITY)
+	}
+	return nil
+}
+
+// Run a query for user
+func Exec(ctx context.Context, u string, req *Request) *graphql.Response {
+	if err := check(req); err != nil {
+		return errorResponse(err)
+	}
+	return schema.Exec(requestContext(ctx, u), req.Query, req.OperationName, req.Variables)
+}
+
+// Run a subscription, or a query, for user, every value on the channel is a *graphql.Response
+// The channel closes when the subscription ends or ctx is cancelled
+func Subscribe(ctx context.Context, u string, req *Request) (<-chan interface{}, error) {
+	if err := check(req); err != nil {
+		return nil, err
+	}
+	return schema.Subscribe(requestContext(ctx, u), req.Query, req.OperationName, req.Variables)
+}
+
+func errorResponse(err error) *graphql.Response {
+	return &graphql.Response{Errors: []*gqlerrors.QueryError{{Message: err.Error()}}}
+}
+
+// Parse the schema and check it against the resolvers
+func Init() {
+	logger.Info("Initializing GraphQL schema")
+	schema = graphql.MustParseSchema(schemaText, &resolver{},
+		graphql.MaxDepth(MAX_DEPTH),
+		graphql.MaxQueryLength(MAX_QUERY_LENGTH),
+	)
+}
@@ -0,0 +1,127 @@
+package graph
+
+import (
+	"errors"
+	"github.com/vektah/gqlparser/v2/ast"
+	"github.com/vektah/gqlparser/v2/parser"
+	"strconv"
+)
+
+// Query limits, checked before anything is resolved
+const (
+	MAX_DEPTH        = 8    // nested selections
+	MAX_COMPLEXITY   = 5000 // estimated fields resolved
+	MAX_QUERY_LENGTH = 8192 // bytes of query text
+)
+
+// Expected list sizes, a list field costs its size times its selection
+// history is priced by its first argument instead
+var listSizes = map[string]int{
+	"groups":  5,
+	"members": 50,
+}
+
+// Default of the history first argument in schema.graphql
+const DEFAULT_HISTORY = 20
+
+var ErrTooComplex = errors.New("query is too complex")
+
+// Estimated cost of running an operation
+// Every field costs 1 plus its selection, multiplied for lists
+func complexity(query string, operationName string, variables map[string]interface{}) (int, error) {
+	doc, err := parser.ParseQuery(&ast.Source{Input: query})
+	if err != nil {
+		return 0, err
+	}
+
+	var op *ast.OperationDefinition
+	if operationName == "" && len(doc.Operations) == 1 {
+		op = doc.Operations[0]
+	} else {
+		op = doc.Operations.ForName(operationName)
+	}
+	if op == nil {
+		// Left for the executor to report
+		return 0, nil
+	}
+
+	c := &coster{doc: doc, op: op, variables: variables, seen: make(map[string]bool)}
+	return c.selection(op.SelectionSet), nil
+}
+
+type coster struct {
+	doc       *ast.QueryDocument
+	op        *ast.OperationDefinition
+	variables map[string]interface{}
+	seen      map[string]bool // fragments on the current path, stops cycles
+}
+
+func (c *coster) selection(set ast.SelectionSet) int {
+	cost := 0
+	for _, s := range set {
+		switch s := s.(type) {
+		case *ast.Field:
+			cost += c.field(s)
+		case *ast.InlineFragment:
+			cost += c.selection(s.SelectionSet)
+		case *ast.FragmentSpread:
+			frag := c.doc.Fragments.ForName(s.Name)
+			if frag == nil || c.seen[s.Name] {
+				continue
+			}
+			c.seen[s.Name] = true
+			cost += c.selection(frag.SelectionSet)
+			delete(c.seen, s.Name)
+		}
+	}
+	return cost
+}
+
+func (c *coster) field(f *ast.Field) int {
+	if len(f.SelectionSet) == 0 {
+		return 1
+	}
+
+	size := 1
+	if n, ok := listSizes[f.Name]; ok {
+		size = n
+	}
+	if f.Name == "history" {
+		size = clampFirst(c.first(f))
+	}
+	return 1 + size*c.selection(f.SelectionSet)
+}
+
+// The first argument of a history field, a literal or a variable
+func (c *coster) first(f *ast.Field) int {
+	arg := f.Arguments.ForName("first")
+	if arg == nil || arg.Value == nil {
+		return DEFAULT_HISTORY
+	}
+
+	switch arg.Value.Kind {
+	case ast.IntValue:
+		n, err := strconv.Atoi(arg.Value.Raw)
+		if err != nil {
+			return MAX_HISTORY
+		}
+		return n
+	case ast.Variable:
+		switch v := c.variables[arg.Value.Raw].(type) {
+		case float64:
+			return int(v)
+		case int:
+			return v
+		case nil:
+			// Unset, the variable's default or the argument's
+			def := c.op.VariableDefinitions.ForName(arg.Value.Raw)
+			if def == nil || def.DefaultValue == nil {
+				return DEFAULT_HISTORY
+			}
+			if n, err := strconv.Atoi(def.DefaultValue.Raw); err == nil {
+				return n
+			}
+		}
+	}
+	return MAX_HISTORY
+}
@@ -0,0 +1,66 @@
+package graph
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestComplexity(t *testing.T) {
+	tests := []struct {
+		name      string
+		query     string
+		operation string
+		variables map[string]interface{}
+		want      int
+	}{
+		{"scalar", `{ me { username } }`, "", nil, 2},
+		{"lists multiply", `{ me { groups { id members { username } } } }`, "", nil, 262},
+		{"history default", `{ group(id: "a") { history { id from } } }`, "", nil, 42},
+		{"history first", `{ group(id: "a") { history(first: 100) { id from } } }`, "", nil, 202},
+		{"history first clamped", `{ group(id: "a") { history(first: 1000) { id from } } }`, "", nil, 202},
+		{"history variable", `query($n: Int) { group(id: "a") { history(first: $n) { id from } } }`, "", map[string]interface{}{"n": float64(5)}, 12},
+		{"history variable default", `query($n: Int = 3) { group(id: "a") { history(first: $n) { id from } } }`, "", nil, 8},
+		{"history variable unset", `query($n: Int) { group(id: "a") { history(first: $n) { id from } } }`, "", nil, 42},
+		{"fragment", `{ me { ...F } } fragment F on User { username }`, "", nil, 2},
+		{"inline fragment", `{ me { ... on User { username } } }`, "", nil, 2},
+		{"fragment cycle", `{ me { ...A } } fragment A on User { ...A }`, "", nil, 1},
+		{"named operation", `query A { me { username } } query B { me { groups { id } } }`, "B", nil, 7},
+		{"unknown operation", `query A { me { username } }`, "B", nil, 0},
+	}
+	for _, tt := range tests {
+		got, err := complexity(tt.query, tt.operation, tt.variables)
+		if err != nil || got != tt.want {
+			t.Errorf("%s: complexity = %d, %v, want %d", tt.name, got, err, tt.want)
+		}
+	}
+
+	if _, err := complexity(`{ me { `, "", nil); err == nil {
+		t.Error("unparsable query costed")
+	}
+}
+
+func TestCheck(t *testing.T) {
+	heavy := `me { groups { members { username } history(first: 100) { id from to coin passedAt } } }`
+
+	tests := []struct {
+		name  string
+		query string
+		want  error
+	}{
+		{"small", `{ me { username } }`, nil},
+		{"under the limit", `{ ` + heavy + ` }`, nil},
+		{"over the limit", `{ a: ` + heavy + ` b: ` + heavy + ` }`, ErrTooComplex},
+		{"unparsable is left to the executor", `{ me { `, nil},
+	}
+	for _, tt := range tests {
+		if err := check(&Request{Query: tt.query}); !errors.Is(err, tt.want) {
+			t.Errorf("%s: check = %v, want %v", tt.name, err, tt.want)
+		}
+	}
+
+	long := `{ me { username } }` + strings.Repeat(" ", MAX_QUERY_LENGTH)
+	if err := check(&Request{Query: long}); err == nil {
+		t.Error("query over MAX_QUERY_LENGTH accepted")
+	}
+}
@@ -0,0 +1,108 @@
+package graph
+
+import (
+	"benschreiber.com/purestserver/src/bsql"
+	"context"
+	"github.com/graph-gophers/dataloader/v7"
+	"time"
+)
+
+// How long a loader collects keys before running its batch
+const BATCH_WAIT = 2 * time.Millisecond
+
+// Key of the history loader, groups asking for the same length share a query
+type historyKey struct {
+	ID    string
+	First int
+}
+
+// Per request loaders, a query hits bsql once per field instead of once per group
+type loaders struct {
+	group   *dataloader.Loader[string, *bsql.Group]
+	members *dataloader.Loader[string, []string]
+	history *dataloader.Loader[historyKey, []bsql.CoinPass]
+	passes  *dataloader.Loader[string, int]
+}
+
+type loadersKey struct{}
+
+// Fresh loaders, cached results must not outlive the request
+func withLoaders(ctx context.Context) context.Context {
+	return context.WithValue(ctx, loadersKey{}, &loaders{
+		group: dataloader.NewBatchedLoader(batchGroups,
+			dataloader.WithWait[string, *bsql.Group](BATCH_WAIT)),
+		members: dataloader.NewBatchedLoader(batchMembers,
+			dataloader.WithWait[string, []string](BATCH_WAIT)),
+		history: dataloader.NewBatchedLoader(batchHistory,
+			dataloader.WithWait[historyKey, []bsql.CoinPass](BATCH_WAIT)),
+		passes: dataloader.NewBatchedLoader(batchPasses,
+			dataloader.WithWait[string, int](BATCH_WAIT)),
+	})
+}
+
+func loadersFrom(ctx context.Context) *loaders {
+	return ctx.Value(loadersKey{}).(*loaders)
+}
+
+// The same error for every key, a failed batch fails each Load
+func failed[K comparable, V any](ctx context.Context, keys []K, err error) []*dataloader.Result[V] {
+	err = internal(ctx, err)
+	res := make([]*dataloader.Result[V], len(keys))
+	for i := range keys {
+		res[i] = &dataloader.Result[V]{Error: err}
+	}
+	return res
+}
+
+// One result per key, in key order
+func results[K comparable, V any](keys []K, values func(K) V) []*dataloader.Result[V] {
+	res := make([]*dataloader.Result[V], len(keys))
+	for i, k := range keys {
+		res[i] = &dataloader.Result[V]{Data: values(k)}
+	}
+	return res
+}
+
+func batchGroups(ctx context.Context, ids []string) []*dataloader.Result[*bsql.Group] {
+	groups, err := bsql.GetGroups(ctx, ids)
+	if err != nil {
+		return failed[string, *bsql.Group](ctx, ids, err)
+	}
+	return results(ids, func(id string) *bsql.Group { return groups[id] })
+}
+
+func batchMembers(ctx context.Context, ids []string) []*dataloader.Result[[]string] {
+	members, err := bsql.GetGroupMembers(ctx, ids)
+	if err != nil {
+		return failed[string, []string](ctx, ids, err)
+	}
+	return results(ids, func(id string) []string { return members[id] })
+}
+
+func batchHistory(ctx context.Context, keys []historyKey) []*dataloader.Result[[]bsql.CoinPass] {
+
+	// One query per distinct length
+	ids := make(map[int][]string)
+	for _, k := range keys {
+		ids[k.First] = append(ids[k.First], k.ID)
+	}
+	passes := make(map[historyKey][]bsql.CoinPass)
+	for first, group := range ids {
+		byGroup, err := bsql.GetRecentCoinPasses(ctx, group, first)
+		if err != nil {
+			return failed[historyKey, []bsql.CoinPass](ctx, keys, err)
+		}
+		for id, p := range byGroup {
+			passes[historyKey{id, first}] = p
+		}
+	}
+	return results(keys, func(k historyKey) []bsql.CoinPass { return passes[k] })
+}
+
+func batchPasses(ctx context.Context, ids []string) []*dataloader.Result[int] {
+	counts, err := bsql.GetGroupPassCounts(ctx, ids)
+	if err != nil {
+		return failed[string, int](ctx, ids, err)
+	}
+	return results(ids, func(id string) int { return counts[id] })
+}
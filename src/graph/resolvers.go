@@ -0,0 +1,278 @@
+package graph
+
+import (
+	"benschreiber.com/purestserver/src/bsql"
+	"benschreiber.com/purestserver/src/events"
+	"benschreiber.com/purestserver/src/groups"
+	"benschreiber.com/purestserver/src/logging"
+	"context"
+	"errors"
+	"github.com/graph-gophers/graphql-go"
+	"strconv"
+)
+
+// Max coin passes a single history field returns
+const MAX_HISTORY = 100
+
+// Sent in place of a database error, the cause only goes to the log
+var errInternal = errors.New("internal server error")
+
+// Log err with the request and return errInternal
+func internal(ctx context.Context, err error) error {
+	logging.From(ctx).Error("resolver failed", "err", err)
+	return errInternal
+}
+
+// Root of Query and Subscription
+type resolver struct{}
+
+func (r *resolver) Me(ctx context.Context) *userResolver {
+	return &userResolver{name: user(ctx)}
+}
+
+// Not found and not a member are errors, the group comes back null
+func (r *resolver) Group(ctx context.Context, args struct{ ID graphql.ID }) (*groupResolver, error) {
+	id := string(args.ID)
+	if err := member(ctx, user(ctx), id); err != nil {
+		return nil, err
+	}
+	return &groupResolver{id: id}, nil
+}
+
+// Coin passes in a group until it is disbanded, the user is kicked or the client leaves
+func (r *resolver) CoinPassed(ctx context.Context, args struct{ Group graphql.ID }) (<-chan *coinPassResolver, error) {
+	u := user(ctx)
+	id := string(args.Group)
+	if err := member(ctx, u, id); err != nil {
+		return nil, err
+	}
+
+	ch, unsubscribe := events.Subscribe(id)
+	out := make(chan *coinPassResolver)
+	go func() {
+		defer close(out)
+		defer unsubscribe()
+		for {
+			select {
+			case e, ok := <-ch:
+				if !ok {
+					return
+				}
+
+				// End the subscription once the user can no longer see the group
+				if events.Removes(e, u) {
+					return
+				}
+
+				pass, ok := e.Data.(*bsql.CoinPass)
+				if e.Type != events.COIN_PASSED || !ok {
+					continue
+				}
+				select {
+				case out <- &coinPassResolver{pass: *pass}:
+				case <-ctx.Done():
+					return
+				}
+
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out, nil
+}
+
+// Membership check, a rule error goes back to the client, anything else is internal
+func member(ctx context.Context, user string, id string) error {
+	err := groups.Member(ctx, user, id)
+	if _, ok := err.(groups.Error); err != nil && !ok {
+		return internal(ctx, err)
+	}
+	return err
+}
+
+type userResolver struct {
+	name string
+}
+
+func (r *userResolver) Username() string {
+	return r.name
+}
+
+func (r *userResolver) Groups(ctx context.Context) ([]*groupResolver, error) {
+	ids, err := bsql.GetUserGroupIDs(ctx, r.name)
+	if err != nil {
+		return nil, internal(ctx, err)
+	}
+	res := make([]*groupResolver, len(ids))
+	for i, id := range ids {
+		res[i] = &groupResolver{id: id}
+	}
+	return res, nil
+}
+
+func (r *userResolver) Stats(ctx context.Context) (*userStatsResolver, error) {
+	passed, received, err := bsql.GetUserPassCounts(ctx, r.name)
+	if err != nil {
+		return nil, internal(ctx, err)
+	}
+	return &userStatsResolver{passed: int32(passed), received: int32(received)}, nil
+}
+
+type userStatsResolver struct {
+	passed   int32
+	received int32
+}
+
+func (r *userStatsResolver) Passed() int32 {
+	return r.passed
+}
+
+func (r *userStatsResolver) Received() int32 {
+	return r.received
+}
+
+// A group the user was checked to be in, fields load through the request's loaders
+type groupResolver struct {
+	id string
+}
+
+// The group row, shared by every field of every group in the request
+// Null if it was disbanded mid request
+func (r *groupResolver) load(ctx context.Context) (*bsql.Group, error) {
+	group, err := loadersFrom(ctx).group.Load(ctx, r.id)()
+	if err != nil {
+		return nil, err
+	}
+	if group == nil {
+		return nil, groups.ErrGroupNotFound
+	}
+	return group, nil
+}
+
+func (r *groupResolver) ID() graphql.ID {
+	return graphql.ID(r.id)
+}
+
+func (r *groupResolver) Coin(ctx context.Context) (int32, error) {
+	group, err := r.load(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return int32(group.Token), nil
+}
+
+func (r *groupResolver) Creator(ctx context.Context) (string, error) {
+	group, err := r.load(ctx)
+	if err != nil {
+		return "", err
+	}
+	return group.Creator, nil
+}
+
+func (r *groupResolver) CoinHolder(ctx context.Context) (string, error) {
+	group, err := r.load(ctx)
+	if err != nil {
+		return "", err
+	}
+	return group.TokenHolder, nil
+}
+
+func (r *groupResolver) Members(ctx context.Context) ([]*memberResolver, error) {
+	group, err := r.load(ctx)
+	if err != nil {
+		return nil, err
+	}
+	names, err := loadersFrom(ctx).members.Load(ctx, r.id)()
+	if err != nil {
+		return nil, err
+	}
+
+	res := make([]*memberResolver, len(names))
+	for i, name := range names {
+		res[i] = &memberResolver{name: name, group: group}
+	}
+	return res, nil
+}
+
+func (r *groupResolver) History(ctx context.Context, args struct{ First int32 }) ([]*coinPassResolver, error) {
+	first := clampFirst(int(args.First))
+	passes, err := loadersFrom(ctx).history.Load(ctx, historyKey{r.id, first})()
+	if err != nil {
+		return nil, err
+	}
+
+	res := make([]*coinPassResolver, len(passes))
+	for i := range passes {
+		res[i] = &coinPassResolver{pass: passes[i]}
+	}
+	return res, nil
+}
+
+func (r *groupResolver) Stats(ctx context.Context) (*groupStatsResolver, error) {
+	passes, err := loadersFrom(ctx).passes.Load(ctx, r.id)()
+	if err != nil {
+		return nil, err
+	}
+	return &groupStatsResolver{passes: int32(passes)}, nil
+}
+
+// History length within 0 and MAX_HISTORY
+func clampFirst(first int) int {
+	if first < 0 {
+		return 0
+	}
+	if first > MAX_HISTORY {
+		return MAX_HISTORY
+	}
+	return first
+}
+
+type groupStatsResolver struct {
+	passes int32
+}
+
+func (r *groupStatsResolver) Passes() int32 {
+	return r.passes
+}
+
+type memberResolver struct {
+	name  string
+	group *bsql.Group
+}
+
+func (r *memberResolver) Username() string {
+	return r.name
+}
+
+func (r *memberResolver) IsCreator() bool {
+	return r.name == r.group.Creator
+}
+
+func (r *memberResolver) HoldsCoin() bool {
+	return r.name == r.group.TokenHolder
+}
+
+type coinPassResolver struct {
+	pass bsql.CoinPass
+}
+
+func (r *coinPassResolver) ID() graphql.ID {
+	return graphql.ID(strconv.FormatInt(r.pass.ID, 10))
+}
+
+func (r *coinPassResolver) From() string {
+	return r.pass.From
+}
+
+func (r *coinPassResolver) To() string {
+	return r.pass.To
+}
+
+func (r *coinPassResolver) Coin() int32 {
+	return int32(r.pass.Coin)
+}
+
+func (r *coinPassResolver) PassedAt() graphql.Time {
+	return graphql.Time{Time: r.pass.PassedAt}
+}
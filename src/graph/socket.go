@@ -0,0 +1,306 @@
+package graph
+
+import (
+	"benschreiber.com/purestserver/src/bres"
+	"benschreiber.com/purestserver/src/bres/ratelimit"
+	"benschreiber.com/purestserver/src/lifecycle"
+	"benschreiber.com/purestserver/src/logging"
+	"context"
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"sync"
+	"time"
+)
+
+// Subscriptions over the graphql-transport-ws protocol
+// https://github.com/enisdenjo/graphql-ws/blob/master/PROTOCOL.md
+const PROTOCOL = "graphql-transport-ws"
+
+const (
+	INIT_WAIT   = 10 * time.Second // client must send connection_init in this time
+	WRITE_WAIT  = 10 * time.Second // max time to write a frame
+	PONG_WAIT   = 60 * time.Second // client must answer pings in this time
+	PING_PERIOD = 50 * time.Second // must be below PONG_WAIT
+	MAX_MESSAGE = 16384            // max bytes of a client message
+)
+
+// Message types of the protocol
+const (
+	CONNECTION_INIT = "connection_init"
+	CONNECTION_ACK  = "connection_ack"
+	PING            = "ping"
+	PONG            = "pong"
+	SUBSCRIBE       = "subscribe"
+	NEXT            = "next"
+	ERROR           = "error"
+	COMPLETE        = "complete"
+)
+
+// Close codes of the protocol
+const (
+	CLOSE_BAD_MESSAGE  = 4400
+	CLOSE_UNAUTHORIZED = 4401
+	CLOSE_FORBIDDEN    = 4403
+	CLOSE_INIT_TIMEOUT = 4408
+	CLOSE_DUPLICATE    = 4409
+	CLOSE_TOO_MANY     = 4429
+)
+
+// Frame written to and read from the socket
+type message struct {
+	ID      string          `json:"id,omitempty"`
+	Type    string          `json:"type"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+// Payload of connection_init, browsers can't set headers on a websocket
+type initPayload struct {
+	Authorization string `json:"authorization"`
+}
+
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+	Subprotocols:    []string{PROTOCOL},
+}
+
+// A single websocket connection, runs each subscribe in its own goroutine
+type conn struct {
+	ws   *websocket.Conn
+	ip   string
+	user string
+	mu   sync.Mutex                    // serializes writes
+	subs map[string]context.CancelFunc // running operations by id
+}
+
+func (c *conn) write(m message) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ws.SetWriteDeadline(time.Now().Add(WRITE_WAIT))
+	return c.ws.WriteJSON(m)
+}
+
+func (c *conn) ping() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.ws.WriteControl(websocket.PingMessage, nil, time.Now().Add(WRITE_WAIT))
+}
+
+// Close with a protocol code, the client sees the reason
+func (c *conn) close(code int, reason string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ws.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(WRITE_WAIT))
+	c.ws.Close()
+}
+
+// Upgrade a request to a graphql-transport-ws socket
+// Authentication happens in connection_init, with the upgrade request's
+// Authorization header as a fallback for clients that can set it
+func Serve(ctx *gin.Context) {
+	ws, err := upgrader.Upgrade(ctx.Writer, ctx.Request, nil)
+	if err != nil {
+		// Upgrader already wrote the error response
+		logging.From(ctx).Info("websocket upgrade failed", "err", err)
+		return
+	}
+
+	c := &conn{
+		ws:   ws,
+		ip:   ctx.ClientIP(),
+		subs: make(map[string]context.CancelFunc),
+	}
+	if ws.Subprotocol() != PROTOCOL {
+		c.close(websocket.CloseProtocolError, "subprotocol must be "+PROTOCOL)
+		return
+	}
+
+	ws.SetReadLimit(MAX_MESSAGE)
+	ws.SetReadDeadline(time.Now().Add(INIT_WAIT))
+	if !c.init(ctx.Request.Context(), ctx.GetHeader("Authorization")) {
+		return
+	}
+
+	// Keep the connection alive, the client answers pings with pongs
+	// Closed going away on shutdown
+	ws.SetReadDeadline(time.Now().Add(PONG_WAIT))
+	ws.SetPongHandler(func(string) error {
+		return ws.SetReadDeadline(time.Now().Add(PONG_WAIT))
+	})
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(PING_PERIOD)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if c.ping() != nil {
+					return
+				}
+			case <-lifecycle.Context().Done():
+				c.close(websocket.CloseGoingAway, "server shutting down")
+				return
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	c.read()
+	close(done)
+
+	// Stop every running operation
+	c.mu.Lock()
+	for _, cancel := range c.subs {
+		cancel()
+	}
+	c.mu.Unlock()
+	ws.Close()
+}
+
+// Wait for connection_init and authenticate it
+// Returns false once the connection is closed
+func (c *conn) init(ctx context.Context, header string) bool {
+	var m message
+	if err := c.ws.ReadJSON(&m); err != nil {
+		if ne, ok := err.(interface{ Timeout() bool }); ok && ne.Timeout() {
+			c.close(CLOSE_INIT_TIMEOUT, "connection initialisation timeout")
+		} else {
+			c.close(CLOSE_BAD_MESSAGE, "invalid message")
+		}
+		return false
+	}
+	if m.Type != CONNECTION_INIT {
+		c.close(CLOSE_UNAUTHORIZED, "unauthorized")
+		return false
+	}
+
+	var payload initPayload
+	if len(m.Payload) > 0 && json.Unmarshal(m.Payload, &payload) != nil {
+		c.close(CLOSE_BAD_MESSAGE, "invalid connection_init payload")
+		return false
+	}
+	auth := payload.Authorization
+	if auth == "" {
+		auth = header
+	}
+
+	token, ok := bres.ParseBearer(auth)
+	if !ok {
+		c.close(CLOSE_FORBIDDEN, "forbidden")
+		return false
+	}
+	user, err := bres.Authenticate(ctx, token, c.ip, "")
+	if err == bres.ErrInvalidToken {
+		c.close(CLOSE_FORBIDDEN, "forbidden")
+		return false
+	}
+	if err != nil {
+		logging.From(ctx).Error("graphql socket authentication failed", "err", err)
+		c.close(websocket.CloseInternalServerErr, "internal server error")
+		return false
+	}
+
+	c.user = user
+	return c.write(message{Type: CONNECTION_ACK}) == nil
+}
+
+// Handle client messages until the connection drops or breaks the protocol
+func (c *conn) read() {
+	for {
+		var m message
+		if err := c.ws.ReadJSON(&m); err != nil {
+			if _, ok := err.(*json.SyntaxError); ok {
+				c.close(CLOSE_BAD_MESSAGE, "invalid message")
+			}
+			return
+		}
+
+		switch m.Type {
+		case PING:
+			if c.write(message{Type: PONG}) != nil {
+				return
+			}
+
+		case PONG:
+
+		case SUBSCRIBE:
+			var req Request
+			if m.ID == "" || json.Unmarshal(m.Payload, &req) != nil || req.Query == "" {
+				c.close(CLOSE_BAD_MESSAGE, "invalid subscribe message")
+				return
+			}
+			// Every operation counts against the same limit as a request
+			if !ratelimit.Allow(c.ip) {
+				c.close(CLOSE_TOO_MANY, "rate limited")
+				return
+			}
+			if !c.subscribe(m.ID, &req) {
+				c.close(CLOSE_DUPLICATE, "subscriber for "+m.ID+" already exists")
+				return
+			}
+
+		case COMPLETE:
+			c.mu.Lock()
+			if cancel, ok := c.subs[m.ID]; ok {
+				cancel()
+				delete(c.subs, m.ID)
+			}
+			c.mu.Unlock()
+
+		default:
+			c.close(CLOSE_BAD_MESSAGE, "unexpected message type "+m.Type)
+			return
+		}
+	}
+}
+
+// Start an operation, false if the id is already running
+func (c *conn) subscribe(id string, req *Request) bool {
+	c.mu.Lock()
+	if _, ok := c.subs[id]; ok {
+		c.mu.Unlock()
+		return false
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	c.subs[id] = cancel
+	c.mu.Unlock()
+
+	go func() {
+		defer cancel()
+
+		results, err := Subscribe(ctx, c.user, req)
+		if err != nil {
+			payload, _ := json.Marshal(errorResponse(err).Errors)
+			c.finish(id, message{ID: id, Type: ERROR, Payload: payload})
+			return
+		}
+
+		for res := range results {
+			payload, err := json.Marshal(res)
+			if err != nil {
+				payload, _ = json.Marshal(errorResponse(internal(ctx, err)).Errors)
+				c.finish(id, message{ID: id, Type: ERROR, Payload: payload})
+				return
+			}
+			if c.write(message{ID: id, Type: NEXT, Payload: payload}) != nil {
+				return
+			}
+		}
+		c.finish(id, message{ID: id, Type: COMPLETE})
+	}()
+	return true
+}
+
+// Send the last message of an operation unless the client already completed it
+func (c *conn) finish(id string, m message) {
+	c.mu.Lock()
+	_, running := c.subs[id]
+	delete(c.subs, id)
+	c.mu.Unlock()
+
+	if running {
+		c.write(m)
+	}
+}
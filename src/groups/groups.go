@@ -0,0 +1,452 @@
+// Group business rules shared by every API
+// Handlers, the CLI and background jobs call these instead of bsql,
+// so existence, membership and ownership are checked the same way everywhere
+// and every change is audited with the user who made it
+package groups
+
+import (
+	"benschreiber.com/purestserver/src/audit"
+	"benschreiber.com/purestserver/src/bsql"
+	"benschreiber.com/purestserver/src/events"
+	"benschreiber.com/purestserver/src/metrics"
+	"context"
+	"github.com/gin-gonic/gin"
+	"strconv"
+)
+
+// A broken business rule
+// Any other error out of this package is a database error
+type Error string
+
+func (e Error) Error() string {
+	return string(e)
+}
+
+const (
+	ErrGroupNotFound  Error = "group not found"
+	ErrMemberNotFound Error = "member not found"
+	ErrNoGroup        Error = "user is not in a group"
+	ErrNotMember      Error = "user is not in the group"
+	ErrNotCreator     Error = "user is not the group creator"
+	ErrNotCoinHolder  Error = "user does not hold the coin"
+	ErrAlreadyMember  Error = "user is already in the group"
+	ErrAlreadyOwner   Error = "user already owns a group"
+	ErrAlreadyHolder  Error = "user already holds the coin"
+)
+
+// Create a group owned by user, who becomes its first member and coin holder
+// Returns the new group's id
+func Create(ctx context.Context, user string) (string, error) {
+	ok, err := bsql.UserOwnsGroup(ctx, user)
+	if err != nil {
+		return "", err
+	}
+	if ok {
+		return "", ErrAlreadyOwner
+	}
+
+	id, err := bsql.InsertNewGroup(ctx, user)
+	if err != nil {
+		return "", err
+	}
+
+	metrics.GroupsCreated.Inc()
+	audit.Record(ctx, audit.Event{Actor: user, Action: audit.GROUP_CREATE, Group: id})
+
+	// Published after the audit event, achievements count creations from it
+	events.Publish(events.Event{
+		Type:  events.GROUP_CREATED,
+		Group: id,
+		Data:  gin.H{"by": user},
+	})
+	return id, nil
+}
+
+// The group user is in
+func ForUser(ctx context.Context, user string) (*bsql.Group, error) {
+	group, ok, err := bsql.GetUserGroup(ctx, user)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, ErrNoGroup
+	}
+	return group, nil
+}
+
+// A group, only visible to its members
+func Get(ctx context.Context, user string, id string) (*bsql.Group, error) {
+	group, ok, err := bsql.GetGroup(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, ErrGroupNotFound
+	}
+
+	ok, err = bsql.UserInGroup(ctx, user, id)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, ErrNotMember
+	}
+	return group, nil
+}
+
+// Check the group exists and user is in it
+func Member(ctx context.Context, user string, id string) error {
+	ok, err := bsql.GroupExists(ctx, id)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrGroupNotFound
+	}
+
+	ok, err = bsql.UserInGroup(ctx, user, id)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrNotMember
+	}
+	return nil
+}
+
+// Check the group exists and user created it
+func Owner(ctx context.Context, user string, id string) error {
+	ok, err := bsql.GroupExists(ctx, id)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrGroupNotFound
+	}
+
+	ok, err = bsql.UserGroupCreator(ctx, user, id)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrNotCreator
+	}
+	return nil
+}
+
+// Add user to a group
+func Join(ctx context.Context, user string, id string) error {
+	ok, err := bsql.GroupExists(ctx, id)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrGroupNotFound
+	}
+
+	// The unique key still catches two joins racing past this check
+	ok, err = bsql.UserInGroup(ctx, user, id)
+	if err != nil {
+		return err
+	}
+	if ok {
+		return ErrAlreadyMember
+	}
+
+	if err = bsql.InsertGroupMember(ctx, user, id); err != nil {
+		if bsql.DuplicateEntry(err) {
+			return ErrAlreadyMember
+		}
+		return err
+	}
+
+	metrics.MembersJoined.Inc()
+	events.Publish(events.Event{
+		Type:  events.MEMBER_JOINED,
+		Group: id,
+		Data:  gin.H{"username": user},
+	})
+	audit.Record(ctx, audit.Event{Actor: user, Action: audit.GROUP_JOIN, Group: id})
+	return nil
+}
+
+// Bump the coin and hand it to a random member, only the holder can
+func PassCoin(ctx context.Context, user string, id string) (*bsql.CoinPass, error) {
+	ok, err := bsql.GroupExists(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, ErrGroupNotFound
+	}
+
+	ok, err = bsql.CoinHolder(ctx, user, id)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, ErrNotCoinHolder
+	}
+
+	p, err := pass(ctx, user, id, false)
+	if err != nil {
+		return nil, err
+	}
+	audit.Record(ctx, audit.Event{Actor: user, Action: audit.COIN_PASS, Target: p.To, Group: id})
+	return p, nil
+}
+
+func pass(ctx context.Context, user string, id string, forced bool) (*bsql.CoinPass, error) {
+	p, err := bsql.UpdateCoin(ctx, user, id, forced)
+	if err != nil {
+		return nil, err
+	}
+	if p == nil {
+		// Someone passed it first, or this is a retry of a pass that went through
+		return nil, ErrNotCoinHolder
+	}
+
+	metrics.CoinsPassed.Inc()
+	publishPass(p)
+	return p, nil
+}
+
+func publishPass(p *bsql.CoinPass) {
+	events.Publish(events.Event{
+		ID:    strconv.FormatInt(p.ID, 10),
+		Type:  events.COIN_PASSED,
+		Group: p.GroupID,
+		Data:  p,
+	})
+}
+
+// A page of groups with their members, for operators
+// q matches the start of the id, the creator or a member, empty lists every group
+func Search(ctx context.Context, q string, limit int, offset int) ([]*bsql.Group, error) {
+	ids, err := bsql.SearchGroupIDs(ctx, q, limit, offset)
+	if err != nil || len(ids) == 0 {
+		return nil, err
+	}
+
+	byID, err := bsql.GetGroups(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+	members, err := bsql.GetGroupMembers(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+
+	// A group disbanded between the two reads is left out
+	var out []*bsql.Group
+	for _, id := range ids {
+		if g, ok := byID[id]; ok {
+			g.Members = members[id]
+			out = append(out, g)
+		}
+	}
+	return out, nil
+}
+
+// Any group, for operators
+func Inspect(ctx context.Context, id string) (*bsql.Group, error) {
+	group, ok, err := bsql.GetGroup(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, ErrGroupNotFound
+	}
+	return group, nil
+}
+
+// Pass the coin on behalf of whoever holds it, for operators unsticking a group
+func ForcePass(ctx context.Context, id string) (*bsql.CoinPass, error) {
+	group, err := Inspect(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	return pass(ctx, group.TokenHolder, id, true)
+}
+
+// Hand the coin to member without counting a pass, for operators
+func Reassign(ctx context.Context, id string, member string) (*bsql.CoinPass, error) {
+	group, err := Inspect(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	ok, err := bsql.UserInGroup(ctx, member, id)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, ErrMemberNotFound
+	}
+	if group.TokenHolder == member {
+		return nil, ErrAlreadyHolder
+	}
+
+	p, err := bsql.ReassignCoin(ctx, id, group.TokenHolder, member)
+	if err != nil {
+		return nil, err
+	}
+	if p == nil {
+		// The holder passed it first
+		return nil, ErrNotCoinHolder
+	}
+
+	publishPass(p)
+	return p, nil
+}
+
+// Remove member from a group, only the creator can
+func Kick(ctx context.Context, user string, id string, member string) error {
+	ok, err := bsql.UserExists(ctx, member)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrMemberNotFound
+	}
+
+	ok, err = bsql.GroupExists(ctx, id)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrGroupNotFound
+	}
+
+	ok, err = bsql.UserInGroup(ctx, member, id)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrMemberNotFound
+	}
+
+	ok, err = bsql.UserGroupCreator(ctx, user, id)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrNotCreator
+	}
+
+	if _, err = bsql.DeleteGroupMember(ctx, member, id); err != nil {
+		return err
+	}
+
+	events.Publish(events.Event{
+		Type:  events.MEMBER_KICKED,
+		Group: id,
+		Data:  gin.H{"username": member, "by": user},
+	})
+	audit.Record(ctx, audit.Event{Actor: user, Action: audit.GROUP_KICK, Target: member, Group: id})
+	return nil
+}
+
+// Take user out of a group
+// What they had goes to a random remaining member, the last one leaving disbands it
+func Leave(ctx context.Context, user string, id string) error {
+	if err := Member(ctx, user, id); err != nil {
+		return err
+	}
+
+	g, ok, err := bsql.LeaveGroup(ctx, user, id)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrNotMember
+	}
+
+	Left(ctx, user, g)
+	return nil
+}
+
+// Audit and publish what user leaving did to a group, for Leave and account deletion
+func Left(ctx context.Context, user string, g *bsql.GroupChange) {
+	if g.Disbanded {
+		metrics.GroupsDisbanded.Inc()
+		audit.Record(ctx, audit.Event{Actor: user, Action: audit.GROUP_DISBAND, Group: g.GroupID})
+		events.Publish(events.Event{
+			Type:  events.GROUP_DISBANDED,
+			Group: g.GroupID,
+			Data:  gin.H{"by": user},
+		})
+		return
+	}
+
+	audit.Record(ctx, audit.Event{Actor: user, Action: audit.GROUP_LEAVE, Group: g.GroupID})
+	if g.NewCreator {
+		audit.Record(ctx, audit.Event{Actor: user, Action: audit.GROUP_TRANSFER, Target: g.Creator, Group: g.GroupID})
+	}
+	if g.NewCoinHolder {
+		audit.Record(ctx, audit.Event{Actor: user, Action: audit.COIN_HANDOVER, Target: g.CoinHolder, Group: g.GroupID})
+	}
+	events.Publish(events.Event{
+		Type:  events.MEMBER_LEFT,
+		Group: g.GroupID,
+		Data:  gin.H{"username": user, "creator": g.Creator, "coin_holder": g.CoinHolder},
+	})
+}
+
+// Hand a group to another member, only the creator can
+// The creator is the group's one setting, changing it is published as a settings change
+func Transfer(ctx context.Context, user string, id string, member string) error {
+	if err := Owner(ctx, user, id); err != nil {
+		return err
+	}
+
+	ok, err := bsql.UserInGroup(ctx, member, id)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrMemberNotFound
+	}
+
+	// A user owns one group at most, the creator included
+	ok, err = bsql.UserOwnsGroup(ctx, member)
+	if err != nil {
+		return err
+	}
+	if ok {
+		return ErrAlreadyOwner
+	}
+
+	if err = bsql.UpdateGroupCreator(ctx, member, id); err != nil {
+		return err
+	}
+
+	events.Publish(events.Event{
+		Type:  events.SETTINGS_CHANGE,
+		Group: id,
+		Data:  gin.H{"creator": member, "by": user},
+	})
+	audit.Record(ctx, audit.Event{Actor: user, Action: audit.GROUP_TRANSFER, Target: member, Group: id})
+	return nil
+}
+
+// Delete a group and its members, only the creator can
+func Disband(ctx context.Context, user string, id string) error {
+	if err := Owner(ctx, user, id); err != nil {
+		return err
+	}
+
+	if err := bsql.DeleteGroup(ctx, id); err != nil {
+		return err
+	}
+
+	metrics.GroupsDisbanded.Inc()
+	events.Publish(events.Event{
+		Type:  events.GROUP_DISBANDED,
+		Group: id,
+		Data:  gin.H{"by": user},
+	})
+	audit.Record(ctx, audit.Event{Actor: user, Action: audit.GROUP_DISBAND, Group: id})
+	return nil
+}
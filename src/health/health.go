@@ -0,0 +1,259 @@
+// Liveness and readiness checks served on the internal admin listener
+// Packages register their own checks in their Init(), like metrics
+// /livez fails when the process should be restarted, a stuck worker or lock
+// /readyz fails when it shouldn't get traffic, a dependency is down or it is shutting down
+// Must call health.Init() after every package has registered its checks
+package health
+
+import (
+	"benschreiber.com/purestserver/src/config"
+	"benschreiber.com/purestserver/src/logging"
+	"context"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var logger = logging.For("health")
+
+const (
+	CHECK_TIMEOUT = 2 * time.Second // per check, a slow dependency counts as down
+	STALE_PERIODS = 3               // missed beats before a worker counts as stuck
+)
+
+const (
+	STATUS_OK   = "ok"
+	STATUS_FAIL = "fail"
+)
+
+// Returned by readiness once shutdown has started
+var ErrDraining = errors.New("shutting down")
+
+// A check returns nil when healthy, it must give up when ctx is done
+type Check func(ctx context.Context) error
+
+type check struct {
+	name string
+	f    Check
+	live bool
+}
+
+var (
+	mu       sync.Mutex
+	checks   []check
+	draining atomic.Bool
+	mounts   []func(router *gin.Engine)
+)
+
+// Result of a single check
+type Result struct {
+	Status    string  `json:"status"`
+	LatencyMS float64 `json:"latency_ms"`
+	Error     string  `json:"error,omitempty"`
+}
+
+// Body of /livez and /readyz
+type Report struct {
+	Status string            `json:"status"`
+	Checks map[string]Result `json:"checks"`
+}
+
+// Add a check to /livez and /readyz
+// Only for faults a restart fixes, a down dependency belongs in Ready
+func Live(name string, f Check) {
+	mu.Lock()
+	defer mu.Unlock()
+	checks = append(checks, check{name: name, f: f, live: true})
+}
+
+// Add a check to /readyz
+func Ready(name string, f Check) {
+	mu.Lock()
+	defer mu.Unlock()
+	checks = append(checks, check{name: name, f: f})
+}
+
+// Background loop that should beat at least once per period
+type Worker struct {
+	name   string
+	period time.Duration
+	last   atomic.Int64
+}
+
+// Register a liveness check for a worker, stuck after STALE_PERIODS periods without a beat
+// period is the longest a healthy loop takes between beats, work included
+func NewWorker(name string, period time.Duration) *Worker {
+	w := &Worker{name: name, period: period}
+	w.Beat()
+	Live("worker:"+name, w.check)
+	return w
+}
+
+// Record that the loop is still going
+func (w *Worker) Beat() {
+	w.last.Store(time.Now().UnixNano())
+}
+
+func (w *Worker) check(ctx context.Context) error {
+	since := time.Since(time.Unix(0, w.last.Load()))
+	if since > STALE_PERIODS*w.period {
+		return errors.New("no beat for " + since.Round(time.Millisecond).String())
+	}
+	return nil
+}
+
+// Fail readiness from now on, load balancers stop sending new requests
+func Drain() {
+	if !draining.Swap(true) {
+		logger.Info("readiness failing for shutdown")
+	}
+}
+
+func Draining() bool {
+	return draining.Load()
+}
+
+// Run the checks concurrently, live only runs the liveness checks
+func Run(ctx context.Context, live bool) Report {
+	mu.Lock()
+	run := make([]check, 0, len(checks))
+	for _, c := range checks {
+		if c.live || !live {
+			run = append(run, c)
+		}
+	}
+	mu.Unlock()
+
+	report := Report{Status: STATUS_OK, Checks: make(map[string]Result, len(run)+1)}
+	results := make([]Result, len(run))
+
+	var wg sync.WaitGroup
+	for i, c := range run {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i] = runCheck(ctx, c.f)
+		}()
+	}
+	wg.Wait()
+
+	for i, c := range run {
+		report.Checks[c.name] = results[i]
+		if results[i].Status != STATUS_OK {
+			report.Status = STATUS_FAIL
+		}
+	}
+
+	if !live && Draining() {
+		report.Checks["shutdown"] = Result{Status: STATUS_FAIL, Error: ErrDraining.Error()}
+		report.Status = STATUS_FAIL
+	}
+	return report
+}
+
+func runCheck(ctx context.Context, f Check) Result {
+	ctx, cancel := context.WithTimeout(ctx, CHECK_TIMEOUT)
+	defer cancel()
+
+	start := time.Now()
+	err := make(chan error, 1)
+	go func() { err <- f(ctx) }()
+
+	// A check ignoring ctx can't hold up the report
+	var res Result
+	select {
+	case e := <-err:
+		res.Status = STATUS_OK
+		if e != nil {
+			res.Status = STATUS_FAIL
+			res.Error = e.Error()
+		}
+	case <-ctx.Done():
+		res.Status = STATUS_FAIL
+		res.Error = "timed out after " + CHECK_TIMEOUT.String()
+	}
+	res.LatencyMS = float64(time.Since(start).Microseconds()) / 1000
+	return res
+}
+
+func respond(c *gin.Context, report Report) {
+	if report.Status != STATUS_OK {
+		var failed []string
+		for name, res := range report.Checks {
+			if res.Status != STATUS_OK {
+				failed = append(failed, name+": "+res.Error)
+			}
+		}
+		logger.Warn("health check failed", "path", c.Request.URL.Path, "failed", failed)
+		c.JSON(503, report)
+		return
+	}
+	c.JSON(200, report)
+}
+
+// METHOD: GET
+// STATUS: 200 alive, 503 with the failing checks
+func getLivez(c *gin.Context) {
+	respond(c, Run(c.Request.Context(), true))
+}
+
+// METHOD: GET
+// STATUS: 200 ready for traffic, 503 with the failing checks
+func getReadyz(c *gin.Context) {
+	respond(c, Run(c.Request.Context(), false))
+}
+
+// Add routes to the admin listener, must be called before Init()
+// They bring their own middleware, the listener adds none
+func Mount(f func(router *gin.Engine)) {
+	mu.Lock()
+	defer mu.Unlock()
+	mounts = append(mounts, f)
+}
+
+// Router of the admin listener, not logged, traced or rate-limited
+func Router() *gin.Engine {
+	router := gin.New()
+	router.Use(gin.Recovery())
+	router.GET("/livez", getLivez)
+	router.GET("/readyz", getReadyz)
+
+	mu.Lock()
+	defer mu.Unlock()
+	for _, f := range mounts {
+		f(router)
+	}
+	return router
+}
+
+// Admin listener started by Init(), nil when it is off
+var server *http.Server
+
+// Serve the admin router on server.admin_addr, off turns the listener off
+// Loopback by default so only the host and its sidecars can reach it
+func Init() {
+	addr := config.Get().Server.AdminAddr
+	if addr == "off" {
+		logger.Info("Admin listener off")
+		return
+	}
+
+	logger.Info("Initializing admin listener", "addr", addr)
+	server = &http.Server{Addr: addr, Handler: Router()}
+	go func() {
+		if err := server.ListenAndServe(); err != http.ErrServerClosed {
+			logging.Fatal(err)
+		}
+	}()
+}
+
+// Stop the admin listener, last so /readyz answers while the rest drains
+func Shutdown(ctx context.Context) error {
+	if server == nil {
+		return nil
+	}
+	return server.Shutdown(ctx)
+}
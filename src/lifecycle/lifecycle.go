@@ -0,0 +1,78 @@
+// Background loops started by package Init()s and stopped together on shutdown
+// Loops beat a health.Worker so a stuck one fails /livez
+package lifecycle
+
+import (
+	"benschreiber.com/purestserver/src/health"
+	"benschreiber.com/purestserver/src/logging"
+	"context"
+	"sync"
+	"time"
+)
+
+var logger = logging.For("lifecycle")
+
+var (
+	wg          sync.WaitGroup
+	ctx, cancel = context.WithCancel(context.Background())
+)
+
+// Done once shutdown starts, for loops and long-lived streams
+func Context() context.Context {
+	return ctx
+}
+
+// Run f every period until shutdown, a run in progress finishes first
+// timeout is the longest a healthy run takes, 0 for quick ones
+// f should stop early between units of work once its ctx is done
+func Every(name string, period time.Duration, timeout time.Duration, f func(ctx context.Context)) {
+	w := health.NewWorker(name, period+timeout)
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		ticker := time.NewTicker(period)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				logger.Debug("worker stopped", "worker", name)
+				return
+			case <-ticker.C:
+			}
+			w.Beat()
+			f(ctx)
+		}
+	}()
+}
+
+// Run f until shutdown, for workers waiting on a channel instead of a period
+// f must return once its ctx is done
+func Go(name string, f func(ctx context.Context)) {
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		f(ctx)
+		logger.Debug("worker stopped", "worker", name)
+	}()
+}
+
+// Stop every loop and wait for running ones, up to done's deadline
+func Stop(done context.Context) error {
+	cancel()
+
+	stopped := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+		return nil
+	case <-done.Done():
+		return done.Err()
+	}
+}
@@ -0,0 +1,211 @@
+// Structured logging shared by every package
+// Packages log through For(component), handlers through From(ctx) so each line
+// carries the request id, route, user and group of the request it belongs to
+// Must call logging.Init() before anything logs, LOG_LEVEL and LOG_FORMAT configure it
+package logging
+
+import (
+	"benschreiber.com/purestserver/src/config"
+	"context"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"log/slog"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Header a request id is read from and echoed in
+const REQUEST_ID_HEADER = "X-Request-ID"
+
+// Attribute keys whose values never reach the output
+var secrets = map[string]bool{
+	"token":         true,
+	"password":      true,
+	"new_password":  true,
+	"secret":        true,
+	"code":          true,
+	"authorization": true,
+	"cookie":        true,
+}
+
+const REDACTED = "[REDACTED]"
+
+// Client supplied ids are kept when they look like ids, anything else is replaced
+var validID = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// Hide secret attributes, at any depth of groups
+func redact(groups []string, a slog.Attr) slog.Attr {
+	if secrets[strings.ToLower(a.Key)] {
+		return slog.String(a.Key, REDACTED)
+	}
+	return a
+}
+
+// Level from log.level, info if it doesn't parse
+func level(name string) slog.Level {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(name)); err != nil {
+		return slog.LevelInfo
+	}
+	return l
+}
+
+// Build the logger from log.level (debug, info, warn, error) and
+// log.format (json, text)
+// The standard log package writes through it too
+func Init() {
+	cfg := config.Get().Log
+	opts := &slog.HandlerOptions{Level: level(cfg.Level), ReplaceAttr: redact}
+
+	var handler slog.Handler
+	if cfg.Format == "text" {
+		handler = slog.NewTextHandler(os.Stderr, opts)
+	} else {
+		handler = slog.NewJSONHandler(os.Stderr, opts)
+	}
+	slog.SetDefault(slog.New(handler))
+
+	slog.Info("Initializing logger", "level", opts.Level.Level().String())
+}
+
+// Handler of a package logger, resolved on every record so package
+// level loggers made before Init() still use the configured handler
+type component struct {
+	name string
+}
+
+func (h component) handler() slog.Handler {
+	return slog.Default().Handler().WithAttrs([]slog.Attr{slog.String("component", h.name)})
+}
+
+func (h component) Enabled(ctx context.Context, l slog.Level) bool {
+	return slog.Default().Handler().Enabled(ctx, l)
+}
+
+func (h component) Handle(ctx context.Context, r slog.Record) error {
+	return h.handler().Handle(ctx, r)
+}
+
+func (h component) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return h.handler().WithAttrs(attrs)
+}
+
+func (h component) WithGroup(name string) slog.Handler {
+	return h.handler().WithGroup(name)
+}
+
+// Logger of a package, every line is tagged with its component
+func For(name string) *slog.Logger {
+	return slog.New(component{name})
+}
+
+// Log err and exit, for startup errors and listeners the server can't run without
+// Requests log and fail on their own instead, see bres.AbortWithError
+func Fatal(err error) {
+	slog.Error("fatal", "err", err)
+	os.Exit(1)
+}
+
+// Per request logger, fields are added as the request learns them
+type requestLogger struct {
+	id     string
+	ip     string
+	logger *slog.Logger
+}
+
+type requestKey struct{}
+
+// A request's logger, or the default logger outside a request
+// Takes a *gin.Context too
+func From(ctx context.Context) *slog.Logger {
+	if c, ok := ctx.(*gin.Context); ok {
+		ctx = c.Request.Context()
+	}
+	if r, ok := ctx.Value(requestKey{}).(*requestLogger); ok {
+		return r.logger
+	}
+	return slog.Default()
+}
+
+// Add fields to every following line of a request, e.g. the user once authenticated
+func With(ctx context.Context, args ...any) {
+	if c, ok := ctx.(*gin.Context); ok {
+		ctx = c.Request.Context()
+	}
+	if r, ok := ctx.Value(requestKey{}).(*requestLogger); ok {
+		r.logger = r.logger.With(args...)
+	}
+}
+
+// Context carrying a logger for request id from a client at ip
+func WithRequest(ctx context.Context, id string, ip string) context.Context {
+	return context.WithValue(ctx, requestKey{}, &requestLogger{
+		id:     id,
+		ip:     ip,
+		logger: slog.Default().With("request_id", id),
+	})
+}
+
+// The id of the request ctx belongs to, empty outside a request
+// Takes a *gin.Context too
+func ID(ctx context.Context) string {
+	if c, ok := ctx.(*gin.Context); ok {
+		ctx = c.Request.Context()
+	}
+	if r, ok := ctx.Value(requestKey{}).(*requestLogger); ok {
+		return r.id
+	}
+	return ""
+}
+
+// The IP of the client that sent the request ctx belongs to, empty outside a request
+// Takes a *gin.Context too
+func IP(ctx context.Context) string {
+	if c, ok := ctx.(*gin.Context); ok {
+		ctx = c.Request.Context()
+	}
+	if r, ok := ctx.Value(requestKey{}).(*requestLogger); ok {
+		return r.ip
+	}
+	return ""
+}
+
+// The client's request id when it is usable, else a new one
+func RequestID(id string) string {
+	if validID.MatchString(id) {
+		return id
+	}
+	return uuid.NewString()
+}
+
+// Assign or propagate X-Request-ID, then log the request once it is done
+// The group comes from the :id param, which the v1 adapters fill in too
+func Middleware(c *gin.Context) {
+	id := RequestID(c.GetHeader(REQUEST_ID_HEADER))
+	c.Header(REQUEST_ID_HEADER, id)
+	c.Request = c.Request.WithContext(WithRequest(c.Request.Context(), id, c.ClientIP()))
+
+	start := time.Now()
+	c.Next()
+
+	status := c.Writer.Status()
+	attrs := []slog.Attr{
+		slog.String("method", c.Request.Method),
+		slog.String("route", c.FullPath()),
+		slog.String("path", c.Request.URL.Path),
+		slog.Int("status", status),
+		slog.Duration("latency", time.Since(start)),
+		slog.String("ip", c.ClientIP()),
+	}
+	if group := c.Param("id"); group != "" {
+		attrs = append(attrs, slog.String("group", group))
+	}
+
+	lvl := slog.LevelInfo
+	if status >= 500 {
+		lvl = slog.LevelError
+	}
+	From(c).LogAttrs(c.Request.Context(), lvl, "request", attrs...)
+}
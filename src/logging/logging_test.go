@@ -0,0 +1,72 @@
+package logging
+
+import (
+	"bytes"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestRedact(t *testing.T) {
+	var out bytes.Buffer
+	log := slog.New(slog.NewJSONHandler(&out, &slog.HandlerOptions{ReplaceAttr: redact}))
+
+	log.Info("login", "user", "ann", "password", "hunter2", "Token", "abc123",
+		slog.Group("req", "authorization", "Bearer abc123", "path", "/api/v2/me"))
+
+	line := out.String()
+	for _, leaked := range []string{"hunter2", "abc123"} {
+		if strings.Contains(line, leaked) {
+			t.Errorf("%q logged in %s", leaked, line)
+		}
+	}
+	for _, kept := range []string{`"user":"ann"`, `"password":"` + REDACTED + `"`, `"Token":"` + REDACTED + `"`, `"path":"/api/v2/me"`} {
+		if !strings.Contains(line, kept) {
+			t.Errorf("missing %s in %s", kept, line)
+		}
+	}
+}
+
+func TestLevel(t *testing.T) {
+	tests := []struct {
+		name string
+		want slog.Level
+	}{
+		{"debug", slog.LevelDebug},
+		{"info", slog.LevelInfo},
+		{"warn", slog.LevelWarn},
+		{"ERROR", slog.LevelError},
+		{"", slog.LevelInfo},
+		{"loud", slog.LevelInfo},
+	}
+	for _, tt := range tests {
+		if got := level(tt.name); got != tt.want {
+			t.Errorf("level(%q) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	tests := []struct {
+		id   string
+		kept bool
+	}{
+		{"abc-123", true},
+		{"4f9c2b1e.retry_2", true},
+		{strings.Repeat("a", 64), true},
+		{strings.Repeat("a", 65), false},
+		{"", false},
+		{"has space", false},
+		{"new\nline", false},
+		{"<script>", false},
+	}
+	for _, tt := range tests {
+		got := RequestID(tt.id)
+		if (got == tt.id) != tt.kept {
+			t.Errorf("RequestID(%q) = %q, kept %v, want %v", tt.id, got, got == tt.id, tt.kept)
+		}
+		if !validID.MatchString(got) {
+			t.Errorf("RequestID(%q) = %q, not a valid id", tt.id, got)
+		}
+	}
+}
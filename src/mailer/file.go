@@ -0,0 +1,26 @@
+// File drop Mailer for local testing, every email becomes a .eml file in Dir
+package mailer
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type FileMailer struct {
+	Dir string
+}
+
+func (f *FileMailer) Send(to string, subject string, body string) error {
+	if err := os.MkdirAll(f.Dir, 0755); err != nil {
+		return err
+	}
+
+	// Keep the name filesystem safe, the address is in the To header anyway
+	name := strconv.FormatInt(time.Now().UnixNano(), 10) + "-" +
+		strings.NewReplacer("@", "_at_", "/", "_", "\\", "_").Replace(to) + ".eml"
+
+	return os.WriteFile(filepath.Join(f.Dir, name), message(to, subject, body), 0644)
+}
@@ -0,0 +1,47 @@
+// Outgoing email for account verification and password resets
+// mail.provider selects "file" (default, drops .eml files in mail.dir) or "smtp"
+// Must call mailer.Init() before sending
+package mailer
+
+import (
+	"benschreiber.com/purestserver/src/config"
+	"benschreiber.com/purestserver/src/logging"
+)
+
+var logger = logging.For("mailer")
+
+// Sends a plain text email
+type Mailer interface {
+	Send(to string, subject string, body string) error
+}
+
+var mailer Mailer
+
+// Address mail is sent from
+var from string
+
+// Send a plain text email through the configured Mailer
+func Send(to string, subject string, body string) error {
+	return mailer.Send(to, subject, body)
+}
+
+// Select the Mailer from the mail config
+func Init() {
+	logger.Info("Initializing mailer")
+
+	cfg := config.Get().Mail
+	from = cfg.From
+
+	switch cfg.Provider {
+	case "smtp":
+		mailer = &SMTPMailer{
+			Host: cfg.SMTP.Host,
+			Port: cfg.SMTP.Port,
+			User: cfg.SMTP.User,
+			Pass: cfg.SMTP.Pass,
+		}
+
+	default:
+		mailer = &FileMailer{Dir: cfg.Dir}
+	}
+}
@@ -0,0 +1,37 @@
+// SMTP Mailer, authenticates with PLAIN when a user is set
+package mailer
+
+import (
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+type SMTPMailer struct {
+	Host string
+	Port string
+	User string
+	Pass string
+}
+
+// Build an RFC 5322 message
+func message(to string, subject string, body string) []byte {
+	var b strings.Builder
+	b.WriteString("From: " + from + "\r\n")
+	b.WriteString("To: " + to + "\r\n")
+	b.WriteString("Subject: " + subject + "\r\n")
+	b.WriteString("Date: " + time.Now().Format(time.RFC1123Z) + "\r\n")
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=UTF-8\r\n")
+	b.WriteString("\r\n")
+	b.WriteString(strings.ReplaceAll(body, "\n", "\r\n"))
+	return []byte(b.String())
+}
+
+func (s *SMTPMailer) Send(to string, subject string, body string) error {
+	var auth smtp.Auth
+	if s.User != "" {
+		auth = smtp.PlainAuth("", s.User, s.Pass, s.Host)
+	}
+	return smtp.SendMail(s.Host+":"+s.Port, auth, from, []string{to}, message(to, subject, body))
+}
@@ -0,0 +1,377 @@
+package main
+
+import (
+	"benschreiber.com/purestserver/src/accounts"
+	"benschreiber.com/purestserver/src/audit"
+	"benschreiber.com/purestserver/src/bres"
+	"benschreiber.com/purestserver/src/bres/ratelimit"
+	"benschreiber.com/purestserver/src/bres/tokens"
+	"benschreiber.com/purestserver/src/bsql"
+	"benschreiber.com/purestserver/src/groups"
+	"benschreiber.com/purestserver/src/logging"
+	"github.com/gin-gonic/gin"
+)
+
+// Users and groups per page when the query doesn't say
+const ADMIN_PAGE = 50
+
+// Register the operator routes on admin, a /api/admin group
+// Every handler requires the admin role and audits what it did
+func registerAdmin(admin *gin.RouterGroup) {
+	admin.GET("/users", getAdminUsers)
+	admin.GET("/users/:user", getAdminUser)
+	admin.POST("/users/:user/disable", postAdminDisable)
+	admin.POST("/users/:user/enable", postAdminEnable)
+	admin.DELETE("/users/:user/sessions", delAdminSessions)
+	admin.GET("/groups", getAdminGroups)
+	admin.GET("/groups/:id", getAdminGroup)
+	admin.POST("/groups/:id/coin", postAdminCoin)
+	admin.GET("/audit", getAdminAudit)
+	admin.GET("/sessions", getAdminSessionList)
+	admin.GET("/ratelimit", getAdminRateLimit)
+}
+
+// Record what an admin did, before they see the result
+func auditAdmin(c *gin.Context, action string, target string, group string) {
+	audit.Record(c.Request.Context(), audit.Event{
+		Actor:  bres.User(c),
+		Action: action,
+		Target: target,
+		Group:  group,
+	})
+}
+
+// Validate the token and the admin role
+// STATUS: 401 Unauthorized on missing, invalid or expired token
+// STATUS: 403 Forbidden for anyone but an admin
+func validateAdmin(c *gin.Context) bool {
+	ok, err := bres.ValidateAdmin(c)
+	if err != nil {
+		bres.AbortWithError(c, err)
+		return false
+	}
+	return ok
+}
+
+// METHOD: GET
+// Search users by username or email prefix
+// Requires Authorization header; q, limit, offset query
+func getAdminUsers(c *gin.Context) {
+
+	// STATUS: 401, 403 as validateAdmin
+	if !validateAdmin(c) {
+		return
+	}
+
+	// STATUS: 400 Bad Request with field errors
+	var q bres.SearchQuery
+	if !bres.BindQuery(c, &q) {
+		return
+	}
+	if q.Limit == 0 {
+		q.Limit = ADMIN_PAGE
+	}
+
+	users, err := accounts.Search(c.Request.Context(), q.Q, q.Limit, q.Offset)
+	if err != nil {
+		bres.AbortWithError(c, err)
+		return
+	}
+	if users == nil {
+		users = []bsql.UserAccount{}
+	}
+
+	auditAdmin(c, audit.ADMIN_SEARCH_USERS, "", "")
+
+	// STATUS: 200 OK
+	c.JSON(200, users)
+}
+
+// METHOD: GET
+// Return a user's account, two-factor status, groups and sessions on this server
+// Requires Authorization header; user param
+func getAdminUser(c *gin.Context) {
+
+	// STATUS: 401, 403 as validateAdmin
+	if !validateAdmin(c) {
+		return
+	}
+
+	// STATUS: 404 on nonexistant user
+	user := c.Param("user")
+	account, err := accounts.Get(c.Request.Context(), user)
+	if err != nil {
+		abortWithAccountError(c, err)
+		return
+	}
+
+	twoFactor, err := bsql.GetTwoFactorStatus(c.Request.Context(), user)
+	if err != nil {
+		bres.AbortWithError(c, err)
+		return
+	}
+	ids, err := bsql.GetUserGroupIDs(c.Request.Context(), user)
+	if err != nil {
+		bres.AbortWithError(c, err)
+		return
+	}
+	if ids == nil {
+		ids = []string{}
+	}
+	sessions := []tokens.Session{}
+	for _, s := range tokens.Sessions() {
+		if s.User == user {
+			sessions = append(sessions, s)
+		}
+	}
+
+	auditAdmin(c, audit.ADMIN_VIEW_USER, user, "")
+
+	// STATUS: 200 OK
+	c.JSON(200, gin.H{
+		"account":    account,
+		"two_factor": twoFactor,
+		"groups":     ids,
+		"sessions":   sessions,
+	})
+}
+
+// METHOD: POST
+// Disable an account, it can't log in and its sessions end
+// Requires Authorization header; user param
+func postAdminDisable(c *gin.Context) {
+
+	// STATUS: 401, 403 as validateAdmin
+	if !validateAdmin(c) {
+		return
+	}
+
+	// STATUS: 400 Bad Request on disabling yourself, nobody could undo it but purestctl
+	user := c.Param("user")
+	if user == bres.User(c) {
+		logging.From(c).Info("admin tried to disable themselves")
+		c.AbortWithStatus(400)
+		return
+	}
+
+	// STATUS: 404 on nonexistant user
+	if err := accounts.Disable(c.Request.Context(), user); err != nil {
+		abortWithAccountError(c, err)
+		return
+	}
+	tokens.RevokeUser(user)
+
+	auditAdmin(c, audit.ADMIN_DISABLE_USER, user, "")
+
+	// STATUS: 200 OK
+	c.Status(200)
+}
+
+// METHOD: POST
+// Let a disabled account log in again
+// Requires Authorization header; user param
+func postAdminEnable(c *gin.Context) {
+
+	// STATUS: 401, 403 as validateAdmin
+	if !validateAdmin(c) {
+		return
+	}
+
+	// STATUS: 404 on nonexistant user
+	user := c.Param("user")
+	if err := accounts.Enable(c.Request.Context(), user); err != nil {
+		abortWithAccountError(c, err)
+		return
+	}
+
+	auditAdmin(c, audit.ADMIN_ENABLE_USER, user, "")
+
+	// STATUS: 200 OK
+	c.Status(200)
+}
+
+// METHOD: DEL
+// End every session of a user on every server
+// Requires Authorization header; user param
+func delAdminSessions(c *gin.Context) {
+
+	// STATUS: 401, 403 as validateAdmin
+	if !validateAdmin(c) {
+		return
+	}
+
+	// STATUS: 404 on nonexistant user
+	user := c.Param("user")
+	if err := accounts.RevokeSessions(c.Request.Context(), user); err != nil {
+		abortWithAccountError(c, err)
+		return
+	}
+	tokens.RevokeUser(user)
+
+	auditAdmin(c, audit.ADMIN_REVOKE_SESSIONS, user, "")
+
+	// STATUS: 200 OK
+	c.Status(200)
+}
+
+// METHOD: GET
+// Search groups by id, creator or member prefix
+// Requires Authorization header; q, limit, offset query
+func getAdminGroups(c *gin.Context) {
+
+	// STATUS: 401, 403 as validateAdmin
+	if !validateAdmin(c) {
+		return
+	}
+
+	// STATUS: 400 Bad Request with field errors
+	var q bres.SearchQuery
+	if !bres.BindQuery(c, &q) {
+		return
+	}
+	if q.Limit == 0 {
+		q.Limit = ADMIN_PAGE
+	}
+
+	list, err := groups.Search(c.Request.Context(), q.Q, q.Limit, q.Offset)
+	if err != nil {
+		bres.AbortWithError(c, err)
+		return
+	}
+	if list == nil {
+		list = []*bsql.Group{}
+	}
+
+	auditAdmin(c, audit.ADMIN_SEARCH_GROUPS, "", "")
+
+	// STATUS: 200 OK
+	c.JSON(200, list)
+}
+
+// METHOD: GET
+// Return any group, whoever is asking
+// Requires Authorization header; group id param
+func getAdminGroup(c *gin.Context) {
+
+	// STATUS: 401, 403 as validateAdmin
+	if !validateAdmin(c) {
+		return
+	}
+
+	// STATUS: 404 on nonexistant group
+	id := c.Param("id")
+	group, err := groups.Inspect(c.Request.Context(), id)
+	if err != nil {
+		abortWithGroupError(c, err)
+		return
+	}
+
+	auditAdmin(c, audit.ADMIN_VIEW_GROUP, "", id)
+
+	// STATUS: 200 OK
+	c.JSON(200, group)
+}
+
+// METHOD: POST
+// Hand the coin to a member without counting a pass
+// Requires Authorization header; group id param; JSON body {username}
+func postAdminCoin(c *gin.Context) {
+
+	// STATUS: 401, 403 as validateAdmin
+	if !validateAdmin(c) {
+		return
+	}
+
+	// STATUS: 400 Bad Request with field errors
+	var req bres.ReassignRequest
+	if !bres.BindRequest(c, &req) {
+		return
+	}
+
+	// STATUS: 404 on nonexistant group or a user outside it
+	// STATUS: 400 when they already hold it
+	// STATUS: 403 when the holder passed it first
+	id := c.Param("id")
+	pass, err := groups.Reassign(c.Request.Context(), id, req.Username)
+	if err != nil {
+		abortWithGroupError(c, err)
+		return
+	}
+
+	auditAdmin(c, audit.ADMIN_REASSIGN_COIN, req.Username, id)
+
+	// STATUS: 201 Created
+	c.JSON(201, pass)
+}
+
+// METHOD: GET
+// Page through the audit log, newest first
+// Requires Authorization header; actor, action, target, group, before, limit query
+func getAdminAudit(c *gin.Context) {
+
+	// STATUS: 401, 403 as validateAdmin
+	if !validateAdmin(c) {
+		return
+	}
+
+	// STATUS: 400 Bad Request with field errors
+	var q bres.AuditQuery
+	if !bres.BindQuery(c, &q) {
+		return
+	}
+
+	events, err := audit.Query(c.Request.Context(), bsql.AuditFilter{
+		Actor:  q.Actor,
+		Action: q.Action,
+		Target: q.Target,
+		Group:  q.Group,
+		Before: q.Before,
+		Limit:  q.Limit,
+	})
+	if err != nil {
+		bres.AbortWithError(c, err)
+		return
+	}
+	if events == nil {
+		events = []bsql.AuditEvent{}
+	}
+
+	auditAdmin(c, audit.ADMIN_VIEW_AUDIT, q.Target, q.Group)
+
+	// STATUS: 200 OK
+	c.JSON(200, events)
+}
+
+// METHOD: GET
+// Every session held by this server, tokens left out
+// Requires Authorization header
+func getAdminSessionList(c *gin.Context) {
+
+	// STATUS: 401, 403 as validateAdmin
+	if !validateAdmin(c) {
+		return
+	}
+
+	sessions := tokens.Sessions()
+	auditAdmin(c, audit.ADMIN_VIEW_SESSIONS, "", "")
+
+	// STATUS: 200 OK
+	c.JSON(200, sessions)
+}
+
+// METHOD: GET
+// Every IP this server's rate limiter is counting, blocked ones first
+// Requires Authorization header
+func getAdminRateLimit(c *gin.Context) {
+
+	// STATUS: 401, 403 as validateAdmin
+	if !validateAdmin(c) {
+		return
+	}
+
+	visitors := ratelimit.Visitors()
+	auditAdmin(c, audit.ADMIN_VIEW_RATE_LIMITS, "", "")
+
+	// STATUS: 200 OK
+	c.JSON(200, visitors)
+}
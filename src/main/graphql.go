@@ -0,0 +1,44 @@
+package main
+
+import (
+	"benschreiber.com/purestserver/src/bres"
+	"benschreiber.com/purestserver/src/graph"
+	"github.com/gin-gonic/gin"
+)
+
+// METHOD: POST
+// Run a GraphQL query
+// Requires Authorization header; query, operationName and variables body
+func postGraphQL(c *gin.Context) {
+
+	// Validate the bearer token, identity goes in the context
+	// STATUS: 401 Unauthorized on missing, invalid or expired token
+	ok, err := bres.ValidateAuthentication(c)
+	if err != nil {
+		bres.AbortWithError(c, err)
+		return
+	}
+	if !ok {
+		return
+	}
+
+	// STATUS: 400 Bad Request on a body that isn't a GraphQL request
+	var req graph.Request
+	if err = c.ShouldBindJSON(&req); err != nil {
+		c.AbortWithStatusJSON(400, gin.H{"errors": []gin.H{{"message": "body must be a GraphQL request"}}})
+		return
+	}
+
+	// Field, depth and complexity errors are in the response
+	// STATUS: 200 OK
+	c.JSON(200, graph.Exec(c.Request.Context(), bres.User(c), &req))
+}
+
+// METHOD: GET
+// Open a graphql-transport-ws socket for subscriptions
+// Authenticates in connection_init, or with the Authorization header
+func getGraphQL(c *gin.Context) {
+
+	// STATUS: 101 Switching Protocols
+	graph.Serve(c)
+}
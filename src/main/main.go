@@ -1,107 +1,241 @@
 package main
 
 import (
+	"benschreiber.com/purestserver/src/accounts"
+	"benschreiber.com/purestserver/src/achievements"
+	"benschreiber.com/purestserver/src/audit"
 	"benschreiber.com/purestserver/src/bres"
 	"benschreiber.com/purestserver/src/bres/ratelimit"
     "benschreiber.com/purestserver/src/bres/tokens"
+	"benschreiber.com/purestserver/src/bres/totp"
 	"benschreiber.com/purestserver/src/bsql"
+	"benschreiber.com/purestserver/src/config"
+	"benschreiber.com/purestserver/src/events"
+	"benschreiber.com/purestserver/src/gateway"
+	"benschreiber.com/purestserver/src/graph"
+	"benschreiber.com/purestserver/src/groups"
+	"benschreiber.com/purestserver/src/health"
+	"benschreiber.com/purestserver/src/logging"
+	"benschreiber.com/purestserver/src/mailer"
+	"benschreiber.com/purestserver/src/metrics"
+	"benschreiber.com/purestserver/src/notify"
+	"benschreiber.com/purestserver/src/rpc"
+	"benschreiber.com/purestserver/src/tracing"
+	"benschreiber.com/purestserver/src/webhooks"
+	"github.com/gin-contrib/sse"
 	"github.com/gin-gonic/gin"
-	"github.com/go-sql-driver/mysql"
-	"log"
+	"github.com/google/uuid"
+	"io"
+	"strconv"
+	"time"
+)
+
+// Name authenticator apps show next to the account
+const TOTP_ISSUER = "Pushup App"
+
+// How long emailed codes stay valid
+const (
+	VERIFY_CODE_LIFETIME = 24 * time.Hour
+	RESET_CODE_LIFETIME  = 15 * time.Minute
 )
 
 func main() {
 
+	//Settings from flags, the environment and the config file, exits on bad ones
+	config.Init()
+
+	//Structured logs, log.level and log.format
+	logging.Init()
+
+	//Trace exporter, tracing.exporter
+	tracing.Init()
+
 	//Establish connection to local db
 	if err := bsql.Establishconnection(); err != nil {
-		log.Fatal(err)
+		logging.Fatal(err)
 	}
 
 	//Establish token pool, establish ratelimit map
 	bres.Init()
 
-	//Define API endpoint
-	router := gin.Default()
-	router.Use(ratelimit.IPRateLimiter)
+	//Establish group event hub, websocket rooms
+	events.Init()
+	gateway.Init()
+
+	//Queue group events for webhooks, start delivering
+	webhooks.Init()
+
+	//Award badges for group events, after webhooks queue the event that earned them
+	achievements.Init()
+
+	//Register push providers, start dispatching the outbox
+	notify.Init()
+
+	//Select the mailer for verification and reset codes
+	mailer.Init()
+
+	//Serve the gRPC API on its own port
+	rpc.Init()
+
+	//Parse the GraphQL schema
+	graph.Init()
+
+	//Serve /livez, /readyz and /metrics on the admin port, and /api/admin when server.admin_api is admin
+	health.Mount(func(router *gin.Engine) {
+		router.GET("/metrics", gin.WrapH(metrics.Handler()))
+	})
+	if config.Get().Server.AdminAPI == "admin" {
+		health.Mount(func(router *gin.Engine) {
+			registerAdmin(router.Group("/api/admin", logging.Middleware, tracing.Middleware, metrics.Middleware, bres.Strict))
+		})
+	}
+	health.Init()
+
+	// API description, startup warns if it misses a route
+	router := newRouter()
+	spec = apiSpec()
+	checkSpec(router)
+
+	//server.port until SIGINT or SIGTERM, then drain and stop
+	serve(router)
+}
+
+// Every public route, server.admin_api decides if /api/admin is one of them
+func newRouter() *gin.Engine {
+	router := gin.New()
+	router.Use(logging.Middleware, tracing.Middleware, metrics.Middleware, gin.Recovery(), ratelimit.IPRateLimiter)
 
 	// Health check 
 	router.GET("/api/healthcheck", healthCheckPing)
 
-	// Client endpoints
-	client := "/api/client/"
-	router.POST(client+"login", loginClient)
-	router.POST(client+"register", registerClient)
+	// Versioned endpoints, v1 adapts onto the v2 handlers
+	registerV1(router)
+	registerV2(router)
+
+	// Operator routes, admin role only
+	if config.Get().Server.AdminAPI == "public" {
+		registerAdmin(router.Group("/api/admin", bres.Strict))
+	}
+
+	// GraphQL queries, subscriptions over a websocket
+	router.POST("/api/graphql", bres.Strict, postGraphQL)
+	router.GET("/api/graphql", getGraphQL)
 
-	// Group endpoints
-	group := "/api/group/"
-	router.GET(group+":user", getGroup)
-	router.POST(group+"create", postGroup)
-	router.POST(group+"join", postGroupMember)
-	router.POST(group+"coin", postCoin)
-	router.DELETE(group+"kick/:user", delGroupMember)
-	router.DELETE(group+"disband", delGroup)
+	// API description, spec_test.go fails if it misses a route
+	router.GET("/api/openapi.json", getOpenAPI)
 
-	//port 8080
-	router.Run()
+	return router
 }
 
-//TODO: Validate this is an internal reuqest
+// Public ping kept for existing clients
+// Orchestrators use /livez and /readyz on the admin listener
 func healthCheckPing(c *gin.Context) {
-	if err := bsql.PingDB(); err != nil {
+	if err := bsql.PingDB(c.Request.Context()); err != nil {
 		c.AbortWithStatus(500)
 		return
 	}
 
-	c.JSON(200, gin.H{"success:": "sucess whale"})
+	c.JSON(200, gin.H{"success": "success whale"})
 
 }
 
 // METHOD: POST
 // Generate API token in bres package
-// Requires Username, Password headers
+// Requires JSON body {username, password}
 func loginClient(c *gin.Context) {
 
-	// Validate headers exist
-	// STATUS: 400 Bad Request on missing headers
-	if !bres.ValidateHeaders(c, "Username", "Password") {
+	// Validate body fields exist and are in allowed characters
+	// STATUS: 400 Bad Request with field errors
+	var req bres.LoginRequest
+	if !bres.BindRequest(c, &req) {
 		return
 	}
 
-	//Grab headers
-	user := c.GetHeader("Username")
-	pass := c.GetHeader("Password")
+	user := req.Username
+	pass := req.Password
+
+	// Validate the credentials the user gave
+	// STATUS: 404 on nonexistant user
+	// STATUS: 401 Unauthorized on invalid credentials
+	// STATUS: 403 Forbidden on a disabled account
+	switch err := accounts.Login(c.Request.Context(), user, pass); err {
+	case nil:
+	case accounts.ErrUserNotFound:
+		c.AbortWithStatus(404)
+		return
+	case accounts.ErrInvalidCredentials:
+		c.AbortWithStatus(401)
+		return
+	case accounts.ErrDisabled:
+		logging.From(c).Info("login to a disabled account", "user", user)
+		c.AbortWithStatus(403)
+		return
+	default:
+		bres.AbortWithError(c, err)
+		return
+	}
 
-	// Validate userpass in allowed characters
-	// STATUS: 400 bad request on illegal characters
-	ok, err := bres.ValidateUserPassRegex(c, user, pass)
+	// With two-factor on, the password only earns a challenge
+	// STATUS: 202 Accepted, finish at login/2fa
+	tf, ok, err := bsql.GetTwoFactor(c.Request.Context(), user)
 	if err != nil {
-		log.Fatal(err)
+		bres.AbortWithError(c, err)
+		return
 	}
-	if !ok {
+	if ok && tf.Enabled {
+		c.JSON(202, gin.H{
+			"challenge":  tokens.AddChallenge(c.ClientIP(), user),
+			"expires_in": int(tokens.CHALLENGE_LIFETIME.Seconds()),
+		})
 		return
 	}
 
-	// STATUS: 404 on nonexistant user
-	ok, err = bsql.UserExists(user)
-	if err != nil {
-		log.Fatal(err)
+	accounts.LoggedIn(c.Request.Context(), user)
+
+	// Create the token in memory, return in JSON
+	// STATUS: 201 Created
+	c.JSON(201, gin.H{"token": tokens.AddClient(c.ClientIP(), user)})
+}
+
+// METHOD: POST
+// Second login step for users with two-factor enabled
+// Requires JSON body {challenge, code} (TOTP or recovery code)
+func loginSecondFactor(c *gin.Context) {
+
+	// Validate body fields exist
+	// STATUS: 400 Bad Request with field errors
+	var req bres.SecondFactorRequest
+	if !bres.BindRequest(c, &req) {
+		return
 	}
+
+	challenge := req.Challenge
+
+	// STATUS: 401 Unauthorized on unknown, expired or foreign challenge
+	user, ok := tokens.GetChallenge(challenge, c.ClientIP())
 	if !ok {
-		c.AbortWithStatus(404)
+		logging.From(c).Info("invalid challenge")
+		c.AbortWithStatus(401)
 		return
 	}
 
-	// Validate the credentials the user gave
-	// STATUS: 401 Unauthorized on invalid credentials
-	ok, err = bsql.MatchUserPass(user, pass)
+	// STATUS: 401 Unauthorized on wrong code
+	ok, err := bres.ValidateSecondFactor(c.Request.Context(), user, req.Code)
 	if err != nil {
-		log.Fatal(err)
+		bres.AbortWithError(c, err)
+		return
 	}
 	if !ok {
+		logging.From(c).Info("invalid second factor", "user", user)
+		tokens.FailChallenge(challenge)
+		accounts.LoginFailed(c.Request.Context(), user, nil)
 		c.AbortWithStatus(401)
 		return
 	}
 
+	tokens.DeleteChallenge(challenge)
+	accounts.LoggedIn(c.Request.Context(), user)
+
 	// Create the token in memory, return in JSON
 	// STATUS: 201 Created
 	c.JSON(201, gin.H{"token": tokens.AddClient(c.ClientIP(), user)})
@@ -109,78 +243,114 @@ func loginClient(c *gin.Context) {
 
 // METHOD: POST
 // Insert a new user into the database
-// Requires Username, Password headers
+// Requires JSON body {username, password}
+// Optional email field, a verification code is mailed to it
 func registerClient(c *gin.Context) {
 
-	// Validate headers exist
-	// STATUS: 400 Bad Request on missing headers
-	if !bres.ValidateHeaders(c, "Username", "Password") {
+	// Validate body fields exist and are in allowed characters
+	// STATUS: 400 Bad Request with field errors
+	var req bres.RegisterRequest
+	if !bres.BindRequest(c, &req) {
 		return
 	}
 
-	// Grab headers
-	user := c.GetHeader("Username")
-	pass := c.GetHeader("Password")
-
-	// Validate userpass in allowed characters
-	// STATUS: 400 bad request on illegal characters
-	ok, err := bres.ValidateUserPassRegex(c, user, pass)
-	if err != nil {
-		log.Fatal(err)
-	}
-	if !ok {
-		return
-	}
+	user := req.Username
+	pass := req.Password
 
-	// Validate Username is unique
+	// Without an email the account can't be recovered, but that is the user's call
 	// STATUS: 400 Bad Request on non unique user
-	ok, err = bsql.UserExists(user)
-	if err != nil {
-		log.Fatal(err)
-	}
-	if ok {
-		log.Println("user already exists")
+	// STATUS: 400 Bad Request on an email used by another account
+	email := req.Email
+	switch err := accounts.Register(c.Request.Context(), user, pass, email); err {
+	case nil:
+	case accounts.ErrUserExists, accounts.ErrEmailInUse:
+		logging.From(c).Info("registration refused", "err", err)
 		c.AbortWithStatus(400)
 		return
+	default:
+		bres.AbortWithError(c, err)
+		return
 	}
 
-	// Add user to db
-	if err = bsql.InsertNewUser(user, pass); err != nil {
-		log.Fatal(err)
+	if email == "" {
+		// STATUS: 201 Created
+		c.Status(201)
+		return
 	}
 
+	sendVerification(c, user, email)
+
 	// STATUS: 201 Created
 	c.Status(201)
 }
 
+// Respond to a broken group rule with its status code
+// Anything else is a database error, a 500 like everywhere else
+func abortWithGroupError(c *gin.Context, err error) {
+	switch err {
+	case groups.ErrGroupNotFound, groups.ErrMemberNotFound, groups.ErrNoGroup:
+		logging.From(c).Info("group rule broken", "err", err)
+		c.AbortWithStatus(404)
+	case groups.ErrNotMember, groups.ErrNotCreator, groups.ErrNotCoinHolder, groups.ErrAlreadyOwner:
+		logging.From(c).Info("group rule broken", "err", err)
+		c.AbortWithStatus(403)
+	case groups.ErrAlreadyMember, groups.ErrAlreadyHolder:
+		logging.From(c).Info("group rule broken", "err", err)
+		c.AbortWithStatus(400)
+	default:
+		bres.AbortWithError(c, err)
+	}
+}
+
+// Respond to a broken account rule with its status code
+// Anything else is a database error, a 500 like everywhere else
+func abortWithAccountError(c *gin.Context, err error) {
+	switch err {
+	case accounts.ErrUserNotFound:
+		logging.From(c).Info("account rule broken", "err", err)
+		c.AbortWithStatus(404)
+	default:
+		bres.AbortWithError(c, err)
+	}
+}
+
+// Mail a fresh verification code, failures only get logged
+// so the user can ask for another one
+func sendVerification(c *gin.Context, user string, email string) {
+	code := bres.NewCode()
+	if err := bsql.InsertCode(c.Request.Context(), user, bsql.CODE_VERIFY, code, VERIFY_CODE_LIFETIME); err != nil {
+		logging.From(c).Error("verification code not saved", "err", err)
+		return
+	}
+
+	body := "Hi " + user + ",\n\n" +
+		"Your pushup app verification code is: " + code + "\n\n" +
+		"It expires in 24 hours.\n"
+	if err := mailer.Send(email, "Verify your email", body); err != nil {
+		logging.From(c).Error("verification email failed", "err", err)
+	}
+}
+
 // METHOD: GET
-// Return all Group fields and Group Members
-// Requires Username, Token headers; user param
+// Return all fields and members of the user's group
+// Requires Authorization header; user param
 func getGroup(c *gin.Context) {
 
-	// Validate userpass and Token fields exis
-	// STATUS: 401 Unauthorized on invalid token
-	// STATUS: 400 Bad Request on missing header; illegal chars
-	// STATUS: 404 on non-existant user
+	// Validate the bearer token, identity goes in the context
+	// STATUS: 401 Unauthorized on missing, invalid or expired token
 	ok, err := bres.ValidateAuthentication(c)
 	if err != nil {
-		log.Fatal(err)
+		bres.AbortWithError(c, err)
+		return
 	}
 	if !ok {
 		return
 	}
 
-	// Grab user parameter
-	user := c.Param("user")
-
-	// Create return JSON
 	// STATUS: 404 Not Found if user is not in a group
-	group, ok, err := bsql.GetUserGroup(user)
+	group, err := groups.ForUser(c.Request.Context(), c.Param("user"))
 	if err != nil {
-		log.Fatal(err)
-	}
-	if !ok {
-		c.AbortWithStatus(404)
+		abortWithGroupError(c, err)
 		return
 	}
 
@@ -190,287 +360,1214 @@ func getGroup(c *gin.Context) {
 
 // METHOD: POST
 // Insert a new group into the database
-// Requires Username, Token headers
+// Requires Authorization header
 func postGroup(c *gin.Context) {
 
-	// Validate userpass and Token fields exis
-	// STATUS: 401 Unauthorized on invalid token
-	// STATUS: 400 Bad Request on missing header; illegal chars
-	// STATUS: 404 on non-existant user
+	// Validate the bearer token, identity goes in the context
+	// STATUS: 401 Unauthorized on missing, invalid or expired token
 	ok, err := bres.ValidateAuthentication(c)
 	if err != nil {
-		log.Fatal(err)
+		bres.AbortWithError(c, err)
+		return
 	}
 	if !ok {
 		return
 	}
 
-	// Grab user parameter
-	user := c.GetHeader("Username")
-
 	// STATUS 403 Forbidden if a user is already a group owner
-	ok, err = bsql.GroupExists(user)
+	id, err := groups.Create(c.Request.Context(), bres.User(c))
 	if err != nil {
-		log.Fatal(err)
-	}
-	if ok {
-		c.AbortWithStatus(403)
+		abortWithGroupError(c, err)
 		return
 	}
 
-	// Register new group
-	if err = bsql.InsertNewGroup(user); err != nil {
-		log.Fatal(err)
-	}
-
 	// STATUS: 200 OK
-	c.Status(200)
+	c.JSON(200, gin.H{"id": id})
 }
 
-// METHOD: POST
-// Inserts user into a specified group
-// Requires Username, Token, ID headers
-func postGroupMember(c *gin.Context) {
+// METHOD: GET
+// Return all Group fields and Group Members
+// Requires Authorization header; group id param
+func getGroupByID(c *gin.Context) {
 
-	// Validate that ID is in the header
-	// STATUS: 400 Bad Request on missing header
-	ok := bres.ValidateHeaders(c, "ID")
+	// Validate the bearer token, identity goes in the context
+	// STATUS: 401 Unauthorized on missing, invalid or expired token
+	ok, err := bres.ValidateAuthentication(c)
+	if err != nil {
+		bres.AbortWithError(c, err)
+		return
+	}
 	if !ok {
 		return
 	}
 
-	// Validate userpass and Token fields exis
-	// STATUS: 401 Unauthorized on invalid token
-	// STATUS: 400 Bad Request on missing header; illegal chars
-	// STATUS: 404 on non-existant user
-	ok, err := bres.ValidateAuthentication(c)
+	// STATUS 404 Not Found on non-existant group
+	// STATUS 403 Forbidden user not in group
+	group, err := groups.Get(c.Request.Context(), bres.User(c), c.Param("id"))
 	if err != nil {
-		log.Fatal(err)
-	}
-	if !ok {
+		abortWithGroupError(c, err)
 		return
 	}
 
-	// Grab user and group id
-	user := c.GetHeader("Username")
-	id := c.GetHeader("ID")
+	// STATUS: 200 OK
+	c.JSON(200, group)
+}
 
-	// STATUS: 404 Not Found on non-existant group
-	ok, err = bsql.GroupExists(id)
+// METHOD: POST
+// Inserts user into a specified group
+// Requires Authorization header; group id param
+func postGroupMember(c *gin.Context) {
+
+	// Validate the bearer token, identity goes in the context
+	// STATUS: 401 Unauthorized on missing, invalid or expired token
+	ok, err := bres.ValidateAuthentication(c)
 	if err != nil {
-		log.Fatal(err)
+		bres.AbortWithError(c, err)
+		return
 	}
 	if !ok {
-		c.AbortWithStatus(404)
 		return
 	}
 
-	// Err on non-unique entry ( user cannot be in same group twice)
-	if err = bsql.InsertGroupMember(user, id); err != nil {
-		if _, ok = err.(*mysql.MySQLError); !ok {
-			log.Fatal(err)
-		}
-		if err.(*mysql.MySQLError).Number == 1062 {
-			log.Println("User already in group they tried to join")
-			c.AbortWithStatus(400)
-			return
-		}
+	// STATUS: 404 Not Found on non-existant group
+	// STATUS: 400 Bad Request if the user is already in the group
+	if err = groups.Join(c.Request.Context(), bres.User(c), c.Param("id")); err != nil {
+		abortWithGroupError(c, err)
+		return
 	}
 
 	// STATUS: 200, OK
 	c.Status(200)
-
 }
 
 // METHOD: POST
 // Updates group's coin
-// Requires Username, Token, ID headers
+// Requires Authorization header; group id param
 func postCoin(c *gin.Context) {
 
-	// Validate that ID is in the header
-	// STATUS: 400 Bad Request on missing header
-	ok := bres.ValidateHeaders(c, "ID")
-	if !ok {
-		return
-	}
-
-	// Validate userpass and Token fields exis
-	// STATUS: 401 Unauthorized on invalid token
-	// STATUS: 400 Bad Request on missing header; illegal chars
-	// STATUS: 404 on non-existant user
+	// Validate the bearer token, identity goes in the context
+	// STATUS: 401 Unauthorized on missing, invalid or expired token
 	ok, err := bres.ValidateAuthentication(c)
 	if err != nil {
-		log.Fatal(err)
+		bres.AbortWithError(c, err)
+		return
 	}
 	if !ok {
 		return
 	}
 
-	// Grab user and group id
-	user := c.GetHeader("Username")
-	id := c.GetHeader("ID")
-
+	// Pass the coin, record it in the history and notify the new holder
 	// STATUS: 404 Not Found on non-existant group
-	ok, err = bsql.GroupExists(id)
+	// STATUS: 403 Forbidden if the user doesn't hold the coin
+	if _, err = groups.PassCoin(c.Request.Context(), bres.User(c), c.Param("id")); err != nil {
+		abortWithGroupError(c, err)
+		return
+	}
+
+	// STATUS: 201 Created
+	c.Status(201)
+}
+
+// METHOD: DEL
+// Delete a member from a group
+// Requires Authorization header; group id, member params
+func delGroupMember(c *gin.Context) {
+
+	// Validate the bearer token, identity goes in the context
+	// STATUS: 401 Unauthorized on missing, invalid or expired token
+	ok, err := bres.ValidateAuthentication(c)
 	if err != nil {
-		log.Fatal(err)
+		bres.AbortWithError(c, err)
+		return
 	}
 	if !ok {
-		c.AbortWithStatus(404)
 		return
 	}
 
-	// Validate the user is authorized to make a coin request
-	// STATUS: 403 Forbidden on not high enough credentials
-	ok, err = bres.ValidateCoinRequest(c, user, id)
+	// STATUS 404 Not Found on non-existant group, member not in group
+	// STATUS 403 Forbidden user not group creator
+	if err = groups.Kick(c.Request.Context(), bres.User(c), c.Param("id"), c.Param("member")); err != nil {
+		abortWithGroupError(c, err)
+		return
+	}
+
+	c.Status(200)
+}
+
+// METHOD: POST
+// Leave a group, what the user had in it goes to another member
+// Requires Authorization header; group id param
+func postLeaveGroup(c *gin.Context) {
+
+	// Validate the bearer token, identity goes in the context
+	// STATUS: 401 Unauthorized on missing, invalid or expired token
+	ok, err := bres.ValidateAuthentication(c)
 	if err != nil {
-		log.Fatal(err)
+		bres.AbortWithError(c, err)
+		return
 	}
 	if !ok {
-		c.AbortWithStatus(403)
 		return
 	}
 
-	if err1, err2 := bsql.UpdateCoin(user, id); err1 != nil || err2 != nil {
-		log.Fatal(err1)
-		log.Fatal(err2)
+	// STATUS 404 Not Found on non-existant group
+	// STATUS 403 Forbidden user not in group
+	if err = groups.Leave(c.Request.Context(), bres.User(c), c.Param("id")); err != nil {
+		abortWithGroupError(c, err)
+		return
 	}
 
-	// STATUS: 201 Created
-	c.Status(201)
-
+	c.Status(200)
 }
 
-// METHOD: DEL
-// Delete a member from a group
-// Requires Username, Token, ID headers, member param
-func delGroupMember(c *gin.Context) {
+// METHOD: PUT
+// Hand the group to another member
+// Requires Authorization header; group id param; JSON body {username}
+func putGroupCreator(c *gin.Context) {
 
-	// Validate that ID is in the header
-	// STATUS: 400 Bad Request on missing header
-	ok := bres.ValidateHeaders(c, "ID")
-	if !ok {
+	// Validate that username is in the body
+	// STATUS: 400 Bad Request with field errors
+	var req bres.TransferRequest
+	if !bres.BindRequest(c, &req) {
 		return
 	}
 
-	// Validate userpass and Token fields exis
-	// STATUS: 401 Unauthorized on invalid token
-	// STATUS: 400 Bad Request on missing header; illegal chars
-	// STATUS: 404 on non-existant user
+	// Validate the bearer token, identity goes in the context
+	// STATUS: 401 Unauthorized on missing, invalid or expired token
 	ok, err := bres.ValidateAuthentication(c)
 	if err != nil {
-		log.Fatal(err)
+		bres.AbortWithError(c, err)
+		return
 	}
 	if !ok {
 		return
 	}
 
-	// Grab user and group id
-	user := c.GetHeader("Username")
-	id := c.GetHeader("ID")
-	member := c.Param("user")
+	// STATUS 404 Not Found on non-existant group, member not in group
+	// STATUS 403 Forbidden user not group creator, member already owns a group
+	if err = groups.Transfer(c.Request.Context(), bres.User(c), c.Param("id"), req.Username); err != nil {
+		abortWithGroupError(c, err)
+		return
+	}
+
+	c.Status(200)
+}
+
+// METHOD: DEL
+// Delete a group, and all its members
+// Requires Authorization header; group id param
+func delGroup(c *gin.Context) {
 
-	// STATUS 404 Not found on non-existant member
-	ok, err = bsql.UserExists(member)
+	// Validate the bearer token, identity goes in the context
+	// STATUS: 401 Unauthorized on missing, invalid or expired token
+	ok, err := bres.ValidateAuthentication(c)
 	if err != nil {
-		log.Fatal(err)
+		bres.AbortWithError(c, err)
+		return
 	}
 	if !ok {
-		c.AbortWithStatus(404)
 		return
 	}
 
 	// STATUS 404 Not Found on non-existant group
-	ok, err = bsql.GroupExists(id)
-	if err != nil {
-		log.Fatal(err)
-	}
-	if !ok {
-		c.AbortWithStatus(404)
+	// STATUS 403 Forbidden user not group creator
+	if err = groups.Disband(c.Request.Context(), bres.User(c), c.Param("id")); err != nil {
+		abortWithGroupError(c, err)
 		return
 	}
 
-	// STATUS 404 User not found in group
-	ok, err = bsql.UserInGroup(member, id)
+	c.Status(200)
+}
+
+// METHOD: GET
+// Stream group events as Server-Sent Events
+// Requires Authorization header; group id param
+// Optional Last-Event-ID header replays missed coin passes
+func getGroupEvents(c *gin.Context) {
+
+	// Validate the bearer token, identity goes in the context
+	// STATUS: 401 Unauthorized on missing, invalid or expired token
+	ok, err := bres.ValidateAuthentication(c)
 	if err != nil {
-		log.Fatal(err)
+		bres.AbortWithError(c, err)
+		return
 	}
 	if !ok {
-		c.AbortWithStatus(404)
 		return
 	}
 
-	// STATUS 403 Forbidden user not group creator
-	ok, err = bsql.UserGroupCreator(user, id)
-	if err != nil {
-		log.Fatal(err)
-	}
-	if !ok {
-		c.AbortWithStatus(403)
+	// Grab user and group id
+	user := bres.User(c)
+	id := c.Param("id")
+
+	// STATUS 404 Not Found on non-existant group
+	// STATUS 403 Forbidden user not in group
+	if err = groups.Member(c.Request.Context(), user, id); err != nil {
+		abortWithGroupError(c, err)
 		return
 	}
 
-	_, err = bsql.DeleteGroupMember(member, id)
-	if err != nil {
-		log.Fatal(err)
+	// STATUS: 400 Bad Request on a malformed Last-Event-ID
+	var lastID int64
+	if h := c.GetHeader("Last-Event-ID"); h != "" {
+		lastID, err = strconv.ParseInt(h, 10, 64)
+		if err != nil {
+			logging.From(c).Info("invalid Last-Event-ID")
+			c.AbortWithStatus(400)
+			return
+		}
 	}
-	c.Status(200)
 
-}
+	// Subscribe before reading the history so no pass falls in between
+	ch, unsubscribe := events.Subscribe(id)
+	defer unsubscribe()
 
-// METHOD: DEL
-// Delete a group, and all its members
-// Requires Username, Token, ID
-func delGroup(c *gin.Context) {
+	var missed []bsql.CoinPass
+	if lastID > 0 {
+		missed, err = bsql.GetCoinPassesSince(c.Request.Context(), id, lastID)
+		if err != nil {
+			bres.AbortWithError(c, err)
+			return
+		}
+	}
 
-	// Validate that ID is in the header
-	// STATUS: 400 Bad Request on missing header
-	ok := bres.ValidateHeaders(c, "ID")
-	if !ok {
-		return
+	// STATUS: 200 OK, stream stays open until the client leaves
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(200)
+
+	for _, pass := range missed {
+		lastID = pass.ID
+		c.Render(-1, sse.Event{
+			Id:    strconv.FormatInt(pass.ID, 10),
+			Event: events.COIN_PASSED,
+			Data:  pass,
+		})
 	}
+	c.Writer.Flush()
+
+	keepAlive := time.NewTicker(30 * time.Second)
+	defer keepAlive.Stop()
+
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case e, ok := <-ch:
+			if !ok {
+				return false
+			}
+
+			// Skip passes already sent from the history
+			if e.Type == events.COIN_PASSED {
+				if n, _ := strconv.ParseInt(e.ID, 10, 64); n <= lastID {
+					return true
+				}
+			}
+
+			c.Render(-1, sse.Event{
+				Id:    e.ID,
+				Event: e.Type,
+				Data:  e.Data,
+			})
+
+			// Close the stream once the user can no longer see the group
+			return !events.Removes(e, user)
+
+		case <-keepAlive.C:
+			c.Render(-1, sse.Event{Event: "ping", Data: time.Now().Unix()})
+			return true
+
+		case <-c.Request.Context().Done():
+			return false
+		}
+	})
+}
+
+// METHOD: GET
+// Upgrade to a websocket for presence, coin handoff and reactions
+// Requires Authorization header; group id param
+func getGroupSocket(c *gin.Context) {
 
-	// Validate userpass and Token fields exis
-	// STATUS: 401 Unauthorized on invalid token
-	// STATUS: 400 Bad Request on missing header; illegal chars
-	// STATUS: 404 on non-existant user
+	// Validate the bearer token, identity goes in the context
+	// STATUS: 401 Unauthorized on missing, invalid or expired token
 	ok, err := bres.ValidateAuthentication(c)
 	if err != nil {
-		log.Fatal(err)
+		bres.AbortWithError(c, err)
+		return
 	}
 	if !ok {
 		return
 	}
 
 	// Grab user and group id
-	user := c.GetHeader("Username")
-	id := c.GetHeader("ID")
+	user := bres.User(c)
+	id := c.Param("id")
 
 	// STATUS 404 Not Found on non-existant group
-	ok, err = bsql.GroupExists(id)
+	// STATUS 403 Forbidden user not in group
+	if err = groups.Member(c.Request.Context(), user, id); err != nil {
+		abortWithGroupError(c, err)
+		return
+	}
+
+	// STATUS: 101 Switching Protocols
+	gateway.Serve(c, user, id)
+}
+
+// Shared checks for the owner-only endpoints, webhooks and the audit log
+// Validates authentication, group and ownership
+// Returns the group id, false if the request was aborted
+func validateOwnerRequest(c *gin.Context) (string, bool) {
+
+	// Validate the bearer token, identity goes in the context
+	// STATUS: 401 Unauthorized on missing, invalid or expired token
+	ok, err := bres.ValidateAuthentication(c)
 	if err != nil {
-		log.Fatal(err)
+		bres.AbortWithError(c, err)
+		return "", false
 	}
 	if !ok {
-		c.AbortWithStatus(404)
-		return
+		return "", false
 	}
 
+	// Grab user and group id
+	user := bres.User(c)
+	id := c.Param("id")
+
+	// STATUS 404 Not Found on non-existant group
 	// STATUS 403 Forbidden user not group creator
-	ok, err = bsql.UserGroupCreator(user, id)
-	if err != nil {
-		log.Fatal(err)
+	if err = groups.Owner(c.Request.Context(), user, id); err != nil {
+		abortWithGroupError(c, err)
+		return "", false
+	}
+
+	return id, true
+}
+
+// METHOD: POST
+// Subscribe a URL to group events
+// Requires Authorization header; group id param; JSON body {url}
+// Optional events (default all), secret (default generated)
+func postWebhook(c *gin.Context) {
+
+	// Validate that url is in the body
+	// STATUS: 400 Bad Request with field errors
+	var req bres.WebhookRequest
+	if !bres.BindRequest(c, &req) {
+		return
 	}
+
+	// STATUS: 401, 404, 403 as validateOwnerRequest
+	id, ok := validateOwnerRequest(c)
 	if !ok {
-		c.AbortWithStatus(403)
 		return
 	}
 
-	err = bsql.DeleteGroup(user)
+	// STATUS: 400 Bad Request on a non http(s) URL, a host that doesn't resolve,
+	// or one resolving to a loopback, private or link-local address
+	u, err := webhooks.CheckURL(c.Request.Context(), req.URL)
 	if err != nil {
-		log.Fatal(err)
+		logging.From(c).Info("invalid webhook url", "err", err)
+		c.AbortWithStatus(400)
+		return
 	}
 
-	c.Status(200)
+	// STATUS: 400 Bad Request on an unknown event type
+	evs := webhooks.Events
+	if len(req.Events) > 0 {
+		evs = req.Events
+		for _, v := range evs {
+			if !webhooks.ValidEvent(v) {
+				logging.From(c).Info("invalid webhook event")
+				c.AbortWithStatus(400)
+				return
+			}
+		}
+	}
+
+	secret := req.Secret
+	if secret == "" {
+		secret = webhooks.NewSecret()
+	}
+
+	hook := &bsql.Webhook{
+		ID:      uuid.New().String(),
+		GroupID: id,
+		URL:     u.String(),
+		Secret:  secret,
+		Events:  evs,
+	}
+	if err = bsql.InsertWebhook(c.Request.Context(), hook); err != nil {
+		bres.AbortWithError(c, err)
+		return
+	}
 
+	// STATUS: 201 Created, the secret is only ever returned here
+	c.JSON(201, gin.H{"id": hook.ID, "events": hook.Events, "secret": secret})
+}
+
+// METHOD: GET
+// List the group's webhooks
+// Requires Authorization header; group id param
+func getWebhooks(c *gin.Context) {
+
+	// STATUS: 401, 404, 403 as validateOwnerRequest
+	id, ok := validateOwnerRequest(c)
+	if !ok {
+		return
+	}
+
+	hooks, err := bsql.GetWebhooks(c.Request.Context(), id)
+	if err != nil {
+		bres.AbortWithError(c, err)
+		return
+	}
+
+	// STATUS: 200 OK
+	c.JSON(200, hooks)
+}
+
+// METHOD: DEL
+// Remove a webhook and its delivery log
+// Requires Authorization header; group id, hook params
+func delWebhook(c *gin.Context) {
+
+	// STATUS: 401, 404, 403 as validateOwnerRequest
+	id, ok := validateOwnerRequest(c)
+	if !ok {
+		return
+	}
+
+	// STATUS 404 Not Found on a webhook outside the group
+	hook := c.Param("hook")
+	_, ok, err := bsql.GetWebhook(c.Request.Context(), hook, id)
+	if err != nil {
+		bres.AbortWithError(c, err)
+		return
+	}
+	if !ok {
+		c.AbortWithStatus(404)
+		return
+	}
+
+	if err = bsql.DeleteWebhook(c.Request.Context(), hook, id); err != nil {
+		bres.AbortWithError(c, err)
+		return
+	}
+
+	// STATUS: 200 OK
+	c.Status(200)
+}
+
+// METHOD: POST
+// Resume deliveries to a webhook disabled after repeated failures
+// Requires Authorization header; group id, hook params
+func postWebhookEnable(c *gin.Context) {
+
+	// STATUS: 401, 404, 403 as validateOwnerRequest
+	id, ok := validateOwnerRequest(c)
+	if !ok {
+		return
+	}
+
+	// STATUS 404 Not Found on a webhook outside the group
+	hook := c.Param("hook")
+	w, ok, err := bsql.GetWebhook(c.Request.Context(), hook, id)
+	if err != nil {
+		bres.AbortWithError(c, err)
+		return
+	}
+	if !ok {
+		c.AbortWithStatus(404)
+		return
+	}
+
+	if err = bsql.EnableWebhook(c.Request.Context(), hook, id); err != nil {
+		bres.AbortWithError(c, err)
+		return
+	}
+	w.Active = true
+	w.Failures = 0
+
+	// STATUS: 200 OK
+	c.JSON(200, w)
+}
+
+// METHOD: GET
+// Return the latest deliveries of a webhook
+// Requires Authorization header; group id, hook params
+func getWebhookDeliveries(c *gin.Context) {
+
+	// STATUS: 401, 404, 403 as validateOwnerRequest
+	id, ok := validateOwnerRequest(c)
+	if !ok {
+		return
+	}
+
+	// STATUS 404 Not Found on a webhook outside the group
+	hook := c.Param("hook")
+	_, ok, err := bsql.GetWebhook(c.Request.Context(), hook, id)
+	if err != nil {
+		bres.AbortWithError(c, err)
+		return
+	}
+	if !ok {
+		c.AbortWithStatus(404)
+		return
+	}
+
+	deliveries, err := bsql.GetWebhookDeliveries(c.Request.Context(), hook, 50)
+	if err != nil {
+		bres.AbortWithError(c, err)
+		return
+	}
+
+	// STATUS: 200 OK
+	c.JSON(200, deliveries)
+}
+
+// METHOD: GET
+// Page through the group's audit log, newest first
+// Requires Authorization header; group id param; actor, action, before, limit query
+func getGroupAudit(c *gin.Context) {
+
+	// STATUS: 401, 404, 403 as validateOwnerRequest
+	id, ok := validateOwnerRequest(c)
+	if !ok {
+		return
+	}
+
+	// STATUS: 400 Bad Request with field errors
+	var q bres.GroupAuditQuery
+	if !bres.BindQuery(c, &q) {
+		return
+	}
+
+	list, err := audit.ForGroup(c.Request.Context(), id, bsql.AuditFilter{
+		Actor:  q.Actor,
+		Action: q.Action,
+		Before: q.Before,
+		Limit:  q.Limit,
+	})
+	if err != nil {
+		bres.AbortWithError(c, err)
+		return
+	}
+	if list == nil {
+		list = []bsql.GroupAuditEvent{}
+	}
+
+	// STATUS: 200 OK
+	c.JSON(200, list)
+}
+
+// METHOD: POST
+// Register a device for push notifications
+// Requires Authorization header; JSON body {token, platform}
+func postDevice(c *gin.Context) {
+
+	// Validate body fields, platform is apns or fcm
+	// STATUS: 400 Bad Request with field errors
+	var req bres.DeviceRequest
+	if !bres.BindRequest(c, &req) {
+		return
+	}
+
+	// Validate the bearer token, identity goes in the context
+	// STATUS: 401 Unauthorized on missing, invalid or expired token
+	ok, err := bres.ValidateAuthentication(c)
+	if err != nil {
+		bres.AbortWithError(c, err)
+		return
+	}
+	if !ok {
+		return
+	}
+
+	if err = bsql.UpsertDevice(c.Request.Context(), req.Token, bres.User(c), req.Platform); err != nil {
+		bres.AbortWithError(c, err)
+		return
+	}
+
+	// STATUS: 201 Created
+	c.Status(201)
+}
+
+// METHOD: DEL
+// Stop push notifications to a device
+// Requires Authorization header; device param
+func delDevice(c *gin.Context) {
+
+	// Validate the bearer token, identity goes in the context
+	// STATUS: 401 Unauthorized on missing, invalid or expired token
+	ok, err := bres.ValidateAuthentication(c)
+	if err != nil {
+		bres.AbortWithError(c, err)
+		return
+	}
+	if !ok {
+		return
+	}
+
+	// STATUS: 404 Not Found if the device is not the user's
+	ok, err = bsql.DeleteUserDevice(c.Request.Context(), c.Param("device"), bres.User(c))
+	if err != nil {
+		bres.AbortWithError(c, err)
+		return
+	}
+	if !ok {
+		c.AbortWithStatus(404)
+		return
+	}
+
+	// STATUS: 200 OK
+	c.Status(200)
+}
+
+// METHOD: POST
+// Hold push notifications between two hours of the day
+// Requires Authorization header; JSON body {start, end} (hours 0-23)
+// Optional timezone (IANA name, default UTC)
+func postQuietHours(c *gin.Context) {
+
+	// Validate hours and timezone
+	// STATUS: 400 Bad Request with field errors
+	var req bres.QuietHoursRequest
+	if !bres.BindRequest(c, &req) {
+		return
+	}
+
+	// Validate the bearer token, identity goes in the context
+	// STATUS: 401 Unauthorized on missing, invalid or expired token
+	ok, err := bres.ValidateAuthentication(c)
+	if err != nil {
+		bres.AbortWithError(c, err)
+		return
+	}
+	if !ok {
+		return
+	}
+
+	tz := req.Timezone
+	if tz == "" {
+		tz = "UTC"
+	}
+
+	q := &bsql.QuietHours{
+		Username: bres.User(c),
+		Start:    *req.Start,
+		End:      *req.End,
+		Timezone: tz,
+	}
+	if err = bsql.UpsertQuietHours(c.Request.Context(), q); err != nil {
+		bres.AbortWithError(c, err)
+		return
+	}
+
+	// STATUS: 200 OK
+	c.JSON(200, q)
+}
+
+// METHOD: DEL
+// Remove the user's quiet hours
+// Requires Authorization header
+func delQuietHours(c *gin.Context) {
+
+	// Validate the bearer token, identity goes in the context
+	// STATUS: 401 Unauthorized on missing, invalid or expired token
+	ok, err := bres.ValidateAuthentication(c)
+	if err != nil {
+		bres.AbortWithError(c, err)
+		return
+	}
+	if !ok {
+		return
+	}
+
+	if err = bsql.DeleteQuietHours(c.Request.Context(), bres.User(c)); err != nil {
+		bres.AbortWithError(c, err)
+		return
+	}
+
+	// STATUS: 200 OK
+	c.Status(200)
+}
+
+// METHOD: POST
+// Set or change the user's email, a verification code is mailed to it
+// Requires Authorization header; JSON body {email}
+func postEmail(c *gin.Context) {
+
+	// Validate email is present and well formed
+	// STATUS: 400 Bad Request with field errors
+	var req bres.EmailRequest
+	if !bres.BindRequest(c, &req) {
+		return
+	}
+
+	// Validate the bearer token, identity goes in the context
+	// STATUS: 401 Unauthorized on missing, invalid or expired token
+	ok, err := bres.ValidateAuthentication(c)
+	if err != nil {
+		bres.AbortWithError(c, err)
+		return
+	}
+	if !ok {
+		return
+	}
+
+	// Grab user and email
+	user := bres.User(c)
+	email := req.Email
+
+	// STATUS: 400 Bad Request on an email used by another account
+	if err = bsql.UpdateUserEmail(c.Request.Context(), user, email); err != nil {
+		if bsql.DuplicateEntry(err) {
+			logging.From(c).Info("email already in use")
+			c.AbortWithStatus(400)
+			return
+		}
+		bres.AbortWithError(c, err)
+		return
+	}
+
+	sendVerification(c, user, email)
+
+	// STATUS: 202 Accepted, waiting on the code
+	c.Status(202)
+}
+
+// METHOD: POST
+// Verify the user's email with the mailed code
+// Requires Authorization header; JSON body {code}
+func postVerifyEmail(c *gin.Context) {
+
+	// Validate that code is in the body
+	// STATUS: 400 Bad Request with field errors
+	var req bres.CodeRequest
+	if !bres.BindRequest(c, &req) {
+		return
+	}
+
+	// Validate the bearer token, identity goes in the context
+	// STATUS: 401 Unauthorized on missing, invalid or expired token
+	ok, err := bres.ValidateAuthentication(c)
+	if err != nil {
+		bres.AbortWithError(c, err)
+		return
+	}
+	if !ok {
+		return
+	}
+
+	user := bres.User(c)
+
+	// STATUS: 401 Unauthorized on a wrong, used or expired code, or one guessed wrong too often
+	ok, err = bsql.ConsumeCode(c.Request.Context(), user, bsql.CODE_VERIFY, req.Code)
+	if err != nil {
+		bres.AbortWithError(c, err)
+		return
+	}
+	if !ok {
+		logging.From(c).Info("invalid verification code")
+		c.AbortWithStatus(401)
+		return
+	}
+
+	if err = bsql.VerifyUserEmail(c.Request.Context(), user); err != nil {
+		bres.AbortWithError(c, err)
+		return
+	}
+
+	// STATUS: 200 OK
+	c.Status(200)
+}
+
+// METHOD: POST
+// Mail a password reset code to the user's verified email
+// Requires JSON body {username}
+func postForgotPassword(c *gin.Context) {
+
+	// Validate username is present and in allowed characters
+	// STATUS: 400 Bad Request with field errors
+	var req bres.ForgotPasswordRequest
+	if !bres.BindRequest(c, &req) {
+		return
+	}
+
+	user := req.Username
+
+	// Only a verified address gets a code
+	// The response is the same either way so accounts can't be probed
+	email, verified, ok, err := bsql.GetUserEmail(c.Request.Context(), user)
+	if err != nil {
+		bres.AbortWithError(c, err)
+		return
+	}
+	if ok && verified {
+		code := bres.NewCode()
+		if err = bsql.InsertCode(c.Request.Context(), user, bsql.CODE_RESET, code, RESET_CODE_LIFETIME); err != nil {
+			bres.AbortWithError(c, err)
+			return
+		}
+
+		body := "Hi " + user + ",\n\n" +
+			"Your pushup app password reset code is: " + code + "\n\n" +
+			"It expires in 15 minutes. If you didn't ask for this you can ignore it.\n"
+		if err = mailer.Send(email, "Reset your password", body); err != nil {
+			logging.From(c).Error("reset email failed", "user", user, "err", err)
+		}
+	} else {
+		logging.From(c).Info("password reset without a verified email", "user", user)
+	}
+
+	// STATUS: 202 Accepted
+	c.Status(202)
+}
+
+// METHOD: POST
+// Set a new password with a mailed reset code, signs out every session
+// Requires JSON body {username, code, password}
+func postResetPassword(c *gin.Context) {
+
+	// Validate body fields exist and are in allowed characters
+	// STATUS: 400 Bad Request with field errors
+	var req bres.ResetPasswordRequest
+	if !bres.BindRequest(c, &req) {
+		return
+	}
+
+	user := req.Username
+	pass := req.Password
+
+	// STATUS: 401 Unauthorized on a wrong, used or expired code, or one guessed wrong too often
+	ok, err := bsql.ConsumeCode(c.Request.Context(), user, bsql.CODE_RESET, req.Code)
+	if err != nil {
+		bres.AbortWithError(c, err)
+		return
+	}
+	if !ok {
+		logging.From(c).Info("invalid reset code")
+		c.AbortWithStatus(401)
+		return
+	}
+
+	// Whoever had the old password may still hold a token, on any server
+	if err = accounts.ResetPassword(c.Request.Context(), user, pass); err != nil {
+		bres.AbortWithError(c, err)
+		return
+	}
+	tokens.RevokeUser(user)
+
+	// STATUS: 200 OK
+	c.Status(200)
+}
+
+// METHOD: POST
+// Change the user's password, signs out every other session
+// Requires Authorization header; JSON body {password, new_password}
+func postPassword(c *gin.Context) {
+
+	// Validate both passwords, the new one in allowed characters
+	// STATUS: 400 Bad Request with field errors
+	var req bres.ChangePasswordRequest
+	if !bres.BindRequest(c, &req) {
+		return
+	}
+
+	// Validate the bearer token, identity goes in the context
+	// STATUS: 401 Unauthorized on missing, invalid or expired token
+	ok, err := bres.ValidateAuthentication(c)
+	if err != nil {
+		bres.AbortWithError(c, err)
+		return
+	}
+	if !ok {
+		return
+	}
+
+	// Grab user and passwords
+	user := bres.User(c)
+	pass := req.Password
+	newPass := req.NewPassword
+
+	// A stolen token alone is not enough to take over the account
+	// STATUS: 401 Unauthorized on wrong current password
+	ok, err = bsql.MatchUserPass(c.Request.Context(), user, pass)
+	if err != nil {
+		bres.AbortWithError(c, err)
+		return
+	}
+	if !ok {
+		c.AbortWithStatus(401)
+		return
+	}
+
+	// Other sessions end on every server, this one carries on
+	revoked, err := accounts.ChangePassword(c.Request.Context(), user, newPass)
+	if err != nil {
+		bres.AbortWithError(c, err)
+		return
+	}
+	tokens.RevokeOthers(user, bres.Token(c), revoked)
+
+	// STATUS: 200 OK
+	c.Status(200)
+}
+
+// METHOD: DEL
+// Delete the user's account
+// Owned groups and held coins pass to another member, history is anonymized
+// Requires Authorization header; JSON body {password}
+func delClient(c *gin.Context) {
+
+	// Validate that password is in the body
+	// STATUS: 400 Bad Request with field errors
+	var req bres.PasswordRequest
+	if !bres.BindRequest(c, &req) {
+		return
+	}
+
+	// Validate the bearer token, identity goes in the context
+	// STATUS: 401 Unauthorized on missing, invalid or expired token
+	ok, err := bres.ValidateAuthentication(c)
+	if err != nil {
+		bres.AbortWithError(c, err)
+		return
+	}
+	if !ok {
+		return
+	}
+
+	user := bres.User(c)
+
+	// Re-authenticate, deletion can't be undone
+	// STATUS: 401 Unauthorized on wrong password
+	ok, err = bsql.MatchUserPass(c.Request.Context(), user, req.Password)
+	if err != nil {
+		bres.AbortWithError(c, err)
+		return
+	}
+	if !ok {
+		c.AbortWithStatus(401)
+		return
+	}
+
+	changes, err := bsql.DeleteAccount(c.Request.Context(), user)
+	if err != nil {
+		bres.AbortWithError(c, err)
+		return
+	}
+
+	tokens.RevokeUser(user)
+
+	// Every group change is audited under the deleted user, the request id ties them together
+	ctx := c.Request.Context()
+	audit.Record(ctx, audit.Event{Actor: user, Action: audit.ACCOUNT_DELETE, Target: user})
+	for i := range changes {
+		groups.Left(ctx, user, &changes[i])
+	}
+
+	// STATUS: 200 OK
+	c.Status(200)
+}
+
+// METHOD: GET
+// Return the user's two-factor status
+// Requires Authorization header
+func getTwoFactor(c *gin.Context) {
+
+	// Validate the bearer token, identity goes in the context
+	// STATUS: 401 Unauthorized on missing, invalid or expired token
+	ok, err := bres.ValidateAuthentication(c)
+	if err != nil {
+		bres.AbortWithError(c, err)
+		return
+	}
+	if !ok {
+		return
+	}
+
+	status, err := bsql.GetTwoFactorStatus(c.Request.Context(), bres.User(c))
+	if err != nil {
+		bres.AbortWithError(c, err)
+		return
+	}
+
+	// STATUS: 200 OK
+	c.JSON(200, status)
+}
+
+// METHOD: POST
+// Start two-factor enrollment, returns the secret and otpauth URI
+// Two-factor is off until confirmed with a code
+// Requires Authorization header; JSON body {password}
+func postTwoFactor(c *gin.Context) {
+
+	// Validate that password is in the body
+	// STATUS: 400 Bad Request with field errors
+	var req bres.PasswordRequest
+	if !bres.BindRequest(c, &req) {
+		return
+	}
+
+	// Validate the bearer token, identity goes in the context
+	// STATUS: 401 Unauthorized on missing, invalid or expired token
+	ok, err := bres.ValidateAuthentication(c)
+	if err != nil {
+		bres.AbortWithError(c, err)
+		return
+	}
+	if !ok {
+		return
+	}
+
+	user := bres.User(c)
+
+	// STATUS: 401 Unauthorized on wrong password
+	ok, err = bsql.MatchUserPass(c.Request.Context(), user, req.Password)
+	if err != nil {
+		bres.AbortWithError(c, err)
+		return
+	}
+	if !ok {
+		c.AbortWithStatus(401)
+		return
+	}
+
+	// STATUS: 403 Forbidden if two-factor is already on
+	tf, ok, err := bsql.GetTwoFactor(c.Request.Context(), user)
+	if err != nil {
+		bres.AbortWithError(c, err)
+		return
+	}
+	if ok && tf.Enabled {
+		logging.From(c).Info("two-factor already enabled")
+		c.AbortWithStatus(403)
+		return
+	}
+
+	secret := totp.GenerateSecret()
+	if err = bsql.InsertTwoFactorSecret(c.Request.Context(), user, secret); err != nil {
+		bres.AbortWithError(c, err)
+		return
+	}
+
+	// STATUS: 201 Created
+	c.JSON(201, gin.H{
+		"secret": secret,
+		"uri":    totp.URI(TOTP_ISSUER, user, secret),
+	})
+}
+
+// METHOD: POST
+// Confirm enrollment with a code from the authenticator app
+// Returns the recovery codes, they are only ever shown here
+// Requires Authorization header; JSON body {code}
+func postConfirmTwoFactor(c *gin.Context) {
+
+	// Validate that code is in the body
+	// STATUS: 400 Bad Request with field errors
+	var req bres.CodeRequest
+	if !bres.BindRequest(c, &req) {
+		return
+	}
+
+	// Validate the bearer token, identity goes in the context
+	// STATUS: 401 Unauthorized on missing, invalid or expired token
+	ok, err := bres.ValidateAuthentication(c)
+	if err != nil {
+		bres.AbortWithError(c, err)
+		return
+	}
+	if !ok {
+		return
+	}
+
+	user := bres.User(c)
+
+	// STATUS: 404 Not Found without a pending enrollment
+	tf, ok, err := bsql.GetTwoFactor(c.Request.Context(), user)
+	if err != nil {
+		bres.AbortWithError(c, err)
+		return
+	}
+	if !ok || tf.Enabled {
+		c.AbortWithStatus(404)
+		return
+	}
+
+	// STATUS: 401 Unauthorized on wrong code
+	step, ok := totp.Validate(tf.Secret, req.Code, time.Now())
+	if !ok {
+		logging.From(c).Info("invalid two-factor code")
+		c.AbortWithStatus(401)
+		return
+	}
+
+	codes := bres.NewRecoveryCodes()
+	if err = bsql.EnableTwoFactor(c.Request.Context(), user, step, codes); err != nil {
+		bres.AbortWithError(c, err)
+		return
+	}
+
+	// STATUS: 200 OK
+	c.JSON(200, gin.H{"recovery_codes": codes})
+}
+
+// METHOD: DEL
+// Turn off two-factor
+// Requires Authorization header; JSON body {password, code}
+func delTwoFactor(c *gin.Context) {
+
+	// Validate that password and code are in the body
+	// STATUS: 400 Bad Request with field errors
+	var req bres.DisableTwoFactorRequest
+	if !bres.BindRequest(c, &req) {
+		return
+	}
+
+	// Validate the bearer token, identity goes in the context
+	// STATUS: 401 Unauthorized on missing, invalid or expired token
+	ok, err := bres.ValidateAuthentication(c)
+	if err != nil {
+		bres.AbortWithError(c, err)
+		return
+	}
+	if !ok {
+		return
+	}
+
+	user := bres.User(c)
+
+	// STATUS: 401 Unauthorized on wrong password
+	ok, err = bsql.MatchUserPass(c.Request.Context(), user, req.Password)
+	if err != nil {
+		bres.AbortWithError(c, err)
+		return
+	}
+	if !ok {
+		c.AbortWithStatus(401)
+		return
+	}
+
+	// STATUS: 401 Unauthorized on wrong code, or two-factor already off
+	ok, err = bres.ValidateSecondFactor(c.Request.Context(), user, req.Code)
+	if err != nil {
+		bres.AbortWithError(c, err)
+		return
+	}
+	if !ok {
+		logging.From(c).Info("invalid second factor", "user", user)
+		c.AbortWithStatus(401)
+		return
+	}
+
+	if err = bsql.DisableTwoFactor(c.Request.Context(), user); err != nil {
+		bres.AbortWithError(c, err)
+		return
+	}
+
+	// STATUS: 200 OK
+	c.Status(200)
 }
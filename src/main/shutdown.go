@@ -0,0 +1,90 @@
+package main
+
+import (
+	"benschreiber.com/purestserver/src/bsql"
+	"benschreiber.com/purestserver/src/config"
+	"benschreiber.com/purestserver/src/events"
+	"benschreiber.com/purestserver/src/health"
+	"benschreiber.com/purestserver/src/lifecycle"
+	"benschreiber.com/purestserver/src/logging"
+	"benschreiber.com/purestserver/src/rpc"
+	"benschreiber.com/purestserver/src/tracing"
+	"context"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+var logger = logging.For("main")
+
+// Serve router until SIGINT or SIGTERM, then shut down
+func serve(router *gin.Engine) {
+	server := &http.Server{Addr: config.Get().Server.Addr(), Handler: router}
+
+	failed := make(chan error, 1)
+	go func() {
+		logger.Info("Listening", "addr", server.Addr)
+		if err := server.ListenAndServe(); err != http.ErrServerClosed {
+			failed <- err
+		}
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case err := <-failed:
+		logging.Fatal(err)
+	case sig := <-signals:
+		logger.Info("Shutting down", "signal", sig.String())
+	}
+	signal.Stop(signals)
+
+	shutdown(server)
+}
+
+// Stop taking traffic, drain every listener and worker, then release the database
+// Steps that run out of time are logged and the rest still run
+// server.drain_delay gives load balancers time to notice, server.shutdown_timeout
+// bounds how long running requests, calls and worker polls get to finish
+func shutdown(server *http.Server) {
+	cfg := config.Get().Server
+
+	// Load balancers see /readyz fail and stop routing here
+	health.Drain()
+	time.Sleep(cfg.DrainDelay)
+
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+
+	// End SSE, websocket and gRPC streams so they don't hold up draining
+	events.Close()
+
+	// Finish running requests and calls, hijacked websockets are closed by their owners
+	if err := server.Shutdown(ctx); err != nil {
+		logger.Warn("HTTP shutdown incomplete", "err", err)
+	}
+	if err := rpc.Shutdown(ctx); err != nil {
+		logger.Warn("gRPC shutdown incomplete", "err", err)
+	}
+
+	// Let worker polls finish, the rest of their batches stay due
+	if err := lifecycle.Stop(ctx); err != nil {
+		logger.Warn("workers still running", "err", err)
+	}
+
+	if err := tracing.Shutdown(ctx); err != nil {
+		logger.Warn("flushing spans failed", "err", err)
+	}
+	if err := health.Shutdown(ctx); err != nil {
+		logger.Warn("admin shutdown incomplete", "err", err)
+	}
+
+	// Tokens and rate limits live in memory only, there is nothing to flush
+	if err := bsql.Close(); err != nil {
+		logger.Warn("closing database failed", "err", err)
+	}
+	logger.Info("Stopped")
+}
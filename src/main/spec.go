@@ -0,0 +1,323 @@
+package main
+
+import (
+	"benschreiber.com/purestserver/src/achievements"
+	"benschreiber.com/purestserver/src/bres"
+	"benschreiber.com/purestserver/src/bres/ratelimit"
+	"benschreiber.com/purestserver/src/bres/tokens"
+	"benschreiber.com/purestserver/src/bsql"
+	"benschreiber.com/purestserver/src/config"
+	"benschreiber.com/purestserver/src/openapi"
+	"benschreiber.com/purestserver/src/stats"
+	"github.com/gin-gonic/gin"
+)
+
+const API_TITLE = "Pushup App API"
+const API_VERSION = "2.0.0"
+
+const API_DESCRIPTION = "Authenticate with Authorization: Bearer <token> from a login. " +
+	"The deprecated v1 routes also take the old Token and Username headers, " +
+	"and header forms of every body, until their Sunset date."
+
+// Built at startup, served at /api/openapi.json
+var spec *openapi.Document
+
+// METHOD: GET
+// Return the OpenAPI document
+func getOpenAPI(c *gin.Context) {
+
+	// STATUS: 200 OK
+	c.JSON(200, spec)
+}
+
+// Warn when a registered route is missing from the spec,
+// or the spec describes a route that isn't registered
+// TestSpecCoversRoutes fails on either, the server still starts
+func checkSpec(router *gin.Engine) {
+	missing, extra := spec.Diff(router.Routes())
+	for _, r := range missing {
+		logger.Warn("route missing from the OpenAPI spec", "route", r)
+	}
+	for _, r := range extra {
+		logger.Warn("OpenAPI spec describes an unregistered route", "route", r)
+	}
+}
+
+// Describe every route registered in main, registerV1, registerV2 and registerAdmin
+// /api/admin is only described while the public router serves it
+func apiSpec() *openapi.Document {
+	doc := openapi.New(API_TITLE, API_VERSION, API_DESCRIPTION)
+	op := openapi.Op
+
+	str := openapi.String()
+	token := openapi.Object(map[string]*openapi.Schema{"token": str})
+	fieldErrors := openapi.Object(map[string]*openapi.Schema{
+		"errors": openapi.Array(doc.Schema(bres.FieldError{})),
+	})
+
+	// JSON body, field errors on a 400
+	body := func(o *openapi.Operation, v interface{}) *openapi.Operation {
+		return o.Body(doc.Schema(v)).Returns(400, fieldErrors)
+	}
+
+	// Sessions and accounts
+	login := body(op("Log in", 404).Tag("sessions"), bres.LoginRequest{}).
+		Returns(201, token).
+		Returns(202, openapi.Object(map[string]*openapi.Schema{
+			"challenge":  str,
+			"expires_in": openapi.Integer(),
+		})).
+		Status(401).
+		Status(403).
+		Describe("202 with a challenge when two-factor is on, finish with the second factor, 403 when the account is disabled")
+	loginSecondFactor := body(op("Finish a two-factor login", 401).Tag("sessions"), bres.SecondFactorRequest{}).
+		Returns(201, token)
+	register := body(op("Create an account", 201).Tag("users"), bres.RegisterRequest{}).
+		Describe("A verification code is mailed to the optional email")
+	userGroup := op("Get the group a user is in", 404).Tag("groups").Auth().
+		Returns(200, doc.Schema(bsql.Group{}))
+	forgotPassword := body(op("Mail a password reset code", 202).Tag("users"), bres.ForgotPasswordRequest{}).
+		Describe("Always 202 so accounts can't be probed")
+	resetPassword := body(op("Reset a password with a mailed code", 200, 401).Tag("users"), bres.ResetPasswordRequest{}).
+		Describe("Signs out every session")
+
+	// The authenticated user
+	deleteAccount := body(op("Delete the account", 200).Tag("users").Auth(), bres.PasswordRequest{}).
+		Describe("Owned groups and held coins pass to another member, history is anonymized")
+	email := body(op("Set the account email", 202).Tag("users").Auth(), bres.EmailRequest{}).
+		Describe("A verification code is mailed to it")
+	verifyEmail := body(op("Verify the account email", 200).Tag("users").Auth(), bres.CodeRequest{})
+	password := body(op("Change the password", 200).Tag("users").Auth(), bres.ChangePasswordRequest{}).
+		Describe("Signs out every other session")
+	twoFactor := op("Get two-factor status").Tag("two-factor").Auth().
+		Returns(200, doc.Schema(bsql.TwoFactorStatus{}))
+	enrollTwoFactor := body(op("Start two-factor enrollment", 403).Tag("two-factor").Auth(), bres.PasswordRequest{}).
+		Returns(201, openapi.Object(map[string]*openapi.Schema{"secret": str, "uri": str}))
+	confirmTwoFactor := body(op("Confirm two-factor enrollment", 404).Tag("two-factor").Auth(), bres.CodeRequest{}).
+		Returns(200, openapi.Object(map[string]*openapi.Schema{"recovery_codes": openapi.Array(str)})).
+		Describe("Recovery codes are only ever returned here")
+	disableTwoFactor := body(op("Turn off two-factor", 200).Tag("two-factor").Auth(), bres.DisableTwoFactorRequest{})
+	device := body(op("Register a push device", 201).Tag("notifications").Auth(), bres.DeviceRequest{})
+	deleteDevice := op("Remove a push device", 200, 404).Tag("notifications").Auth()
+	quiet := body(op("Set quiet hours").Tag("notifications").Auth(), bres.QuietHoursRequest{}).
+		Returns(200, doc.Schema(bsql.QuietHours{}))
+	deleteQuiet := op("Remove quiet hours", 200).Tag("notifications").Auth()
+
+	// Groups
+	createGroup := op("Create a group", 403).Tag("groups").Auth().
+		Returns(200, openapi.Object(map[string]*openapi.Schema{"id": str}))
+	group := op("Get a group", 403, 404).Tag("groups").Auth().
+		Returns(200, doc.Schema(bsql.Group{}))
+	disband := op("Disband a group", 200, 403, 404).Tag("groups").Auth()
+	join := op("Join a group", 200, 400, 404).Tag("groups").Auth()
+	kick := op("Kick a member", 200, 403, 404).Tag("groups").Auth()
+	leave := op("Leave a group", 200, 403, 404).Tag("groups").Auth().
+		Describe("A creator or coin holder leaving hands the group or coin to a random member, the last member leaving disbands it")
+	transfer := body(op("Hand the group to another member", 200, 403, 404).Tag("groups").Auth(), bres.TransferRequest{}).
+		Describe("Sent to streams and webhooks as a settings event, 403 if the member already owns a group")
+	coin := op("Pass the coin", 201, 403, 404).Tag("groups").Auth()
+	events := op("Stream group events", 400, 403, 404).Tag("groups").Auth().
+		Content(200, "text/event-stream", str).
+		Header("Last-Event-ID", false, "Replay coin passes after this id")
+	socket := op("Open the group websocket", 101, 403, 404).Tag("groups").Auth()
+
+	// Stats
+	userStats := op("Get a user's stats", 404).Tag("stats").Auth().
+		Returns(200, doc.Schema(stats.UserStats{})).
+		Describe("Over every group they passed in, a pass at coin n counts n pushups")
+	userAchievements := op("Get a user's badges", 404).Tag("stats").Auth().
+		Returns(200, openapi.Array(doc.Schema(achievements.Badge{}))).
+		Describe("Oldest first, earning one sends a badge event to the group it was earned in")
+	groupStats := op("Get a group's stats", 403, 404).Tag("stats").Auth().
+		Returns(200, doc.Schema(stats.GroupStats{}))
+	leaderboard := doc.Query(op("Rank the members by pushups", 400, 403, 404).Tag("stats").Auth(), bres.LeaderboardQuery{}).
+		Returns(200, openapi.Array(doc.Schema(stats.Entry{}))).
+		Describe("Periods start at the current day, week (Monday) or month, all time by default")
+
+	// Webhooks, group owner only
+	webhook := body(op("Subscribe a webhook", 403, 404).Tag("webhooks").Auth(), bres.WebhookRequest{}).
+		Returns(201, openapi.Object(map[string]*openapi.Schema{
+			"id":     str,
+			"events": openapi.Array(str),
+			"secret": str,
+		})).
+		Describe("The secret is only ever returned here, urls reaching loopback, private or link-local addresses are refused")
+	webhooks := op("List webhooks", 403, 404).Tag("webhooks").Auth().
+		Returns(200, openapi.Array(doc.Schema(bsql.Webhook{})))
+	deleteWebhook := op("Remove a webhook", 200, 403, 404).Tag("webhooks").Auth()
+	enableWebhook := op("Resume a webhook disabled after repeated failures", 403, 404).Tag("webhooks").Auth().
+		Returns(200, doc.Schema(bsql.Webhook{}))
+	deliveries := op("List recent webhook deliveries", 403, 404).Tag("webhooks").Auth().
+		Returns(200, openapi.Array(doc.Schema(bsql.WebhookDelivery{})))
+
+	// Audit log, group owner only
+	groupAudit := doc.Query(op("Page through the group's audit log", 400, 403, 404).Tag("groups").Auth(), bres.GroupAuditQuery{}).
+		Returns(200, openapi.Array(doc.Schema(bsql.GroupAuditEvent{}))).
+		Describe("Joins, kicks, coin passes and admin actions in the group, newest first, pass the smallest id seen as before for the next page. IPs and request ids are only shown to admins")
+
+	doc.Add("GET", "/api/healthcheck", op("Ping the database", 200, 500).Tag("meta"))
+	doc.Add("POST", "/api/graphql", op("Run a GraphQL query").Tag("graphql").Auth().
+		Body(openapi.Object(map[string]*openapi.Schema{
+			"query":         str,
+			"operationName": str,
+			"variables":     &openapi.Schema{Type: "object"},
+		})).
+		Returns(200, &openapi.Schema{Type: "object"}).
+		Status(400).
+		Describe("Errors, including the depth and complexity limits, come back in a 200 body"))
+	doc.Add("GET", "/api/graphql", op("Open a GraphQL subscription socket", 101).Tag("graphql").
+		Describe("graphql-transport-ws, send Authorization in the connection_init payload"))
+	doc.Add("GET", "/api/openapi.json", op("This document").Tag("meta").Returns(200, &openapi.Schema{Type: "object"}))
+
+	// v2
+	v2 := func(method string, route string, o *openapi.Operation) {
+		doc.Add(method, "/api/v2"+route, o)
+	}
+	v2("POST", "/sessions", login)
+	v2("POST", "/sessions/2fa", loginSecondFactor)
+	v2("POST", "/users", register)
+	v2("GET", "/users/:user/group", userGroup)
+	v2("GET", "/users/:user/stats", userStats)
+	v2("GET", "/users/:user/achievements", userAchievements)
+	v2("POST", "/password/forgot", forgotPassword)
+	v2("POST", "/password/reset", resetPassword)
+	v2("DELETE", "/me", deleteAccount)
+	v2("PUT", "/me/email", email)
+	v2("POST", "/me/email/verify", verifyEmail)
+	v2("PUT", "/me/password", password)
+	v2("GET", "/me/2fa", twoFactor)
+	v2("POST", "/me/2fa", enrollTwoFactor)
+	v2("POST", "/me/2fa/confirm", confirmTwoFactor)
+	v2("DELETE", "/me/2fa", disableTwoFactor)
+	v2("POST", "/me/devices", device)
+	v2("DELETE", "/me/devices/:device", deleteDevice)
+	v2("PUT", "/me/quiet", quiet)
+	v2("DELETE", "/me/quiet", deleteQuiet)
+	v2("POST", "/groups", createGroup)
+	v2("GET", "/groups/:id", group)
+	v2("DELETE", "/groups/:id", disband)
+	v2("POST", "/groups/:id/members", join)
+	v2("DELETE", "/groups/:id/members/:member", kick)
+	v2("POST", "/groups/:id/leave", leave)
+	v2("PUT", "/groups/:id/creator", transfer)
+	v2("POST", "/groups/:id/coin", coin)
+	v2("GET", "/groups/:id/events", events)
+	v2("GET", "/groups/:id/ws", socket)
+	v2("GET", "/groups/:id/stats", groupStats)
+	v2("GET", "/groups/:id/leaderboard", leaderboard)
+	v2("POST", "/groups/:id/webhooks", webhook)
+	v2("GET", "/groups/:id/webhooks", webhooks)
+	v2("DELETE", "/groups/:id/webhooks/:hook", deleteWebhook)
+	v2("POST", "/groups/:id/webhooks/:hook/enable", enableWebhook)
+	v2("GET", "/groups/:id/webhooks/:hook/deliveries", deliveries)
+	v2("GET", "/groups/:id/audit", groupAudit)
+
+	// Operators, admin role only
+	if config.Get().Server.AdminAPI == "public" {
+		adminOp := func(summary string, codes ...int) *openapi.Operation {
+			return op(summary, codes...).Tag("admin").Auth().Status(403)
+		}
+		adminUsers := doc.Query(adminOp("Search users", 400), bres.SearchQuery{}).
+			Returns(200, openapi.Array(doc.Schema(bsql.UserAccount{}))).
+			Describe("q matches the start of the username or email")
+		adminUser := adminOp("Get a user", 404).
+			Returns(200, openapi.Object(map[string]*openapi.Schema{
+				"account":    doc.Schema(bsql.UserAccount{}),
+				"two_factor": doc.Schema(bsql.TwoFactorStatus{}),
+				"groups":     openapi.Array(str),
+				"sessions":   openapi.Array(doc.Schema(tokens.Session{})),
+			})).
+			Describe("Sessions are the ones held by the server answering")
+		adminDisable := adminOp("Disable a user", 200, 400, 404).
+			Describe("Ends their sessions, admins can't disable themselves")
+		adminEnable := adminOp("Enable a user", 200, 404)
+		adminSessions := adminOp("Sign a user out everywhere", 200, 404)
+		adminGroups := doc.Query(adminOp("Search groups", 400), bres.SearchQuery{}).
+			Returns(200, openapi.Array(doc.Schema(bsql.Group{}))).
+			Describe("q matches the start of the id, the creator or a member")
+		adminGroup := adminOp("Get any group", 404).
+			Returns(200, doc.Schema(bsql.Group{}))
+		adminCoin := body(adminOp("Hand the coin to a member", 403, 404), bres.ReassignRequest{}).
+			Returns(201, doc.Schema(bsql.CoinPass{})).
+			Describe("Not counted as a pass")
+		adminAudit := doc.Query(adminOp("Page through the audit log", 400), bres.AuditQuery{}).
+			Returns(200, openapi.Array(doc.Schema(bsql.AuditEvent{}))).
+			Describe("Newest first, pass the smallest id seen as before for the next page")
+		adminSessionList := adminOp("List sessions").
+			Returns(200, openapi.Array(doc.Schema(tokens.Session{}))).
+			Describe("Held by the server answering")
+		adminRateLimit := adminOp("List rate limited IPs").
+			Returns(200, openapi.Array(doc.Schema(ratelimit.Visitor{}))).
+			Describe("Counted by the server answering, blocked ones first")
+
+		admin := func(method string, route string, o *openapi.Operation) {
+			doc.Add(method, "/api/admin"+route, o)
+		}
+		admin("GET", "/users", adminUsers)
+		admin("GET", "/users/:user", adminUser)
+		admin("POST", "/users/:user/disable", adminDisable)
+		admin("POST", "/users/:user/enable", adminEnable)
+		admin("DELETE", "/users/:user/sessions", adminSessions)
+		admin("GET", "/groups", adminGroups)
+		admin("GET", "/groups/:id", adminGroup)
+		admin("POST", "/groups/:id/coin", adminCoin)
+		admin("GET", "/audit", adminAudit)
+		admin("GET", "/sessions", adminSessionList)
+		admin("GET", "/ratelimit", adminRateLimit)
+	}
+
+	// v1, deprecated
+	// The group id moves from the path to an ID header or the body
+	v1 := func(method string, route string, o *openapi.Operation) {
+		doc.Add(method, route, o.Deprecate())
+	}
+	groupHeader := func(o *openapi.Operation) *openapi.Operation {
+		return o.Deprecate().Header("ID", true, "Group id").Status(400)
+	}
+	groupBody := func(o *openapi.Operation) *openapi.Operation {
+		return body(o.Deprecate(), bres.GroupRequest{})
+	}
+
+	v1("POST", "/api/client/login", login)
+	v1("POST", "/api/client/login/2fa", loginSecondFactor)
+	v1("POST", "/api/client/register", register)
+	v1("POST", "/api/client/email", email)
+	v1("POST", "/api/client/email/verify", verifyEmail)
+	v1("POST", "/api/client/password/forgot", forgotPassword)
+	v1("POST", "/api/client/password/reset", resetPassword)
+	v1("POST", "/api/client/password", password)
+	v1("DELETE", "/api/client", deleteAccount)
+	v1("GET", "/api/client/2fa", twoFactor)
+	v1("POST", "/api/client/2fa", enrollTwoFactor)
+	v1("POST", "/api/client/2fa/confirm", confirmTwoFactor)
+	v1("DELETE", "/api/client/2fa", disableTwoFactor)
+	v1("POST", "/api/client/device", device)
+	v1("DELETE", "/api/client/device", deleteDevice.Deprecate().Header("Device", true, "Device token").Status(400))
+	v1("POST", "/api/client/quiet", quiet)
+	v1("DELETE", "/api/client/quiet", deleteQuiet)
+	v1("GET", "/api/group/:user", userGroup)
+	v1("GET", "/api/group/:user/events", events.Deprecate().Describe(":user holds the group id"))
+	v1("GET", "/api/group/:user/ws", socket.Deprecate().Describe(":user holds the group id"))
+	v1("POST", "/api/group/create", createGroup)
+	v1("POST", "/api/group/join", groupBody(join))
+	v1("POST", "/api/group/coin", groupBody(coin))
+	v1("DELETE", "/api/group/kick/:user", groupHeader(kick).Describe(":user is the member to kick"))
+	v1("POST", "/api/group/leave", groupBody(leave))
+	v1("POST", "/api/group/transfer", groupHeader(transfer))
+	v1("DELETE", "/api/group/disband", groupHeader(disband))
+	v1("POST", "/api/group/webhook", groupHeader(webhook))
+	v1("GET", "/api/group/webhook", groupHeader(webhooks))
+	v1("DELETE", "/api/group/webhook/:hook", groupHeader(deleteWebhook))
+	v1("POST", "/api/group/webhook/:hook/enable", groupHeader(enableWebhook))
+	v1("GET", "/api/group/webhook/:hook/deliveries", groupHeader(deliveries))
+	v1("GET", "/api/user/:user/achievements", userAchievements)
+
+	// Every route sits behind the IP rate limiter
+	for _, item := range doc.Paths {
+		for _, o := range *item {
+			o.Status(429)
+		}
+	}
+
+	return doc
+}
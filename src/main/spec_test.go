@@ -0,0 +1,54 @@
+package main
+
+import (
+	"benschreiber.com/purestserver/src/config"
+	"github.com/gin-gonic/gin"
+	"testing"
+)
+
+func TestSpecCoversRoutes(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	// /api/admin is on the public router and in the spec only when public
+	for _, adminAPI := range []string{"public", "admin", "off"} {
+		t.Run(adminAPI, func(t *testing.T) {
+			c := config.Default()
+			c.Server.AdminAPI = adminAPI
+			config.Set(c)
+
+			router := newRouter()
+			missing, extra := apiSpec().Diff(router.Routes())
+			for _, r := range missing {
+				t.Errorf("route missing from the OpenAPI spec: %s", r)
+			}
+			for _, r := range extra {
+				t.Errorf("OpenAPI spec describes an unregistered route: %s", r)
+			}
+			if len(router.Routes()) == 0 {
+				t.Fatal("no routes registered")
+			}
+		})
+	}
+}
+
+func TestSpecAdminRoutes(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	tests := []struct {
+		adminAPI string
+		want     bool
+	}{
+		{"public", true},
+		{"admin", false},
+		{"off", false},
+	}
+	for _, tt := range tests {
+		c := config.Default()
+		c.Server.AdminAPI = tt.adminAPI
+		config.Set(c)
+
+		if got := apiSpec().Has("GET", "/api/admin/users"); got != tt.want {
+			t.Errorf("admin_api %s: spec has /api/admin/users = %v, want %v", tt.adminAPI, got, tt.want)
+		}
+	}
+}
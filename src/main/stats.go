@@ -0,0 +1,142 @@
+package main
+
+import (
+	"benschreiber.com/purestserver/src/achievements"
+	"benschreiber.com/purestserver/src/bres"
+	"benschreiber.com/purestserver/src/bsql"
+	"benschreiber.com/purestserver/src/groups"
+	"benschreiber.com/purestserver/src/stats"
+	"github.com/gin-gonic/gin"
+)
+
+// METHOD: GET
+// Return a user's pushups, passes, holds and streak over every group
+// Requires Authorization header; user param
+func getUserStats(c *gin.Context) {
+
+	// Validate the bearer token, identity goes in the context
+	// STATUS: 401 Unauthorized on missing, invalid or expired token
+	ok, err := bres.ValidateAuthentication(c)
+	if err != nil {
+		bres.AbortWithError(c, err)
+		return
+	}
+	if !ok {
+		return
+	}
+
+	// STATUS: 404 on nonexistant user
+	s, err := stats.ForUser(c.Request.Context(), c.Param("user"))
+	if err != nil {
+		abortWithAccountError(c, err)
+		return
+	}
+
+	// STATUS: 200 OK
+	c.JSON(200, s)
+}
+
+// Shared checks for the group stats endpoints
+// Validates authentication and membership
+// Returns the group, false if the request was aborted
+func validateMemberGroup(c *gin.Context) (*bsql.Group, bool) {
+
+	// Validate the bearer token, identity goes in the context
+	// STATUS: 401 Unauthorized on missing, invalid or expired token
+	ok, err := bres.ValidateAuthentication(c)
+	if err != nil {
+		bres.AbortWithError(c, err)
+		return nil, false
+	}
+	if !ok {
+		return nil, false
+	}
+
+	// STATUS 404 Not Found on non-existant group
+	// STATUS 403 Forbidden user not in group
+	group, err := groups.Get(c.Request.Context(), bres.User(c), c.Param("id"))
+	if err != nil {
+		abortWithGroupError(c, err)
+		return nil, false
+	}
+
+	return group, true
+}
+
+// METHOD: GET
+// Return the group's pushups, passes, holds and streak
+// Requires Authorization header; group id param
+func getGroupStats(c *gin.Context) {
+
+	// STATUS: 401, 404, 403 as validateMemberGroup
+	group, ok := validateMemberGroup(c)
+	if !ok {
+		return
+	}
+
+	s, err := stats.ForGroup(c.Request.Context(), group)
+	if err != nil {
+		bres.AbortWithError(c, err)
+		return
+	}
+
+	// STATUS: 200 OK
+	c.JSON(200, s)
+}
+
+// METHOD: GET
+// Rank the group's members by pushups over a period
+// Requires Authorization header; group id param; optional period query (day, week, month, all)
+func getLeaderboard(c *gin.Context) {
+
+	// STATUS: 401, 404, 403 as validateMemberGroup
+	group, ok := validateMemberGroup(c)
+	if !ok {
+		return
+	}
+
+	// STATUS: 400 Bad Request with field errors
+	var q bres.LeaderboardQuery
+	if !bres.BindQuery(c, &q) {
+		return
+	}
+	if q.Period == "" {
+		q.Period = bsql.PERIOD_ALL
+	}
+
+	entries, err := stats.Leaderboard(c.Request.Context(), group, q.Period)
+	if err != nil {
+		bres.AbortWithError(c, err)
+		return
+	}
+
+	// STATUS: 200 OK
+	c.JSON(200, entries)
+}
+
+// METHOD: GET
+// Return the badges a user earned, oldest first
+// Requires Authorization header; user param
+func getUserAchievements(c *gin.Context) {
+
+	// Validate the bearer token, identity goes in the context
+	// STATUS: 401 Unauthorized on missing, invalid or expired token
+	ok, err := bres.ValidateAuthentication(c)
+	if err != nil {
+		bres.AbortWithError(c, err)
+		return
+	}
+	if !ok {
+		return
+	}
+
+	// STATUS: 404 on nonexistant user
+	badges, err := achievements.For(c.Request.Context(), c.Param("user"))
+	if err != nil {
+		abortWithAccountError(c, err)
+		return
+	}
+
+	// STATUS: 200 OK
+	c.JSON(200, badges)
+}
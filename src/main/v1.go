@@ -0,0 +1,124 @@
+package main
+
+import (
+	"benschreiber.com/purestserver/src/bres"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"time"
+)
+
+// Date the v1 routes stop being served
+var V1_SUNSET = time.Date(2027, time.May, 1, 0, 0, 0, 0, time.UTC)
+
+// Mark every v1 response as deprecated, pointing at v2
+func deprecatedV1(c *gin.Context) {
+	c.Header("Deprecation", "true")
+	c.Header("Sunset", V1_SUNSET.Format(http.TimeFormat))
+	c.Header("Link", `</api/v2>; rel="successor-version"`)
+	c.Next()
+}
+
+// Register the original routes under /api/client and /api/group
+// Handlers shared with v2 where the request has the same shape,
+// otherwise an adapter moves the v1 inputs where the v2 handler reads them
+func registerV1(router *gin.Engine) {
+
+	// Client endpoints
+	client := router.Group("/api/client", deprecatedV1)
+	client.POST("/login", loginClient)
+	client.POST("/login/2fa", loginSecondFactor)
+	client.POST("/register", registerClient)
+	client.POST("/email", postEmail)
+	client.POST("/email/verify", postVerifyEmail)
+	client.POST("/password/forgot", postForgotPassword)
+	client.POST("/password/reset", postResetPassword)
+	client.POST("/password", postPassword)
+	client.DELETE("", delClient)
+	client.GET("/2fa", getTwoFactor)
+	client.POST("/2fa", postTwoFactor)
+	client.POST("/2fa/confirm", postConfirmTwoFactor)
+	client.DELETE("/2fa", delTwoFactor)
+	client.POST("/device", postDevice)
+	client.DELETE("/device", v1DelDevice)
+	client.POST("/quiet", postQuietHours)
+	client.DELETE("/quiet", delQuietHours)
+
+	// Group endpoints
+	group := router.Group("/api/group", deprecatedV1)
+	group.GET("/:user", getGroup)
+	// gin requires the wildcard name to match the route above, :user holds the group id
+	group.GET("/:user/events", v1GroupParam(getGroupEvents))
+	group.GET("/:user/ws", v1GroupParam(getGroupSocket))
+	group.POST("/create", postGroup)
+	group.POST("/join", v1GroupBody(postGroupMember))
+	group.POST("/coin", v1GroupBody(postCoin))
+	group.DELETE("/kick/:user", v1GroupHeader(v1Kick))
+	group.POST("/leave", v1GroupBody(postLeaveGroup))
+	group.POST("/transfer", v1GroupHeader(putGroupCreator))
+	group.DELETE("/disband", v1GroupHeader(delGroup))
+
+	// Webhook endpoints, group owner only
+	group.POST("/webhook", v1GroupHeader(postWebhook))
+	group.GET("/webhook", v1GroupHeader(getWebhooks))
+	group.DELETE("/webhook/:hook", v1GroupHeader(delWebhook))
+	group.POST("/webhook/:hook/enable", v1GroupHeader(postWebhookEnable))
+	group.GET("/webhook/:hook/deliveries", v1GroupHeader(getWebhookDeliveries))
+
+	// User endpoints
+	user := router.Group("/api/user", deprecatedV1)
+	user.GET("/:user/achievements", getUserAchievements)
+}
+
+// Set a path param the v2 handler reads
+func setParam(c *gin.Context, key string, value string) {
+	c.Params = append(c.Params, gin.Param{Key: key, Value: value})
+}
+
+// Group id from the :user param
+func v1GroupParam(h gin.HandlerFunc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		setParam(c, "id", c.Param("user"))
+		h(c)
+	}
+}
+
+// Group id from the ID header
+// STATUS: 400 Bad Request on missing header
+func v1GroupHeader(h gin.HandlerFunc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !bres.ValidateHeaders(c, "ID") {
+			return
+		}
+		setParam(c, "id", c.GetHeader("ID"))
+		h(c)
+	}
+}
+
+// Group id from the JSON body {id}, or the ID header
+// STATUS: 400 Bad Request with field errors
+func v1GroupBody(h gin.HandlerFunc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req bres.GroupRequest
+		if !bres.BindRequest(c, &req) {
+			return
+		}
+		setParam(c, "id", req.ID)
+		h(c)
+	}
+}
+
+// Kicked member from the :user param
+func v1Kick(c *gin.Context) {
+	setParam(c, "member", c.Param("user"))
+	delGroupMember(c)
+}
+
+// Device token from the Device header
+// STATUS: 400 Bad Request on missing header
+func v1DelDevice(c *gin.Context) {
+	if !bres.ValidateHeaders(c, "Device") {
+		return
+	}
+	setParam(c, "device", c.GetHeader("Device"))
+	delDevice(c)
+}
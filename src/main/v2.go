@@ -0,0 +1,62 @@
+package main
+
+import (
+	"benschreiber.com/purestserver/src/bres"
+	"github.com/gin-gonic/gin"
+)
+
+// Register the resource oriented routes under /api/v2
+// JSON bodies and Authorization: Bearer only, group ids in the path
+func registerV2(router *gin.Engine) {
+	v2 := router.Group("/api/v2", bres.Strict)
+
+	// Sessions and accounts
+	v2.POST("/sessions", loginClient)
+	v2.POST("/sessions/2fa", loginSecondFactor)
+	v2.POST("/users", registerClient)
+	v2.GET("/users/:user/group", getGroup)
+	v2.GET("/users/:user/stats", getUserStats)
+	v2.GET("/users/:user/achievements", getUserAchievements)
+	v2.POST("/password/forgot", postForgotPassword)
+	v2.POST("/password/reset", postResetPassword)
+
+	// The authenticated user
+	me := v2.Group("/me")
+	me.DELETE("", delClient)
+	me.PUT("/email", postEmail)
+	me.POST("/email/verify", postVerifyEmail)
+	me.PUT("/password", postPassword)
+	me.GET("/2fa", getTwoFactor)
+	me.POST("/2fa", postTwoFactor)
+	me.POST("/2fa/confirm", postConfirmTwoFactor)
+	me.DELETE("/2fa", delTwoFactor)
+	me.POST("/devices", postDevice)
+	me.DELETE("/devices/:device", delDevice)
+	me.PUT("/quiet", postQuietHours)
+	me.DELETE("/quiet", delQuietHours)
+
+	// Groups
+	groups := v2.Group("/groups")
+	groups.POST("", postGroup)
+	groups.GET("/:id", getGroupByID)
+	groups.DELETE("/:id", delGroup)
+	groups.POST("/:id/members", postGroupMember)
+	groups.DELETE("/:id/members/:member", delGroupMember)
+	groups.POST("/:id/leave", postLeaveGroup)
+	groups.PUT("/:id/creator", putGroupCreator)
+	groups.POST("/:id/coin", postCoin)
+	groups.GET("/:id/events", getGroupEvents)
+	groups.GET("/:id/ws", getGroupSocket)
+	groups.GET("/:id/stats", getGroupStats)
+	groups.GET("/:id/leaderboard", getLeaderboard)
+
+	// Webhooks, group owner only
+	groups.POST("/:id/webhooks", postWebhook)
+	groups.GET("/:id/webhooks", getWebhooks)
+	groups.DELETE("/:id/webhooks/:hook", delWebhook)
+	groups.POST("/:id/webhooks/:hook/enable", postWebhookEnable)
+	groups.GET("/:id/webhooks/:hook/deliveries", getWebhookDeliveries)
+
+	// Audit log, group owner only
+	groups.GET("/:id/audit", getGroupAudit)
+}
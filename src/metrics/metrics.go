@@ -0,0 +1,147 @@
+// Prometheus metrics served at /metrics on the admin listener, never the public router
+// Counters and histograms shared across packages are defined here,
+// packages owning a gauge register it themselves in their Init()
+package metrics
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Prefix of every metric name
+const NAMESPACE = "pushup"
+
+// Route label of requests no route matched, keeps the label set bounded
+const UNMATCHED = "unmatched"
+
+var registry = prometheus.NewRegistry()
+
+var (
+	HTTPDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: NAMESPACE,
+		Name:      "http_request_duration_seconds",
+		Help:      "HTTP request latency by method, route and status.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method", "route", "status"})
+
+	HTTPInFlight = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: NAMESPACE,
+		Name:      "http_requests_in_flight",
+		Help:      "HTTP requests being served.",
+	})
+
+	QueryDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: NAMESPACE,
+		Name:      "db_query_duration_seconds",
+		Help:      "Database statement latency by bsql query.",
+		Buckets:   []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1},
+	}, []string{"query"})
+
+	QueryErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: NAMESPACE,
+		Name:      "db_query_errors_total",
+		Help:      "Database statements that failed, not counting no rows, by bsql query.",
+	}, []string{"query"})
+
+	RateLimited = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: NAMESPACE,
+		Name:      "rate_limited_total",
+		Help:      "Requests rejected by the IP rate limiter, on every API.",
+	})
+
+	UsersRegistered = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: NAMESPACE,
+		Name:      "users_registered_total",
+		Help:      "Accounts created.",
+	})
+
+	GroupsCreated = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: NAMESPACE,
+		Name:      "groups_created_total",
+		Help:      "Groups created.",
+	})
+
+	GroupsDisbanded = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: NAMESPACE,
+		Name:      "groups_disbanded_total",
+		Help:      "Groups disbanded by their creator.",
+	})
+
+	MembersJoined = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: NAMESPACE,
+		Name:      "members_joined_total",
+		Help:      "Users who joined a group.",
+	})
+
+	CoinsPassed = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: NAMESPACE,
+		Name:      "coins_passed_total",
+		Help:      "Coins passed on.",
+	})
+)
+
+func init() {
+	registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		HTTPDuration,
+		HTTPInFlight,
+		QueryDuration,
+		QueryErrors,
+		RateLimited,
+		UsersRegistered,
+		GroupsCreated,
+		GroupsDisbanded,
+		MembersJoined,
+		CoinsPassed,
+	)
+}
+
+// Add a package's own collectors, e.g. a gauge over its in-memory maps
+func Register(cs ...prometheus.Collector) {
+	registry.MustRegister(cs...)
+}
+
+// Gauge read from f on every scrape
+func GaugeFunc(name string, help string, f func() float64) prometheus.Collector {
+	return prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: NAMESPACE,
+		Name:      name,
+		Help:      help,
+	}, f)
+}
+
+// Time a database statement under its bsql query name
+// err is the statement's error, sql.ErrNoRows should be passed as nil
+func ObserveQuery(query string, start time.Time, err error) {
+	QueryDuration.WithLabelValues(query).Observe(time.Since(start).Seconds())
+	if err != nil {
+		QueryErrors.WithLabelValues(query).Inc()
+	}
+}
+
+// Record latency per route and status
+// Runs before the rate limiter so 429s are counted too
+func Middleware(c *gin.Context) {
+	HTTPInFlight.Inc()
+	start := time.Now()
+	c.Next()
+	HTTPInFlight.Dec()
+
+	route := c.FullPath()
+	if route == "" {
+		route = UNMATCHED
+	}
+	HTTPDuration.WithLabelValues(c.Request.Method, route, strconv.Itoa(c.Writer.Status())).
+		Observe(time.Since(start).Seconds())
+}
+
+// Serves the registry in the Prometheus text format
+func Handler() http.Handler {
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+}
@@ -0,0 +1,168 @@
+// Apple Push Notification service provider
+// Uses token based auth, a JWT signed with the team's .p8 key
+package notify
+
+import (
+	"benschreiber.com/purestserver/src/bsql"
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	APNS_HOST         = "https://api.push.apple.com"
+	APNS_SANDBOX_HOST = "https://api.sandbox.push.apple.com"
+	APNS_JWT_LIFETIME = 50 * time.Minute // Apple rejects tokens older than an hour
+)
+
+type APNs struct {
+	Host   string
+	Topic  string
+	KeyID  string
+	TeamID string
+	Client *http.Client
+
+	key    *ecdsa.PrivateKey
+	mu     sync.Mutex
+	jwt    string
+	jwtExp time.Time
+}
+
+// Create an APNs provider from a .p8 key file
+func NewAPNs(keyFile string, keyID string, teamID string, topic string, sandbox bool) (*APNs, error) {
+	data, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("apns key is not PEM encoded")
+	}
+
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	key, ok := parsed.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("apns key is not an ECDSA key")
+	}
+
+	host := APNS_HOST
+	if sandbox {
+		host = APNS_SANDBOX_HOST
+	}
+
+	return &APNs{
+		Host:   host,
+		Topic:  topic,
+		KeyID:  keyID,
+		TeamID: teamID,
+		Client: &http.Client{Timeout: SEND_TIMEOUT},
+		key:    key,
+	}, nil
+}
+
+// Provider token, reused until it is close to expiring
+func (a *APNs) token() (string, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.jwt != "" && time.Now().Before(a.jwtExp) {
+		return a.jwt, nil
+	}
+
+	enc := base64.RawURLEncoding
+	header, _ := json.Marshal(map[string]string{"alg": "ES256", "kid": a.KeyID})
+	claims, _ := json.Marshal(map[string]interface{}{"iss": a.TeamID, "iat": time.Now().Unix()})
+	unsigned := enc.EncodeToString(header) + "." + enc.EncodeToString(claims)
+
+	sum := sha256.Sum256([]byte(unsigned))
+	r, s, err := ecdsa.Sign(rand.Reader, a.key, sum[:])
+	if err != nil {
+		return "", err
+	}
+
+	// JWS wants r and s as fixed size big endian values
+	sig := make([]byte, 64)
+	pad(r, sig[:32])
+	pad(s, sig[32:])
+
+	a.jwt = unsigned + "." + enc.EncodeToString(sig)
+	a.jwtExp = time.Now().Add(APNS_JWT_LIFETIME)
+	return a.jwt, nil
+}
+
+// Write n into b, left padded with zeros
+func pad(n *big.Int, b []byte) {
+	raw := n.Bytes()
+	copy(b[len(b)-len(raw):], raw)
+}
+
+func (a *APNs) Send(device *bsql.Device, m *Message) error {
+	payload := map[string]interface{}{
+		"aps": map[string]interface{}{
+			"alert": map[string]string{"title": m.Title, "body": m.Body},
+			"sound": "default",
+		},
+	}
+	for k, v := range m.Data {
+		payload[k] = v
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	jwt, err := a.token()
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", a.Host+"/3/device/"+device.Token, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("authorization", "bearer "+jwt)
+	req.Header.Set("apns-topic", a.Topic)
+	req.Header.Set("apns-push-type", "alert")
+	req.Header.Set("apns-priority", "10")
+	if m.CollapseID != "" {
+		req.Header.Set("apns-collapse-id", m.CollapseID)
+	}
+
+	res, err := a.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == 200 {
+		return nil
+	}
+
+	var reason struct {
+		Reason string `json:"reason"`
+	}
+	json.NewDecoder(res.Body).Decode(&reason)
+
+	// 410 is an uninstalled app, bad tokens are never going to work
+	if res.StatusCode == 410 || reason.Reason == "BadDeviceToken" || reason.Reason == "Unregistered" {
+		return ErrInvalidDevice
+	}
+	return fmt.Errorf("apns responded %d: %s", res.StatusCode, reason.Reason)
+}
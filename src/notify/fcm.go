@@ -0,0 +1,111 @@
+// Firebase Cloud Messaging provider, HTTP v1 API
+// The OAuth2 access token comes from a TokenSource so it can be refreshed outside the server
+package notify
+
+import (
+	"benschreiber.com/purestserver/src/bsql"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+const FCM_HOST = "https://fcm.googleapis.com"
+
+// Returns a current OAuth2 access token for the FCM scope
+type TokenSource func() (string, error)
+
+// Read the access token from an environment variable on every send
+func EnvToken(name string) TokenSource {
+	return func() (string, error) {
+		token := os.Getenv(name)
+		if token == "" {
+			return "", errors.New(name + " is not set")
+		}
+		return token, nil
+	}
+}
+
+// Read the access token from a file on every send, e.g. one a sidecar refreshes
+func FileToken(path string) TokenSource {
+	return func() (string, error) {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return "", err
+		}
+		token := strings.TrimSpace(string(data))
+		if token == "" {
+			return "", errors.New(path + " is empty")
+		}
+		return token, nil
+	}
+}
+
+type FCM struct {
+	Host    string
+	Project string
+	Token   TokenSource
+	Client  *http.Client
+}
+
+func NewFCM(project string, token TokenSource) *FCM {
+	return &FCM{
+		Host:    FCM_HOST,
+		Project: project,
+		Token:   token,
+		Client:  &http.Client{Timeout: SEND_TIMEOUT},
+	}
+}
+
+func (f *FCM) Send(device *bsql.Device, m *Message) error {
+	msg := map[string]interface{}{
+		"token":        device.Token,
+		"notification": map[string]string{"title": m.Title, "body": m.Body},
+		"data":         m.Data,
+	}
+	if m.CollapseID != "" {
+		msg["android"] = map[string]string{"collapse_key": m.CollapseID}
+	}
+	body, err := json.Marshal(map[string]interface{}{"message": msg})
+	if err != nil {
+		return err
+	}
+
+	token, err := f.Token()
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", f.Host+"/v1/projects/"+f.Project+"/messages:send", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := f.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == 200 {
+		return nil
+	}
+
+	var reason struct {
+		Error struct {
+			Status string `json:"status"`
+		} `json:"error"`
+	}
+	json.NewDecoder(res.Body).Decode(&reason)
+
+	// Unregistered tokens come back as 404 NOT_FOUND / UNREGISTERED
+	if res.StatusCode == 404 || reason.Error.Status == "UNREGISTERED" {
+		return ErrInvalidDevice
+	}
+	return fmt.Errorf("fcm responded %d: %s", res.StatusCode, reason.Error.Status)
+}
@@ -0,0 +1,47 @@
+// Notifiers for local development
+package notify
+
+import (
+	"benschreiber.com/purestserver/src/bsql"
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+)
+
+// Writes every message to the server log
+type LogNotifier struct{}
+
+func (l *LogNotifier) Send(device *bsql.Device, m *Message) error {
+	logger.Info("push", "user", device.Username, "platform", device.Platform, "title", m.Title, "body", m.Body)
+	return nil
+}
+
+// Appends every message as a JSON line to Path
+type FileNotifier struct {
+	Path string
+	mu   sync.Mutex
+}
+
+func (f *FileNotifier) Send(device *bsql.Device, m *Message) error {
+	line, err := json.Marshal(struct {
+		Device  *bsql.Device `json:"device"`
+		Message *Message     `json:"message"`
+		SentAt  time.Time    `json:"sent_at"`
+	}{device, m, time.Now()})
+	if err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	file, err := os.OpenFile(f.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = file.Write(append(line, '\n'))
+	return err
+}
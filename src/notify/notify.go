@@ -0,0 +1,272 @@
+// Push notifications for coin handoffs
+// bsql.UpdateCoin writes to the notification_outbox table in the same transaction
+// as the pass, a worker dispatches due rows to every device of the user
+// through the Notifier registered for the device platform
+// Must call notify.Init() after bsql is initialized
+package notify
+
+import (
+	"benschreiber.com/purestserver/src/bsql"
+	"benschreiber.com/purestserver/src/config"
+	"benschreiber.com/purestserver/src/lifecycle"
+	"benschreiber.com/purestserver/src/logging"
+	"benschreiber.com/purestserver/src/tracing"
+	"context"
+	"encoding/json"
+	"errors"
+	"go.opentelemetry.io/otel/attribute"
+	"strconv"
+	"time"
+)
+
+var logger = logging.For("notify")
+
+const (
+	POLL_PERIOD  = 5 * time.Second  // how often the worker looks for due notifications
+	BATCH_SIZE   = 50               // notifications sent per poll
+	BASE_BACKOFF = 15 * time.Second // wait after the first failed attempt, doubled each attempt
+	MAX_BACKOFF  = time.Hour
+	MAX_ATTEMPTS = 6                // attempts before a notification is marked failed
+	SEND_TIMEOUT = 10 * time.Second // per request timeout of the live notifiers
+	LEASE        = 15 * time.Minute // a claimed notification is left to its server this long
+)
+
+// Device platforms a user can register
+const (
+	PLATFORM_APNS = "apns"
+	PLATFORM_FCM  = "fcm"
+)
+
+// Returned by a Notifier when the provider says the device token is dead
+// The device is removed instead of retried
+var ErrInvalidDevice = errors.New("invalid device token")
+
+// A push message, independent of provider
+type Message struct {
+	Title      string            `json:"title"`
+	Body       string            `json:"body"`
+	Data       map[string]string `json:"data"`
+	CollapseID string            `json:"collapse_id"`
+}
+
+// Sends a message to a single device
+type Notifier interface {
+	Send(device *bsql.Device, m *Message) error
+}
+
+// Notifier per device platform
+var providers = make(map[string]Notifier)
+
+// Platform is one a device can be registered with
+func ValidPlatform(platform string) bool {
+	return platform == PLATFORM_APNS || platform == PLATFORM_FCM
+}
+
+// Hours between start and end in loc, end is exclusive
+// Returns when the quiet hours end if now is inside them
+func quietUntil(q *bsql.QuietHours, now time.Time) (time.Time, bool) {
+	loc, err := time.LoadLocation(q.Timezone)
+	if err != nil {
+		loc = time.UTC
+	}
+	now = now.In(loc)
+
+	h := now.Hour()
+	quiet := false
+	if q.Start < q.End {
+		quiet = h >= q.Start && h < q.End
+	} else if q.Start > q.End {
+		quiet = h >= q.Start || h < q.End
+	}
+	if !quiet {
+		return now, false
+	}
+
+	end := time.Date(now.Year(), now.Month(), now.Day(), q.End, 0, 0, 0, loc)
+	if !end.After(now) {
+		end = end.AddDate(0, 0, 1)
+	}
+	return end, true
+}
+
+// Wait before the next attempt after attempts failed attempts
+func backoff(attempts int) time.Duration {
+	d := BASE_BACKOFF
+	for i := 1; i < attempts && d < MAX_BACKOFF; i++ {
+		d *= 2
+	}
+	if d > MAX_BACKOFF {
+		d = MAX_BACKOFF
+	}
+	return d
+}
+
+// Build the push message for an outbox row
+func message(n *bsql.Notification) (*Message, error) {
+	switch n.Kind {
+	case bsql.NOTIFY_COIN:
+		var pass bsql.CoinPass
+		if err := json.Unmarshal([]byte(n.Payload), &pass); err != nil {
+			return nil, err
+		}
+		return &Message{
+			Title: "You have the coin",
+			Body:  pass.From + " passed you the coin, it's your turn",
+			Data: map[string]string{
+				"group_id": pass.GroupID,
+				"pass_id":  strconv.FormatInt(pass.ID, 10),
+				"coin":     strconv.Itoa(pass.Coin),
+			},
+			CollapseID: "coin-" + pass.GroupID,
+		}, nil
+	}
+	return nil, errors.New("unknown notification kind: " + n.Kind)
+}
+
+// Send one outbox row to every device of its user and record the outcome
+func dispatch(ctx context.Context, n *bsql.Notification) error {
+
+	// Hold the notification until the user's quiet hours end
+	q, ok, err := bsql.GetQuietHours(ctx, n.Username)
+	if err != nil {
+		return err
+	}
+	if ok {
+		if until, quiet := quietUntil(q, time.Now()); quiet {
+			return bsql.RetryNotification(ctx, n.ID, "quiet hours", time.Until(until), false)
+		}
+	}
+
+	m, err := message(n)
+	if err != nil {
+		return bsql.FinishNotification(ctx, n.ID, bsql.OUTBOX_FAILED, err.Error())
+	}
+
+	devices, err := bsql.GetUserDevices(ctx, n.Username)
+	if err != nil {
+		return err
+	}
+	if len(devices) == 0 {
+		return bsql.FinishNotification(ctx, n.ID, bsql.OUTBOX_SKIPPED, "no devices")
+	}
+
+	// Devices already sent to on an earlier attempt are skipped
+	sent, err := bsql.GetNotifiedDevices(ctx, n.ID)
+	if err != nil {
+		return err
+	}
+
+	var failure error
+	for i := range devices {
+		d := &devices[i]
+		if sent[d.Token] {
+			continue
+		}
+
+		p, ok := providers[d.Platform]
+		if !ok {
+			logger.Warn("no notifier for platform", "platform", d.Platform)
+			continue
+		}
+
+		err = p.Send(d, m)
+		if err == ErrInvalidDevice {
+			logger.Info("removing invalid device", "user", d.Username, "platform", d.Platform)
+			if err = bsql.DeleteDevice(ctx, d.Token); err != nil {
+				return err
+			}
+			continue
+		}
+		if err != nil {
+			failure = err
+			continue
+		}
+
+		if err = bsql.InsertNotifiedDevice(ctx, n.ID, d.Token); err != nil {
+			return err
+		}
+	}
+
+	if failure == nil {
+		return bsql.FinishNotification(ctx, n.ID, bsql.OUTBOX_SENT, "")
+	}
+
+	msg := failure.Error()
+	if len(msg) > 512 {
+		msg = msg[:512]
+	}
+
+	attempts := n.Attempts + 1
+	if attempts >= MAX_ATTEMPTS {
+		return bsql.FinishNotification(ctx, n.ID, bsql.OUTBOX_FAILED, msg)
+	}
+	return bsql.RetryNotification(ctx, n.ID, msg, backoff(attempts), true)
+}
+
+// Claim and dispatch every due notification once, runs every POLL_PERIOD
+// Servers sharing the database claim different rows, so each is sent once
+// Stops between notifications on shutdown, the rest are due again after LEASE
+func dispatchDue(ctx context.Context) {
+	notifications, err := bsql.ClaimDueNotifications(ctx, BATCH_SIZE, LEASE)
+	if err != nil {
+		logger.Error("notification poll failed", "err", err)
+		return
+	}
+
+	for i := range notifications {
+		if ctx.Err() != nil {
+			return
+		}
+		n := &notifications[i]
+		ctx, span := tracing.Start(context.Background(), "notify.dispatch", attribute.Int64("notification.id", n.ID))
+		if err = dispatch(ctx, n); err != nil {
+			logger.Error("notification dispatch failed", "err", err)
+		}
+		tracing.Fail(span, err)
+		span.End()
+	}
+}
+
+// Register notifiers from the push config and start the worker
+// push.provider selects "log" (default), "file" (push.file) or "live"
+// live registers APNs when push.apns.key_file is set and FCM when push.fcm.project is set
+func Init() {
+	logger.Info("Initializing push notifications")
+
+	cfg := config.Get().Push
+	switch cfg.Provider {
+	case "live":
+		if cfg.APNs.KeyFile != "" {
+			p, err := NewAPNs(
+				cfg.APNs.KeyFile,
+				cfg.APNs.KeyID,
+				cfg.APNs.TeamID,
+				cfg.APNs.Topic,
+				cfg.APNs.Sandbox)
+			if err != nil {
+				logging.Fatal(err)
+			}
+			providers[PLATFORM_APNS] = p
+		}
+		if cfg.FCM.Project != "" {
+			token := EnvToken("FCM_ACCESS_TOKEN")
+			if cfg.FCM.AccessTokenFile != "" {
+				token = FileToken(cfg.FCM.AccessTokenFile)
+			}
+			providers[PLATFORM_FCM] = NewFCM(cfg.FCM.Project, token)
+		}
+
+	case "file":
+		p := &FileNotifier{Path: cfg.File}
+		providers[PLATFORM_APNS] = p
+		providers[PLATFORM_FCM] = p
+
+	default:
+		p := &LogNotifier{}
+		providers[PLATFORM_APNS] = p
+		providers[PLATFORM_FCM] = p
+	}
+
+	// A full batch of timeouts, one device each, is the slowest healthy poll
+	lifecycle.Every("notifications", POLL_PERIOD, BATCH_SIZE*SEND_TIMEOUT, dispatchDue)
+}
@@ -0,0 +1,86 @@
+package notify
+
+import (
+	"benschreiber.com/purestserver/src/bsql"
+	"testing"
+	"time"
+	_ "time/tzdata"
+)
+
+func TestQuietUntil(t *testing.T) {
+	utc := func(s string) time.Time {
+		v, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+
+	tests := []struct {
+		name  string
+		q     bsql.QuietHours
+		now   string
+		quiet bool
+		until string
+	}{
+		{"before same-day hours", bsql.QuietHours{Start: 13, End: 15, Timezone: "UTC"}, "2021-10-25T12:59:00Z", false, ""},
+		{"inside same-day hours", bsql.QuietHours{Start: 13, End: 15, Timezone: "UTC"}, "2021-10-25T14:30:00Z", true, "2021-10-25T15:00:00Z"},
+		{"end is exclusive", bsql.QuietHours{Start: 13, End: 15, Timezone: "UTC"}, "2021-10-25T15:00:00Z", false, ""},
+		{"overnight before midnight", bsql.QuietHours{Start: 22, End: 7, Timezone: "UTC"}, "2021-10-25T23:10:00Z", true, "2021-10-26T07:00:00Z"},
+		{"overnight after midnight", bsql.QuietHours{Start: 22, End: 7, Timezone: "UTC"}, "2021-10-26T03:00:00Z", true, "2021-10-26T07:00:00Z"},
+		{"overnight outside", bsql.QuietHours{Start: 22, End: 7, Timezone: "UTC"}, "2021-10-26T12:00:00Z", false, ""},
+		{"start equals end is never quiet", bsql.QuietHours{Start: 8, End: 8, Timezone: "UTC"}, "2021-10-26T08:30:00Z", false, ""},
+		{"in the user's timezone", bsql.QuietHours{Start: 22, End: 7, Timezone: "Europe/Berlin"}, "2021-10-25T21:30:00Z", true, "2021-10-26T05:00:00Z"},
+		{"outside in the user's timezone", bsql.QuietHours{Start: 22, End: 7, Timezone: "Europe/Berlin"}, "2021-10-25T06:30:00Z", false, ""},
+		{"unknown timezone is UTC", bsql.QuietHours{Start: 13, End: 15, Timezone: "Mars/Olympus"}, "2021-10-25T14:00:00Z", true, "2021-10-25T15:00:00Z"},
+	}
+	for _, tt := range tests {
+		until, quiet := quietUntil(&tt.q, utc(tt.now))
+		if quiet != tt.quiet {
+			t.Errorf("%s: quiet = %v, want %v", tt.name, quiet, tt.quiet)
+			continue
+		}
+		if quiet && !until.Equal(utc(tt.until)) {
+			t.Errorf("%s: quiet until %v, want %s", tt.name, until.UTC(), tt.until)
+		}
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{1, BASE_BACKOFF},
+		{2, 2 * BASE_BACKOFF},
+		{5, 16 * BASE_BACKOFF},
+		{8, 128 * BASE_BACKOFF},
+		{9, MAX_BACKOFF},
+		{50, MAX_BACKOFF},
+	}
+	for _, tt := range tests {
+		if got := backoff(tt.attempts); got != tt.want {
+			t.Errorf("backoff(%d) = %v, want %v", tt.attempts, got, tt.want)
+		}
+	}
+}
+
+func TestMessage(t *testing.T) {
+	m, err := message(&bsql.Notification{Kind: bsql.NOTIFY_COIN, Payload: `{"id":12,"group_id":"abc","from":"ann","to":"bob","coin":4}`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Body != "ann passed you the coin, it's your turn" || m.CollapseID != "coin-abc" {
+		t.Errorf("message %+v", m)
+	}
+	if m.Data["group_id"] != "abc" || m.Data["pass_id"] != "12" || m.Data["coin"] != "4" {
+		t.Errorf("data %v", m.Data)
+	}
+
+	if _, err = message(&bsql.Notification{Kind: bsql.NOTIFY_COIN, Payload: "{"}); err == nil {
+		t.Error("bad payload accepted")
+	}
+	if _, err = message(&bsql.Notification{Kind: "carrier-pigeon", Payload: "{}"}); err == nil {
+		t.Error("unknown kind accepted")
+	}
+}
@@ -0,0 +1,422 @@
+// OpenAPI 3 document types and a builder for describing the gin routes
+// Request and response schemas are reflected from the Go types the handlers
+// bind and return, so json and binding tags stay the single source of truth
+package openapi
+
+import (
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const VERSION = "3.0.3"
+
+// Name of the bearer security scheme
+const BEARER = "bearer"
+
+type Document struct {
+	OpenAPI    string               `json:"openapi"`
+	Info       Info                 `json:"info"`
+	Paths      map[string]*PathItem `json:"paths"`
+	Components Components           `json:"components"`
+}
+
+type Info struct {
+	Title       string `json:"title"`
+	Version     string `json:"version"`
+	Description string `json:"description,omitempty"`
+}
+
+type Components struct {
+	Schemas         map[string]*Schema         `json:"schemas"`
+	SecuritySchemes map[string]*SecurityScheme `json:"securitySchemes"`
+}
+
+type SecurityScheme struct {
+	Type        string `json:"type"`
+	Scheme      string `json:"scheme,omitempty"`
+	Description string `json:"description,omitempty"`
+}
+
+// Operations of a path by lowercase method
+type PathItem map[string]*Operation
+
+type Operation struct {
+	Summary     string                `json:"summary"`
+	Description string                `json:"description,omitempty"`
+	Tags        []string              `json:"tags,omitempty"`
+	Deprecated  bool                  `json:"deprecated,omitempty"`
+	Parameters  []*Parameter          `json:"parameters,omitempty"`
+	RequestBody *RequestBody          `json:"requestBody,omitempty"`
+	Responses   map[string]*Response  `json:"responses"`
+	Security    []map[string][]string `json:"security,omitempty"`
+}
+
+type Parameter struct {
+	Name        string  `json:"name"`
+	In          string  `json:"in"`
+	Required    bool    `json:"required,omitempty"`
+	Description string  `json:"description,omitempty"`
+	Schema      *Schema `json:"schema"`
+}
+
+type RequestBody struct {
+	Required bool                  `json:"required"`
+	Content  map[string]*MediaType `json:"content"`
+}
+
+type MediaType struct {
+	Schema *Schema `json:"schema,omitempty"`
+}
+
+type Response struct {
+	Description string                `json:"description"`
+	Content     map[string]*MediaType `json:"content,omitempty"`
+}
+
+type Schema struct {
+	Ref         string             `json:"$ref,omitempty"`
+	Type        string             `json:"type,omitempty"`
+	Format      string             `json:"format,omitempty"`
+	Description string             `json:"description,omitempty"`
+	Nullable    bool               `json:"nullable,omitempty"`
+	Properties  map[string]*Schema `json:"properties,omitempty"`
+	Required    []string           `json:"required,omitempty"`
+	Items       *Schema            `json:"items,omitempty"`
+	Enum        []string           `json:"enum,omitempty"`
+	MinLength   *int               `json:"minLength,omitempty"`
+	MaxLength   *int               `json:"maxLength,omitempty"`
+	Minimum     *int               `json:"minimum,omitempty"`
+	Maximum     *int               `json:"maximum,omitempty"`
+}
+
+// Empty document with the bearer scheme registered
+func New(title string, version string, description string) *Document {
+	return &Document{
+		OpenAPI: VERSION,
+		Info:    Info{Title: title, Version: version, Description: description},
+		Paths:   map[string]*PathItem{},
+		Components: Components{
+			Schemas: map[string]*Schema{},
+			SecuritySchemes: map[string]*SecurityScheme{
+				BEARER: {Type: "http", Scheme: "bearer", Description: "Token from login"},
+			},
+		},
+	}
+}
+
+// gin path to OpenAPI path, /group/:id becomes /group/{id}
+func Path(route string) string {
+	parts := strings.Split(route, "/")
+	for i, p := range parts {
+		if strings.HasPrefix(p, ":") || strings.HasPrefix(p, "*") {
+			parts[i] = "{" + p[1:] + "}"
+		}
+	}
+	return strings.Join(parts, "/")
+}
+
+// Describe a gin route, path params are added from the route
+// op is copied so one operation can describe several routes
+func (d *Document) Add(method string, route string, op *Operation) {
+	var params []*Parameter
+	for _, p := range strings.Split(route, "/") {
+		if strings.HasPrefix(p, ":") {
+			params = append(params, &Parameter{
+				Name:     p[1:],
+				In:       "path",
+				Required: true,
+				Schema:   String(),
+			})
+		}
+	}
+	cp := *op
+	cp.Parameters = append(params, op.Parameters...)
+
+	path := Path(route)
+	item, ok := d.Paths[path]
+	if !ok {
+		item = &PathItem{}
+		d.Paths[path] = item
+	}
+	(*item)[strings.ToLower(method)] = &cp
+}
+
+// Whether a gin route is described
+func (d *Document) Has(method string, route string) bool {
+	item, ok := d.Paths[Path(route)]
+	if !ok {
+		return false
+	}
+	_, ok = (*item)[strings.ToLower(method)]
+	return ok
+}
+
+// Registered routes the document doesn't describe, and described operations
+// no route serves, as "METHOD path"
+func (d *Document) Diff(routes gin.RoutesInfo) ([]string, []string) {
+	var missing, extra []string
+
+	served := map[string]bool{}
+	for _, r := range routes {
+		served[r.Method+" "+Path(r.Path)] = true
+		if !d.Has(r.Method, r.Path) {
+			missing = append(missing, r.Method+" "+r.Path)
+		}
+	}
+
+	for path, item := range d.Paths {
+		for method := range *item {
+			if !served[strings.ToUpper(method)+" "+path] {
+				extra = append(extra, strings.ToUpper(method)+" "+path)
+			}
+		}
+	}
+
+	sort.Strings(missing)
+	sort.Strings(extra)
+	return missing, extra
+}
+
+// Operation with a summary and plain responses for each status code
+func Op(summary string, codes ...int) *Operation {
+	op := &Operation{Summary: summary, Responses: map[string]*Response{}}
+	for _, code := range codes {
+		op.Status(code)
+	}
+	return op
+}
+
+// Add a response without a body
+func (op *Operation) Status(code int) *Operation {
+	op.Responses[strconv.Itoa(code)] = &Response{Description: http.StatusText(code)}
+	return op
+}
+
+// Add a JSON response
+func (op *Operation) Returns(code int, schema *Schema) *Operation {
+	return op.Content(code, "application/json", schema)
+}
+
+// Add a response with any content type
+func (op *Operation) Content(code int, contentType string, schema *Schema) *Operation {
+	op.Responses[strconv.Itoa(code)] = &Response{
+		Description: http.StatusText(code),
+		Content:     map[string]*MediaType{contentType: {Schema: schema}},
+	}
+	return op
+}
+
+// Require a JSON request body
+func (op *Operation) Body(schema *Schema) *Operation {
+	op.RequestBody = &RequestBody{
+		Required: true,
+		Content:  map[string]*MediaType{"application/json": {Schema: schema}},
+	}
+	return op
+}
+
+// Require the bearer token, a missing or bad one is a 401
+func (op *Operation) Auth() *Operation {
+	op.Security = []map[string][]string{{BEARER: {}}}
+	return op.Status(401)
+}
+
+// Add a header parameter
+func (op *Operation) Header(name string, required bool, description string) *Operation {
+	op.Parameters = append(op.Parameters, &Parameter{
+		Name:        name,
+		In:          "header",
+		Required:    required,
+		Description: description,
+		Schema:      String(),
+	})
+	return op
+}
+
+// Add a query parameter for each field of v with a form tag, rules from its binding tag
+func (d *Document) Query(op *Operation, v interface{}) *Operation {
+	t := reflect.TypeOf(v)
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name := f.Tag.Get("form")
+		if name == "" || name == "-" {
+			continue
+		}
+
+		s := d.schema(f.Type)
+		op.Parameters = append(op.Parameters, &Parameter{
+			Name:     name,
+			In:       "query",
+			Required: bindingRules(s, f.Tag.Get("binding")),
+			Schema:   s,
+		})
+	}
+	return op
+}
+
+func (op *Operation) Describe(description string) *Operation {
+	op.Description = description
+	return op
+}
+
+func (op *Operation) Tag(tags ...string) *Operation {
+	op.Tags = append(op.Tags, tags...)
+	return op
+}
+
+// Copy of the operation marked deprecated
+func (op *Operation) Deprecate() *Operation {
+	cp := *op
+	cp.Parameters = append([]*Parameter(nil), op.Parameters...)
+	cp.Responses = map[string]*Response{}
+	for k, v := range op.Responses {
+		cp.Responses[k] = v
+	}
+	cp.Deprecated = true
+	return &cp
+}
+
+func String() *Schema {
+	return &Schema{Type: "string"}
+}
+
+func Integer() *Schema {
+	return &Schema{Type: "integer"}
+}
+
+func Array(items *Schema) *Schema {
+	return &Schema{Type: "array", Items: items}
+}
+
+// Inline object, every property required
+func Object(props map[string]*Schema) *Schema {
+	s := &Schema{Type: "object", Properties: props}
+	for name := range props {
+		s.Required = append(s.Required, name)
+	}
+	sort.Strings(s.Required)
+	return s
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// Reference to the schema of v's type, registered under its type name
+func (d *Document) Schema(v interface{}) *Schema {
+	return d.schema(reflect.TypeOf(v))
+}
+
+func (d *Document) schema(t reflect.Type) *Schema {
+	switch {
+	case t == timeType:
+		return &Schema{Type: "string", Format: "date-time"}
+	case t.Kind() == reflect.Ptr:
+		s := d.schema(t.Elem())
+		if s.Ref == "" {
+			s.Nullable = true
+		}
+		return s
+	case t.Kind() == reflect.Slice:
+		return Array(d.schema(t.Elem()))
+	case t.Kind() == reflect.String:
+		return String()
+	case t.Kind() == reflect.Bool:
+		return &Schema{Type: "boolean"}
+	case t.Kind() >= reflect.Int && t.Kind() <= reflect.Uint64:
+		return Integer()
+	case t.Kind() == reflect.Float32 || t.Kind() == reflect.Float64:
+		return &Schema{Type: "number"}
+	case t.Kind() == reflect.Map:
+		return &Schema{Type: "object"}
+	case t.Kind() != reflect.Struct:
+		return &Schema{}
+	}
+
+	ref := &Schema{Ref: "#/components/schemas/" + t.Name()}
+	if _, ok := d.Components.Schemas[t.Name()]; ok {
+		return ref
+	}
+
+	s := &Schema{Type: "object", Properties: map[string]*Schema{}}
+	d.Components.Schemas[t.Name()] = s
+	d.properties(s, t)
+	return ref
+}
+
+// Add the fields of struct type t to s
+// Embedded structs without a json name are flattened like encoding/json does
+func (d *Document) properties(s *Schema, t reflect.Type) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name := strings.SplitN(f.Tag.Get("json"), ",", 2)[0]
+		if f.Anonymous && name == "" && f.Type.Kind() == reflect.Struct {
+			d.properties(s, f.Type)
+			continue
+		}
+		if f.PkgPath != "" || name == "-" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+
+		prop := d.schema(f.Type)
+		if bindingRules(prop, f.Tag.Get("binding")) {
+			// A required pointer only tells given from zero, it can't be null
+			prop.Nullable = false
+			s.Required = append(s.Required, name)
+		}
+		s.Properties[name] = prop
+	}
+}
+
+// Carry binding tags over to the schema, true if the field is required
+func bindingRules(s *Schema, tag string) bool {
+	required := false
+	for _, rule := range strings.Split(tag, ",") {
+		kv := strings.SplitN(rule, "=", 2)
+		n := 0
+		if len(kv) == 2 {
+			n, _ = strconv.Atoi(kv[1])
+		}
+
+		switch kv[0] {
+		case "required":
+			required = true
+		case "dive":
+			// Rules after dive apply to the items
+			if s.Items != nil {
+				s = s.Items
+			}
+		case "max":
+			if s.Type == "integer" {
+				s.Maximum = &n
+			} else {
+				s.MaxLength = &n
+			}
+		case "min":
+			if s.Type == "integer" {
+				s.Minimum = &n
+			} else {
+				s.MinLength = &n
+			}
+		case "oneof":
+			s.Enum = strings.Fields(kv[1])
+		case "email":
+			s.Format = "email"
+		case "url":
+			s.Format = "uri"
+		case "alphanum":
+			s.Description = "Letters and numbers only"
+		case "nowhitespace":
+			s.Description = "No whitespace"
+		case "timezone":
+			s.Description = "IANA timezone name"
+		}
+	}
+	return required
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"benschreiber.com/purestserver/src/audit"
+	"benschreiber.com/purestserver/src/bsql"
+	"bufio"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+	"time"
+)
+
+func migrateStatus(ctx context.Context, fs *flag.FlagSet, args []string) error {
+	if _, err := parse(fs, args, 0); err != nil {
+		return err
+	}
+
+	all, err := bsql.Migrations(ctx)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "MIGRATION\tAPPLIED AT")
+	for _, m := range all {
+		at := "pending"
+		if m.AppliedAt != nil {
+			at = m.AppliedAt.Format(time.RFC3339)
+		}
+		fmt.Fprintf(w, "%s\t%s\n", m.String(), at)
+	}
+	return w.Flush()
+}
+
+func migrate(ctx context.Context, fs *flag.FlagSet, args []string) error {
+	if _, err := parse(fs, args, 0); err != nil {
+		return err
+	}
+
+	applied, err := bsql.Migrate(ctx)
+	for _, m := range applied {
+		fmt.Println("applied", m.String())
+	}
+	if err != nil {
+		return err
+	}
+	if len(applied) == 0 {
+		fmt.Println("nothing to apply")
+	}
+	return nil
+}
+
+// One line of an export
+type exportLine struct {
+	Table string      `json:"table"`
+	Row   interface{} `json:"row"`
+}
+
+func export(ctx context.Context, fs *flag.FlagSet, args []string) error {
+	out := fs.String("out", "", "file to write, stdout when empty")
+	if _, err := parse(fs, args, 0); err != nil {
+		return err
+	}
+
+	var w io.Writer = os.Stdout
+	if *out != "" {
+		// Holds email addresses, only the operator reads it
+		f, err := os.OpenFile(*out, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+
+	buf := bufio.NewWriter(w)
+	enc := json.NewEncoder(buf)
+	counts := make(map[string]int)
+	err := bsql.Export(ctx, func(table string, row interface{}) error {
+		counts[table]++
+		return enc.Encode(exportLine{Table: table, Row: row})
+	})
+	if err != nil {
+		return err
+	}
+	if err = buf.Flush(); err != nil {
+		return err
+	}
+	record(ctx, audit.ADMIN_EXPORT, "", "")
+
+	fmt.Fprintf(os.Stderr, "exported %d users, %d groups, %d members, %d coin passes\n",
+		counts[bsql.EXPORT_USERS], counts[bsql.EXPORT_GROUPS], counts[bsql.EXPORT_MEMBERS], counts[bsql.EXPORT_COIN_PASSES])
+	return nil
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"benschreiber.com/purestserver/src/audit"
+	"benschreiber.com/purestserver/src/bsql"
+	"benschreiber.com/purestserver/src/groups"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Coin passes shown by group inspect
+const RECENT_PASSES = 10
+
+func printJSON(v interface{}) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+func printPass(p *bsql.CoinPass) {
+	fmt.Printf("coin %d passed from %s to %s in %s\n", p.Coin, p.From, p.To, p.GroupID)
+}
+
+func groupList(ctx context.Context, fs *flag.FlagSet, args []string) error {
+	search := fs.String("search", "", "only groups whose id, creator or a member starts with this")
+	limit := fs.Int("limit", 50, "groups to list")
+	offset := fs.Int("offset", 0, "groups to skip")
+	asJSON := fs.Bool("json", false, "print JSON")
+	if _, err := parse(fs, args, 0); err != nil {
+		return err
+	}
+	if *limit < 1 || *offset < 0 {
+		return errUsage
+	}
+
+	list, err := groups.Search(ctx, *search, *limit, *offset)
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		if list == nil {
+			list = []*bsql.Group{}
+		}
+		return printJSON(list)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tCOIN\tCREATOR\tHOLDER\tMEMBERS")
+	for _, g := range list {
+		fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%d\n", g.ID, g.Token, g.Creator, g.TokenHolder, len(g.Members))
+	}
+	return w.Flush()
+}
+
+func groupInspect(ctx context.Context, fs *flag.FlagSet, args []string) error {
+	asJSON := fs.Bool("json", false, "print JSON")
+	args, err := parse(fs, args, 1)
+	if err != nil {
+		return err
+	}
+
+	group, err := groups.Inspect(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	passes, err := bsql.GetRecentCoinPasses(ctx, []string{group.ID}, RECENT_PASSES)
+	if err != nil {
+		return err
+	}
+	recent := passes[group.ID]
+
+	if *asJSON {
+		if recent == nil {
+			recent = []bsql.CoinPass{}
+		}
+		return printJSON(struct {
+			*bsql.Group
+			RecentPasses []bsql.CoinPass `json:"recent_passes"`
+		}{group, recent})
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "id:\t%s\n", group.ID)
+	fmt.Fprintf(w, "coin:\t%d\n", group.Token)
+	fmt.Fprintf(w, "creator:\t%s\n", group.Creator)
+	fmt.Fprintf(w, "holder:\t%s\n", group.TokenHolder)
+	fmt.Fprintf(w, "members:\t%s\n", strings.Join(group.Members, ", "))
+	if err = w.Flush(); err != nil {
+		return err
+	}
+
+	fmt.Println("\nrecent passes:")
+	w = tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "  PASSED AT\tCOIN\tFROM\tTO")
+	for _, p := range recent {
+		fmt.Fprintf(w, "  %s\t%d\t%s\t%s\n", p.PassedAt.Format(time.RFC3339), p.Coin, p.From, p.To)
+	}
+	return w.Flush()
+}
+
+func coinPass(ctx context.Context, fs *flag.FlagSet, args []string) error {
+	args, err := parse(fs, args, 1)
+	if err != nil {
+		return err
+	}
+
+	pass, err := groups.ForcePass(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	record(ctx, audit.ADMIN_PASS_COIN, pass.To, pass.GroupID)
+	printPass(pass)
+	return nil
+}
+
+func coinReassign(ctx context.Context, fs *flag.FlagSet, args []string) error {
+	args, err := parse(fs, args, 2)
+	if err != nil {
+		return err
+	}
+
+	pass, err := groups.Reassign(ctx, args[0], args[1])
+	if err != nil {
+		return err
+	}
+	record(ctx, audit.ADMIN_REASSIGN_COIN, pass.To, pass.GroupID)
+	printPass(pass)
+	return nil
+}
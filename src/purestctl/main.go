@@ -0,0 +1,194 @@
+// Operator commands run against the server's database
+// Reads the server's configuration the same way and goes through the same
+// accounts and groups packages, so every rule the APIs check applies here too
+//
+//	purestctl [config flags] <command> [arguments]
+//
+// Sessions live in each server's memory, revoking them is recorded in the
+// database and they stop working on their next request
+// Events published here reach webhooks, live streams on the servers don't see them
+// Changes are audited like admin actions, the actor is purestctl:<login>
+package main
+
+import (
+	"benschreiber.com/purestserver/src/audit"
+	"benschreiber.com/purestserver/src/bsql"
+	"benschreiber.com/purestserver/src/config"
+	"benschreiber.com/purestserver/src/events"
+	"benschreiber.com/purestserver/src/lifecycle"
+	"benschreiber.com/purestserver/src/logging"
+	"benschreiber.com/purestserver/src/tracing"
+	"benschreiber.com/purestserver/src/webhooks"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/user"
+	"strings"
+	"time"
+)
+
+// Exit statuses, config.EXIT_INVALID for a bad configuration
+const (
+	EXIT_FAILED = 1
+	EXIT_USAGE  = 2
+)
+
+// How long a command may run before it is cancelled
+const COMMAND_TIMEOUT = 10 * time.Minute
+
+// How long queueing webhook deliveries may take after a command
+const STOP_TIMEOUT = 30 * time.Second
+
+// Returned by a command for bad arguments, its usage is printed
+var errUsage = errors.New("usage")
+
+type command struct {
+	name  string // words after the config flags
+	args  string
+	help  string
+	run   func(ctx context.Context, fs *flag.FlagSet, args []string) error
+	setup func() error // bsql.Establishconnection unless set
+}
+
+// Longer names first so "migrate status" wins over "migrate"
+var commands = []command{
+	{name: "user show", args: "[--json] <username>", help: "show a user's account, two-factor status and groups", run: userShow},
+	{name: "user create", args: "[--email address] <username>", help: "create a user, the password is read from stdin", run: userCreate},
+	{name: "user disable", args: "<username>", help: "stop a user from logging in and end their sessions", run: userDisable},
+	{name: "user enable", args: "<username>", help: "let a disabled user log in again", run: userEnable},
+	{name: "user role", args: "<username> <user|admin>", help: "set a user's role, admins can use /api/admin", run: userRole},
+	{name: "user reset-password", args: "<username>", help: "set a password read from stdin and end every session", run: userResetPassword},
+	{name: "session revoke", args: "<username>", help: "end every session of a user on every server", run: sessionRevoke},
+	{name: "group list", args: "[--search prefix] [--limit n] [--offset n] [--json]", help: "list groups with their coin and members", run: groupList},
+	{name: "group inspect", args: "[--json] <group id>", help: "show a group, its members and recent coin passes", run: groupInspect},
+	{name: "coin pass", args: "<group id>", help: "pass the coin on behalf of its holder", run: coinPass},
+	{name: "coin reassign", args: "<group id> <username>", help: "hand the coin to a member without counting a pass", run: coinReassign},
+	{name: "migrate status", help: "list migrations and when they were applied", run: migrateStatus, setup: bsql.Open},
+	{name: "migrate", help: "apply pending migrations", run: migrate, setup: bsql.Open},
+	{name: "export", args: "[--out file]", help: "write users, groups, members and coin passes as JSON lines", run: export},
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: purestctl [config flags] <command> [arguments]")
+	fmt.Fprintln(os.Stderr, "\ncommands:")
+	for _, c := range commands {
+		fmt.Fprintf(os.Stderr, "  %s %s\n    \t%s\n", c.name, c.args, c.help)
+	}
+	fmt.Fprintln(os.Stderr, "\nconfig flags are the server's, see purestctl -h")
+}
+
+// The command named by the first words of args, and the arguments after them
+func find(args []string) (*command, []string) {
+	for i := range commands {
+		words := strings.Fields(commands[i].name)
+		if len(args) < len(words) {
+			continue
+		}
+		if strings.Join(args[:len(words)], " ") == commands[i].name {
+			return &commands[i], args[len(words):]
+		}
+	}
+	return nil, nil
+}
+
+// Flag set a command adds its flags to, -h prints them
+func flags(c *command) *flag.FlagSet {
+	fs := flag.NewFlagSet(c.name, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: purestctl %s %s\n", c.name, c.args)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+func main() {
+	// The server's settings, quieter and without migrating behind the operator's back
+	defaults := config.Default()
+	defaults.DB.Migrate = false
+	defaults.Log.Level = "warn"
+	defaults.Log.Format = "text"
+	args := config.InitCommand(defaults)
+
+	c, rest := find(args)
+	if c == nil {
+		usage()
+		os.Exit(EXIT_USAGE)
+	}
+
+	os.Exit(run(c, rest))
+}
+
+func run(c *command, args []string) int {
+	logging.Init()
+	tracing.Init()
+	defer tracing.Shutdown(context.Background())
+
+	setup := c.setup
+	if setup == nil {
+		setup = bsql.Establishconnection
+	}
+	if err := setup(); err != nil {
+		fmt.Fprintln(os.Stderr, "purestctl: database:", err)
+		return EXIT_FAILED
+	}
+	defer bsql.Close()
+
+	// Group events still queue webhook deliveries, the servers deliver them
+	events.Init()
+	webhooks.Queue()
+	defer stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), COMMAND_TIMEOUT)
+	defer cancel()
+
+	err := c.run(ctx, flags(c), args)
+	if err == errUsage || err == flag.ErrHelp {
+		if err == errUsage {
+			fmt.Fprintf(os.Stderr, "usage: purestctl %s %s\n", c.name, c.args)
+		}
+		return EXIT_USAGE
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "purestctl %s: %s\n", c.name, err)
+		return EXIT_FAILED
+	}
+	return 0
+}
+
+// Wait for the command's events to be queued as webhook deliveries
+func stop() {
+	ctx, cancel := context.WithTimeout(context.Background(), STOP_TIMEOUT)
+	defer cancel()
+	if err := lifecycle.Stop(ctx); err != nil {
+		fmt.Fprintln(os.Stderr, "purestctl: queueing webhook deliveries:", err)
+	}
+}
+
+// Audit a change made from here
+// The operator's login stands in for a user, there is no session or IP
+func record(ctx context.Context, action string, target string, group string) {
+	login := "unknown"
+	if u, err := user.Current(); err == nil {
+		login = u.Username
+	}
+	audit.Record(ctx, audit.Event{
+		Actor:  "purestctl:" + login,
+		Action: action,
+		Target: target,
+		Group:  group,
+	})
+}
+
+// Parse a command's flags and check it got want positional arguments
+// The flag package already printed what was wrong with a flag
+func parse(fs *flag.FlagSet, args []string, want int) ([]string, error) {
+	if err := fs.Parse(args); err != nil {
+		return nil, flag.ErrHelp
+	}
+	if fs.NArg() != want {
+		return nil, errUsage
+	}
+	return fs.Args(), nil
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"benschreiber.com/purestserver/src/accounts"
+	"benschreiber.com/purestserver/src/audit"
+	"benschreiber.com/purestserver/src/bres"
+	"benschreiber.com/purestserver/src/bsql"
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Read a password from the first line of stdin, prompting when it is a terminal
+// Nothing hides the input, pipe it in from a file or a password manager
+func readPassword() (string, error) {
+	if info, err := os.Stdin.Stat(); err == nil && info.Mode()&os.ModeCharDevice != 0 {
+		fmt.Fprint(os.Stderr, "Password: ")
+	}
+
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		return "", errors.New("no password on stdin")
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// Field errors from the request's binding tags, the same rules the APIs apply
+func invalid(err error) error {
+	return errors.New("invalid " + strings.ReplaceAll(err.Error(), "\n", ", "))
+}
+
+func userShow(ctx context.Context, fs *flag.FlagSet, args []string) error {
+	asJSON := fs.Bool("json", false, "print JSON")
+	args, err := parse(fs, args, 1)
+	if err != nil {
+		return err
+	}
+
+	account, err := accounts.Get(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	twoFactor, err := bsql.GetTwoFactorStatus(ctx, account.Username)
+	if err != nil {
+		return err
+	}
+	ids, err := bsql.GetUserGroupIDs(ctx, account.Username)
+	if err != nil {
+		return err
+	}
+
+	if *asJSON {
+		if ids == nil {
+			ids = []string{}
+		}
+		return printJSON(struct {
+			*bsql.UserAccount
+			TwoFactor *bsql.TwoFactorStatus `json:"two_factor"`
+			Groups    []string              `json:"groups"`
+		}{account, twoFactor, ids})
+	}
+
+	optional := func(t *time.Time) string {
+		if t == nil {
+			return "-"
+		}
+		return t.Format(time.RFC3339)
+	}
+	email := "-"
+	if account.Email != nil {
+		email = *account.Email
+		if !account.EmailVerified {
+			email += " (unverified)"
+		}
+	}
+	twoFactorText := "off"
+	if twoFactor.Enabled {
+		twoFactorText = fmt.Sprintf("%s since %s, %d recovery codes left",
+			twoFactor.Method, optional(twoFactor.ConfirmedAt), twoFactor.RecoveryCodes)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "username:\t%s\n", account.Username)
+	fmt.Fprintf(w, "email:\t%s\n", email)
+	fmt.Fprintf(w, "role:\t%s\n", account.Role)
+	fmt.Fprintf(w, "disabled:\t%s\n", optional(account.DisabledAt))
+	fmt.Fprintf(w, "sessions revoked:\t%s\n", optional(account.SessionsRevokedAt))
+	fmt.Fprintf(w, "two-factor:\t%s\n", twoFactorText)
+	fmt.Fprintf(w, "groups:\t%s\n", strings.Join(ids, ", "))
+	return w.Flush()
+}
+
+func userCreate(ctx context.Context, fs *flag.FlagSet, args []string) error {
+	email := fs.String("email", "", "email of the account, unverified until the user asks for a code")
+	args, err := parse(fs, args, 1)
+	if err != nil {
+		return err
+	}
+
+	pass, err := readPassword()
+	if err != nil {
+		return err
+	}
+
+	req := bres.RegisterRequest{Username: args[0], Password: pass, Email: *email}
+	if err = bres.Validate(&req); err != nil {
+		return invalid(err)
+	}
+
+	if err = accounts.Register(ctx, req.Username, req.Password, req.Email); err != nil {
+		return err
+	}
+	record(ctx, audit.ADMIN_CREATE_USER, req.Username, "")
+	fmt.Println("created", req.Username)
+	return nil
+}
+
+func userDisable(ctx context.Context, fs *flag.FlagSet, args []string) error {
+	args, err := parse(fs, args, 1)
+	if err != nil {
+		return err
+	}
+
+	if err = accounts.Disable(ctx, args[0]); err != nil {
+		return err
+	}
+	record(ctx, audit.ADMIN_DISABLE_USER, args[0], "")
+	fmt.Println("disabled", args[0])
+	return nil
+}
+
+func userEnable(ctx context.Context, fs *flag.FlagSet, args []string) error {
+	args, err := parse(fs, args, 1)
+	if err != nil {
+		return err
+	}
+
+	if err = accounts.Enable(ctx, args[0]); err != nil {
+		return err
+	}
+	record(ctx, audit.ADMIN_ENABLE_USER, args[0], "")
+	fmt.Println("enabled", args[0])
+	return nil
+}
+
+func userResetPassword(ctx context.Context, fs *flag.FlagSet, args []string) error {
+	args, err := parse(fs, args, 1)
+	if err != nil {
+		return err
+	}
+
+	pass, err := readPassword()
+	if err != nil {
+		return err
+	}
+
+	// A new password follows the registration rules
+	req := bres.RegisterRequest{Username: args[0], Password: pass}
+	if err = bres.Validate(&req); err != nil {
+		return invalid(err)
+	}
+
+	if err = accounts.ResetPassword(ctx, args[0], pass); err != nil {
+		return err
+	}
+	record(ctx, audit.ADMIN_RESET_PASSWORD, args[0], "")
+	fmt.Println("password reset, sessions revoked for", args[0])
+	return nil
+}
+
+func sessionRevoke(ctx context.Context, fs *flag.FlagSet, args []string) error {
+	args, err := parse(fs, args, 1)
+	if err != nil {
+		return err
+	}
+
+	if err = accounts.RevokeSessions(ctx, args[0]); err != nil {
+		return err
+	}
+	record(ctx, audit.ADMIN_REVOKE_SESSIONS, args[0], "")
+	fmt.Println("sessions revoked for", args[0])
+	return nil
+}
+
+// The only way to make an admin, the API can't grant roles
+func userRole(ctx context.Context, fs *flag.FlagSet, args []string) error {
+	args, err := parse(fs, args, 2)
+	if err != nil {
+		return err
+	}
+
+	if err = accounts.SetRole(ctx, args[0], args[1]); err != nil {
+		return err
+	}
+	record(ctx, audit.ADMIN_SET_ROLE, args[0], "")
+	fmt.Println(args[0], "is now", args[1])
+	return nil
+}
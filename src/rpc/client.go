@@ -0,0 +1,35 @@
+package rpc
+
+import (
+	"benschreiber.com/purestserver/src/rpc/pushuppb"
+	"context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// Per call credentials sending a bearer token
+type bearer string
+
+func (b bearer) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	return map[string]string{"authorization": "Bearer " + string(b)}, nil
+}
+
+// The listener is plaintext and on loopback unless server.grpc_addr says otherwise
+func (b bearer) RequireTransportSecurity() bool {
+	return false
+}
+
+// Client for internal tools
+// Every call carries token when it isn't empty, close the conn when done
+func Dial(addr string, token string) (pushuppb.PushupClient, *grpc.ClientConn, error) {
+	opts := []grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials())}
+	if token != "" {
+		opts = append(opts, grpc.WithPerRPCCredentials(bearer(token)))
+	}
+
+	conn, err := grpc.NewClient(addr, opts...)
+	if err != nil {
+		return nil, nil, err
+	}
+	return pushuppb.NewPushupClient(conn), conn, nil
+}
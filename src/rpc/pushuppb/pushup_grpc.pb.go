@@ -0,0 +1,479 @@
+// gRPC API, the same operations as the REST routes under /api/v2
+// Authenticate with "authorization: Bearer <token>" metadata from Login
+
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.6.2
+// - protoc             (unknown)
+// source: pushup.proto
+
+package pushuppb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+	emptypb "google.golang.org/protobuf/types/known/emptypb"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.64.0 or later.
+const _ = grpc.SupportPackageIsVersion9
+
+const (
+	Pushup_Register_FullMethodName          = "/pushup.Pushup/Register"
+	Pushup_Login_FullMethodName             = "/pushup.Pushup/Login"
+	Pushup_LoginSecondFactor_FullMethodName = "/pushup.Pushup/LoginSecondFactor"
+	Pushup_GetGroup_FullMethodName          = "/pushup.Pushup/GetGroup"
+	Pushup_CreateGroup_FullMethodName       = "/pushup.Pushup/CreateGroup"
+	Pushup_JoinGroup_FullMethodName         = "/pushup.Pushup/JoinGroup"
+	Pushup_PassCoin_FullMethodName          = "/pushup.Pushup/PassCoin"
+	Pushup_Kick_FullMethodName              = "/pushup.Pushup/Kick"
+	Pushup_Disband_FullMethodName           = "/pushup.Pushup/Disband"
+	Pushup_StreamGroupEvents_FullMethodName = "/pushup.Pushup/StreamGroupEvents"
+)
+
+// PushupClient is the client API for Pushup service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type PushupClient interface {
+	// Create an account, no authentication
+	Register(ctx context.Context, in *RegisterRequest, opts ...grpc.CallOption) (*emptypb.Empty, error)
+	// Returns a token, or a challenge when two-factor is on, no authentication
+	Login(ctx context.Context, in *LoginRequest, opts ...grpc.CallOption) (*LoginResponse, error)
+	// Finish a login with a TOTP or recovery code, no authentication
+	LoginSecondFactor(ctx context.Context, in *SecondFactorRequest, opts ...grpc.CallOption) (*LoginResponse, error)
+	GetGroup(ctx context.Context, in *GroupRequest, opts ...grpc.CallOption) (*Group, error)
+	CreateGroup(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*CreateGroupResponse, error)
+	JoinGroup(ctx context.Context, in *GroupRequest, opts ...grpc.CallOption) (*emptypb.Empty, error)
+	PassCoin(ctx context.Context, in *GroupRequest, opts ...grpc.CallOption) (*CoinPass, error)
+	Kick(ctx context.Context, in *KickRequest, opts ...grpc.CallOption) (*emptypb.Empty, error)
+	Disband(ctx context.Context, in *GroupRequest, opts ...grpc.CallOption) (*emptypb.Empty, error)
+	// Group events until the group is disbanded or the caller is kicked
+	StreamGroupEvents(ctx context.Context, in *StreamGroupEventsRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[Event], error)
+}
+
+type pushupClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewPushupClient(cc grpc.ClientConnInterface) PushupClient {
+	return &pushupClient{cc}
+}
+
+func (c *pushupClient) Register(ctx context.Context, in *RegisterRequest, opts ...grpc.CallOption) (*emptypb.Empty, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(emptypb.Empty)
+	err := c.cc.Invoke(ctx, Pushup_Register_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *pushupClient) Login(ctx context.Context, in *LoginRequest, opts ...grpc.CallOption) (*LoginResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(LoginResponse)
+	err := c.cc.Invoke(ctx, Pushup_Login_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *pushupClient) LoginSecondFactor(ctx context.Context, in *SecondFactorRequest, opts ...grpc.CallOption) (*LoginResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(LoginResponse)
+	err := c.cc.Invoke(ctx, Pushup_LoginSecondFactor_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *pushupClient) GetGroup(ctx context.Context, in *GroupRequest, opts ...grpc.CallOption) (*Group, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(Group)
+	err := c.cc.Invoke(ctx, Pushup_GetGroup_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *pushupClient) CreateGroup(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*CreateGroupResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(CreateGroupResponse)
+	err := c.cc.Invoke(ctx, Pushup_CreateGroup_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *pushupClient) JoinGroup(ctx context.Context, in *GroupRequest, opts ...grpc.CallOption) (*emptypb.Empty, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(emptypb.Empty)
+	err := c.cc.Invoke(ctx, Pushup_JoinGroup_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *pushupClient) PassCoin(ctx context.Context, in *GroupRequest, opts ...grpc.CallOption) (*CoinPass, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(CoinPass)
+	err := c.cc.Invoke(ctx, Pushup_PassCoin_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *pushupClient) Kick(ctx context.Context, in *KickRequest, opts ...grpc.CallOption) (*emptypb.Empty, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(emptypb.Empty)
+	err := c.cc.Invoke(ctx, Pushup_Kick_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *pushupClient) Disband(ctx context.Context, in *GroupRequest, opts ...grpc.CallOption) (*emptypb.Empty, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(emptypb.Empty)
+	err := c.cc.Invoke(ctx, Pushup_Disband_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *pushupClient) StreamGroupEvents(ctx context.Context, in *StreamGroupEventsRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[Event], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &Pushup_ServiceDesc.Streams[0], Pushup_StreamGroupEvents_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[StreamGroupEventsRequest, Event]{ClientStream: stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Pushup_StreamGroupEventsClient = grpc.ServerStreamingClient[Event]
+
+// PushupServer is the server API for Pushup service.
+// All implementations must embed UnimplementedPushupServer
+// for forward compatibility.
+type PushupServer interface {
+	// Create an account, no authentication
+	Register(context.Context, *RegisterRequest) (*emptypb.Empty, error)
+	// Returns a token, or a challenge when two-factor is on, no authentication
+	Login(context.Context, *LoginRequest) (*LoginResponse, error)
+	// Finish a login with a TOTP or recovery code, no authentication
+	LoginSecondFactor(context.Context, *SecondFactorRequest) (*LoginResponse, error)
+	GetGroup(context.Context, *GroupRequest) (*Group, error)
+	CreateGroup(context.Context, *emptypb.Empty) (*CreateGroupResponse, error)
+	JoinGroup(context.Context, *GroupRequest) (*emptypb.Empty, error)
+	PassCoin(context.Context, *GroupRequest) (*CoinPass, error)
+	Kick(context.Context, *KickRequest) (*emptypb.Empty, error)
+	Disband(context.Context, *GroupRequest) (*emptypb.Empty, error)
+	// Group events until the group is disbanded or the caller is kicked
+	StreamGroupEvents(*StreamGroupEventsRequest, grpc.ServerStreamingServer[Event]) error
+	mustEmbedUnimplementedPushupServer()
+}
+
+// UnimplementedPushupServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedPushupServer struct{}
+
+func (UnimplementedPushupServer) Register(context.Context, *RegisterRequest) (*emptypb.Empty, error) {
+	return nil, status.Error(codes.Unimplemented, "method Register not implemented")
+}
+func (UnimplementedPushupServer) Login(context.Context, *LoginRequest) (*LoginResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "method Login not implemented")
+}
+func (UnimplementedPushupServer) LoginSecondFactor(context.Context, *SecondFactorRequest) (*LoginResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "method LoginSecondFactor not implemented")
+}
+func (UnimplementedPushupServer) GetGroup(context.Context, *GroupRequest) (*Group, error) {
+	return nil, status.Error(codes.Unimplemented, "method GetGroup not implemented")
+}
+func (UnimplementedPushupServer) CreateGroup(context.Context, *emptypb.Empty) (*CreateGroupResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "method CreateGroup not implemented")
+}
+func (UnimplementedPushupServer) JoinGroup(context.Context, *GroupRequest) (*emptypb.Empty, error) {
+	return nil, status.Error(codes.Unimplemented, "method JoinGroup not implemented")
+}
+func (UnimplementedPushupServer) PassCoin(context.Context, *GroupRequest) (*CoinPass, error) {
+	return nil, status.Error(codes.Unimplemented, "method PassCoin not implemented")
+}
+func (UnimplementedPushupServer) Kick(context.Context, *KickRequest) (*emptypb.Empty, error) {
+	return nil, status.Error(codes.Unimplemented, "method Kick not implemented")
+}
+func (UnimplementedPushupServer) Disband(context.Context, *GroupRequest) (*emptypb.Empty, error) {
+	return nil, status.Error(codes.Unimplemented, "method Disband not implemented")
+}
+func (UnimplementedPushupServer) StreamGroupEvents(*StreamGroupEventsRequest, grpc.ServerStreamingServer[Event]) error {
+	return status.Error(codes.Unimplemented, "method StreamGroupEvents not implemented")
+}
+func (UnimplementedPushupServer) mustEmbedUnimplementedPushupServer() {}
+func (UnimplementedPushupServer) testEmbeddedByValue()                {}
+
+// UnsafePushupServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to PushupServer will
+// result in compilation errors.
+type UnsafePushupServer interface {
+	mustEmbedUnimplementedPushupServer()
+}
+
+func RegisterPushupServer(s grpc.ServiceRegistrar, srv PushupServer) {
+	// If the following call panics, it indicates UnimplementedPushupServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&Pushup_ServiceDesc, srv)
+}
+
+func _Pushup_Register_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(RegisterRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(PushupServer).Register(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Pushup_Register_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(PushupServer).Register(ctx, req.(*RegisterRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Pushup_Login_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(LoginRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(PushupServer).Login(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Pushup_Login_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(PushupServer).Login(ctx, req.(*LoginRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Pushup_LoginSecondFactor_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(SecondFactorRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(PushupServer).LoginSecondFactor(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Pushup_LoginSecondFactor_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(PushupServer).LoginSecondFactor(ctx, req.(*SecondFactorRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Pushup_GetGroup_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GroupRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(PushupServer).GetGroup(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Pushup_GetGroup_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(PushupServer).GetGroup(ctx, req.(*GroupRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Pushup_CreateGroup_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(emptypb.Empty)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(PushupServer).CreateGroup(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Pushup_CreateGroup_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(PushupServer).CreateGroup(ctx, req.(*emptypb.Empty))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Pushup_JoinGroup_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GroupRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(PushupServer).JoinGroup(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Pushup_JoinGroup_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(PushupServer).JoinGroup(ctx, req.(*GroupRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Pushup_PassCoin_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GroupRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(PushupServer).PassCoin(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Pushup_PassCoin_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(PushupServer).PassCoin(ctx, req.(*GroupRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Pushup_Kick_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(KickRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(PushupServer).Kick(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Pushup_Kick_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(PushupServer).Kick(ctx, req.(*KickRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Pushup_Disband_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GroupRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(PushupServer).Disband(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Pushup_Disband_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(PushupServer).Disband(ctx, req.(*GroupRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Pushup_StreamGroupEvents_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(StreamGroupEventsRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(PushupServer).StreamGroupEvents(m, &grpc.GenericServerStream[StreamGroupEventsRequest, Event]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Pushup_StreamGroupEventsServer = grpc.ServerStreamingServer[Event]
+
+// Pushup_ServiceDesc is the grpc.ServiceDesc for Pushup service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Pushup_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "pushup.Pushup",
+	HandlerType: (*PushupServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Register",
+			Handler:    _Pushup_Register_Handler,
+		},
+		{
+			MethodName: "Login",
+			Handler:    _Pushup_Login_Handler,
+		},
+		{
+			MethodName: "LoginSecondFactor",
+			Handler:    _Pushup_LoginSecondFactor_Handler,
+		},
+		{
+			MethodName: "GetGroup",
+			Handler:    _Pushup_GetGroup_Handler,
+		},
+		{
+			MethodName: "CreateGroup",
+			Handler:    _Pushup_CreateGroup_Handler,
+		},
+		{
+			MethodName: "JoinGroup",
+			Handler:    _Pushup_JoinGroup_Handler,
+		},
+		{
+			MethodName: "PassCoin",
+			Handler:    _Pushup_PassCoin_Handler,
+		},
+		{
+			MethodName: "Kick",
+			Handler:    _Pushup_Kick_Handler,
+		},
+		{
+			MethodName: "Disband",
+			Handler:    _Pushup_Disband_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "StreamGroupEvents",
+			Handler:       _Pushup_StreamGroupEvents_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "pushup.proto",
+}
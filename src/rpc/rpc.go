@@ -0,0 +1,516 @@
+// gRPC API on its own listener, alongside the gin router
+// Calls go through the same groups service, bres authentication and
+// IP rate limiter as REST, so the two APIs can't drift apart on rules
+package rpc
+
+import (
+	"benschreiber.com/purestserver/src/accounts"
+	"benschreiber.com/purestserver/src/bres"
+	"benschreiber.com/purestserver/src/bres/ratelimit"
+	"benschreiber.com/purestserver/src/bres/tokens"
+	"benschreiber.com/purestserver/src/bsql"
+	"benschreiber.com/purestserver/src/config"
+	"benschreiber.com/purestserver/src/events"
+	"benschreiber.com/purestserver/src/groups"
+	"benschreiber.com/purestserver/src/logging"
+	"benschreiber.com/purestserver/src/rpc/pushuppb"
+	"benschreiber.com/purestserver/src/tracing"
+	"context"
+	"encoding/json"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"log/slog"
+	"net"
+	"strconv"
+	"time"
+)
+
+var logger = logging.For("rpc")
+
+// Metadata key of the request id, the gRPC form of X-Request-ID
+const REQUEST_ID_KEY = "x-request-id"
+
+// Methods callable without a token
+var public = map[string]bool{
+	pushuppb.Pushup_Register_FullMethodName:          true,
+	pushuppb.Pushup_Login_FullMethodName:             true,
+	pushuppb.Pushup_LoginSecondFactor_FullMethodName: true,
+}
+
+type server struct {
+	pushuppb.UnimplementedPushupServer
+}
+
+// Context key for the authenticated username
+type userKey struct{}
+
+func user(ctx context.Context) string {
+	u, _ := ctx.Value(userKey{}).(string)
+	return u
+}
+
+// Caller's IP, tokens are bound to it like on REST
+func peerIP(ctx context.Context) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(p.Addr.String())
+	if err != nil {
+		return p.Addr.String()
+	}
+	return host
+}
+
+// Rate limit, then resolve the bearer token unless the method is public
+func authorize(ctx context.Context, method string) (context.Context, error) {
+	ip := peerIP(ctx)
+	if !ratelimit.Allow(ip) {
+		return nil, status.Error(codes.ResourceExhausted, "rate limited")
+	}
+
+	if public[method] {
+		return ctx, nil
+	}
+
+	md, _ := metadata.FromIncomingContext(ctx)
+	auth := md.Get("authorization")
+	if len(auth) == 0 {
+		return nil, status.Error(codes.Unauthenticated, "missing bearer token")
+	}
+
+	token, ok := bres.ParseBearer(auth[0])
+	if !ok {
+		return nil, status.Error(codes.Unauthenticated, "invalid authorization")
+	}
+
+	u, err := bres.Authenticate(ctx, token, ip, "")
+	if err == bres.ErrInvalidToken {
+		return nil, status.Error(codes.Unauthenticated, err.Error())
+	}
+	if err != nil {
+		return nil, internal(ctx, err)
+	}
+	logging.With(ctx, "user", u)
+	return context.WithValue(ctx, userKey{}, u), nil
+}
+
+// Assign or propagate x-request-id like the REST middleware
+func requestContext(ctx context.Context) (context.Context, metadata.MD) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	var id string
+	if v := md.Get(REQUEST_ID_KEY); len(v) > 0 {
+		id = v[0]
+	}
+	id = logging.RequestID(id)
+	return logging.WithRequest(ctx, id, peerIP(ctx)), metadata.Pairs(REQUEST_ID_KEY, id)
+}
+
+// Incoming metadata as a propagation carrier, keys are lowercase
+type metadataCarrier metadata.MD
+
+func (m metadataCarrier) Get(key string) string {
+	if v := metadata.MD(m).Get(key); len(v) > 0 {
+		return v[0]
+	}
+	return ""
+}
+
+func (m metadataCarrier) Set(key string, value string) {
+	metadata.MD(m).Set(key, value)
+}
+
+func (m metadataCarrier) Keys() []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// Server span per call, continuing the caller's trace from traceparent metadata
+func startSpan(ctx context.Context, method string) (context.Context, trace.Span) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	return tracing.Serve(ctx, metadataCarrier(md), method,
+		attribute.String("rpc.system", "grpc"),
+		attribute.String("rpc.method", method),
+		attribute.String("client.address", peerIP(ctx)))
+}
+
+// Record the status code, only server faults mark the span failed
+func endSpan(span trace.Span, err error) {
+	code := status.Code(err)
+	span.SetAttributes(attribute.Int("rpc.grpc.status_code", int(code)))
+	if code == codes.Internal || code == codes.Unknown {
+		tracing.Fail(span, err)
+	}
+	span.End()
+}
+
+// Log a finished call with its status code
+func logCall(ctx context.Context, method string, start time.Time, err error) {
+	code := status.Code(err)
+	lvl := slog.LevelInfo
+	if code == codes.Internal || code == codes.Unknown {
+		lvl = slog.LevelError
+	}
+	logging.From(ctx).LogAttrs(ctx, lvl, "rpc",
+		slog.String("method", method),
+		slog.String("code", code.String()),
+		slog.Duration("latency", time.Since(start)),
+		slog.String("ip", peerIP(ctx)))
+}
+
+func unaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp interface{}, err error) {
+	ctx, header := requestContext(ctx)
+	grpc.SetHeader(ctx, header)
+	ctx, span := startSpan(ctx, info.FullMethod)
+	start := time.Now()
+	defer func() {
+		logCall(ctx, info.FullMethod, start, err)
+		endSpan(span, err)
+	}()
+
+	authed, err := authorize(ctx, info.FullMethod)
+	if err != nil {
+		return nil, err
+	}
+	return handler(authed, req)
+}
+
+// Server stream carrying the authorized context
+type authStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *authStream) Context() context.Context {
+	return s.ctx
+}
+
+func streamInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) (err error) {
+	ctx, header := requestContext(ss.Context())
+	ss.SetHeader(header)
+	ctx, span := startSpan(ctx, info.FullMethod)
+	start := time.Now()
+	defer func() {
+		logCall(ctx, info.FullMethod, start, err)
+		endSpan(span, err)
+	}()
+
+	authed, err := authorize(ctx, info.FullMethod)
+	if err != nil {
+		return err
+	}
+	return handler(srv, &authStream{ServerStream: ss, ctx: authed})
+}
+
+// Log err and hide it behind codes.Internal, for database errors
+func internal(ctx context.Context, err error) error {
+	logging.From(ctx).Error("call failed", "err", err)
+	return status.Error(codes.Internal, "internal server error")
+}
+
+// Map a broken group rule to a status, anything else is internal like a 500 on REST
+func groupError(ctx context.Context, err error) error {
+	switch err {
+	case groups.ErrGroupNotFound, groups.ErrMemberNotFound, groups.ErrNoGroup:
+		return status.Error(codes.NotFound, err.Error())
+	case groups.ErrNotMember, groups.ErrNotCreator, groups.ErrNotCoinHolder, groups.ErrAlreadyOwner:
+		return status.Error(codes.PermissionDenied, err.Error())
+	case groups.ErrAlreadyMember:
+		return status.Error(codes.AlreadyExists, err.Error())
+	}
+	return internal(ctx, err)
+}
+
+// Validate a request with the binding tags REST uses
+func validate(req interface{}) error {
+	if err := bres.Validate(req); err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	return nil
+}
+
+func (s *server) Register(ctx context.Context, in *pushuppb.RegisterRequest) (*emptypb.Empty, error) {
+	if err := validate(&bres.RegisterRequest{Username: in.Username, Password: in.Password}); err != nil {
+		return nil, err
+	}
+
+	switch err := accounts.Register(ctx, in.Username, in.Password, ""); err {
+	case nil:
+	case accounts.ErrUserExists:
+		return nil, status.Error(codes.AlreadyExists, err.Error())
+	default:
+		return nil, internal(ctx, err)
+	}
+	return &emptypb.Empty{}, nil
+}
+
+func (s *server) Login(ctx context.Context, in *pushuppb.LoginRequest) (*pushuppb.LoginResponse, error) {
+	if err := validate(&bres.LoginRequest{Username: in.Username, Password: in.Password}); err != nil {
+		return nil, err
+	}
+
+	switch err := accounts.Login(ctx, in.Username, in.Password); err {
+	case nil:
+	case accounts.ErrUserNotFound:
+		return nil, status.Error(codes.NotFound, err.Error())
+	case accounts.ErrInvalidCredentials:
+		return nil, status.Error(codes.Unauthenticated, err.Error())
+	case accounts.ErrDisabled:
+		return nil, status.Error(codes.PermissionDenied, err.Error())
+	default:
+		return nil, internal(ctx, err)
+	}
+
+	// With two-factor on, the password only earns a challenge
+	tf, ok, err := bsql.GetTwoFactor(ctx, in.Username)
+	if err != nil {
+		return nil, internal(ctx, err)
+	}
+	if ok && tf.Enabled {
+		return &pushuppb.LoginResponse{
+			Challenge: tokens.AddChallenge(peerIP(ctx), in.Username),
+			ExpiresIn: int32(tokens.CHALLENGE_LIFETIME.Seconds()),
+		}, nil
+	}
+
+	accounts.LoggedIn(ctx, in.Username)
+	return &pushuppb.LoginResponse{Token: tokens.AddClient(peerIP(ctx), in.Username)}, nil
+}
+
+func (s *server) LoginSecondFactor(ctx context.Context, in *pushuppb.SecondFactorRequest) (*pushuppb.LoginResponse, error) {
+	if err := validate(&bres.SecondFactorRequest{Challenge: in.Challenge, Code: in.Code}); err != nil {
+		return nil, err
+	}
+
+	u, ok := tokens.GetChallenge(in.Challenge, peerIP(ctx))
+	if !ok {
+		return nil, status.Error(codes.Unauthenticated, "invalid challenge")
+	}
+
+	ok, err := bres.ValidateSecondFactor(ctx, u, in.Code)
+	if err != nil {
+		return nil, internal(ctx, err)
+	}
+	if !ok {
+		tokens.FailChallenge(in.Challenge)
+		accounts.LoginFailed(ctx, u, nil)
+		return nil, status.Error(codes.Unauthenticated, "invalid second factor")
+	}
+
+	tokens.DeleteChallenge(in.Challenge)
+	accounts.LoggedIn(ctx, u)
+	return &pushuppb.LoginResponse{Token: tokens.AddClient(peerIP(ctx), u)}, nil
+}
+
+func (s *server) GetGroup(ctx context.Context, in *pushuppb.GroupRequest) (*pushuppb.Group, error) {
+	group, err := groups.Get(ctx, user(ctx), in.Id)
+	if err != nil {
+		return nil, groupError(ctx, err)
+	}
+
+	return &pushuppb.Group{
+		Id:         group.ID,
+		Coin:       int32(group.Token),
+		Creator:    group.Creator,
+		CoinHolder: group.TokenHolder,
+		Members:    group.Members,
+	}, nil
+}
+
+func (s *server) CreateGroup(ctx context.Context, in *emptypb.Empty) (*pushuppb.CreateGroupResponse, error) {
+	id, err := groups.Create(ctx, user(ctx))
+	if err != nil {
+		return nil, groupError(ctx, err)
+	}
+	return &pushuppb.CreateGroupResponse{Id: id}, nil
+}
+
+func (s *server) JoinGroup(ctx context.Context, in *pushuppb.GroupRequest) (*emptypb.Empty, error) {
+	if err := groups.Join(ctx, user(ctx), in.Id); err != nil {
+		return nil, groupError(ctx, err)
+	}
+	return &emptypb.Empty{}, nil
+}
+
+func (s *server) PassCoin(ctx context.Context, in *pushuppb.GroupRequest) (*pushuppb.CoinPass, error) {
+	pass, err := groups.PassCoin(ctx, user(ctx), in.Id)
+	if err != nil {
+		return nil, groupError(ctx, err)
+	}
+	return coinPass(pass), nil
+}
+
+func (s *server) Kick(ctx context.Context, in *pushuppb.KickRequest) (*emptypb.Empty, error) {
+	if err := groups.Kick(ctx, user(ctx), in.Id, in.Member); err != nil {
+		return nil, groupError(ctx, err)
+	}
+	return &emptypb.Empty{}, nil
+}
+
+func (s *server) Disband(ctx context.Context, in *pushuppb.GroupRequest) (*emptypb.Empty, error) {
+	if err := groups.Disband(ctx, user(ctx), in.Id); err != nil {
+		return nil, groupError(ctx, err)
+	}
+	return &emptypb.Empty{}, nil
+}
+
+func (s *server) StreamGroupEvents(in *pushuppb.StreamGroupEventsRequest, stream grpc.ServerStreamingServer[pushuppb.Event]) error {
+	ctx := stream.Context()
+	u := user(ctx)
+
+	if err := groups.Member(ctx, u, in.Id); err != nil {
+		return groupError(ctx, err)
+	}
+
+	// Subscribe before reading the history so no pass falls in between
+	ch, unsubscribe := events.Subscribe(in.Id)
+	defer unsubscribe()
+
+	lastID := in.LastEventId
+	if lastID > 0 {
+		missed, err := bsql.GetCoinPassesSince(ctx, in.Id, lastID)
+		if err != nil {
+			return internal(ctx, err)
+		}
+		for i := range missed {
+			lastID = missed[i].ID
+			e := events.Event{
+				ID:    strconv.FormatInt(missed[i].ID, 10),
+				Type:  events.COIN_PASSED,
+				Group: in.Id,
+				Data:  &missed[i],
+			}
+			ev, err := event(ctx, e)
+			if err != nil {
+				return err
+			}
+			if err = stream.Send(ev); err != nil {
+				return err
+			}
+		}
+	}
+
+	for {
+		select {
+		case e, ok := <-ch:
+			if !ok {
+				return nil
+			}
+
+			// Skip passes already sent from the history
+			if e.Type == events.COIN_PASSED {
+				if n, _ := strconv.ParseInt(e.ID, 10, 64); n <= lastID {
+					continue
+				}
+			}
+
+			ev, err := event(ctx, e)
+			if err != nil {
+				return err
+			}
+			if err = stream.Send(ev); err != nil {
+				return err
+			}
+
+			// End the stream once the user can no longer see the group
+			if events.Removes(e, u) {
+				return nil
+			}
+
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+func coinPass(pass *bsql.CoinPass) *pushuppb.CoinPass {
+	return &pushuppb.CoinPass{
+		Id:       pass.ID,
+		GroupId:  pass.GroupID,
+		From:     pass.From,
+		To:       pass.To,
+		Coin:     int32(pass.Coin),
+		PassedAt: timestamppb.New(pass.PassedAt),
+	}
+}
+
+func event(ctx context.Context, e events.Event) (*pushuppb.Event, error) {
+	data, err := json.Marshal(e.Data)
+	if err != nil {
+		return nil, internal(ctx, err)
+	}
+	return &pushuppb.Event{Id: e.ID, Type: e.Type, Group: e.Group, Data: string(data)}, nil
+}
+
+// Server started by Init(), nil when the listener is off
+var grpcServer *grpc.Server
+
+// New gRPC server with the auth and rate limit interceptors
+func NewServer() *grpc.Server {
+	srv := grpc.NewServer(
+		grpc.UnaryInterceptor(unaryInterceptor),
+		grpc.StreamInterceptor(streamInterceptor),
+	)
+	pushuppb.RegisterPushupServer(srv, &server{})
+	return srv
+}
+
+// Start serving on server.grpc_addr, off turns the listener off
+// Warns when it is reachable off this host, passwords and tokens cross it in plaintext
+func Init() {
+	addr := config.Get().Server.GRPCAddr
+	if addr == "off" {
+		logger.Info("gRPC API off")
+		return
+	}
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+			logger.Warn("gRPC API is plaintext and listens beyond loopback, put it behind TLS", "addr", addr)
+		}
+	}
+
+	logger.Info("Initializing gRPC API", "addr", addr)
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		logging.Fatal(err)
+	}
+
+	grpcServer = NewServer()
+	go func() {
+		if err := grpcServer.Serve(lis); err != nil {
+			logging.Fatal(err)
+		}
+	}()
+}
+
+// Stop accepting calls and wait for running ones
+// Calls still running when ctx is done are cancelled
+func Shutdown(ctx context.Context) error {
+	if grpcServer == nil {
+		return nil
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		grpcServer.GracefulStop()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+		return nil
+	case <-ctx.Done():
+		grpcServer.Stop()
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,151 @@
+// Pushup stats and leaderboards, read from the pass rollup instead of the coin history
+// The coin goes up by one with every pass and the passer did that many pushups,
+// so a pass at coin n counts n pushups
+// A hold is how long the passer had the coin, from the group's previous pass to theirs,
+// and a missed deadline a hold longer than bsql.HOLD_DEADLINE
+package stats
+
+import (
+	"benschreiber.com/purestserver/src/accounts"
+	"benschreiber.com/purestserver/src/bsql"
+	"context"
+	"time"
+)
+
+// Totals shared by users, groups and leaderboard entries
+type Stats struct {
+	Pushups            int64   `json:"pushups"`
+	CoinsPassed        int     `json:"coins_passed"`
+	AverageHoldSeconds float64 `json:"average_hold_seconds"`
+	MissedDeadlines    int     `json:"missed_deadlines"`
+}
+
+// A user's stats over every group they passed in, kept after they leave it
+type UserStats struct {
+	Username string `json:"username"`
+	Stats
+	LongestStreak int `json:"longest_streak"` // most consecutive days with a pass
+}
+
+// A group's stats, every pass by anyone who was ever in it
+type GroupStats struct {
+	GroupID string `json:"group_id"`
+	Coin    int    `json:"coin"`
+	Stats
+	LongestStreak int `json:"longest_streak"` // most consecutive days anyone passed
+}
+
+// A member's place on a leaderboard, ties share a rank
+type Entry struct {
+	Rank     int    `json:"rank"`
+	Username string `json:"username"`
+	Stats
+}
+
+func fromTotals(t *bsql.PassTotals) Stats {
+	s := Stats{
+		Pushups:         t.Pushups,
+		CoinsPassed:     t.Passes,
+		MissedDeadlines: t.Missed,
+	}
+	if t.Holds > 0 {
+		s.AverageHoldSeconds = float64(t.HeldSeconds) / float64(t.Holds)
+	}
+	return s
+}
+
+// Most consecutive days in days, which are sorted and distinct
+func longestStreak(days []time.Time) int {
+	longest, run := 0, 0
+	for i, day := range days {
+		if i > 0 && day.Equal(days[i-1].AddDate(0, 0, 1)) {
+			run++
+		} else {
+			run = 1
+		}
+		if run > longest {
+			longest = run
+		}
+	}
+	return longest
+}
+
+// Stats of any user
+func ForUser(ctx context.Context, user string) (*UserStats, error) {
+	ok, err := bsql.UserExists(ctx, user)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, accounts.ErrUserNotFound
+	}
+
+	totals, err := bsql.GetUserTotals(ctx, user)
+	if err != nil {
+		return nil, err
+	}
+	days, err := bsql.GetUserPassDays(ctx, user)
+	if err != nil {
+		return nil, err
+	}
+
+	return &UserStats{
+		Username:      user,
+		Stats:         fromTotals(totals),
+		LongestStreak: longestStreak(days),
+	}, nil
+}
+
+// Stats of a group the caller already checked they may see
+func ForGroup(ctx context.Context, group *bsql.Group) (*GroupStats, error) {
+	totals, err := bsql.GetGroupTotals(ctx, group.ID)
+	if err != nil {
+		return nil, err
+	}
+	days, err := bsql.GetGroupPassDays(ctx, group.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &GroupStats{
+		GroupID:       group.ID,
+		Coin:          group.Token,
+		Stats:         fromTotals(totals),
+		LongestStreak: longestStreak(days),
+	}, nil
+}
+
+// Every current member of group ranked by pushups over period, one of bsql.PERIOD_*
+// Members without a pass in it come last with zeros
+func Leaderboard(ctx context.Context, group *bsql.Group, period string) ([]Entry, error) {
+	rows, err := bsql.GetLeaderboard(ctx, group.ID, period, len(group.Members))
+	if err != nil {
+		return nil, err
+	}
+	return rank(rows, group.Members), nil
+}
+
+// Rank rows, most pushups first, then every member missing from them
+func rank(rows []bsql.LeaderboardRow, members []string) []Entry {
+	out := make([]Entry, 0, len(members))
+	add := func(e Entry) {
+		e.Rank = len(out) + 1
+		if n := len(out); n > 0 && out[n-1].Pushups == e.Pushups {
+			e.Rank = out[n-1].Rank
+		}
+		out = append(out, e)
+	}
+
+	ranked := make(map[string]bool, len(rows))
+	for _, r := range rows {
+		add(Entry{Username: r.Username, Stats: fromTotals(&r.PassTotals)})
+		ranked[r.Username] = true
+	}
+
+	for _, m := range members {
+		if !ranked[m] {
+			add(Entry{Username: m})
+		}
+	}
+	return out
+}
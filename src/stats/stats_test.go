@@ -0,0 +1,91 @@
+package stats
+
+import (
+	"benschreiber.com/purestserver/src/bsql"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func days(dates ...string) []time.Time {
+	out := make([]time.Time, len(dates))
+	for i, d := range dates {
+		t, err := time.Parse("2006-01-02", d)
+		if err != nil {
+			panic(err)
+		}
+		out[i] = t
+	}
+	return out
+}
+
+func TestLongestStreak(t *testing.T) {
+	tests := []struct {
+		name string
+		days []time.Time
+		want int
+	}{
+		{"none", nil, 0},
+		{"one day", days("2021-10-01"), 1},
+		{"two runs", days("2021-10-01", "2021-10-02", "2021-10-04", "2021-10-05", "2021-10-06"), 3},
+		{"longest first", days("2021-10-01", "2021-10-02", "2021-10-03", "2021-10-10"), 3},
+		{"gaps only", days("2021-10-01", "2021-10-03", "2021-10-05"), 1},
+		{"across months", days("2021-09-29", "2021-09-30", "2021-10-01"), 3},
+		{"across years", days("2020-12-31", "2021-01-01"), 2},
+		{"leap day", days("2020-02-28", "2020-02-29", "2020-03-01"), 3},
+	}
+	for _, tt := range tests {
+		if got := longestStreak(tt.days); got != tt.want {
+			t.Errorf("%s: longestStreak = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func row(user string, pushups int64) bsql.LeaderboardRow {
+	return bsql.LeaderboardRow{Username: user, PassTotals: bsql.PassTotals{Pushups: pushups, Passes: 1}}
+}
+
+func TestRank(t *testing.T) {
+	tests := []struct {
+		name    string
+		rows    []bsql.LeaderboardRow
+		members []string
+		want    string
+	}{
+		{"no passes", nil, []string{"ann", "bob"}, "1 ann 0, 1 bob 0"},
+		{"distinct", []bsql.LeaderboardRow{row("bob", 30), row("ann", 20)}, []string{"ann", "bob"}, "1 bob 30, 2 ann 20"},
+		{"tie shares a rank and skips the next", []bsql.LeaderboardRow{row("ann", 30), row("bob", 30), row("cat", 10)}, []string{"ann", "bob", "cat"}, "1 ann 30, 1 bob 30, 3 cat 10"},
+		{"tie after the first", []bsql.LeaderboardRow{row("ann", 30), row("bob", 10), row("cat", 10)}, []string{"ann", "bob", "cat"}, "1 ann 30, 2 bob 10, 2 cat 10"},
+		{"members without passes last", []bsql.LeaderboardRow{row("bob", 5)}, []string{"ann", "bob", "cat"}, "1 bob 5, 2 ann 0, 2 cat 0"},
+		{"zero row ties members without passes", []bsql.LeaderboardRow{row("bob", 5), row("ann", 0)}, []string{"ann", "bob", "cat"}, "1 bob 5, 2 ann 0, 2 cat 0"},
+		{"no members", nil, nil, ""},
+	}
+	for _, tt := range tests {
+		got := ""
+		for i, e := range rank(tt.rows, tt.members) {
+			if i > 0 {
+				got += ", "
+			}
+			got += fmt.Sprintf("%d %s %d", e.Rank, e.Username, e.Pushups)
+		}
+		if got != tt.want {
+			t.Errorf("%s: rank = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestFromTotals(t *testing.T) {
+	tests := []struct {
+		totals bsql.PassTotals
+		want   Stats
+	}{
+		{bsql.PassTotals{}, Stats{}},
+		{bsql.PassTotals{Pushups: 10, Passes: 4, HeldSeconds: 300, Holds: 3, Missed: 1}, Stats{Pushups: 10, CoinsPassed: 4, AverageHoldSeconds: 100, MissedDeadlines: 1}},
+		{bsql.PassTotals{Pushups: 1, Passes: 1}, Stats{Pushups: 1, CoinsPassed: 1}},
+	}
+	for _, tt := range tests {
+		if got := fromTotals(&tt.totals); got != tt.want {
+			t.Errorf("fromTotals(%+v) = %+v, want %+v", tt.totals, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,146 @@
+// OpenTelemetry tracing with W3C trace-context propagation
+// tracing.exporter (OTEL_TRACES_EXPORTER) selects "otlp" (OTEL_EXPORTER_OTLP_ENDPOINT, a local
+// collector by default), "console" (stdout) or "none" (default)
+// Must call tracing.Init() before serving, Shutdown() flushes queued spans
+package tracing
+
+import (
+	"benschreiber.com/purestserver/src/config"
+	"benschreiber.com/purestserver/src/logging"
+	"context"
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"strconv"
+)
+
+// service.name unless OTEL_SERVICE_NAME is set
+const SERVICE_NAME = "purestserver"
+
+// Instrumentation scope of every span
+const SCOPE = "benschreiber.com/purestserver"
+
+var logger = logging.For("tracing")
+
+var provider *sdktrace.TracerProvider
+
+// Tracer for spans of this server, a no-op until Init()
+func Tracer() trace.Tracer {
+	return otel.Tracer(SCOPE)
+}
+
+// Start a span as a child of whatever span is in ctx
+func Start(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return Tracer().Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// Mark span failed with err, nil leaves it as is
+func Fail(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+}
+
+// Server span continuing the caller's trace from the traceparent in carrier
+// The trace id is added to the call's log lines
+func Serve(ctx context.Context, carrier propagation.TextMapCarrier, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	ctx = otel.GetTextMapPropagator().Extract(ctx, carrier)
+	ctx, span := Tracer().Start(ctx, name,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(attrs...))
+
+	if sc := span.SpanContext(); sc.IsValid() {
+		logging.With(ctx, "trace_id", sc.TraceID().String())
+	}
+	return ctx, span
+}
+
+// Span per request
+func Middleware(c *gin.Context) {
+	route := c.FullPath()
+	name := c.Request.Method + " " + route
+	if route == "" {
+		name = c.Request.Method
+	}
+	ctx, span := Serve(c.Request.Context(), propagation.HeaderCarrier(c.Request.Header), name,
+		attribute.String("http.request.method", c.Request.Method),
+		attribute.String("http.route", route),
+		attribute.String("url.path", c.Request.URL.Path),
+		attribute.String("client.address", c.ClientIP()))
+	defer span.End()
+
+	c.Request = c.Request.WithContext(ctx)
+	c.Next()
+
+	status := c.Writer.Status()
+	span.SetAttributes(attribute.Int("http.response.status_code", status))
+	if status >= 500 {
+		span.SetStatus(codes.Error, strconv.Itoa(status))
+	}
+}
+
+func exporter(ctx context.Context, name string) (sdktrace.SpanExporter, error) {
+	switch name {
+	case "otlp":
+		return otlptracehttp.New(ctx)
+	case "console":
+		return stdouttrace.New(stdouttrace.WithPrettyPrint())
+	}
+	return nil, nil
+}
+
+// Install the tracer provider and the trace-context propagator
+// Propagation works with no exporter so traces pass through to downstream calls
+func Init() {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{},
+		propagation.Baggage{},
+	))
+
+	name := config.Get().Tracing.Exporter
+	ctx := context.Background()
+	exp, err := exporter(ctx, name)
+	if err != nil {
+		logging.Fatal(err)
+	}
+	if exp == nil {
+		logger.Info("Tracing off")
+		return
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(
+		attribute.String("service.name", SERVICE_NAME),
+	))
+	if err != nil {
+		logging.Fatal(err)
+	}
+	// OTEL_SERVICE_NAME and OTEL_RESOURCE_ATTRIBUTES win over the default name
+	if env, err := resource.New(ctx, resource.WithFromEnv()); err == nil {
+		if merged, err := resource.Merge(res, env); err == nil {
+			res = merged
+		}
+	}
+
+	provider = sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exp),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(provider)
+	logger.Info("Initializing tracing", "exporter", name)
+}
+
+// Flush and stop the exporter
+func Shutdown(ctx context.Context) error {
+	if provider == nil {
+		return nil
+	}
+	return provider.Shutdown(ctx)
+}
@@ -0,0 +1,85 @@
+// Webhook URLs must reach the public internet, never the server's own network
+// Checked when a webhook is registered, and again on every dial so a name
+// that later resolves to a private address (DNS rebinding) is still refused
+package webhooks
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"syscall"
+	"time"
+)
+
+// Returned for a URL or dial to an address deliveries may not reach
+var ErrPrivateAddress = errors.New("webhook address is not public")
+
+// Returned for a URL that isn't absolute http(s)
+var ErrInvalidURL = errors.New("webhook url must be http or https with a host")
+
+// Deliver to loopback, private and link-local addresses too
+// Only for tests delivering to an httptest receiver
+var AllowPrivate = false
+
+// Address deliveries may not reach: loopback, RFC 1918 and RFC 4193 private,
+// link-local (169.254.169.254 metadata included), unspecified and multicast
+func private(ip net.IP) bool {
+	return ip.IsLoopback() ||
+		ip.IsPrivate() ||
+		ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() ||
+		ip.IsMulticast() ||
+		ip.IsUnspecified()
+}
+
+// Parse a webhook URL and check every address its host resolves to
+// Any error is the client's, a host that doesn't resolve included
+func CheckURL(ctx context.Context, raw string) (*url.URL, error) {
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Hostname() == "" {
+		return nil, ErrInvalidURL
+	}
+	if AllowPrivate {
+		return u, nil
+	}
+
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, u.Hostname())
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range addrs {
+		if private(a.IP) {
+			return nil, ErrPrivateAddress
+		}
+	}
+	return u, nil
+}
+
+// net.Dialer Control, refuses a connection to a private address after resolution
+func control(network string, address string, _ syscall.RawConn) error {
+	if AllowPrivate {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || private(ip) {
+		return ErrPrivateAddress
+	}
+	return nil
+}
+
+// Client for deliveries, every dial and redirect goes through control
+// No proxy, the address checked has to be the one connected to
+func newClient() *http.Client {
+	dialer := &net.Dialer{Timeout: TIMEOUT, KeepAlive: 30 * time.Second, Control: control}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+	return &http.Client{Timeout: TIMEOUT, Transport: transport}
+}
@@ -0,0 +1,289 @@
+// Outgoing webhooks for group events
+// Published events are handed to a worker that queues them in the webhook_delivery table
+// A worker POSTs due deliveries, retrying with exponential backoff
+// Payloads are signed with HMAC-SHA256 of "<timestamp>.<body>" using the webhook secret
+// Must call webhooks.Init() after bsql and events are initialized
+package webhooks
+
+import (
+	"benschreiber.com/purestserver/src/bsql"
+	"benschreiber.com/purestserver/src/events"
+	"benschreiber.com/purestserver/src/lifecycle"
+	"benschreiber.com/purestserver/src/logging"
+	"benschreiber.com/purestserver/src/tracing"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"go.opentelemetry.io/otel/attribute"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+var logger = logging.For("webhooks")
+
+const (
+	POLL_PERIOD   = 5 * time.Second  // how often the worker looks for due deliveries
+	BATCH_SIZE    = 20               // deliveries sent per poll
+	TIMEOUT       = 10 * time.Second // per request timeout
+	BASE_BACKOFF  = 30 * time.Second // wait after the first failed attempt, doubled each attempt
+	MAX_BACKOFF   = 6 * time.Hour
+	MAX_ATTEMPTS  = 8                // attempts before a delivery is marked failed
+	DISABLE_AFTER = 20               // consecutive failed attempts before a webhook is disabled
+	LEASE         = 10 * time.Minute // a claimed delivery is left to its server this long
+)
+
+// Events waiting for the worker before new ones are dropped
+// Events still waiting at shutdown are queued before the worker stops
+const QUEUE_SIZE = 256
+
+var queue chan events.Event
+
+// Headers sent with every delivery
+const (
+	EVENT_HEADER     = "X-Pushup-Event"
+	DELIVERY_HEADER  = "X-Pushup-Delivery"
+	TIMESTAMP_HEADER = "X-Pushup-Timestamp"
+	SIGNATURE_HEADER = "X-Pushup-Signature"
+)
+
+// Event types a webhook may subscribe to
+// Creating a group comes before any of its webhooks and disbanding deletes them, so neither is offered
+var Events = []string{
+	events.COIN_PASSED,
+	events.MEMBER_JOINED,
+	events.MEMBER_LEFT,
+	events.MEMBER_KICKED,
+	events.SETTINGS_CHANGE,
+	events.BADGE_EARNED,
+}
+
+// Client used for deliveries, refuses private addresses unless AllowPrivate
+var Client = newClient()
+
+// Body POSTed to a webhook
+type Payload struct {
+	Event     string      `json:"event"`
+	EventID   string      `json:"event_id,omitempty"`
+	GroupID   string      `json:"group_id"`
+	Data      interface{} `json:"data"`
+	CreatedAt time.Time   `json:"created_at"`
+}
+
+// Event type is one a webhook may subscribe to
+func ValidEvent(event string) bool {
+	for _, v := range Events {
+		if v == event {
+			return true
+		}
+	}
+	return false
+}
+
+// Generate a random webhook secret
+func NewSecret() string {
+	b := make([]byte, 32)
+	rand.Read(b) // never fails, crypto/rand crashes the process instead
+	return hex.EncodeToString(b)
+}
+
+// Signature header value for a body sent at timestamp
+// Receivers recompute this with their copy of the secret
+func Sign(secret string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Wait before the next attempt after attempts failed attempts
+func backoff(attempts int) time.Duration {
+	d := BASE_BACKOFF
+	for i := 1; i < attempts && d < MAX_BACKOFF; i++ {
+		d *= 2
+	}
+	if d > MAX_BACKOFF {
+		d = MAX_BACKOFF
+	}
+	return d
+}
+
+// Events sink, hand events to the worker without blocking the publisher
+func enqueue(e events.Event) {
+	select {
+	case queue <- e:
+	default:
+		logger.Warn("dropping event, webhooks are behind", "group", e.Group, "type", e.Type)
+	}
+}
+
+// Queue deliveries for handed over events until shutdown, then for the ones still waiting
+func work(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			for {
+				select {
+				case e := <-queue:
+					store(context.Background(), e)
+				default:
+					return
+				}
+			}
+		case e := <-queue:
+			store(ctx, e)
+		}
+	}
+}
+
+// Queue a delivery for every webhook of the group that wants the event
+func store(ctx context.Context, e events.Event) {
+	hooks, err := bsql.GetWebhooks(ctx, e.Group)
+	if err != nil {
+		logger.Error("webhook lookup failed", "group", e.Group, "err", err)
+		return
+	}
+
+	var body []byte
+	for _, w := range hooks {
+		if !w.Active || !w.Wants(e.Type) {
+			continue
+		}
+
+		if body == nil {
+			body, err = json.Marshal(Payload{
+				Event:     e.Type,
+				EventID:   e.ID,
+				GroupID:   e.Group,
+				Data:      e.Data,
+				CreatedAt: time.Now().UTC(),
+			})
+			if err != nil {
+				logger.Error("webhook payload failed", "webhook", w.ID, "err", err)
+				return
+			}
+		}
+
+		if err = bsql.InsertWebhookDelivery(ctx, w.ID, e.Type, string(body)); err != nil {
+			logger.Error("webhook enqueue failed", "webhook", w.ID, "err", err)
+		}
+	}
+}
+
+// POST a single delivery
+// Returns the response status code, 0 if no response was received
+func Deliver(d *bsql.WebhookDelivery) (int, error) {
+	body := []byte(d.Payload)
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+
+	req, err := http.NewRequest("POST", d.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "pushupapp-webhooks")
+	req.Header.Set(EVENT_HEADER, d.Event)
+	req.Header.Set(DELIVERY_HEADER, strconv.FormatInt(d.ID, 10))
+	req.Header.Set(TIMESTAMP_HEADER, timestamp)
+	req.Header.Set(SIGNATURE_HEADER, Sign(d.Secret, timestamp, body))
+
+	res, err := Client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(res.Body, 64<<10))
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return res.StatusCode, fmt.Errorf("receiver responded %d", res.StatusCode)
+	}
+	return res.StatusCode, nil
+}
+
+// Send a due delivery and record the outcome
+func attempt(d *bsql.WebhookDelivery) {
+	ctx, span := tracing.Start(context.Background(), "webhooks.deliver",
+		attribute.Int64("webhook.delivery.id", d.ID),
+		attribute.String("webhook.event", d.Event))
+	defer span.End()
+
+	code, err := Deliver(d)
+	span.SetAttributes(attribute.Int("http.response.status_code", code))
+	tracing.Fail(span, err)
+	if err == nil {
+		if err = bsql.WebhookDelivered(ctx, d, code); err != nil {
+			logger.Error("webhook update failed", "webhook", d.WebhookID, "err", err)
+		}
+		return
+	}
+
+	// Retry later, or give up on the delivery
+	attempts := d.Attempts + 1
+	status := bsql.DELIVERY_PENDING
+	if attempts >= MAX_ATTEMPTS {
+		status = bsql.DELIVERY_FAILED
+	}
+
+	msg := err.Error()
+	if len(msg) > 512 {
+		msg = msg[:512]
+	}
+
+	failures, err := bsql.WebhookAttemptFailed(ctx, d, status, code, msg, backoff(attempts))
+	if err != nil {
+		logger.Error("webhook update failed", "webhook", d.WebhookID, "err", err)
+		return
+	}
+
+	if failures >= DISABLE_AFTER {
+		logger.Warn("disabling webhook after repeated failures", "webhook", d.WebhookID, "failures", failures)
+		if err = bsql.DisableWebhook(ctx, d.WebhookID); err != nil {
+			logger.Error("webhook update failed", "webhook", d.WebhookID, "err", err)
+		}
+	}
+}
+
+// Claim and send every due delivery once, runs every POLL_PERIOD
+// Servers sharing the database claim different rows, so each is sent once
+// Stops between deliveries on shutdown, the rest are due again after LEASE
+func deliverDue(ctx context.Context) {
+	deliveries, err := bsql.ClaimDueWebhookDeliveries(ctx, BATCH_SIZE, LEASE)
+	if err != nil {
+		logger.Error("webhook poll failed", "err", err)
+		return
+	}
+
+	for i := range deliveries {
+		if ctx.Err() != nil {
+			return
+		}
+		attempt(&deliveries[i])
+	}
+}
+
+// Queue deliveries for group events without delivering them,
+// for processes like purestctl that leave delivery to the server
+// lifecycle.Stop() waits for the events published until then to be queued
+func Queue() {
+	queue = make(chan events.Event, QUEUE_SIZE)
+	lifecycle.Go("webhook queue", work)
+	events.AddSink(enqueue)
+}
+
+// Subscribe to group events and start the delivery worker
+func Init() {
+	logger.Info("Initializing webhook deliveries")
+
+	Queue()
+
+	// A full batch of timeouts is the slowest healthy poll
+	lifecycle.Every("webhooks", POLL_PERIOD, BATCH_SIZE*TIMEOUT, deliverDue)
+}
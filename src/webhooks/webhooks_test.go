@@ -0,0 +1,175 @@
+package webhooks
+
+import (
+	"benschreiber.com/purestserver/src/bsql"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Receiver checking every request the way a subscriber would
+// Fails the first fail requests with 503
+func receiver(t *testing.T, secret string, fail int32) (*httptest.Server, *int32) {
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&calls, 1)
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Errorf("reading body: %v", err)
+		}
+		timestamp := r.Header.Get(TIMESTAMP_HEADER)
+		if _, err := strconv.ParseInt(timestamp, 10, 64); err != nil {
+			t.Errorf("timestamp %q: %v", timestamp, err)
+		}
+		if got, want := r.Header.Get(SIGNATURE_HEADER), Sign(secret, timestamp, body); got != want {
+			t.Errorf("signature %q, want %q", got, want)
+		}
+		if got := r.Header.Get(EVENT_HEADER); got != "coin" {
+			t.Errorf("event header %q, want coin", got)
+		}
+		if got := r.Header.Get(DELIVERY_HEADER); got != "7" {
+			t.Errorf("delivery header %q, want 7", got)
+		}
+
+		if n <= fail {
+			w.WriteHeader(503)
+			return
+		}
+		w.WriteHeader(204)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &calls
+}
+
+func allowPrivate(t *testing.T) {
+	AllowPrivate = true
+	t.Cleanup(func() { AllowPrivate = false })
+}
+
+func TestSign(t *testing.T) {
+	// echo -n '1700000000.{"a":1}' | openssl dgst -sha256 -hmac secret
+	got := Sign("secret", "1700000000", []byte(`{"a":1}`))
+	want := "sha256=49f24e537407743fa4a0242bb63b94b9a47ee99cbbe071ccd8a22550ae411686"
+	if got != want {
+		t.Fatalf("Sign = %q, want %q", got, want)
+	}
+	if Sign("other", "1700000000", []byte(`{"a":1}`)) == got {
+		t.Error("Sign ignores the secret")
+	}
+	if Sign("secret", "1700000001", []byte(`{"a":1}`)) == got {
+		t.Error("Sign ignores the timestamp")
+	}
+	if Sign("secret", "1700000000", []byte(`{"a":2}`)) == got {
+		t.Error("Sign ignores the body")
+	}
+}
+
+func TestDeliverSigned(t *testing.T) {
+	allowPrivate(t)
+	srv, calls := receiver(t, "s3cret", 0)
+
+	code, err := Deliver(&bsql.WebhookDelivery{ID: 7, Event: "coin", Payload: `{"event":"coin"}`, URL: srv.URL, Secret: "s3cret"})
+	if err != nil || code != 204 {
+		t.Fatalf("Deliver = %d, %v, want 204, nil", code, err)
+	}
+	if *calls != 1 {
+		t.Errorf("receiver called %d times, want 1", *calls)
+	}
+}
+
+func TestDeliverRetries(t *testing.T) {
+	allowPrivate(t)
+	srv, calls := receiver(t, "s3cret", 2)
+	d := &bsql.WebhookDelivery{ID: 7, Event: "coin", Payload: `{}`, URL: srv.URL, Secret: "s3cret"}
+
+	// Each failure is an error with the code, the worker retries until one succeeds
+	for attempt := 1; attempt <= 3; attempt++ {
+		code, err := Deliver(d)
+		if attempt < 3 && (err == nil || code != 503) {
+			t.Fatalf("attempt %d = %d, %v, want 503 and an error", attempt, code, err)
+		}
+		if attempt == 3 && (err != nil || code != 204) {
+			t.Fatalf("attempt %d = %d, %v, want 204, nil", attempt, code, err)
+		}
+	}
+	if *calls != 3 {
+		t.Errorf("receiver called %d times, want 3", *calls)
+	}
+}
+
+func TestDeliverUnreachable(t *testing.T) {
+	allowPrivate(t)
+	srv := httptest.NewServer(http.NotFoundHandler())
+	url := srv.URL
+	srv.Close()
+
+	code, err := Deliver(&bsql.WebhookDelivery{ID: 7, Event: "coin", URL: url, Secret: "s"})
+	if err == nil || code != 0 {
+		t.Fatalf("Deliver = %d, %v, want 0 and an error", code, err)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{1, BASE_BACKOFF},
+		{2, 2 * BASE_BACKOFF},
+		{3, 4 * BASE_BACKOFF},
+		{8, 128 * BASE_BACKOFF},
+		{20, MAX_BACKOFF},
+		{100, MAX_BACKOFF},
+	}
+	for _, tt := range tests {
+		if got := backoff(tt.attempts); got != tt.want {
+			t.Errorf("backoff(%d) = %v, want %v", tt.attempts, got, tt.want)
+		}
+	}
+}
+
+func TestDeliverRefusesPrivate(t *testing.T) {
+	srv, calls := receiver(t, "s", 0)
+
+	_, err := Deliver(&bsql.WebhookDelivery{ID: 7, Event: "coin", URL: srv.URL, Secret: "s"})
+	if !errors.Is(err, ErrPrivateAddress) {
+		t.Fatalf("Deliver to loopback = %v, want ErrPrivateAddress", err)
+	}
+	if *calls != 0 {
+		t.Errorf("receiver called %d times, want 0", *calls)
+	}
+}
+
+func TestCheckURL(t *testing.T) {
+	tests := []struct {
+		url  string
+		want error
+	}{
+		{"https://93.184.216.34/hook", nil},
+		{"http://[2606:4700::1111]:8080/", nil},
+		{"ftp://93.184.216.34/", ErrInvalidURL},
+		{"/relative", ErrInvalidURL},
+		{"http://", ErrInvalidURL},
+		{"http://127.0.0.1/", ErrPrivateAddress},
+		{"http://[::1]/", ErrPrivateAddress},
+		{"http://10.1.2.3/", ErrPrivateAddress},
+		{"http://172.16.0.1/", ErrPrivateAddress},
+		{"http://192.168.1.1/", ErrPrivateAddress},
+		{"http://169.254.169.254/latest/meta-data", ErrPrivateAddress},
+		{"http://0.0.0.0/", ErrPrivateAddress},
+		{"http://[fd00::1]/", ErrPrivateAddress},
+		{"http://[::ffff:127.0.0.1]/", ErrPrivateAddress},
+	}
+	for _, tt := range tests {
+		if _, err := CheckURL(context.Background(), tt.url); err != tt.want {
+			t.Errorf("CheckURL(%q) = %v, want %v", tt.url, err, tt.want)
+		}
+	}
+}